@@ -25,22 +25,43 @@ type MerkleTree struct {
 
 var DummyMerkleTree = &MerkleTree{nil, nil, nil}
 
+// RFC 6962的域分隔前缀：叶子哈希为SHA-256(0x00||data)，中间节点为SHA-256(0x01||left||right)，
+// 中间节点的哈希不能被当作叶子数据重放（第二原像攻击）
+const (
+	leafHashPrefix byte = 0x00
+	nodeHashPrefix byte = 0x01
+)
+
+// 叶子节点的哈希
+func hashLeaf(data []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{leafHashPrefix})
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+// 中间节点的哈希
+func hashChildren(left, right []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{nodeHashPrefix})
+	h.Write(left)
+	h.Write(right)
+	return h.Sum(nil)
+}
+
+// 空树的根哈希，RFC 6962中为空串的哈希
+func emptyRootHash() []byte {
+	hash := sha256.Sum256(nil)
+	return hash[:]
+}
+
 // NewMerkleNode 创建一个新的默克尔树节点
 func NewMerkleNode(left, right *MerkleNode, data []byte) *MerkleNode {
 	node := new(MerkleNode)
 	if left == nil && right == nil {
-		hash := sha256.Sum256(data)
-		node.Data = hash[:]
+		node.Data = hashLeaf(data)
 	} else {
-		prevHashes := make([]byte, 0)
-		if left != nil {
-			prevHashes = append(prevHashes, left.Data...)
-		}
-		if right != nil {
-			prevHashes = append(prevHashes, right.Data...)
-		}
-		hash := sha256.Sum256(prevHashes)
-		node.Data = hash[:]
+		node.Data = hashChildren(nodeData(left), nodeData(right))
 	}
 	node.Left = left
 	node.Right = right
@@ -53,8 +74,11 @@ func NewEmptyMerkleTree() *MerkleTree {
 	return &MerkleTree{Root: nil, DataList: make([][]byte, 0), LeafNodes: nil}
 }
 
-// NewMerkleTree 构建一个新的默克尔树
+// NewMerkleTree 构建一个新的默克尔树，data为空时返回空树（如空区块的交易树）
 func NewMerkleTree(data [][]byte) *MerkleTree {
+	if len(data) == 0 {
+		return NewEmptyMerkleTree()
+	}
 	//用data创建一个dataList,并复制data的值到dataList中
 	dataList := make([][]byte, len(data))
 	for i := 0; i < len(data); i++ {
@@ -94,8 +118,11 @@ func (tree *MerkleTree) GetRoot() *MerkleNode {
 	return tree.Root
 }
 
-// GetRootHash 获取默克尔树的根节点的哈希值
+// GetRootHash 获取默克尔树的根节点的哈希值，空树返回空串的哈希（与RFC 6962一致）
 func (tree *MerkleTree) GetRootHash() []byte {
+	if tree.Root == nil {
+		return emptyRootHash()
+	}
 	return tree.Root.Data
 }
 
@@ -103,27 +130,26 @@ func (tree *MerkleTree) GetRootHash() []byte {
 func (tree *MerkleTree) UpdateRoot(i int, data []byte) []byte {
 	tree.DataList[i] = data
 	//修改叶子节点
-	hash := sha256.Sum256(data)
-	tree.LeafNodes[i].Data = hash[:]
+	tree.LeafNodes[i].Data = hashLeaf(data)
 	//递归修改父节点
 	updateParentData(tree.LeafNodes[i].Parent)
 	return tree.Root.Data
 }
 
+// 节点的哈希，nil节点为空
+func nodeData(node *MerkleNode) []byte {
+	if node == nil {
+		return nil
+	}
+	return node.Data
+}
+
 // 递归修改父节点的data
 func updateParentData(node *MerkleNode) {
 	if node == nil {
 		return
 	}
-	prevHashes := make([]byte, 0)
-	if node.Left != nil {
-		prevHashes = append(prevHashes, node.Left.Data...)
-	}
-	if node.Right != nil {
-		prevHashes = append(prevHashes, node.Right.Data...)
-	}
-	hash := sha256.Sum256(prevHashes)
-	node.Data = hash[:]
+	node.Data = hashChildren(nodeData(node.Left), nodeData(node.Right))
 	updateParentData(node.Parent)
 }
 
@@ -0,0 +1,145 @@
+package blockchain
+
+import (
+	"bytes"
+	"errors"
+	"simplechain/utils"
+)
+
+// MHTConsistencyProof 两个树规模之间的一致性证明（RFC 6962语义）
+// 证明规模为OldSize的树是规模为NewSize的树的前缀
+type MHTConsistencyProof struct {
+	OldSize int      //旧树的叶子数量
+	NewSize int      //新树的叶子数量
+	Hashes  [][]byte //证明路径上的哈希值
+}
+
+func (proof *MHTConsistencyProof) GetSizeOf() uint {
+	ret := 2 * utils.SIZEOFINT
+	for _, hash := range proof.Hashes {
+		ret += uint(len(hash)) * utils.SIZEOFBYTE
+	}
+	return ret
+}
+
+// 小于n的最大的2的幂（n>1）
+func largestPowerOfTwoLessThan(n int) int {
+	k := 1
+	for k<<1 < n {
+		k <<= 1
+	}
+	return k
+}
+
+// 根据叶子哈希按RFC 6962的划分方式计算树根，空树的根为空串的哈希
+func rootOfLeafHashes(leaves [][]byte) []byte {
+	switch len(leaves) {
+	case 0:
+		return emptyRootHash()
+	case 1:
+		return leaves[0]
+	}
+	k := largestPowerOfTwoLessThan(len(leaves))
+	return hashChildren(rootOfLeafHashes(leaves[:k]), rootOfLeafHashes(leaves[k:]))
+}
+
+// RFC 6962中的SUBPROOF(m, D[n], b)
+func subConsistencyProof(m int, leaves [][]byte, complete bool) [][]byte {
+	n := len(leaves)
+	if m == n {
+		if complete {
+			return [][]byte{}
+		}
+		return [][]byte{rootOfLeafHashes(leaves)}
+	}
+	k := largestPowerOfTwoLessThan(n)
+	if m <= k {
+		proof := subConsistencyProof(m, leaves[:k], complete)
+		return append(proof, rootOfLeafHashes(leaves[k:]))
+	}
+	proof := subConsistencyProof(m-k, leaves[k:], false)
+	return append(proof, rootOfLeafHashes(leaves[:k]))
+}
+
+// 根据叶子哈希生成规模m到n的一致性证明
+func consistencyProofOfLeafHashes(m int, leaves [][]byte) (*MHTConsistencyProof, error) {
+	n := len(leaves)
+	if m < 0 || m > n {
+		return nil, errors.New("consistency proof: old size out of range")
+	}
+	proof := &MHTConsistencyProof{m, n, [][]byte{}}
+	if m == 0 || m == n {
+		return proof, nil
+	}
+	proof.Hashes = subConsistencyProof(m, leaves, true)
+	return proof, nil
+}
+
+// 获取默克尔树所有叶子节点的哈希
+func (tree *MerkleTree) getLeafHashes() [][]byte {
+	leaves := make([][]byte, len(tree.LeafNodes))
+	for i, leaf := range tree.LeafNodes {
+		leaves[i] = leaf.Data
+	}
+	return leaves
+}
+
+// GetRootHashAt 获取默克尔树只包含前m个数据时的根哈希
+func (tree *MerkleTree) GetRootHashAt(m int) ([]byte, error) {
+	if m < 0 || m > len(tree.LeafNodes) {
+		return nil, errors.New("root hash: size out of range")
+	}
+	return rootOfLeafHashes(tree.getLeafHashes()[:m]), nil
+}
+
+// GetConsistencyProof 返回前m个数据构成的树与当前树之间的一致性证明
+func (tree *MerkleTree) GetConsistencyProof(m int) (*MHTConsistencyProof, error) {
+	return consistencyProofOfLeafHashes(m, tree.getLeafHashes())
+}
+
+// VerifyConsistencyProof 验证规模为OldSize、根为oldRoot的树是规模为NewSize、根为newRoot的树的前缀
+func VerifyConsistencyProof(proof *MHTConsistencyProof, oldRoot []byte, newRoot []byte) bool {
+	m, n := proof.OldSize, proof.NewSize
+	if m < 0 || m > n {
+		return false
+	}
+	if m == 0 {
+		//空树是任何树的前缀
+		return len(proof.Hashes) == 0
+	}
+	if m == n {
+		return len(proof.Hashes) == 0 && bytes.Equal(oldRoot, newRoot)
+	}
+	hashes := proof.Hashes
+	//m为2的幂时旧树根本身就是新树的一个子树，证明中不包含它
+	if m&(m-1) == 0 {
+		hashes = append([][]byte{oldRoot}, hashes...)
+	}
+	if len(hashes) == 0 {
+		return false
+	}
+	fn, sn := m-1, n-1
+	for fn&1 == 1 {
+		fn >>= 1
+		sn >>= 1
+	}
+	fr, sr := hashes[0], hashes[0]
+	for _, c := range hashes[1:] {
+		if sn == 0 {
+			return false
+		}
+		if fn&1 == 1 || fn == sn {
+			fr = hashChildren(c, fr)
+			sr = hashChildren(c, sr)
+			for fn&1 == 0 && fn != 0 {
+				fn >>= 1
+				sn >>= 1
+			}
+		} else {
+			sr = hashChildren(sr, c)
+		}
+		fn >>= 1
+		sn >>= 1
+	}
+	return sn == 0 && bytes.Equal(fr, oldRoot) && bytes.Equal(sr, newRoot)
+}
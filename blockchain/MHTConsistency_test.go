@@ -0,0 +1,278 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"testing"
+)
+
+// certificate-transparency参考实现中的叶子数据和树根（RFC 6962）
+var rfc6962Leaves = []string{"", "00", "10", "2021", "3031", "40414243", "5051525354555657", "606162636465666768696a6b6c6d6e6f"}
+
+var rfc6962Roots = []string{
+	"e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+	"6e340b9cffb37a989ca544e6bb780a2c78901d3fb33738768511a30617afa01d",
+	"fac54203e7cc696cf0dfcb42c92a1d9dbaf70ad9e621f4bd8d98662f00e3c125",
+	"aeb6bcfe274b70a14fb067a5e5578264db0fa9b51af5e0ba159158f329e06e77",
+	"d37ee418976dd95753c1c73862b9398fa2a2cf9b4ff0fdfe8b30cd95209614b7",
+	"4e3bbb1f7b478dcfe71fb631631519a3bca12c9aefca1612bfce4c13a86264d4",
+	"76e67dadbcdf1e10e1b74ddc608abd2f98dfb16fbce75277b5232a127f2087ef",
+	"ddb89be403809e325750d3d263cd78929c2942b7942a34b77e122c9594a74c8c",
+	"5dc9da79a70659a9ad559cb701ded9a2ab9d823aad2f4960cfe370eff4604328",
+}
+
+var rfc6962Proofs = []struct {
+	m, n   int
+	hashes []string
+}{
+	{1, 1, nil},
+	{1, 8, []string{
+		"96a296d224f285c67bee93c30f8a309157f0daa35dc5b87e410b78630a09cfc7",
+		"5f083f0a1a33ca076a95279832580db3e0ef4584bdff1f54c8a360f50de3031e",
+		"6b47aaf29ee3c2af9af889bc1fb9254dabd31177f16232dd6aab035ca39bf6e4",
+	}},
+	{6, 8, []string{
+		"0ebc5d3437fbe2db158b9f126a1d118e308181031d0a949f8dededebc558ef6a",
+		"ca854ea128ed050b41b35ffc1b87b8eb2bde461e9e3b5596ece6b9d5975a0ae0",
+		"d37ee418976dd95753c1c73862b9398fa2a2cf9b4ff0fdfe8b30cd95209614b7",
+	}},
+	{2, 5, []string{
+		"5f083f0a1a33ca076a95279832580db3e0ef4584bdff1f54c8a360f50de3031e",
+		"bc1a0643b12e4d2d7c77918f44e0f4f79a838b6cf9ec5b5c283e1f4d88599e6b",
+	}},
+}
+
+func mustHex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func rfc6962Data(t *testing.T) [][]byte {
+	data := make([][]byte, len(rfc6962Leaves))
+	for i, leaf := range rfc6962Leaves {
+		data[i] = mustHex(t, leaf)
+	}
+	return data
+}
+
+func testLeafData(n int) [][]byte {
+	data := make([][]byte, n)
+	for i := range data {
+		data[i] = []byte(fmt.Sprintf("tx-%d", i))
+	}
+	return data
+}
+
+func TestRFC6962Roots(t *testing.T) {
+	data := rfc6962Data(t)
+	tree := NewMerkleTree(data)
+	for m, want := range rfc6962Roots {
+		root, err := tree.GetRootHashAt(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hex.EncodeToString(root) != want {
+			t.Errorf("root at %d = %x, want %s", m, root, want)
+		}
+		if got := NewMerkleTree(data[:m]).GetRootHash(); hex.EncodeToString(got) != want {
+			t.Errorf("MerkleTree root of %d leaves = %x, want %s", m, got, want)
+		}
+	}
+}
+
+func TestRFC6962ConsistencyProofs(t *testing.T) {
+	data := rfc6962Data(t)
+	for _, tc := range rfc6962Proofs {
+		proof, err := NewMerkleTree(data[:tc.n]).GetConsistencyProof(tc.m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(proof.Hashes) != len(tc.hashes) {
+			t.Fatalf("proof %d->%d has %d hashes, want %d", tc.m, tc.n, len(proof.Hashes), len(tc.hashes))
+		}
+		for i, want := range tc.hashes {
+			if hex.EncodeToString(proof.Hashes[i]) != want {
+				t.Errorf("proof %d->%d hash %d = %x, want %s", tc.m, tc.n, i, proof.Hashes[i], want)
+			}
+		}
+		if !VerifyConsistencyProof(proof, mustHex(t, rfc6962Roots[tc.m]), mustHex(t, rfc6962Roots[tc.n])) {
+			t.Errorf("proof %d->%d rejected", tc.m, tc.n)
+		}
+	}
+}
+
+func TestConsistencyProofAllSizes(t *testing.T) {
+	const maxSize = 20
+	tree := NewMerkleTree(testLeafData(maxSize))
+	roots := make([][]byte, maxSize+1)
+	for m := range roots {
+		roots[m], _ = tree.GetRootHashAt(m)
+	}
+	for n := 1; n <= maxSize; n++ {
+		sub := NewMerkleTree(tree.DataList[:n])
+		for m := 0; m <= n; m++ {
+			proof, err := sub.GetConsistencyProof(m)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !VerifyConsistencyProof(proof, roots[m], roots[n]) {
+				t.Fatalf("valid proof %d->%d rejected", m, n)
+			}
+			if m == 0 {
+				continue
+			}
+			//错误的旧根或新根
+			if VerifyConsistencyProof(proof, roots[m-1], roots[n]) {
+				t.Errorf("proof %d->%d accepted with the wrong old root", m, n)
+			}
+			if m < n && VerifyConsistencyProof(proof, roots[m], roots[n-1]) {
+				t.Errorf("proof %d->%d accepted with the wrong new root", m, n)
+			}
+			//篡改证明中的每个哈希
+			for i := range proof.Hashes {
+				tampered := cloneConsistencyProof(proof)
+				tampered.Hashes[i][0] ^= 0x80
+				if VerifyConsistencyProof(tampered, roots[m], roots[n]) {
+					t.Errorf("proof %d->%d accepted with hash %d tampered", m, n, i)
+				}
+			}
+			//截断或追加哈希
+			if len(proof.Hashes) > 0 {
+				tampered := cloneConsistencyProof(proof)
+				tampered.Hashes = tampered.Hashes[:len(tampered.Hashes)-1]
+				if VerifyConsistencyProof(tampered, roots[m], roots[n]) {
+					t.Errorf("proof %d->%d accepted with a hash removed", m, n)
+				}
+			}
+			tampered := cloneConsistencyProof(proof)
+			tampered.Hashes = append(tampered.Hashes, roots[n])
+			if VerifyConsistencyProof(tampered, roots[m], roots[n]) {
+				t.Errorf("proof %d->%d accepted with a hash appended", m, n)
+			}
+		}
+	}
+}
+
+func cloneConsistencyProof(proof *MHTConsistencyProof) *MHTConsistencyProof {
+	hashes := make([][]byte, len(proof.Hashes))
+	for i, hash := range proof.Hashes {
+		hashes[i] = append([]byte(nil), hash...)
+	}
+	return &MHTConsistencyProof{proof.OldSize, proof.NewSize, hashes}
+}
+
+func TestConsistencyProofOutOfRange(t *testing.T) {
+	tree := NewMerkleTree(testLeafData(4))
+	if _, err := tree.GetConsistencyProof(5); err == nil {
+		t.Error("proof for a size larger than the tree")
+	}
+	if _, err := tree.GetConsistencyProof(-1); err == nil {
+		t.Error("proof for a negative size")
+	}
+	if VerifyConsistencyProof(&MHTConsistencyProof{5, 4, nil}, nil, nil) {
+		t.Error("accepted old size larger than new size")
+	}
+}
+
+func TestMerkleTreeMatchesConsistencyRoots(t *testing.T) {
+	for n := 0; n <= 20; n++ {
+		data := testLeafData(n)
+		tree := NewMerkleTree(data)
+		leaves := make([][]byte, n)
+		for i := range data {
+			leaves[i] = hashLeaf(data[i])
+		}
+		if !bytes.Equal(tree.GetRootHash(), rootOfLeafHashes(leaves)) {
+			t.Fatalf("MerkleTree and RFC 6962 roots differ for %d leaves", n)
+		}
+		for i := range data {
+			if !VerifyMHTProof(data[i], tree.GetProof(i), tree.GetRootHash()) {
+				t.Fatalf("inclusion proof of leaf %d/%d rejected", i, n)
+			}
+		}
+	}
+	if !bytes.Equal(NewEmptyMerkleTree().GetRootHash(), emptyRootHash()) {
+		t.Error("empty MerkleTree root differs from the RFC 6962 empty root")
+	}
+}
+
+func TestMerkleTreeUpdateRoot(t *testing.T) {
+	data := testLeafData(7)
+	tree := NewMerkleTree(data)
+	data[3] = []byte("updated")
+	if !bytes.Equal(tree.UpdateRoot(3, data[3]), NewMerkleTree(data).GetRootHash()) {
+		t.Error("UpdateRoot differs from rebuilding the tree")
+	}
+}
+
+// 中间节点的两个子哈希拼接后作为叶子数据时不能得到相同的根
+func TestLeafNodeDomainSeparation(t *testing.T) {
+	tree := NewMerkleTree(testLeafData(2))
+	forged := append(append([]byte(nil), tree.LeafNodes[0].Data...), tree.LeafNodes[1].Data...)
+	if bytes.Equal(NewMerkleTree([][]byte{forged}).GetRootHash(), tree.GetRootHash()) {
+		t.Error("interior node accepted as a leaf")
+	}
+	//用中间节点冒充叶子的包含证明
+	if VerifyMHTProof(forged, &MHTProof{isExist: true}, tree.GetRootHash()) {
+		t.Error("inclusion proof accepted an interior node as a leaf")
+	}
+}
+
+func TestTxAccumulatorConsistency(t *testing.T) {
+	acc := NewTxAccumulator()
+	data := testLeafData(16)
+	for _, d := range data {
+		acc.Append(d)
+	}
+	if !bytes.Equal(acc.GetRootHash(), NewMerkleTree(data).GetRootHash()) {
+		t.Fatal("accumulator root differs from MerkleTree root")
+	}
+	for n := 0; n <= acc.Size(); n++ {
+		newRoot, _ := acc.GetRootHashAt(n)
+		for m := 0; m <= n; m++ {
+			oldRoot, _ := acc.GetRootHashAt(m)
+			proof, err := acc.GetConsistencyProof(m, n)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !VerifyConsistencyProof(proof, oldRoot, newRoot) {
+				t.Fatalf("accumulator proof %d->%d rejected", m, n)
+			}
+		}
+	}
+}
+
+// 增量计算的根与按全部叶子计算的根在每个规模上相同，复制后的累加器与原累加器互不影响
+func TestTxAccumulatorIncrementalRoot(t *testing.T) {
+	acc := NewTxAccumulator()
+	data := testLeafData(70)
+	for n := 0; n <= len(data); n++ {
+		if n > 0 {
+			acc.Append(data[n-1])
+		}
+		if !bytes.Equal(acc.GetRootHash(), rootOfLeafHashes(acc.LeafHashes)) {
+			t.Fatalf("incremental root differs at size %d", n)
+		}
+		if len(acc.frontier) > 7 {
+			t.Fatalf("%d frontier hashes at size %d", len(acc.frontier), n)
+		}
+	}
+	root := acc.GetRootHash()
+	clone := acc.Clone()
+	clone.Append([]byte("clone"))
+	acc.Append([]byte("original"))
+	if bytes.Equal(clone.GetRootHash(), acc.GetRootHash()) {
+		t.Fatal("clone and original share appended leaves")
+	}
+	if got, _ := clone.GetRootHashAt(len(data)); !bytes.Equal(got, root) {
+		t.Error("clone changed the shared prefix")
+	}
+	if !bytes.Equal(clone.GetRootHash(), rootOfLeafHashes(clone.LeafHashes)) || !bytes.Equal(acc.GetRootHash(), rootOfLeafHashes(acc.LeafHashes)) {
+		t.Error("root differs from the leaves after clone")
+	}
+}
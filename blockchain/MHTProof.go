@@ -1,6 +1,9 @@
 package blockchain
 
-import "simplechain/utils"
+import (
+	"simplechain/storage"
+	"simplechain/utils"
+)
 
 type ProofPair struct {
 	Index int    //0表示左子节点,1表示右子节点
@@ -65,3 +68,37 @@ func (mhtProof *MHTProof) GetSegKeys() []string {
 func (mhtProof *MHTProof) GetSegRootHashes() [][]byte {
 	return mhtProof.segRootHashes
 }
+
+// Serialize 将存在证明编码为规范化的二进制形式，用于向轻节点发送
+func (mhtProof *MHTProof) Serialize() []byte {
+	e := storage.NewEncoder()
+	e.WriteBool(mhtProof.isExist)
+	e.WriteInt(len(mhtProof.proofPairs))
+	for _, pair := range mhtProof.proofPairs {
+		e.WriteInt(pair.Index)
+		e.WriteBytes(pair.Hash)
+	}
+	e.WriteBool(mhtProof.isSegExist)
+	e.WriteStringList(mhtProof.values)
+	e.WriteStringList(mhtProof.segKeys)
+	e.WriteBytesList(mhtProof.segRootHashes)
+	return e.Bytes()
+}
+
+// DeserializeMHTProof 解析Serialize的编码结果
+func DeserializeMHTProof(data []byte) (*MHTProof, error) {
+	d := storage.NewDecoder(data)
+	mhtProof := &MHTProof{isExist: d.ReadBool(), proofPairs: make([]ProofPair, 0)}
+	pairNum := d.ReadInt()
+	for i := 0; i < pairNum && d.Err() == nil; i++ {
+		mhtProof.proofPairs = append(mhtProof.proofPairs, ProofPair{d.ReadInt(), d.ReadBytes()})
+	}
+	mhtProof.isSegExist = d.ReadBool()
+	mhtProof.values = d.ReadStringList()
+	mhtProof.segKeys = d.ReadStringList()
+	mhtProof.segRootHashes = d.ReadBytesList()
+	if err := d.Finish(); err != nil {
+		return nil, err
+	}
+	return mhtProof, nil
+}
@@ -0,0 +1,82 @@
+package blockchain
+
+import "errors"
+
+// TxAccumulator 全链交易哈希的只追加累加器
+// 按上链顺序记录所有区块中的交易哈希，审计者可以通过一致性证明检查
+// 规模为m时的累加器是规模为n时的前缀
+type TxAccumulator struct {
+	LeafHashes [][]byte //叶子哈希（带0x00前缀的交易哈希的哈希，与MerkleTree的叶子计算方式一致）
+	//右边缘上满二叉子树的根哈希，与规模的二进制表示中的每个1对应，从大到小排列
+	frontier [][]byte
+}
+
+func NewTxAccumulator() *TxAccumulator {
+	return &TxAccumulator{make([][]byte, 0), nil}
+}
+
+// Append 追加一个交易哈希，返回累加器新的规模
+func (acc *TxAccumulator) Append(txHash []byte) int {
+	acc.AppendLeafHash(hashLeaf(txHash))
+	return len(acc.LeafHashes)
+}
+
+// AppendLeafHash 追加一个已计算好的叶子哈希，用于从存储中恢复累加器
+func (acc *TxAccumulator) AppendLeafHash(leaf []byte) {
+	acc.LeafHashes = append(acc.LeafHashes, leaf)
+	acc.frontier = append(acc.frontier, leaf)
+	//规模的二进制表示末尾每有一个0，就把最后两个大小相同的子树合并
+	for n := len(acc.LeafHashes); n%2 == 0; n /= 2 {
+		last := len(acc.frontier) - 1
+		acc.frontier = append(acc.frontier[:last-1], hashChildren(acc.frontier[last-1], acc.frontier[last]))
+	}
+}
+
+// Clone 复制累加器，只复制右边缘的O(log n)个哈希，已有的叶子共享
+func (acc *TxAccumulator) Clone() *TxAccumulator {
+	//限制容量使追加时重新分配底层数组，因此可以共享已有的叶子
+	leaves := acc.LeafHashes[:len(acc.LeafHashes):len(acc.LeafHashes)]
+	return &TxAccumulator{leaves, append([][]byte(nil), acc.frontier...)}
+}
+
+// AppendBlock 按顺序追加区块中所有交易的哈希，返回累加器新的规模
+func (acc *TxAccumulator) AppendBlock(block *Block) int {
+	for _, tx := range block.Transactions {
+		acc.Append(tx.TxHash)
+	}
+	return len(acc.LeafHashes)
+}
+
+// Size 获取累加器当前的规模
+func (acc *TxAccumulator) Size() int {
+	return len(acc.LeafHashes)
+}
+
+// GetRootHash 获取累加器当前的根哈希
+// 从右向左合并右边缘的子树，与rootOfLeafHashes按最大的2的幂划分得到的根相同
+func (acc *TxAccumulator) GetRootHash() []byte {
+	if len(acc.frontier) == 0 {
+		return emptyRootHash()
+	}
+	root := acc.frontier[len(acc.frontier)-1]
+	for i := len(acc.frontier) - 2; i >= 0; i-- {
+		root = hashChildren(acc.frontier[i], root)
+	}
+	return root
+}
+
+// GetRootHashAt 获取累加器规模为m时的根哈希
+func (acc *TxAccumulator) GetRootHashAt(m int) ([]byte, error) {
+	if m < 0 || m > len(acc.LeafHashes) {
+		return nil, errors.New("accumulator: size out of range")
+	}
+	return rootOfLeafHashes(acc.LeafHashes[:m]), nil
+}
+
+// GetConsistencyProof 获取累加器规模m到规模n之间的一致性证明
+func (acc *TxAccumulator) GetConsistencyProof(m int, n int) (*MHTConsistencyProof, error) {
+	if n < 0 || n > len(acc.LeafHashes) {
+		return nil, errors.New("accumulator: size out of range")
+	}
+	return consistencyProofOfLeafHashes(m, acc.LeafHashes[:n])
+}
@@ -2,26 +2,41 @@ package blockchain
 
 import (
 	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"simplechain/storage"
 	"time"
 )
 
-type Block struct {
+const BlockVersion uint32 = 2 //当前区块格式版本，版本2在区块头中加入布隆过滤器
 
-	//header
+// BlockHeader 区块头，区块哈希覆盖区块头所有字段的规范化编码
+type BlockHeader struct {
+	Version       uint32 //区块格式版本
 	Height        int    //区块高度
 	PrevBlockHash []byte //上一个区块的哈希
-	Hash          []byte //当前区块的哈希
-	Timestamp     string //时间戳
 	TxMHTRoot     []byte //交易Merkle树根
+	StateRoot     []byte //状态树根
+	Proposer      string //提议该区块的主节点ID
+	Timestamp     int64  //UTC时间戳（纳秒）
+	Bloom         []byte //交易发送者和请求主题的布隆过滤器，见bloom.go
+}
+
+type Block struct {
+	//header
+	BlockHeader
+	Hash []byte //当前区块的哈希（即区块头的哈希）
 
 	//body
 	Transactions []*Transaction //交易列表
+
+	//finality
+	ProposerSign []byte                     //主节点对区块摘要的签名
+	Cert         *storage.CommitCertificate //提交证书，区块共识完成后才有
 }
 
-func NewBlock(height int, prevBlockHash []byte, transactions []*Transaction) *Block {
-	currentTime := time.Now().Format("2006-01-02 15:04:05")
+func NewBlock(height int, prevBlockHash []byte, stateRoot []byte, proposer string, transactions []*Transaction) *Block {
 	//根据transactions构建默克尔树
 	//将transactions转换为哈希值
 	txhashes := make([][]byte, 0)
@@ -30,53 +45,122 @@ func NewBlock(height int, prevBlockHash []byte, transactions []*Transaction) *Bl
 	}
 	//构建默克尔树
 	txMHT := NewMerkleTree(txhashes)
-	//计算当前区块的哈希值Hash(PrevBlockHash+Timestamp+TxMHTRoot)
-	blockcontent := make([]byte, 0)
-	blockcontent = append(blockcontent, prevBlockHash...)
-	blockcontent = append(blockcontent, []byte(currentTime)...)
-	blockcontent = append(blockcontent, txMHT.GetRootHash()...)
-	hash := sha256.Sum256(blockcontent)
-	block := &Block{height, prevBlockHash, hash[:], currentTime, txMHT.GetRootHash(), transactions}
+	header := BlockHeader{BlockVersion, height, prevBlockHash, txMHT.GetRootHash(), stateRoot, proposer, time.Now().UTC().UnixNano(), NewBlockBloom(transactions)}
+	block := &Block{header, header.ComputeHash(), transactions, nil, nil}
 	return block
 }
 
-type SeBlock struct {
-	//header
-	Height        int    //区块高度
-	PrevBlockHash []byte //上一个区块的哈希
-	Hash          []byte //当前区块的哈希
-	Timestamp     string //时间戳
-	TxMHTRoot     []byte //交易Merkle树根
+func (header *BlockHeader) encodeTo(e *storage.Encoder) {
+	e.WriteUint64(uint64(header.Version))
+	e.WriteInt(header.Height)
+	e.WriteBytes(header.PrevBlockHash)
+	e.WriteBytes(header.TxMHTRoot)
+	e.WriteBytes(header.StateRoot)
+	e.WriteString(header.Proposer)
+	e.WriteInt64(header.Timestamp)
+	e.WriteBytes(header.Bloom)
+}
 
-	//body
-	Transactions [][]byte //交易列表
+func (header *BlockHeader) decodeFrom(d *storage.Decoder) {
+	header.Version = uint32(d.ReadUint64())
+	header.Height = d.ReadInt()
+	header.PrevBlockHash = d.ReadBytes()
+	header.TxMHTRoot = d.ReadBytes()
+	header.StateRoot = d.ReadBytes()
+	header.Proposer = d.ReadString()
+	header.Timestamp = d.ReadInt64()
+	header.Bloom = d.ReadBytes()
+}
+
+// SerializeHeader 将区块头编码为规范化的二进制形式，轻节点只需下载区块头
+func (header *BlockHeader) SerializeHeader() []byte {
+	e := storage.NewEncoder()
+	header.encodeTo(e)
+	return e.Bytes()
+}
+
+// DeserializeHeader 从规范化编码中解析区块头
+func DeserializeHeader(data []byte) (*BlockHeader, error) {
+	header := new(BlockHeader)
+	d := storage.NewDecoder(data)
+	header.decodeFrom(d)
+	if err := d.Finish(); err != nil {
+		fmt.Printf("DeserializeHeader error: %v\n", err)
+		return nil, err
+	}
+	return header, nil
+}
+
+// ComputeHash 根据区块头的规范化编码计算区块哈希
+func (header *BlockHeader) ComputeHash() []byte {
+	hash := sha256.Sum256(header.SerializeHeader())
+	return hash[:]
+}
+
+// GetTime 获取区块头中的UTC时间
+func (header *BlockHeader) GetTime() time.Time {
+	return time.Unix(0, header.Timestamp).UTC()
 }
 
+// SerializeBlock 将区块编码为规范化的二进制形式：区块头后接交易列表，区块哈希由区块头导出，不单独编码
 func (block *Block) SerializeBlock() ([]byte, error) {
-	//将区块序列化
-	seblock := &SeBlock{block.Height, block.PrevBlockHash, block.Hash, block.Timestamp, block.TxMHTRoot, make([][]byte, 0)}
+	e := storage.NewEncoder()
+	block.BlockHeader.encodeTo(e)
+	e.WriteInt(len(block.Transactions))
 	for _, tx := range block.Transactions {
-		setx, _ := tx.SerializeTx()
-		seblock.Transactions = append(seblock.Transactions, setx)
+		tx.encodeTo(e)
 	}
-	jsonBlock, err := json.Marshal(seblock)
-	if err != nil {
-		fmt.Printf("SerializeBlock error: %v\n", err)
-		return nil, err
-	}
-	return jsonBlock, nil
+	return e.Bytes(), nil
 }
 
 func DeserializeBlock(data []byte) (*Block, error) {
-	var seblock SeBlock
-	if err := json.Unmarshal(data, &seblock); err != nil {
+	d := storage.NewDecoder(data)
+	block := &Block{}
+	block.BlockHeader.decodeFrom(d)
+	txNum := d.ReadInt()
+	block.Transactions = make([]*Transaction, 0)
+	for i := 0; i < txNum && d.Err() == nil; i++ {
+		transaction, err := decodeTx(d)
+		if err != nil {
+			fmt.Printf("DeserializeBlock error: %v\n", err)
+			return nil, err
+		}
+		block.Transactions = append(block.Transactions, transaction)
+	}
+	if err := d.Finish(); err != nil {
 		fmt.Printf("DeserializeBlock error: %v\n", err)
 		return nil, err
 	}
-	block := &Block{seblock.Height, seblock.PrevBlockHash, seblock.Hash, seblock.Timestamp, seblock.TxMHTRoot, make([]*Transaction, 0)}
-	for i := 0; i < len(seblock.Transactions); i++ {
-		transaction, _ := DeserializeTx(seblock.Transactions[i])
-		block.Transactions = append(block.Transactions, transaction)
-	}
+	block.Hash = block.ComputeHash()
 	return block, nil
 }
+
+// 导出为JSON时使用的区块结构，字节串以十六进制表示
+type SeBlock struct {
+	//header
+	Version       uint32 //区块格式版本
+	Height        int    //区块高度
+	PrevBlockHash string //上一个区块的哈希
+	Hash          string //当前区块的哈希
+	TxMHTRoot     string //交易Merkle树根
+	StateRoot     string //状态树根
+	Proposer      string //提议该区块的主节点ID
+	Timestamp     string //UTC时间
+	Bloom         string //布隆过滤器
+
+	//body
+	Transactions []*Transaction //交易列表
+}
+
+// ExportBlockJSON 将区块导出为JSON，仅用于调试和导出，不参与哈希和签名
+func (block *Block) ExportBlockJSON() ([]byte, error) {
+	seblock := &SeBlock{block.Version, block.Height, hex.EncodeToString(block.PrevBlockHash), hex.EncodeToString(block.Hash),
+		hex.EncodeToString(block.TxMHTRoot), hex.EncodeToString(block.StateRoot), block.Proposer,
+		block.GetTime().Format(time.RFC3339Nano), hex.EncodeToString(block.Bloom), block.Transactions}
+	jsonBlock, err := json.Marshal(seblock)
+	if err != nil {
+		fmt.Printf("ExportBlockJSON error: %v\n", err)
+		return nil, err
+	}
+	return jsonBlock, nil
+}
@@ -0,0 +1,169 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"simplechain/storage"
+)
+
+var ErrBlockNoCert = errors.New("block: missing commit certificate")
+var ErrBlockProposer = errors.New("block: certificate proposer does not match header")
+var ErrBlockTxRoot = errors.New("block: transaction root mismatch")
+var ErrBlockBloom = errors.New("block: bloom filter mismatch")
+var ErrBlockStateRoot = errors.New("block: state root mismatch")
+var ErrBlockLink = errors.New("block: does not extend the chain")
+
+// BlockToRequest 将区块确定性地转换为共识使用的Request，序号即区块高度
+func BlockToRequest(block *Block) storage.Request {
+	//将区块序列化
+	seblock, _ := block.SerializeBlock()
+	r := storage.Request{}
+	r.Timestamp = block.Timestamp
+	r.ClientAddr = "" //总的区块不包含客户端，每个交易包含客户端
+	r.Message.ID = block.Height
+	r.Message.Content = seblock
+	return r
+}
+
+// RequestDigest 区块请求在共识中的摘要，即区块头的哈希
+// 交易列表由区块头中的交易树根约束，因此只持有区块头的节点也能验证提交证书
+// 请求不是合法区块时返回空串，共识中会因摘要不一致而拒绝
+func RequestDigest(request storage.Request) string {
+	block, err := DeserializeBlock(request.Content)
+	if err != nil || block.Height != request.ID || block.Timestamp != request.Timestamp || block.ValidateBody() != nil {
+		return ""
+	}
+	return block.Digest()
+}
+
+// Digest 区块在共识中的请求摘要，提交证书中的签名都是针对这一摘要
+func (header *BlockHeader) Digest() string {
+	return hex.EncodeToString(header.ComputeHash())
+}
+
+// ValidateBody 检查交易列表与区块头中的交易树根和布隆过滤器一致
+func (block *Block) ValidateBody() error {
+	txhashes := make([][]byte, 0)
+	for _, tx := range block.Transactions {
+		txhashes = append(txhashes, tx.TxHash)
+	}
+	if !bytes.Equal(NewMerkleTree(txhashes).GetRootHash(), block.TxMHTRoot) {
+		return ErrBlockTxRoot
+	}
+	if !bytes.Equal(NewBlockBloom(block.Transactions), block.Bloom) {
+		return ErrBlockBloom
+	}
+	return nil
+}
+
+// CertifiedHeader 带主节点签名和提交证书的区块头，可以脱离区块体独立验证
+type CertifiedHeader struct {
+	BlockHeader
+	ProposerSign []byte                     //主节点对区块摘要的签名
+	Cert         *storage.CommitCertificate //提交证书
+}
+
+// GetCertifiedHeader 获取区块的带证书区块头
+func (block *Block) GetCertifiedHeader() *CertifiedHeader {
+	return &CertifiedHeader{block.BlockHeader, block.ProposerSign, block.Cert}
+}
+
+// Verify 验证区块头的主节点签名和提交证书
+func (ch *CertifiedHeader) Verify(validators map[string][]byte) error {
+	if ch.Cert == nil {
+		return ErrBlockNoCert
+	}
+	if ch.Cert.ProposerID != ch.Proposer || !bytes.Equal(ch.Cert.ProposerSign, ch.ProposerSign) {
+		return ErrBlockProposer
+	}
+	return ch.Cert.Verify(ch.Height, ch.Digest(), validators)
+}
+
+// VerifyCertificate 验证区块的主节点签名和提交证书
+func (block *Block) VerifyCertificate(validators map[string][]byte) error {
+	return block.GetCertifiedHeader().Verify(validators)
+}
+
+// 编码主节点签名和提交证书
+func encodeFinality(e *storage.Encoder, proposerSign []byte, cert *storage.CommitCertificate) {
+	e.WriteBytes(proposerSign)
+	e.WriteBool(cert != nil)
+	if cert != nil {
+		e.WriteBytes(cert.Serialize())
+	}
+}
+
+func decodeFinality(d *storage.Decoder) ([]byte, *storage.CommitCertificate, error) {
+	proposerSign := d.ReadBytes()
+	if !d.ReadBool() {
+		return proposerSign, nil, d.Err()
+	}
+	secert := d.ReadBytes()
+	if err := d.Err(); err != nil {
+		return nil, nil, err
+	}
+	cert, err := storage.DeserializeCommitCertificate(secert)
+	return proposerSign, cert, err
+}
+
+// SerializeCertifiedHeader 将带证书区块头编码为规范化的二进制形式
+func (ch *CertifiedHeader) SerializeCertifiedHeader() []byte {
+	e := storage.NewEncoder()
+	e.WriteBytes(ch.SerializeHeader())
+	encodeFinality(e, ch.ProposerSign, ch.Cert)
+	return e.Bytes()
+}
+
+// DeserializeCertifiedHeader 解析SerializeCertifiedHeader的编码结果
+func DeserializeCertifiedHeader(data []byte) (*CertifiedHeader, error) {
+	d := storage.NewDecoder(data)
+	seheader := d.ReadBytes()
+	proposerSign, cert, err := decodeFinality(d)
+	if err == nil {
+		err = d.Finish()
+	}
+	if err != nil {
+		fmt.Printf("DeserializeCertifiedHeader error: %v\n", err)
+		return nil, err
+	}
+	header, err := DeserializeHeader(seheader)
+	if err != nil {
+		return nil, err
+	}
+	return &CertifiedHeader{*header, proposerSign, cert}, nil
+}
+
+// SerializeBlockWithCert 将区块连同主节点签名和提交证书一起编码，用于区块同步和持久化
+func (block *Block) SerializeBlockWithCert() ([]byte, error) {
+	seblock, err := block.SerializeBlock()
+	if err != nil {
+		return nil, err
+	}
+	e := storage.NewEncoder()
+	e.WriteBytes(seblock)
+	encodeFinality(e, block.ProposerSign, block.Cert)
+	return e.Bytes(), nil
+}
+
+// DeserializeBlockWithCert 解析SerializeBlockWithCert的编码结果
+func DeserializeBlockWithCert(data []byte) (*Block, error) {
+	d := storage.NewDecoder(data)
+	seblock := d.ReadBytes()
+	proposerSign, cert, err := decodeFinality(d)
+	if err == nil {
+		err = d.Finish()
+	}
+	if err != nil {
+		fmt.Printf("DeserializeBlockWithCert error: %v\n", err)
+		return nil, err
+	}
+	block, err := DeserializeBlock(seblock)
+	if err != nil {
+		return nil, err
+	}
+	block.ProposerSign = proposerSign
+	block.Cert = cert
+	return block, nil
+}
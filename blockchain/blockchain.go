@@ -1,13 +1,32 @@
 package blockchain
 
+import (
+	"bytes"
+	"log"
+	"simplechain/storage"
+)
+
 type Blockchain struct {
 	CurrentHeight int
 	Chain         []*Block
+	TxLog         *TxAccumulator //全链交易哈希累加器（即State.TxLog）
+	State         *State         //最新区块之后的世界状态
+
+	BaseHeight int              //Chain中第一个区块的高度，从快照启动时大于0
+	BaseHeader *CertifiedHeader //从快照启动时快照对应的区块头
+	LastHash   []byte           //最新区块的哈希
+
+	DB *storage.DB //区块和状态的持久化存储，为nil时只保存在内存中
+
+	Mode         StorageMode //存储模式，见history.go
+	PruneDepth   int         //裁剪模式下保留区块体和历史状态的区块数量
+	PrunedHeight int         //低于该高度的区块只保留区块头和证书
 }
 
 func NewBlockchain() *Blockchain {
 	chain := make([]*Block, 0)
-	return &Blockchain{0, chain}
+	state := NewState()
+	return &Blockchain{0, chain, state.TxLog, state, 0, nil, nil, nil, ArchiveMode, DefaultPruneDepth, 0}
 }
 
 // 获取区块链最新的区块
@@ -21,11 +40,91 @@ func (blockchain *Blockchain) GetLastBlock() *Block {
 // 添加区块,返回最新区块高度
 func (blockchain *Blockchain) AddBlock(block *Block) int {
 	blockchain.Chain = append(blockchain.Chain, block)
+	leafStart := blockchain.State.TxLog.Size()
+	blockchain.State.ApplyBlock(block)
+	//已提交的区块无法写入存储时不能继续运行，否则重启后会丢失区块
+	if blockchain.DB != nil {
+		if err := blockchain.persistBlock(block, leafStart); err != nil {
+			log.Panic(err)
+		}
+	}
+	blockchain.LastHash = block.Hash
 	blockchain.CurrentHeight++
+	//裁剪失败不影响已上链的区块，下一个区块上链时重试
+	if err := blockchain.maybePrune(); err != nil {
+		log.Println("prune blocks failed:", err)
+	}
 	return blockchain.CurrentHeight
 }
 
-// 根据块高获取区块指针，创世区块块高为0
+// 检查区块能否衔接在当前链的末尾
+func (blockchain *Blockchain) checkLink(block *Block) error {
+	if block.Height != blockchain.CurrentHeight {
+		return ErrBlockLink
+	}
+	if !bytes.Equal(block.PrevBlockHash, blockchain.LastHash) || !bytes.Equal(block.Hash, block.ComputeHash()) {
+		return ErrBlockLink
+	}
+	return nil
+}
+
+// CheckStateRoot 检查区块应用到当前状态之后的状态根与区块头中的状态根一致
+func (blockchain *Blockchain) CheckStateRoot(block *Block) error {
+	state := blockchain.State.Clone()
+	state.ApplyBlock(block)
+	if !bytes.Equal(state.GetRootHash(), block.StateRoot) {
+		return ErrBlockStateRoot
+	}
+	return nil
+}
+
+// ValidateProposal 验证紧接在当前链末尾的区块的哈希链接、交易树根、交易nonce和状态根，
+// 即除提交证书以外上链前的所有检查，用于共识中验证主节点提议的区块
+func (blockchain *Blockchain) ValidateProposal(block *Block) error {
+	if err := blockchain.checkLink(block); err != nil {
+		return err
+	}
+	if err := block.ValidateBody(); err != nil {
+		return err
+	}
+	if err := blockchain.State.CheckNonces(block.Transactions); err != nil {
+		return err
+	}
+	return blockchain.CheckStateRoot(block)
+}
+
+// ImportBlock 验证区块的哈希链接、交易树根、交易nonce、状态根和提交证书后将其上链，返回最新区块高度
+func (blockchain *Blockchain) ImportBlock(block *Block, validators map[string][]byte) (int, error) {
+	if err := blockchain.ValidateProposal(block); err != nil {
+		return blockchain.CurrentHeight, err
+	}
+	if err := block.VerifyCertificate(validators); err != nil {
+		return blockchain.CurrentHeight, err
+	}
+	return blockchain.AddBlock(block), nil
+}
+
+// RestoreFromSnapshot 以快照中的区块头和状态作为链的起点，之后只需同步快照之后的区块
+func (blockchain *Blockchain) RestoreFromSnapshot(header *CertifiedHeader, state *State) {
+	if blockchain.DB != nil {
+		if err := blockchain.persistSnapshot(header, state); err != nil {
+			log.Panic(err)
+		}
+	}
+	blockchain.Chain = make([]*Block, 0)
+	blockchain.PrunedHeight = 0
+	blockchain.State = state
+	blockchain.TxLog = state.TxLog
+	blockchain.BaseHeight = header.Height + 1
+	blockchain.BaseHeader = header
+	blockchain.LastHash = header.ComputeHash()
+	blockchain.CurrentHeight = header.Height + 1
+}
+
+// 根据块高获取区块指针，创世区块块高为0，本地没有该区块时返回nil
 func (blockchain *Blockchain) GetBlockByHeight(height int) *Block {
-	return blockchain.Chain[height]
+	if height < blockchain.BaseHeight || height >= blockchain.BaseHeight+len(blockchain.Chain) {
+		return nil
+	}
+	return blockchain.Chain[height-blockchain.BaseHeight]
 }
@@ -0,0 +1,83 @@
+package blockchain
+
+import (
+	"errors"
+	"fmt"
+	"simplechain/storage"
+	"testing"
+)
+
+func testTx(sender string, nonce int) *Transaction {
+	r := storage.Request{Message: storage.Message{Content: []byte(fmt.Sprintf("%s-%d", sender, nonce)), ID: nonce}, ClientAddr: sender, Nonce: nonce}
+	return NewTransaction(nonce, r.Serialize())
+}
+
+// 在链末尾构造状态根正确的区块
+func nextBlock(chain *Blockchain, transactions ...*Transaction) *Block {
+	state := chain.State.Clone()
+	state.ApplyBlock(NewBlock(chain.CurrentHeight, chain.LastHash, nil, "node1", transactions))
+	return NewBlock(chain.CurrentHeight, chain.LastHash, state.GetRootHash(), "node1", transactions)
+}
+
+func TestValidateProposal(t *testing.T) {
+	chain := NewBlockchain()
+	for height := 0; height < 3; height++ {
+		block := nextBlock(chain, testTx("alice", 2*height), testTx("alice", 2*height+1), testTx("bob", height))
+		if err := chain.ValidateProposal(block); err != nil {
+			t.Fatalf("valid block %d rejected: %v", height, err)
+		}
+		chain.AddBlock(block)
+	}
+
+	cases := []struct {
+		name  string
+		block func() *Block
+		want  error
+	}{
+		{"wrong height", func() *Block {
+			return NewBlock(chain.CurrentHeight+1, chain.LastHash, nil, "node1", nil)
+		}, ErrBlockLink},
+		{"wrong previous hash", func() *Block {
+			block := nextBlock(chain, testTx("alice", 6))
+			block.PrevBlockHash = chain.GetBlockByHeight(1).Hash
+			block.Hash = block.ComputeHash()
+			return block
+		}, ErrBlockLink},
+		{"stale hash", func() *Block {
+			block := nextBlock(chain, testTx("alice", 6))
+			block.Timestamp++
+			return block
+		}, ErrBlockLink},
+		{"body does not match the transaction root", func() *Block {
+			block := nextBlock(chain, testTx("alice", 6))
+			block.Transactions = append(block.Transactions, testTx("alice", 7))
+			return block
+		}, ErrBlockTxRoot},
+		{"reused nonce", func() *Block {
+			return nextBlock(chain, testTx("alice", 5))
+		}, ErrNonceReused},
+		{"nonce gap", func() *Block {
+			return nextBlock(chain, testTx("bob", 4))
+		}, ErrNonceGap},
+		{"wrong state root", func() *Block {
+			return NewBlock(chain.CurrentHeight, chain.LastHash, chain.GetLastBlock().StateRoot, "node1", []*Transaction{testTx("alice", 6)})
+		}, ErrBlockStateRoot},
+	}
+	for _, tc := range cases {
+		if err := chain.ValidateProposal(tc.block()); !errors.Is(err, tc.want) {
+			t.Errorf("%s: %v, want %v", tc.name, err, tc.want)
+		}
+	}
+
+	//通过验证的提议没有提交证书时仍然不能导入
+	block := nextBlock(chain, testTx("alice", 6))
+	if err := chain.ValidateProposal(block); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := chain.ImportBlock(block, nil); !errors.Is(err, ErrBlockNoCert) {
+		t.Errorf("import without certificate: %v, want ErrBlockNoCert", err)
+	}
+	if chain.CurrentHeight != 3 {
+		t.Errorf("height %d after rejected import, want 3", chain.CurrentHeight)
+	}
+}
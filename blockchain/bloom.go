@@ -0,0 +1,161 @@
+package blockchain
+
+import (
+	"bytes"
+	"errors"
+	"simplechain/storage"
+)
+
+// 区块头中的布隆过滤器覆盖区块内每笔交易的发送者和请求中声明的主题，
+// 按发送者或主题查找交易时先检查区块头，只有过滤器命中时才需要获取区块体。
+// 过滤器大小固定，区块头中只保存位数组，哈希函数个数为常量。
+
+const (
+	BlockBloomSize   = 256 //布隆过滤器位数组的字节数
+	BlockBloomHashes = 3   //布隆过滤器的哈希函数个数
+)
+
+var ErrBlockHeaderMismatch = errors.New("block: body does not match header")
+
+// 发送者和主题加上不同前缀，避免同名的发送者和主题互相命中
+func senderBloomKey(sender string) []byte {
+	return append([]byte("s/"), sender...)
+}
+
+func topicBloomKey(topic string) []byte {
+	return append([]byte("t/"), topic...)
+}
+
+func blockBloom(bits []byte) *storage.BloomFilter {
+	return &storage.BloomFilter{Bits: bits, Hashes: BlockBloomHashes}
+}
+
+// NewBlockBloom 根据交易列表计算区块头中的布隆过滤器
+func NewBlockBloom(transactions []*Transaction) []byte {
+	bf := blockBloom(make([]byte, BlockBloomSize))
+	for _, tx := range transactions {
+		bf.Add(senderBloomKey(tx.Sender))
+		if r, err := tx.GetRequest(); err == nil {
+			for _, topic := range r.Topics {
+				bf.Add(topicBloomKey(topic))
+			}
+		}
+	}
+	return bf.Bits
+}
+
+// MayContainSender 区块中是否可能有该发送者的交易
+func (header *BlockHeader) MayContainSender(sender string) bool {
+	return blockBloom(header.Bloom).MayContain(senderBloomKey(sender))
+}
+
+// MayContainTopic 区块中是否可能有声明了该主题的交易
+func (header *BlockHeader) MayContainTopic(topic string) bool {
+	return blockBloom(header.Bloom).MayContain(topicBloomKey(topic))
+}
+
+// TxFilter 交易过滤条件：Sender为空时匹配任意发送者，Topics为空时匹配任意主题，
+// 否则匹配声明了其中任一主题的交易
+type TxFilter struct {
+	Sender string
+	Topics []string
+}
+
+// MatchHeader 根据区块头的布隆过滤器判断区块中是否可能有匹配的交易
+func (filter *TxFilter) MatchHeader(header *BlockHeader) bool {
+	if filter.Sender != "" && !header.MayContainSender(filter.Sender) {
+		return false
+	}
+	if len(filter.Topics) == 0 {
+		return true
+	}
+	for _, topic := range filter.Topics {
+		if header.MayContainTopic(topic) {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchTx 判断交易是否匹配
+func (filter *TxFilter) MatchTx(tx *Transaction) bool {
+	if filter.Sender != "" && tx.Sender != filter.Sender {
+		return false
+	}
+	if len(filter.Topics) == 0 {
+		return true
+	}
+	r, err := tx.GetRequest()
+	if err != nil {
+		return false
+	}
+	for _, topic := range r.Topics {
+		for _, want := range filter.Topics {
+			if topic == want {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// 构造区块中第index笔交易的存在证明
+func blockTxWithProof(block *Block, index int) *TxWithProof {
+	txhashes := make([][]byte, 0, len(block.Transactions))
+	for _, tx := range block.Transactions {
+		txhashes = append(txhashes, tx.TxHash)
+	}
+	proof := NewMerkleTree(txhashes).GetProof(index)
+	return &TxWithProof{block.Transactions[index], TxLocation{block.Height, index}, proof, block.TxMHTRoot}
+}
+
+// ScanHeaders 依次检查区块头，只对布隆过滤器命中的区块调用fetch获取区块体，
+// 返回匹配的交易及其存在证明；获取到的区块体必须与区块头一致
+func ScanHeaders(headers []*BlockHeader, filter *TxFilter, fetch func(height int) (*Block, error)) ([]*TxWithProof, error) {
+	txs := make([]*TxWithProof, 0)
+	for _, header := range headers {
+		if !filter.MatchHeader(header) {
+			continue
+		}
+		block, err := fetch(header.Height)
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(block.ComputeHash(), header.ComputeHash()) {
+			return nil, ErrBlockHeaderMismatch
+		}
+		if err := block.ValidateBody(); err != nil {
+			return nil, err
+		}
+		for i, tx := range block.Transactions {
+			if filter.MatchTx(tx) {
+				txs = append(txs, blockTxWithProof(block, i))
+			}
+		}
+	}
+	return txs, nil
+}
+
+// ScanTransactions 在高度[from, to)的区块中查找匹配的交易，超出本地区块范围以及区块体已被裁剪的部分被忽略
+func (blockchain *Blockchain) ScanTransactions(filter *TxFilter, from int, to int) ([]*TxWithProof, error) {
+	if from < blockchain.BaseHeight {
+		from = blockchain.BaseHeight
+	}
+	if from < blockchain.PrunedHeight {
+		from = blockchain.PrunedHeight
+	}
+	if to > blockchain.CurrentHeight {
+		to = blockchain.CurrentHeight
+	}
+	headers := make([]*BlockHeader, 0)
+	for i := from; i < to; i++ {
+		headers = append(headers, &blockchain.GetBlockByHeight(i).BlockHeader)
+	}
+	return ScanHeaders(headers, filter, func(height int) (*Block, error) {
+		block := blockchain.GetBlockByHeight(height)
+		if block == nil {
+			return nil, ErrTxNotFound
+		}
+		return block, nil
+	})
+}
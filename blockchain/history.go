@@ -0,0 +1,192 @@
+package blockchain
+
+import (
+	"encoding/binary"
+	"errors"
+	"simplechain/storage"
+)
+
+// 历史状态和存储模式：
+//   v/<发送者长度><发送者><高度>      账户在该高度的区块应用之后的状态，只在账户被修改的高度记录
+//   m/pruned                         区块体已被裁剪的高度，低于该高度的区块只保留区块头和证书
+// 归档模式保留所有区块体和历史状态；裁剪模式只保留最近PruneDepth个区块的区块体和历史状态，
+// 每个账户在裁剪边界之前只保留最后一个版本，使裁剪边界之后的任何高度都能查询。
+
+var ErrStateHistoryDisabled = errors.New("history: blockchain has no storage")
+var ErrStatePruned = errors.New("history: state at this height has been pruned")
+var ErrStateHeight = errors.New("history: height out of range")
+
+var (
+	keyPrunedHeight      = []byte("m/pruned")
+	prefixAccountVersion = []byte("v/")
+)
+
+// StorageMode 全节点的存储模式
+type StorageMode int
+
+const (
+	ArchiveMode StorageMode = iota //保留所有区块体和历史状态
+	PrunedMode                     //只保留最近PruneDepth个区块的区块体和历史状态
+)
+
+const (
+	DefaultPruneDepth = 64 //裁剪模式默认保留的区块数量
+	PruneBatch        = 8  //裁剪边界每推进多少个区块执行一次裁剪
+)
+
+func (mode StorageMode) String() string {
+	if mode == PrunedMode {
+		return "pruned"
+	}
+	return "archive"
+}
+
+// SetStorageMode 设置存储模式，裁剪模式下depth为保留区块体和历史状态的区块数量
+func (blockchain *Blockchain) SetStorageMode(mode StorageMode, depth int) {
+	if depth < 1 {
+		depth = DefaultPruneDepth
+	}
+	blockchain.Mode = mode
+	blockchain.PruneDepth = depth
+}
+
+func accountVersionPrefix(sender string) []byte {
+	key := binary.BigEndian.AppendUint32(append([]byte(nil), prefixAccountVersion...), uint32(len(sender)))
+	return append(key, sender...)
+}
+
+func accountVersionKey(sender string, height int) []byte {
+	return binary.BigEndian.AppendUint64(accountVersionPrefix(sender), uint64(height))
+}
+
+// 可以查询历史状态的最低高度
+func (blockchain *Blockchain) historyFloor() int {
+	floor := blockchain.BaseHeight - 1
+	if blockchain.PrunedHeight-1 > floor {
+		floor = blockchain.PrunedHeight - 1
+	}
+	if floor < 0 {
+		floor = 0
+	}
+	return floor
+}
+
+// GetAccountAt 查询账户在高度为height的区块应用之后的状态，账户当时不存在时返回nil
+func (blockchain *Blockchain) GetAccountAt(sender string, height int) (*Account, error) {
+	if blockchain.DB == nil {
+		return nil, ErrStateHistoryDisabled
+	}
+	if height >= blockchain.CurrentHeight || height < 0 {
+		return nil, ErrStateHeight
+	}
+	if height < blockchain.historyFloor() {
+		return nil, ErrStatePruned
+	}
+	var value []byte
+	prefix := accountVersionPrefix(sender)
+	it := blockchain.DB.NewIterator(prefix)
+	defer it.Release()
+	for it.Next() {
+		if len(it.Key()) != len(prefix)+8 {
+			continue
+		}
+		if int(binary.BigEndian.Uint64(it.Key()[len(prefix):])) > height {
+			break
+		}
+		value = it.Value()
+	}
+	if err := it.Err(); err != nil {
+		return nil, err
+	}
+	if value == nil {
+		return nil, nil
+	}
+	return deserializeAccount(value)
+}
+
+// GetStateRootAt 获取高度为height的区块应用之后的状态根
+func (blockchain *Blockchain) GetStateRootAt(height int) ([]byte, error) {
+	if height == blockchain.BaseHeight-1 && blockchain.BaseHeader != nil {
+		return blockchain.BaseHeader.StateRoot, nil
+	}
+	block := blockchain.GetBlockByHeight(height)
+	if block == nil {
+		return nil, ErrStateHeight
+	}
+	return block.StateRoot, nil
+}
+
+// 将区块的交易索引从批次中删除
+func unindexBlock(batch *storage.Batch, block *Block) {
+	for i, tx := range block.Transactions {
+		loc := TxLocation{block.Height, i}
+		batch.Delete(txHashKey(tx.TxHash))
+		batch.Delete(appendLocation(senderPrefix(tx.Sender), loc))
+		if r, err := tx.GetRequest(); err == nil {
+			batch.Delete(appendLocation(requestPrefix(r.ID), loc))
+		}
+	}
+}
+
+// 裁剪模式下裁剪边界推进足够多时执行裁剪
+func (blockchain *Blockchain) maybePrune() error {
+	if blockchain.Mode != PrunedMode || blockchain.DB == nil {
+		return nil
+	}
+	to := blockchain.CurrentHeight - blockchain.PruneDepth
+	if to < blockchain.PrunedHeight+PruneBatch || to <= blockchain.BaseHeight {
+		return nil
+	}
+	return blockchain.prune(to)
+}
+
+// 裁剪高度低于to的区块体和交易索引，以及被高度不超过to-1的版本覆盖的账户历史版本
+func (blockchain *Blockchain) prune(to int) error {
+	from := blockchain.PrunedHeight
+	if from < blockchain.BaseHeight {
+		from = blockchain.BaseHeight
+	}
+	batch := storage.NewBatch()
+	pruned := make([]*Block, 0, to-from)
+	for h := from; h < to; h++ {
+		block := blockchain.GetBlockByHeight(h)
+		unindexBlock(batch, block)
+		header := &Block{block.BlockHeader, block.Hash, nil, block.ProposerSign, block.Cert}
+		seblock, err := header.SerializeBlockWithCert()
+		if err != nil {
+			return err
+		}
+		batch.Put(indexKey(prefixBlock, h), seblock)
+		pruned = append(pruned, header)
+	}
+	//账户版本按发送者和高度排序，同一发送者不超过to-1的版本中只保留最后一个
+	var prev, prevSender []byte
+	it := blockchain.DB.NewIterator(prefixAccountVersion)
+	defer it.Release()
+	for it.Next() {
+		key := it.Key()
+		if len(key) < len(prefixAccountVersion)+8 {
+			continue
+		}
+		sender := key[:len(key)-8]
+		if int(binary.BigEndian.Uint64(key[len(key)-8:])) > to-1 {
+			continue
+		}
+		if prev != nil && string(sender) == string(prevSender) {
+			batch.Delete(prev)
+		}
+		prev, prevSender = key, sender
+	}
+	if err := it.Err(); err != nil {
+		return err
+	}
+	batch.Put(keyPrunedHeight, encodeInt(to))
+	if err := blockchain.DB.Write(batch); err != nil {
+		return err
+	}
+	for i, block := range pruned {
+		blockchain.Chain[from+i-blockchain.BaseHeight] = block
+	}
+	blockchain.PrunedHeight = to
+	return nil
+}
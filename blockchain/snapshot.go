@@ -0,0 +1,68 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+)
+
+const SnapshotChunkSize = 64 * 1024 //快照分块大小（字节）
+
+var ErrSnapshotChunk = errors.New("snapshot: chunk hash mismatch")
+var ErrSnapshotStateRoot = errors.New("snapshot: state root mismatch")
+
+// Snapshot 检查点快照：检查点区块的带证书区块头，以及该区块之后的状态编码（分块存放）
+type Snapshot struct {
+	Header *CertifiedHeader //检查点区块头
+	Chunks [][]byte         //状态编码的分块
+}
+
+// NewSnapshot 为检查点区块创建快照，state必须是该区块上链之后的状态
+func NewSnapshot(header *CertifiedHeader, state *State, chunkSize int) *Snapshot {
+	data := state.SerializeState()
+	chunks := make([][]byte, 0, len(data)/chunkSize+1)
+	for len(data) > chunkSize {
+		chunks = append(chunks, data[:chunkSize])
+		data = data[chunkSize:]
+	}
+	chunks = append(chunks, data)
+	return &Snapshot{header, chunks}
+}
+
+// GetChunkHashes 获取每个分块的哈希
+func (snapshot *Snapshot) GetChunkHashes() [][]byte {
+	hashes := make([][]byte, len(snapshot.Chunks))
+	for i, chunk := range snapshot.Chunks {
+		hash := sha256.Sum256(chunk)
+		hashes[i] = hash[:]
+	}
+	return hashes
+}
+
+// VerifyChunk 根据分块哈希列表验证第index个分块
+func VerifyChunk(chunkHashes [][]byte, index int, chunk []byte) error {
+	if index < 0 || index >= len(chunkHashes) {
+		return ErrSnapshotChunk
+	}
+	hash := sha256.Sum256(chunk)
+	if !bytes.Equal(hash[:], chunkHashes[index]) {
+		return ErrSnapshotChunk
+	}
+	return nil
+}
+
+// RestoreState 由快照分块恢复状态，恢复出的状态根必须与检查点区块头中的状态根一致
+func RestoreState(header *CertifiedHeader, chunks [][]byte) (*State, error) {
+	data := make([]byte, 0)
+	for _, chunk := range chunks {
+		data = append(data, chunk...)
+	}
+	state, err := DeserializeState(data)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(state.GetRootHash(), header.StateRoot) {
+		return nil, ErrSnapshotStateRoot
+	}
+	return state, nil
+}
@@ -0,0 +1,160 @@
+package blockchain
+
+import (
+	"errors"
+	"simplechain/storage"
+	"sort"
+)
+
+var ErrNonceReused = errors.New("state: nonce already used")
+var ErrNonceGap = errors.New("state: nonce is ahead of the sender's next nonce")
+
+// Account 账户状态，以交易发送者作为账户
+type Account struct {
+	TxCount    int    //已上链的交易数量，也是该发送者下一笔交易的nonce
+	LastTxHash []byte //最近一笔上链交易的哈希
+}
+
+// State 世界状态：所有账户以及全链交易哈希累加器
+type State struct {
+	Accounts map[string]*Account //发送者对应的账户
+	TxLog    *TxAccumulator      //全链交易哈希累加器
+}
+
+func NewState() *State {
+	return &State{make(map[string]*Account), NewTxAccumulator()}
+}
+
+// GetAccount 获取发送者的账户，不存在时返回nil
+func (state *State) GetAccount(sender string) *Account {
+	return state.Accounts[sender]
+}
+
+// GetNonce 发送者下一笔交易应使用的nonce
+func (state *State) GetNonce(sender string) int {
+	if account, ok := state.Accounts[sender]; ok {
+		return account.TxCount
+	}
+	return 0
+}
+
+// CheckNonces 检查交易依次应用到状态上时，每个发送者的nonce从其下一个nonce开始连续递增
+func (state *State) CheckNonces(transactions []*Transaction) error {
+	return state.checkNonces(transactions, false)
+}
+
+// CheckPendingNonces 检查尚未提交的前序区块之后的区块：每个发送者的nonce不能已被使用，且在区块内连续递增，
+// 但第一笔交易的nonce可以超前（前序区块可能使用了中间的nonce）
+func (state *State) CheckPendingNonces(transactions []*Transaction) error {
+	return state.checkNonces(transactions, true)
+}
+
+func (state *State) checkNonces(transactions []*Transaction, pending bool) error {
+	next := make(map[string]int)
+	for _, tx := range transactions {
+		expect, ok := next[tx.Sender]
+		if !ok {
+			expect = state.GetNonce(tx.Sender)
+			if pending && tx.Nonce > expect {
+				expect = tx.Nonce
+			}
+		}
+		if tx.Nonce < expect {
+			return ErrNonceReused
+		}
+		if tx.Nonce > expect {
+			return ErrNonceGap
+		}
+		next[tx.Sender] = expect + 1
+	}
+	return nil
+}
+
+// ApplyBlock 将区块中的交易依次应用到状态上
+func (state *State) ApplyBlock(block *Block) {
+	state.ApplyTransactions(block.Transactions)
+}
+
+// ApplyTransactions 将交易依次应用到状态上
+func (state *State) ApplyTransactions(transactions []*Transaction) {
+	for _, tx := range transactions {
+		account, ok := state.Accounts[tx.Sender]
+		if !ok {
+			account = &Account{}
+			state.Accounts[tx.Sender] = account
+		}
+		account.TxCount++
+		account.LastTxHash = tx.TxHash
+		state.TxLog.Append(tx.TxHash)
+	}
+}
+
+// Clone 复制状态，复制后的状态可以独立修改
+func (state *State) Clone() *State {
+	accounts := make(map[string]*Account, len(state.Accounts))
+	for sender, account := range state.Accounts {
+		copied := *account
+		accounts[sender] = &copied
+	}
+	return &State{accounts, state.TxLog.Clone()}
+}
+
+// 按发送者排序后的账户列表
+func (state *State) sortedSenders() []string {
+	senders := make([]string, 0, len(state.Accounts))
+	for sender := range state.Accounts {
+		senders = append(senders, sender)
+	}
+	sort.Strings(senders)
+	return senders
+}
+
+func encodeAccount(e *storage.Encoder, sender string, account *Account) {
+	e.WriteString(sender)
+	e.WriteInt(account.TxCount)
+	e.WriteBytes(account.LastTxHash)
+}
+
+// GetRootHash 状态根：按发送者排序的账户编码构成的默克尔树根与交易累加器根的哈希
+func (state *State) GetRootHash() []byte {
+	leaves := make([][]byte, 0, len(state.Accounts))
+	for _, sender := range state.sortedSenders() {
+		e := storage.NewEncoder()
+		encodeAccount(e, sender, state.Accounts[sender])
+		leaves = append(leaves, hashLeaf(e.Bytes()))
+	}
+	return hashChildren(rootOfLeafHashes(leaves), state.TxLog.GetRootHash())
+}
+
+// SerializeState 将状态编码为规范化的二进制形式
+func (state *State) SerializeState() []byte {
+	e := storage.NewEncoder()
+	senders := state.sortedSenders()
+	e.WriteInt(len(senders))
+	for _, sender := range senders {
+		encodeAccount(e, sender, state.Accounts[sender])
+	}
+	e.WriteBytesList(state.TxLog.LeafHashes)
+	return e.Bytes()
+}
+
+// DeserializeState 从规范化编码中解析状态
+func DeserializeState(data []byte) (*State, error) {
+	state := NewState()
+	d := storage.NewDecoder(data)
+	accountNum := d.ReadInt()
+	for i := 0; i < accountNum && d.Err() == nil; i++ {
+		sender := d.ReadString()
+		account := &Account{}
+		account.TxCount = d.ReadInt()
+		account.LastTxHash = d.ReadBytes()
+		state.Accounts[sender] = account
+	}
+	for _, leaf := range d.ReadBytesList() {
+		state.TxLog.AppendLeafHash(leaf)
+	}
+	if err := d.Finish(); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
@@ -0,0 +1,196 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/binary"
+	"simplechain/storage"
+)
+
+// 区块链在键值存储中的布局：
+//   m/height        当前区块链高度
+//   m/base          从快照启动时快照对应的带证书区块头
+//   b/<高度>        带证书的区块
+//   a/<发送者>      账户状态
+//   t/<序号>        交易累加器的叶子
+// 高度和序号编码为8字节大端序，使键的字典序与数值顺序一致。
+// 每个区块上链时，区块、其修改的账户及其历史版本（见history.go）、交易累加器叶子、交易索引（见txindex.go）
+// 以及新高度在同一个批次中原子写入。
+
+var (
+	keyHeight     = []byte("m/height")
+	keyBaseHeader = []byte("m/base")
+	prefixBlock   = []byte("b/")
+	prefixAccount = []byte("a/")
+	prefixTxLeaf  = []byte("t/")
+)
+
+func indexKey(prefix []byte, i int) []byte {
+	return binary.BigEndian.AppendUint64(append([]byte(nil), prefix...), uint64(i))
+}
+
+func accountKey(sender string) []byte {
+	return append(append([]byte(nil), prefixAccount...), sender...)
+}
+
+func encodeInt(v int) []byte {
+	e := storage.NewEncoder()
+	e.WriteInt(v)
+	return e.Bytes()
+}
+
+func decodeInt(data []byte) (int, error) {
+	d := storage.NewDecoder(data)
+	v := d.ReadInt()
+	return v, d.Finish()
+}
+
+func serializeAccount(account *Account) []byte {
+	e := storage.NewEncoder()
+	e.WriteInt(account.TxCount)
+	e.WriteBytes(account.LastTxHash)
+	return e.Bytes()
+}
+
+func deserializeAccount(data []byte) (*Account, error) {
+	d := storage.NewDecoder(data)
+	account := &Account{TxCount: d.ReadInt(), LastTxHash: d.ReadBytes()}
+	return account, d.Finish()
+}
+
+// OpenBlockchain 从键值存储中加载区块链，存储为空时返回空链
+// 加载后检查状态根与最新区块头中的状态根一致
+func OpenBlockchain(db *storage.DB) (*Blockchain, error) {
+	blockchain := NewBlockchain()
+	blockchain.DB = db
+	seheight, err := db.Get(keyHeight)
+	if err == storage.ErrKVNotFound {
+		return blockchain, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	height, err := decodeInt(seheight)
+	if err != nil {
+		return nil, err
+	}
+	//从快照启动的链从快照之后开始
+	if seheader, err := db.Get(keyBaseHeader); err == nil {
+		header, err := DeserializeCertifiedHeader(seheader)
+		if err != nil {
+			return nil, err
+		}
+		blockchain.BaseHeader = header
+		blockchain.BaseHeight = header.Height + 1
+		blockchain.LastHash = header.ComputeHash()
+		blockchain.CurrentHeight = blockchain.BaseHeight
+	} else if err != storage.ErrKVNotFound {
+		return nil, err
+	}
+	if sepruned, err := db.Get(keyPrunedHeight); err == nil {
+		if blockchain.PrunedHeight, err = decodeInt(sepruned); err != nil {
+			return nil, err
+		}
+	} else if err != storage.ErrKVNotFound {
+		return nil, err
+	}
+	expectRoot := []byte(nil)
+	if blockchain.BaseHeader != nil {
+		expectRoot = blockchain.BaseHeader.StateRoot
+	}
+	for i := blockchain.BaseHeight; i < height; i++ {
+		seblock, err := db.Get(indexKey(prefixBlock, i))
+		if err != nil {
+			return nil, err
+		}
+		block, err := DeserializeBlockWithCert(seblock)
+		if err != nil {
+			return nil, err
+		}
+		if err := blockchain.checkLink(block); err != nil {
+			return nil, err
+		}
+		blockchain.Chain = append(blockchain.Chain, block)
+		blockchain.LastHash = block.Hash
+		blockchain.CurrentHeight = block.Height + 1
+		expectRoot = block.StateRoot
+	}
+	//加载状态
+	state := NewState()
+	it := db.NewIterator(prefixAccount)
+	defer it.Release()
+	for it.Next() {
+		account, err := deserializeAccount(it.Value())
+		if err != nil {
+			return nil, err
+		}
+		state.Accounts[string(it.Key()[len(prefixAccount):])] = account
+	}
+	if err := it.Err(); err != nil {
+		return nil, err
+	}
+	it = db.NewIterator(prefixTxLeaf)
+	defer it.Release()
+	for it.Next() {
+		state.TxLog.AppendLeafHash(it.Value())
+	}
+	if err := it.Err(); err != nil {
+		return nil, err
+	}
+	if expectRoot != nil && !bytes.Equal(state.GetRootHash(), expectRoot) {
+		return nil, ErrBlockStateRoot
+	}
+	blockchain.State = state
+	blockchain.TxLog = state.TxLog
+	if err := blockchain.rebuildTxIndex(); err != nil {
+		return nil, err
+	}
+	return blockchain, nil
+}
+
+// 将新上链的区块及其对状态的修改原子地写入存储，调用时区块已经应用到状态上
+func (blockchain *Blockchain) persistBlock(block *Block, leafStart int) error {
+	seblock, err := block.SerializeBlockWithCert()
+	if err != nil {
+		return err
+	}
+	batch := storage.NewBatch()
+	batch.Put(indexKey(prefixBlock, block.Height), seblock)
+	for _, tx := range block.Transactions {
+		seaccount := serializeAccount(blockchain.State.Accounts[tx.Sender])
+		batch.Put(accountKey(tx.Sender), seaccount)
+		batch.Put(accountVersionKey(tx.Sender, block.Height), seaccount)
+	}
+	for i := leafStart; i < blockchain.State.TxLog.Size(); i++ {
+		batch.Put(indexKey(prefixTxLeaf, i), blockchain.State.TxLog.LeafHashes[i])
+	}
+	indexBlock(batch, block)
+	batch.Put(keyHeight, encodeInt(block.Height+1))
+	return blockchain.DB.Write(batch)
+}
+
+// 从快照启动时用快照替换存储中的区块和状态
+func (blockchain *Blockchain) persistSnapshot(header *CertifiedHeader, state *State) error {
+	batch := storage.NewBatch()
+	for _, prefix := range [][]byte{prefixBlock, prefixAccount, prefixAccountVersion, prefixTxLeaf, prefixTxHash, prefixTxSender, prefixTxRequest} {
+		it := blockchain.DB.NewIterator(prefix)
+		for it.Next() {
+			batch.Delete(it.Key())
+		}
+		if err := it.Err(); err != nil {
+			return err
+		}
+	}
+	for sender, account := range state.Accounts {
+		seaccount := serializeAccount(account)
+		batch.Put(accountKey(sender), seaccount)
+		batch.Put(accountVersionKey(sender, header.Height), seaccount)
+	}
+	for i, leaf := range state.TxLog.LeafHashes {
+		batch.Put(indexKey(prefixTxLeaf, i), leaf)
+	}
+	batch.Delete(keyPrunedHeight)
+	batch.Put(keyBaseHeader, header.SerializeCertifiedHeader())
+	batch.Put(keyIndexHeight, encodeInt(header.Height+1))
+	batch.Put(keyHeight, encodeInt(header.Height+1))
+	return blockchain.DB.Write(batch)
+}
@@ -10,38 +10,81 @@ import (
 
 type Transaction struct {
 	TxID    int    //交易ID
-	Content []byte //交易内容(序列化后的Request)
+	Content []byte //交易内容(规范化编码后的Request)
 	TxHash  []byte //交易哈希
 	Sender  string //交易发送者
+
+	Nonce    int    //发送者的第几笔交易
+	Fee      int    //交易的费用（优先级）
+	PubKeyID string //客户端签名公钥的ID
+	Sign     []byte //客户端对请求的签名
 }
 
 func NewTransaction(txid int, content []byte) *Transaction {
-	hash := sha256.Sum256(content)
-	//解析content，获得发送者
-	r := new(storage.Request)
-	err := json.Unmarshal(content, r)
+	tx, err := newTransaction(txid, content)
 	if err != nil {
 		log.Panic(err)
 	}
-	tx := &Transaction{txid, content, hash[:], r.ClientAddr}
 	return tx
 }
 
-func (tx *Transaction) SerializeTx() ([]byte, error) {
-	jsonTx, err := json.Marshal(tx)
+// 由交易内容构建交易，交易哈希覆盖content的全部字节
+func newTransaction(txid int, content []byte) (*Transaction, error) {
+	hash := sha256.Sum256(content)
+	//解析content，获得发送者
+	r, err := storage.DeserializeRequest(content)
 	if err != nil {
-		fmt.Printf("SerializeTx error: %v\n", err)
 		return nil, err
 	}
-	return jsonTx, nil
+	tx := &Transaction{txid, content, hash[:], r.ClientAddr, r.Nonce, r.Fee, r.PubKeyID, r.Sign}
+	return tx, nil
+}
+
+// GetRequest 解析交易内容中的Request
+func (tx *Transaction) GetRequest() (*storage.Request, error) {
+	return storage.DeserializeRequest(tx.Content)
+}
+
+// SerializeTx 将交易编码为规范化的二进制形式，交易哈希和发送者由内容导出，不单独编码
+func (tx *Transaction) SerializeTx() ([]byte, error) {
+	e := storage.NewEncoder()
+	tx.encodeTo(e)
+	return e.Bytes(), nil
+}
+
+func (tx *Transaction) encodeTo(e *storage.Encoder) {
+	e.WriteInt(tx.TxID)
+	e.WriteBytes(tx.Content)
+}
+
+func decodeTx(d *storage.Decoder) (*Transaction, error) {
+	txid := d.ReadInt()
+	content := d.ReadBytes()
+	if err := d.Err(); err != nil {
+		return nil, err
+	}
+	return newTransaction(txid, content)
 }
 
 func DeserializeTx(data []byte) (*Transaction, error) {
-	tx := &Transaction{}
-	err := json.Unmarshal(data, tx)
+	d := storage.NewDecoder(data)
+	tx, err := decodeTx(d)
+	if err == nil {
+		err = d.Finish()
+	}
 	if err != nil {
 		fmt.Printf("DeserializeTx error: %v\n", err)
 		return nil, err
 	}
 	return tx, nil
 }
+
+// ExportTxJSON 将交易导出为JSON，仅用于调试和导出，不参与哈希和签名
+func (tx *Transaction) ExportTxJSON() ([]byte, error) {
+	jsonTx, err := json.Marshal(tx)
+	if err != nil {
+		fmt.Printf("ExportTxJSON error: %v\n", err)
+		return nil, err
+	}
+	return jsonTx, nil
+}
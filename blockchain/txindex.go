@@ -0,0 +1,216 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"simplechain/storage"
+)
+
+// 交易索引在键值存储中的布局：
+//   x/height                          已建立索引的区块高度
+//   x/h/<交易哈希>                    交易所在的区块高度和区块内序号
+//   x/s/<发送者长度><发送者><高度><序号>  发送者的交易
+//   x/r/<请求ID><高度><序号>          请求ID对应的交易（不同客户端的请求ID可能相同）
+// 索引与区块在同一个批次中写入，启动时补建缺失的索引。
+
+var ErrTxNotFound = errors.New("txindex: transaction not found")
+var ErrTxIndexDisabled = errors.New("txindex: blockchain has no storage")
+
+var (
+	keyIndexHeight  = []byte("x/height")
+	prefixTxHash    = []byte("x/h/")
+	prefixTxSender  = []byte("x/s/")
+	prefixTxRequest = []byte("x/r/")
+)
+
+// TxLocation 交易在链上的位置
+type TxLocation struct {
+	Height int //区块高度
+	Index  int //区块内的序号
+}
+
+// TxWithProof 查询得到的交易及其在区块交易树中的存在证明
+type TxWithProof struct {
+	Transaction *Transaction
+	TxLocation
+	Proof     *MHTProof //交易哈希在区块交易树中的存在证明
+	TxMHTRoot []byte    //区块头中的交易树根
+}
+
+func txHashKey(txHash []byte) []byte {
+	return append(append([]byte(nil), prefixTxHash...), txHash...)
+}
+
+func senderPrefix(sender string) []byte {
+	key := binary.BigEndian.AppendUint32(append([]byte(nil), prefixTxSender...), uint32(len(sender)))
+	return append(key, sender...)
+}
+
+func requestPrefix(requestID int) []byte {
+	return binary.BigEndian.AppendUint64(append([]byte(nil), prefixTxRequest...), uint64(requestID))
+}
+
+func appendLocation(key []byte, loc TxLocation) []byte {
+	key = binary.BigEndian.AppendUint64(key, uint64(loc.Height))
+	return binary.BigEndian.AppendUint64(key, uint64(loc.Index))
+}
+
+// 从键的末尾16字节解析交易位置
+func locationFromKey(key []byte) (TxLocation, bool) {
+	if len(key) < 16 {
+		return TxLocation{}, false
+	}
+	tail := key[len(key)-16:]
+	return TxLocation{int(binary.BigEndian.Uint64(tail[:8])), int(binary.BigEndian.Uint64(tail[8:]))}, true
+}
+
+// 将区块中所有交易的索引加入批次
+func indexBlock(batch *storage.Batch, block *Block) {
+	for i, tx := range block.Transactions {
+		loc := TxLocation{block.Height, i}
+		batch.Put(txHashKey(tx.TxHash), appendLocation(nil, loc))
+		batch.Put(appendLocation(senderPrefix(tx.Sender), loc), nil)
+		if r, err := tx.GetRequest(); err == nil {
+			batch.Put(appendLocation(requestPrefix(r.ID), loc), nil)
+		}
+	}
+	batch.Put(keyIndexHeight, encodeInt(block.Height+1))
+}
+
+// 启动时为尚未建立索引的区块补建索引
+func (blockchain *Blockchain) rebuildTxIndex() error {
+	indexed := blockchain.BaseHeight
+	if seheight, err := blockchain.DB.Get(keyIndexHeight); err == nil {
+		if indexed, err = decodeInt(seheight); err != nil {
+			return err
+		}
+	} else if err != storage.ErrKVNotFound {
+		return err
+	}
+	if indexed < blockchain.BaseHeight {
+		indexed = blockchain.BaseHeight
+	}
+	if indexed >= blockchain.CurrentHeight {
+		return nil
+	}
+	batch := storage.NewBatch()
+	for i := indexed; i < blockchain.CurrentHeight; i++ {
+		indexBlock(batch, blockchain.GetBlockByHeight(i))
+	}
+	return blockchain.DB.Write(batch)
+}
+
+// 获取某个位置的交易及其存在证明
+func (blockchain *Blockchain) getTxWithProof(loc TxLocation) (*TxWithProof, error) {
+	block := blockchain.GetBlockByHeight(loc.Height)
+	if block == nil || loc.Index < 0 || loc.Index >= len(block.Transactions) {
+		return nil, ErrTxNotFound
+	}
+	return blockTxWithProof(block, loc.Index), nil
+}
+
+// 获取以prefix开头的索引键对应的所有交易
+func (blockchain *Blockchain) getTxsByPrefix(prefix []byte) ([]*TxWithProof, error) {
+	if blockchain.DB == nil {
+		return nil, ErrTxIndexDisabled
+	}
+	txs := make([]*TxWithProof, 0)
+	it := blockchain.DB.NewIterator(prefix)
+	defer it.Release()
+	for it.Next() {
+		loc, ok := locationFromKey(it.Key())
+		if !ok || len(it.Key()) != len(prefix)+16 {
+			continue
+		}
+		tx, err := blockchain.getTxWithProof(loc)
+		if err != nil {
+			return nil, err
+		}
+		txs = append(txs, tx)
+	}
+	return txs, it.Err()
+}
+
+// GetTxByHash 根据交易哈希查询交易及其存在证明
+func (blockchain *Blockchain) GetTxByHash(txHash []byte) (*TxWithProof, error) {
+	if blockchain.DB == nil {
+		return nil, ErrTxIndexDisabled
+	}
+	seloc, err := blockchain.DB.Get(txHashKey(txHash))
+	if err == storage.ErrKVNotFound {
+		return nil, ErrTxNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	loc, ok := locationFromKey(seloc)
+	if !ok {
+		return nil, ErrTxNotFound
+	}
+	return blockchain.getTxWithProof(loc)
+}
+
+// GetTxsBySender 按上链顺序查询某个发送者的所有交易及其存在证明
+func (blockchain *Blockchain) GetTxsBySender(sender string) ([]*TxWithProof, error) {
+	return blockchain.getTxsByPrefix(senderPrefix(sender))
+}
+
+// GetTxsByRequestID 查询请求ID对应的所有交易及其存在证明
+func (blockchain *Blockchain) GetTxsByRequestID(requestID int) ([]*TxWithProof, error) {
+	return blockchain.getTxsByPrefix(requestPrefix(requestID))
+}
+
+// Verify 验证交易哈希与交易内容一致，且交易包含在交易树根为TxMHTRoot的区块中
+func (txp *TxWithProof) Verify() bool {
+	hash := sha256.Sum256(txp.Transaction.Content)
+	return bytes.Equal(hash[:], txp.Transaction.TxHash) && VerifyMHTProof(txp.Transaction.TxHash, txp.Proof, txp.TxMHTRoot)
+}
+
+// Serialize 将交易及其存在证明编码为规范化的二进制形式
+func (txp *TxWithProof) Serialize() []byte {
+	e := storage.NewEncoder()
+	e.WriteInt(txp.Height)
+	e.WriteInt(txp.Index)
+	txp.Transaction.encodeTo(e)
+	e.WriteBytes(txp.Proof.Serialize())
+	e.WriteBytes(txp.TxMHTRoot)
+	return e.Bytes()
+}
+
+// DeserializeTxWithProof 解析Serialize的编码结果
+func DeserializeTxWithProof(data []byte) (*TxWithProof, error) {
+	d := storage.NewDecoder(data)
+	txp := &TxWithProof{TxLocation: TxLocation{d.ReadInt(), d.ReadInt()}}
+	tx, err := decodeTx(d)
+	if err != nil {
+		return nil, err
+	}
+	txp.Transaction = tx
+	seproof := d.ReadBytes()
+	txp.TxMHTRoot = d.ReadBytes()
+	if err := d.Finish(); err != nil {
+		return nil, err
+	}
+	if txp.Proof, err = DeserializeMHTProof(seproof); err != nil {
+		return nil, err
+	}
+	return txp, nil
+}
+
+// VerifyMHTProof 根据存在证明由data计算默克尔树根，并与root比较
+func VerifyMHTProof(data []byte, proof *MHTProof, root []byte) bool {
+	if proof == nil || !proof.GetIsExist() {
+		return false
+	}
+	node := hashLeaf(data)
+	for _, pair := range proof.GetProofPairs() {
+		if pair.Index == 1 {
+			node = hashChildren(node, pair.Hash)
+		} else {
+			node = hashChildren(pair.Hash, node)
+		}
+	}
+	return bytes.Equal(node, root)
+}
@@ -1,28 +1,32 @@
 package consensus
 
 import (
-	"encoding/hex"
-	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
-	"os"
 	"simplechain/network"
 	"simplechain/storage"
 	"simplechain/utils"
+	"sort"
 	"strconv"
 	"sync"
+	"sync/atomic"
 )
 
 type Pbft struct {
-	NodeID     string //节点ID
-	Addr       string //节点网络监听地址
-	RsaPrivKey []byte //RSA私钥
-	RsaPubKey  []byte //RSA公钥
+	NodeID string       //节点ID
+	Addr   string       //节点网络监听地址
+	Signer utils.Signer //节点的签名者，签名方案与网络一致
 
 	P2P         *network.P2P //一个P2P网络
 	SequenceIDL int          //当前已提交消息的自增序号(低水位线)
+	View        int          //当前视图编号
+
+	WAL *storage.WAL //预写日志，为nil时不持久化协议状态
+	//从预写日志恢复的、本节点发出但尚未提交的消息，等待重新广播
+	walResend []storage.WALRecord
 
-	Lock sync.Mutex //锁
 	//临时消息池，消息摘要对应消息本体
 	MessagePool map[string]*storage.Request
 	//存放收到的prepare数量(至少需要收到并确认2f个)，根据摘要来对应
@@ -35,17 +39,55 @@ type Pbft struct {
 	IsReply map[string]bool
 	//暂存完成共识待commit的消息
 	MessageToCommit map[int]storage.Commit
+	//主节点对各消息的PrePrepare签名，根据摘要来对应
+	PrePrepareSigns map[string][]byte
+	//收到的commit签名（包括自己的），根据摘要和节点ID来对应，用于构建提交证书
+	CommitSigns map[string]map[string][]byte
 
 	MessageCommitted []storage.Message //本地消息池（模拟持久化层），只有确认提交成功后才会存入此池
 	Loger            *log.Logger       //日志对象
+
+	RequestDigest func(request storage.Request) string //计算请求摘要的函数，默认为storage.GetDigest，返回空串表示请求不合法
+
+	VerifyWorkers int          //并行验证签名的协程数量，为0时在事件循环中依次验证
+	verifyCache   *verifyCache //已验证签名的(摘要, 节点)对
+	verifyOrder   chan *verifyJob
+	verifyJobs    chan *verifyJob
+
+	inbox     chan func()            //事件循环的收件箱，协议状态只由事件循环修改
+	committed chan *CommittedMessage //按序号依次提交的消息
+	started   atomic.Bool            //事件循环是否已经启动
+	stopped   chan struct{}          //Stop之后关闭，之后提交的事件和消息都被丢弃
+	loopDone  chan struct{}          //事件循环退出后关闭
+	stopOnce  sync.Once
+
+	rejected      map[string]int //各发送者被拒绝的消息数量
+	rejectedMutex sync.Mutex
 }
 
-func NewPBFT(nodeID string, addr string, privkey []byte, pubkey []byte, p2p *network.P2P) *Pbft {
+var (
+	ErrInvalidRequest = errors.New("pbft: invalid request")
+	ErrDigestMismatch = errors.New("pbft: digest does not match the request")
+	ErrUnknownSigner  = errors.New("pbft: signer is not a validator")
+)
+
+const (
+	InboxSize       = 1024 //事件循环收件箱的容量
+	CommittedBuffer = 64   //已提交消息通道的容量
+)
+
+// CommittedMessage 完成共识、按序号依次提交的消息及其提交证书
+type CommittedMessage struct {
+	SequenceID int
+	Request    *storage.Request
+	Cert       *storage.CommitCertificate
+}
+
+func NewPBFT(nodeID string, addr string, signer utils.Signer, p2p *network.P2P) *Pbft {
 	p := new(Pbft)
 	p.NodeID = nodeID
 	p.Addr = addr
-	p.RsaPrivKey = privkey
-	p.RsaPubKey = pubkey
+	p.Signer = signer
 	p.P2P = p2p
 	p.SequenceIDL = 0
 	p.MessagePool = make(map[string]*storage.Request)
@@ -55,62 +97,208 @@ func NewPBFT(nodeID string, addr string, privkey []byte, pubkey []byte, p2p *net
 	p.IsReply = make(map[string]bool)
 	p.MessageCommitted = make([]storage.Message, 0)
 	p.MessageToCommit = make(map[int]storage.Commit)
+	p.PrePrepareSigns = make(map[string][]byte)
+	p.CommitSigns = make(map[string]map[string][]byte)
+	p.RequestDigest = storage.GetDigest
+	p.Loger = log.New(io.Discard, "", log.Lshortfile)
+	p.inbox = make(chan func(), InboxSize)
+	p.committed = make(chan *CommittedMessage, CommittedBuffer)
+	p.stopped = make(chan struct{})
+	p.loopDone = make(chan struct{})
+	p.VerifyWorkers = DefaultVerifyWorkers
+	p.verifyCache = newVerifyCache()
+	p.rejected = make(map[string]int)
+	p.verifyOrder = make(chan *verifyJob, VerifyQueueSize)
+	p.verifyJobs = make(chan *verifyJob, VerifyQueueSize)
 	return p
 }
 
+// 共识的并发模型：Start之后协议状态只在事件循环协程中读写，其他协程通过收件箱提交事件，
+// 完成提交的消息通过Committed通道按序号交给上层。事件循环会调用RequestDigest，
+// 因此持有RequestDigest所需锁的协程不能向事件循环提交事件，否则可能互相等待。
+// Start之前（打开预写日志、恢复状态时）所有方法直接在调用者的协程中执行。
+// Stop之后事件循环和验证协程退出，提交的事件和收到的消息都被丢弃。
+
+// Start 启动事件循环和签名验证协程池，之后不能再直接访问协议状态
+func (p *Pbft) Start() {
+	if p.started.Swap(true) {
+		return
+	}
+	if p.VerifyWorkers > 0 {
+		p.startVerifiers()
+	}
+	go func() {
+		defer close(p.loopDone)
+		for {
+			select {
+			case event := <-p.inbox:
+				event()
+			case <-p.stopped:
+				return
+			}
+		}
+	}()
+}
+
+// Stop 停止事件循环和签名验证协程池并关闭预写日志，返回时事件循环已经退出
+func (p *Pbft) Stop() {
+	p.stopOnce.Do(func() {
+		close(p.stopped)
+		if p.started.Load() {
+			<-p.loopDone
+		}
+		if p.WAL != nil {
+			if err := p.WAL.Close(); err != nil {
+				p.Loger.Println("节点", p.NodeID, "关闭预写日志失败:", err)
+			}
+		}
+	})
+}
+
+// 将fn交给事件循环异步执行，事件循环启动之前直接执行，停止之后丢弃
+func (p *Pbft) post(fn func()) {
+	if !p.started.Load() {
+		fn()
+		return
+	}
+	select {
+	case p.inbox <- fn:
+	case <-p.stopped:
+	}
+}
+
+// 在事件循环中执行fn并等待其完成，事件循环启动之前直接执行，停止之后不执行fn直接返回
+func (p *Pbft) call(fn func()) {
+	if !p.started.Load() {
+		fn()
+		return
+	}
+	done := make(chan struct{})
+	select {
+	case p.inbox <- func() {
+		fn()
+		close(done)
+	}:
+	case <-p.stopped:
+		return
+	}
+	select {
+	case <-done:
+	case <-p.loopDone:
+	}
+}
+
+// Committed 按序号依次提交的消息，只有事件循环启动之后提交的消息才会发送到该通道
+func (p *Pbft) Committed() <-chan *CommittedMessage {
+	return p.committed
+}
+
+// CommittedFrom 获取序号在[sequenceID, 低水位线)之间、已完成共识的消息，用于重启后将预写日志中已提交的消息上链
+func (p *Pbft) CommittedFrom(sequenceID int) []*CommittedMessage {
+	var committed []*CommittedMessage
+	p.call(func() {
+		for i := sequenceID; i < p.SequenceIDL; i++ {
+			commit, ok := p.MessageToCommit[i]
+			if !ok || p.MessagePool[commit.Digest] == nil {
+				break
+			}
+			committed = append(committed, &CommittedMessage{i, p.MessagePool[commit.Digest], p.commitCertificate(i, commit.Digest)})
+		}
+	})
+	return committed
+}
+
+// HandleRequest 将收到的消息交给事件循环处理，启用了验证协程池时先并行验证签名
 func (p *Pbft) HandleRequest(data []byte) {
-	//切割消息，根据消息命令调用不同的功能
-	cmd, content := storage.SplitMessage(data) //拆解消息类别，content是序列化后的Request、PrePrepare、Prepare或Commit
-	switch storage.Command(cmd) {
-	case storage.CRequest:
-		p.HandleClientRequest(content)
-	case storage.CPrePrepare:
-		p.HandlePrePrepare(content)
-	case storage.CPrepare:
-		p.HandlePrepare(content)
-	case storage.CCommit:
-		p.HandleCommit(content)
+	if p.started.Load() && p.VerifyWorkers > 0 {
+		p.dispatchVerify(data)
+		return
 	}
+	p.post(func() { p.handleMessage(data) })
 }
 
-// 处理客户端发来的请求
-func (p *Pbft) HandleClientRequest(content []byte) {
-	logFile, logerr := os.OpenFile("./logout/"+p.NodeID+"_log", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-	if logerr != nil {
-		fmt.Println("open log file failed, err:", logerr)
+func (p *Pbft) handleMessage(data []byte) {
+	//解析消息信封，根据消息类型调用不同的功能
+	env, err := storage.UnpackMessage(data) //env.Payload是protobuf编码的Request、PrePrepare、Prepare或Commit
+	if err != nil {
+		//协议版本不兼容、消息类型未知或消息格式错误时直接丢弃
+		if env != nil {
+			p.reject(env.Sender, env.Type, fmt.Errorf("protocol version %d: %w", env.Version, err))
+		} else {
+			p.reject("", storage.MsgUnknown, err)
+		}
+		return
+	}
+	switch env.Type {
+	case storage.MsgRequest:
+		p.handleClientRequest(env.Sender, env.Payload)
+	case storage.MsgPrePrepare:
+		// 反序列化得到PrePrepare结构体
+		pp, err := storage.UnmarshalPrePrepareProto(env.Payload)
+		if err != nil {
+			p.reject(env.Sender, env.Type, err)
+			return
+		}
+		p.handlePrePrepare(env.Sender, pp, false)
+	case storage.MsgPrepare:
+		//反序列化得到Prepare结构体
+		pre, err := storage.UnmarshalPrepareProto(env.Payload)
+		if err != nil {
+			p.reject(env.Sender, env.Type, err)
+			return
+		}
+		p.handlePrepare(env.Sender, pre, false)
+	case storage.MsgCommit:
+		//反序列化得到Commit结构体
+		c, err := storage.UnmarshalCommitProto(env.Payload)
+		if err != nil {
+			p.reject(env.Sender, env.Type, err)
+			return
+		}
+		p.handleCommit(env.Sender, c, false)
+	default:
+		p.Loger.Println("节点", p.NodeID, "忽略来自", env.Sender, "的消息", env.Type)
 	}
-	defer logFile.Close()
-	// 创建日志对象
-	p.Loger = log.New(logFile, "", log.Lshortfile)
+}
 
+// 处理客户端发来的请求
+func (p *Pbft) handleClientRequest(sender string, content []byte) {
 	// fmt.Println("节点", p.NodeID, "已接收到客户端发来的request")
 	p.Loger.Println("节点", p.NodeID, "已接收到客户端发来的request")
-	//使用json解析出Request结构体（反序列化得到request）
-	r := new(storage.Request)
-	err := json.Unmarshal(content, r)
+	//解析出Request结构体（反序列化得到request）
+	r, err := storage.UnmarshalRequestProto(content)
 	if err != nil {
-		log.Panic(err)
+		p.reject(sender, storage.MsgRequest, err)
+		return
 	}
 	//获取消息摘要
-	digest := storage.GetDigest(*r)
+	digest := p.RequestDigest(*r)
+	if digest == "" {
+		p.reject(sender, storage.MsgRequest, ErrInvalidRequest)
+		return
+	}
 	// fmt.Println("节点", p.NodeID, "已将request存入临时消息池")
 	p.Loger.Println("节点", p.NodeID, "已将request存入临时消息池")
 	//存入临时消息池
 	p.MessagePool[digest] = r
-	//主节点对消息摘要进行签名
-	digestByte, _ := hex.DecodeString(digest)
-	signInfo := utils.RsaSignWithSha256(digestByte, p.RsaPrivKey)
 	//拼接成PrePrepare，准备发往follower节点
-	pp := storage.PrePrepare{RequestMessage: *r, Digest: digest, SequenceID: r.ID, Sign: signInfo}
-	//将PrePrepare序列化
-	b, err := json.Marshal(pp)
-	if err != nil {
-		log.Panic(err)
+	pp := storage.PrePrepare{RequestMessage: *r, Digest: digest, SequenceID: r.ID}
+	//主节点对PrePrepare的签名内容进行签名
+	if pp.Sign, err = p.Signer.Sign(pp.SigningBytes()); err != nil {
+		p.Loger.Println("节点", p.NodeID, "签名PrePrepare失败:", err)
+		return
+	}
+	//广播之前先写入预写日志
+	if !p.appendWAL(storage.WALPrePrepare, pp.Serialize()) {
+		return
 	}
+	p.PrePrepareSigns[digest] = pp.Sign
+	//将PrePrepare编码
+	b := pp.MarshalProto()
 	// fmt.Println("节点", p.NodeID, "正在向其他节点进行进行PrePrepare广播")
 	p.Loger.Println("节点", p.NodeID, "正在向其他节点进行进行PrePrepare广播")
-	//给序列化后的PrePrepare消息添加消息类别
-	message := storage.JointMessage(storage.CPrePrepare, b)
+	//将编码后的PrePrepare装入消息信封
+	message := storage.PackMessage(storage.MsgPrePrepare, p.NodeID, b)
 	//进行PrePrepare广播
 	p.P2P.Broadcast(p.NodeID, message)
 	// fmt.Println("节点", p.NodeID, " PrePrepare广播完成")
@@ -118,91 +306,62 @@ func (p *Pbft) HandleClientRequest(content []byte) {
 }
 
 // 序号累加
-func (p *Pbft) SequenceIDLAdd() {
-	p.Lock.Lock()
+func (p *Pbft) sequenceIDLAdd() {
 	p.SequenceIDL++
-	p.Lock.Unlock()
+	vs := storage.ViewState{View: p.View, SequenceID: p.SequenceIDL}
+	p.appendWAL(storage.WALView, vs.Serialize())
 }
 
-// 处理预准备消息
-func (p *Pbft) HandlePrePrepare(content []byte) {
-	logFile, logerr := os.OpenFile("./logout/"+p.NodeID+"_log", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-	if logerr != nil {
-		fmt.Println("open log file failed, err:", logerr)
-	}
-	defer logFile.Close()
-	// 创建日志对象
-	p.Loger = log.New(logFile, "", log.Lshortfile)
-
+// 处理预准备消息，verified表示签名已由验证协程池验证
+func (p *Pbft) handlePrePrepare(sender string, pp *storage.PrePrepare, verified bool) {
 	// fmt.Println("节点", p.NodeID, "已接收到主节点发来的PrePrepare")
 	p.Loger.Println("节点", p.NodeID, "已接收到主节点发来的PrePrepare")
-	// 反序列化得到PrePrepare结构体
-	pp := new(storage.PrePrepare)
-	err := json.Unmarshal(content, pp)
-	if err != nil {
-		log.Panic(err)
-	}
-	//获取主节点的公钥，用于数字签名验证
-	primaryNodePubKey := p.P2P.GetPrimaryPubkey()
-	digestByte, _ := hex.DecodeString(pp.Digest)
-	if digest := storage.GetDigest(pp.RequestMessage); digest != pp.Digest {
+	if digest := p.RequestDigest(pp.RequestMessage); digest == "" || digest != pp.Digest {
 		// fmt.Println("信息摘要对不上,拒绝进行prepare广播")
-		p.Loger.Println("信息摘要对不上,拒绝进行prepare广播")
-	} else if !utils.RsaVerySignWithSha256(digestByte, pp.Sign, primaryNodePubKey) {
+		p.reject(sender, storage.MsgPrePrepare, ErrDigestMismatch)
+	} else if err := p.verifyPrePrepare(pp, verified); err != nil {
 		// fmt.Println("主节点签名验证失败,拒绝进行prepare广播")
-		p.Loger.Println("主节点签名验证失败,拒绝进行prepare广播")
+		p.reject(sender, storage.MsgPrePrepare, err)
 	} else {
 		//将信息存入临时消息池
 		// fmt.Println("节点", p.NodeID, "已将消息存入临时节点池")
 		p.Loger.Println("节点", p.NodeID, "已将消息存入临时节点池")
-		p.MessagePool[pp.Digest] = &pp.RequestMessage
-		//节点使用私钥对其签名
-		sign := utils.RsaSignWithSha256(digestByte, p.RsaPrivKey)
 		//拼接成Prepare
-		pre := storage.Prepare{Digest: pp.Digest, SequenceID: pp.SequenceID, NodeID: p.NodeID, Sign: sign}
-		//将Prepare序列化
-		bPre, err := json.Marshal(pre)
-		if err != nil {
-			log.Panic(err)
+		pre := storage.Prepare{Digest: pp.Digest, SequenceID: pp.SequenceID, NodeID: p.NodeID}
+		//节点使用私钥对其签名
+		if pre.Sign, err = p.Signer.Sign(pre.SigningBytes()); err != nil {
+			p.Loger.Println("节点", p.NodeID, "签名Prepare失败:", err)
+			return
+		}
+		//接受PrePrepare和广播Prepare之前先写入预写日志
+		if !p.appendWAL(storage.WALPrePrepare, pp.Serialize()) || !p.appendWAL(storage.WALPrepare, pre.Serialize()) {
+			return
 		}
+		p.MessagePool[pp.Digest] = &pp.RequestMessage
+		p.PrePrepareSigns[pp.Digest] = pp.Sign
+		//将Prepare编码
+		bPre := pre.MarshalProto()
 		//进行准备阶段的广播
 		// fmt.Println("节点", p.NodeID, "正在进行Prepare广播")
 		p.Loger.Println("节点", p.NodeID, "正在进行Prepare广播")
-		//为序列化后的Prepare消息添加消息类别
-		p.P2P.Broadcast(p.NodeID, storage.JointMessage(storage.CPrepare, bPre))
+		//将编码后的Prepare装入消息信封后广播
+		p.P2P.Broadcast(p.NodeID, storage.PackMessage(storage.MsgPrepare, p.NodeID, bPre))
 		// fmt.Println("节点", p.NodeID, " Prepare广播完成")
 		p.Loger.Println("节点", p.NodeID, " Prepare广播完成")
 	}
 }
 
-// 处理准备消息
-func (p *Pbft) HandlePrepare(content []byte) {
-	logFile, logerr := os.OpenFile("./logout/"+p.NodeID+"_log", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-	if logerr != nil {
-		fmt.Println("open log file failed, err:", logerr)
-	}
-	defer logFile.Close()
-	// 创建日志对象
-	p.Loger = log.New(logFile, "", log.Lshortfile)
-
-	//反序列化得到Prepare结构体
-	pre := new(storage.Prepare)
-	err := json.Unmarshal(content, pre)
-	if err != nil {
-		log.Panic(err)
-	}
+// 处理准备消息，verified表示签名已由验证协程池验证
+func (p *Pbft) handlePrepare(sender string, pre *storage.Prepare, verified bool) {
 	// fmt.Println("节点", p.NodeID, "已接收到节点", pre.NodeID, "发来的Prepare")
 	p.Loger.Println("节点", p.NodeID, "已接收到节点", pre.NodeID, "发来的Prepare")
-	//获取消息源节点的公钥，用于数字签名验证
-	MessageNodePubKey := p.P2P.GetNodePubkey(pre.NodeID)
-	digestByte, _ := hex.DecodeString(pre.Digest)
 	if _, ok := p.MessagePool[pre.Digest]; !ok {
 		// fmt.Println("当前临时消息池无此摘要,拒绝执行commit广播")
 		p.Loger.Println("当前临时消息池无此摘要,拒绝执行commit广播")
-	} else if !utils.RsaVerySignWithSha256(digestByte, pre.Sign, MessageNodePubKey) {
+	} else if err := p.verifyPrepare(pre, verified); err != nil {
 		// fmt.Println("节点签名验证失败,拒绝执行commit广播")
-		p.Loger.Println("节点签名验证失败,拒绝执行commit广播")
-	} else {
+		p.reject(sender, storage.MsgPrepare, err)
+	} else if p.appendWAL(storage.WALPrepare, pre.Serialize()) {
 		p.SetPrePareConfirmMap(pre.Digest, pre.NodeID, true)
 		count := 0
 		for range p.PrePareConfirmCount[pre.Digest] {
@@ -211,29 +370,33 @@ func (p *Pbft) HandlePrepare(content []byte) {
 		//因为主节点不会发送Prepare，所以不包含自己
 		specifiedCount := 0
 		if p.NodeID == p.P2P.GetPrimaryID() {
-			specifiedCount = len(p.P2P.NodeTable) / 3 * 2
+			specifiedCount = p.P2P.NodeCount() / 3 * 2
 		} else {
-			specifiedCount = (len(p.P2P.NodeTable) / 3 * 2) - 1
+			specifiedCount = (p.P2P.NodeCount() / 3 * 2) - 1
 		}
 		//如果节点至少收到了2f个prepare的消息（包括自己）,并且没有进行过commit广播，则进行commit广播
 		//获取消息源节点的公钥，用于数字签名验证
 		if count >= specifiedCount && !p.IsCommitBordcast[pre.Digest] {
 			// fmt.Println("节点", p.NodeID, "已收到至少2f个节点(包括本地节点)发来的Prepare信息")
 			p.Loger.Println("节点", p.NodeID, "已收到至少2f个节点(包括本地节点)发来的Prepare信息")
-			//节点使用私钥对其签名
-			sign := utils.RsaSignWithSha256(digestByte, p.RsaPrivKey)
 			//构建Commit结构体
-			c := storage.Commit{Digest: pre.Digest, SequenceID: pre.SequenceID, NodeID: p.NodeID, Sign: sign}
-			//将Commit序列化
-			bc, err := json.Marshal(c)
-			if err != nil {
-				log.Panic(err)
+			c := storage.Commit{Digest: pre.Digest, SequenceID: pre.SequenceID, NodeID: p.NodeID}
+			//节点使用私钥对其签名
+			if c.Sign, err = p.Signer.Sign(c.SigningBytes()); err != nil {
+				p.Loger.Println("节点", p.NodeID, "签名Commit失败:", err)
+				return
+			}
+			if !p.appendWAL(storage.WALCommit, c.Serialize()) {
+				return
 			}
+			p.SetCommitSign(c.Digest, p.NodeID, c.Sign)
+			//将Commit编码
+			bc := c.MarshalProto()
 			//进行提交信息的广播
 			// fmt.Println("节点", p.NodeID, "正在进行commit广播")
 			p.Loger.Println("节点", p.NodeID, "正在进行commit广播")
-			//将序列化后的Commit添加消息类别后广播
-			p.P2P.Broadcast(p.NodeID, storage.JointMessage(storage.CCommit, bc))
+			//将编码后的Commit装入消息信封后广播
+			p.P2P.Broadcast(p.NodeID, storage.PackMessage(storage.MsgCommit, p.NodeID, bc))
 			p.IsCommitBordcast[pre.Digest] = true
 			// fmt.Println("节点", p.NodeID, "commit广播完成")
 			p.Loger.Println("节点", p.NodeID, "commit广播完成")
@@ -249,73 +412,37 @@ func (p *Pbft) SetPrePareConfirmMap(val, val2 string, b bool) {
 	p.PrePareConfirmCount[val][val2] = b
 }
 
-// 处理提交确认消息
-func (p *Pbft) HandleCommit(content []byte) {
-	logFile, logerr := os.OpenFile("./logout/"+p.NodeID+"_log", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-	if logerr != nil {
-		fmt.Println("open log file failed, err:", logerr)
-	}
-	defer logFile.Close()
-	// 创建日志对象
-	p.Loger = log.New(logFile, "", log.Lshortfile)
-
-	//反序列化得到Commit结构体
-	c := new(storage.Commit)
-	err := json.Unmarshal(content, c)
-	if err != nil {
-		log.Panic(err)
-	}
+// 处理提交确认消息，verified表示签名已由验证协程池验证
+func (p *Pbft) handleCommit(sender string, c *storage.Commit, verified bool) {
 	// fmt.Println("节点", p.NodeID, "已接收到节点", c.NodeID, "发来的Commit")
 	p.Loger.Println("节点", p.NodeID, "已接收到节点", c.NodeID, "发来的Commit")
-	//获取消息源节点的公钥，用于数字签名验证
-	MessageNodePubKey := p.P2P.GetNodePubkey(c.NodeID)
-	digestByte, _ := hex.DecodeString(c.Digest)
 	if _, ok := p.PrePareConfirmCount[c.Digest]; !ok {
 		// fmt.Println("当前prepare池无此摘要,拒绝将信息持久化到本地消息池")
 		p.Loger.Println("当前prepare池无此摘要,拒绝将信息持久化到本地消息池")
-	} else if !utils.RsaVerySignWithSha256(digestByte, c.Sign, MessageNodePubKey) {
+	} else if err := p.verifyCommit(c, verified); err != nil {
 		// fmt.Println("节点签名验证失败,拒绝将信息持久化到本地消息池")
-		p.Loger.Println("节点签名验证失败,拒绝将信息持久化到本地消息池")
-	} else {
+		p.reject(sender, storage.MsgCommit, err)
+	} else if p.appendWAL(storage.WALCommit, c.Serialize()) {
 		p.SetCommitConfirmMap(c.Digest, c.NodeID, true)
+		p.SetCommitSign(c.Digest, c.NodeID, c.Sign)
 		count := 0
 		for range p.CommitConfirmCount[c.Digest] {
 			count++
 		}
 		//如果节点至少收到了2f+1个commit消息（包括自己）,并且节点没有回复过,并且已进行过commit广播，则提交信息至本地消息池，并reply成功标志至客户端！
-		if count >= len(p.P2P.NodeTable)/3*2 && !p.IsReply[c.Digest] && p.IsCommitBordcast[c.Digest] {
+		if count >= p.P2P.NodeCount()/3*2 && !p.IsReply[c.Digest] && p.IsCommitBordcast[c.Digest] {
 			// fmt.Println("节点", p.NodeID, "已收到至少2f + 1 个节点(包括本地节点)发来的Commit信息")
 			p.Loger.Println("节点", p.NodeID, "已收到至少2f + 1 个节点(包括本地节点)发来的Commit信息")
+			//记录该消息已完成共识
+			if c.SequenceID >= p.SequenceIDL && !p.appendWAL(storage.WALCommitted, c.Serialize()) {
+				return
+			}
 
 			//判断是否是当前最小序号
 			if c.SequenceID == p.SequenceIDL {
-				//将消息放入待提交池中（用于上链时获取摘要）
+				//将消息放入待提交池中（用于上链时获取摘要），并依次提交低水位线处连续的消息
 				p.MessageToCommit[c.SequenceID] = *c
-				//将消息信息，提交到本地消息池中！
-				p.MessageCommitted = append(p.MessageCommitted, p.MessagePool[c.Digest].Message) //Message中包含区块高度和序列化后的区块（见Fullnode.go中的函数BlockToRequest）
-				info := p.NodeID + "节点已将msgid:" + strconv.Itoa(p.MessagePool[c.Digest].ID) + "存入本地消息池中,消息内容为：" + string(p.MessagePool[c.Digest].Content)
-				p.Loger.Println(info)
-				//只将回复位置为true，不实际执行回复，实际回复在Fullnode中将区块拆解为交易后，依次回复每笔交易
-				//p.Loger.Println("节点", p.NodeID, "正在reply客户端")
-				//p.P2P.SendRequest([]byte(info), p.MessagePool[c.Digest].ClientAddr)
-				p.IsReply[c.Digest] = true
-				//p.Loger.Println("节点", p.NodeID, "reply完毕")
-				p.SequenceIDLAdd()
-				for {
-					if _, ok := p.MessageToCommit[p.SequenceIDL]; ok {
-						p.MessageCommitted = append(p.MessageCommitted, p.MessagePool[p.MessageToCommit[p.SequenceIDL].Digest].Message)
-						info := p.NodeID + "节点已将msgid:" + strconv.Itoa(p.MessageToCommit[p.SequenceIDL].SequenceID) + "存入本地消息池中,消息内容为：" + string(p.MessagePool[p.MessageToCommit[p.SequenceIDL].Digest].Content)
-						p.Loger.Println(info)
-						//只将回复位置为true，不实际执行回复，实际回复在Fullnode中将区块拆解为交易后，依次回复每笔交易
-						//p.Loger.Println("节点", p.NodeID, "正在reply客户端")
-						//p.P2P.SendRequest([]byte(info), p.MessagePool[p.MessageToCommit[p.SequenceIDL].Digest].ClientAddr)
-						p.IsReply[p.MessageToCommit[p.SequenceIDL].Digest] = true
-						//p.Loger.Println("节点", p.NodeID, "reply完毕")
-						p.SequenceIDLAdd()
-					} else {
-						break
-					}
-				}
+				p.commitPending()
 			} else if c.SequenceID > p.SequenceIDL {
 				//如果收到的消息序号大于当前最小序号，则将消息存入待commit消息池
 				p.MessageToCommit[c.SequenceID] = *c
@@ -326,6 +453,52 @@ func (p *Pbft) HandleCommit(content []byte) {
 	}
 }
 
+// 依次提交低水位线处连续的、已完成共识的消息，事件循环启动之后将其发送到Committed通道
+func (p *Pbft) commitPending() {
+	for {
+		commit, ok := p.MessageToCommit[p.SequenceIDL]
+		if !ok {
+			break
+		}
+		request := p.MessagePool[commit.Digest]
+		if request == nil {
+			p.Loger.Println("节点", p.NodeID, "缺少已完成共识的消息", p.SequenceIDL, ",等待区块同步")
+			break
+		}
+		//将消息信息，提交到本地消息池中！Message中包含区块高度和序列化后的区块（见Fullnode.go中的函数BlockToRequest）
+		p.MessageCommitted = append(p.MessageCommitted, request.Message)
+		info := p.NodeID + "节点已将msgid:" + strconv.Itoa(commit.SequenceID) + "存入本地消息池中,消息长度为：" + strconv.Itoa(len(request.Content))
+		p.Loger.Println(info)
+		//只将回复位置为true，不实际执行回复，实际回复在Fullnode中将区块拆解为交易后，依次回复每笔交易
+		p.IsReply[commit.Digest] = true
+		committed := &CommittedMessage{commit.SequenceID, request, p.commitCertificate(commit.SequenceID, commit.Digest)}
+		p.sequenceIDLAdd()
+		if p.started.Load() {
+			select {
+			case p.committed <- committed:
+			case <-p.stopped:
+			}
+		}
+	}
+}
+
+// FastForward 通过区块同步追上其他节点后推进低水位线，序号小于sequenceID的消息视为已提交
+func (p *Pbft) FastForward(sequenceID int) {
+	p.post(func() { p.fastForward(sequenceID) })
+}
+
+func (p *Pbft) fastForward(sequenceID int) {
+	if sequenceID <= p.SequenceIDL {
+		return
+	}
+	p.SequenceIDL = sequenceID
+	vs := storage.ViewState{View: p.View, SequenceID: p.SequenceIDL}
+	p.appendWAL(storage.WALView, vs.Serialize())
+	p.Loger.Println("节点", p.NodeID, "通过区块同步将低水位线推进到", sequenceID)
+	//之后的消息可能已经完成共识，只是在等待缺失的消息
+	p.commitPending()
+}
+
 // 为多重映射开辟赋值
 func (p *Pbft) SetCommitConfirmMap(val, val2 string, b bool) {
 	if _, ok := p.CommitConfirmCount[val]; !ok {
@@ -333,3 +506,27 @@ func (p *Pbft) SetCommitConfirmMap(val, val2 string, b bool) {
 	}
 	p.CommitConfirmCount[val][val2] = b
 }
+
+// 记录某个节点对某条消息的commit签名
+func (p *Pbft) SetCommitSign(digest, nodeID string, sign []byte) {
+	if _, ok := p.CommitSigns[digest]; !ok {
+		p.CommitSigns[digest] = make(map[string][]byte)
+	}
+	p.CommitSigns[digest][nodeID] = sign
+}
+
+// 获取已提交消息的提交证书，包含主节点签名和收到的所有commit签名
+func (p *Pbft) commitCertificate(sequenceID int, digest string) *storage.CommitCertificate {
+	cert := &storage.CommitCertificate{SequenceID: sequenceID, Digest: digest, ProposerID: p.P2P.GetPrimaryID(), ProposerSign: p.PrePrepareSigns[digest]}
+	//按节点ID排序，使证书的编码确定
+	signers := make([]string, 0, len(p.CommitSigns[digest]))
+	for nodeID := range p.CommitSigns[digest] {
+		signers = append(signers, nodeID)
+	}
+	sort.Strings(signers)
+	for _, nodeID := range signers {
+		cert.Signers = append(cert.Signers, nodeID)
+		cert.Signs = append(cert.Signs, p.CommitSigns[digest][nodeID])
+	}
+	return cert
+}
@@ -0,0 +1,152 @@
+package consensus
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"simplechain/network"
+	"simplechain/storage"
+	"simplechain/utils"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// 测试用的副本：监听收到的每个连接都在新的协程中交给HandleRequest
+type testReplica struct {
+	pbft     *Pbft
+	listener net.Listener
+	handlers sync.WaitGroup
+}
+
+func (r *testReplica) serve() {
+	defer r.handlers.Done()
+	for {
+		conn, err := r.listener.Accept()
+		if err != nil {
+			return
+		}
+		r.handlers.Add(1)
+		go func() {
+			defer r.handlers.Done()
+			defer conn.Close()
+			data, err := io.ReadAll(conn)
+			if err == nil {
+				r.pbft.HandleRequest(data)
+			}
+		}()
+	}
+}
+
+// 在本进程中启动n个副本，node1为主节点
+func startTestReplicas(t *testing.T, n int, workers int) []*testReplica {
+	p2p := network.NewP2P("tcp")
+	if err := p2p.SetScheme(utils.SchemeEd25519); err != nil {
+		t.Fatal(err)
+	}
+	replicas := make([]*testReplica, n)
+	for i := range replicas {
+		nodeID := fmt.Sprintf("node%d", i+1)
+		signer, err := utils.GenerateSigner(utils.SchemeEd25519)
+		if err != nil {
+			t.Fatal(err)
+		}
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		p2p.AddFullNode(nodeID, listener.Addr().String())
+		if err := p2p.AddPubKey(nodeID, signer.PublicKey()); err != nil {
+			t.Fatal(err)
+		}
+		pbft := NewPBFT(nodeID, listener.Addr().String(), signer, p2p)
+		pbft.VerifyWorkers = workers
+		replicas[i] = &testReplica{pbft: pbft, listener: listener}
+	}
+	p2p.SetPrimaryNode("node1")
+	for _, r := range replicas {
+		r.pbft.Start()
+		r.handlers.Add(1)
+		go r.serve()
+	}
+	t.Cleanup(func() {
+		for _, r := range replicas {
+			r.listener.Close()
+			r.pbft.Stop()
+			r.handlers.Wait()
+		}
+	})
+	return replicas
+}
+
+// 多个协程同时向主节点提交请求，所有副本都按序号依次提交全部请求，且提交的内容一致
+func TestPbftConcurrentRequests(t *testing.T) {
+	const (
+		submitters = 8
+		requests   = 64
+	)
+	for _, workers := range []int{0, 2} {
+		t.Run(fmt.Sprintf("workers=%d", workers), func(t *testing.T) {
+			replicas := startTestReplicas(t, 4, workers)
+			var next atomic.Int64
+			var wg sync.WaitGroup
+			for i := 0; i < submitters; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for {
+						id := int(next.Add(1) - 1)
+						if id >= requests {
+							return
+						}
+						r := storage.Request{Message: storage.Message{Content: []byte(fmt.Sprintf("request %d", id)), ID: id}, Timestamp: time.Now().UnixNano()}
+						replicas[0].pbft.HandleRequest(storage.PackMessage(storage.MsgRequest, "client1", r.MarshalProto()))
+					}
+				}()
+			}
+			wg.Wait()
+
+			committed := make([][]*CommittedMessage, len(replicas))
+			var collect sync.WaitGroup
+			for i, r := range replicas {
+				collect.Add(1)
+				go func(i int, pbft *Pbft) {
+					defer collect.Done()
+					timeout := time.After(30 * time.Second)
+					for len(committed[i]) < requests {
+						select {
+						case c := <-pbft.Committed():
+							committed[i] = append(committed[i], c)
+						case <-timeout:
+							return
+						}
+					}
+				}(i, r.pbft)
+			}
+			collect.Wait()
+			for i, messages := range committed {
+				if len(messages) != requests {
+					t.Fatalf("node%d committed %d requests, want %d", i+1, len(messages), requests)
+				}
+				for seq, c := range messages {
+					if c.SequenceID != seq {
+						t.Fatalf("node%d committed sequence %d at position %d", i+1, c.SequenceID, seq)
+					}
+					if !bytes.Equal(c.Request.Content, committed[0][seq].Request.Content) {
+						t.Errorf("node%d committed %q at %d, node1 committed %q", i+1, c.Request.Content, seq, committed[0][seq].Request.Content)
+					}
+					if len(c.Cert.Signers) < 3 {
+						t.Errorf("node%d certificate for %d has %d commit signatures", i+1, seq, len(c.Cert.Signers))
+					}
+				}
+			}
+			for _, r := range replicas {
+				if rejected := r.pbft.Rejected(); len(rejected) != 0 {
+					t.Errorf("%s rejected messages: %v", r.pbft.NodeID, rejected)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,230 @@
+package consensus
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"runtime"
+	"simplechain/storage"
+	"simplechain/utils"
+	"sync"
+)
+
+// 并行签名验证：事件循环启动后，收到的PrePrepare、Prepare和Commit先交给验证协程池解析并验证签名，
+// 验证结果按消息到达的顺序投递到事件循环，事件循环中不再重复验证。
+// 同一节点对同一摘要的签名验证通过后记入缓存，重发的消息不再重复验证。
+
+const (
+	VerifyQueueSize = 1024 //等待验证的消息数量上限
+	VerifyCacheSize = 4096 //签名验证缓存的容量
+)
+
+var DefaultVerifyWorkers = runtime.NumCPU() //默认的验证协程数量
+
+// 一条等待验证的消息，done中返回验证之后交给事件循环执行的处理函数
+type verifyJob struct {
+	data []byte
+	done chan func()
+}
+
+// 签名验证缓存的键：消息类型、摘要和签名节点
+type verifyKey struct {
+	Type   storage.MessageType
+	Digest string
+	NodeID string
+}
+
+// verifyCache 已验证签名的(摘要, 节点)对，容量满时淘汰最早加入的项
+type verifyCache struct {
+	entries map[verifyKey][32]byte //值为签名内容和签名的哈希，命中时必须与当前消息完全一致
+	order   []verifyKey
+	mutex   sync.Mutex
+}
+
+func newVerifyCache() *verifyCache {
+	return &verifyCache{entries: make(map[verifyKey][32]byte), order: make([]verifyKey, 0, VerifyCacheSize)}
+}
+
+func verifyCacheValue(data []byte, sign []byte) [32]byte {
+	h := sha256.New()
+	h.Write(data)
+	h.Write(sign)
+	var sum [32]byte
+	copy(sum[:], h.Sum(nil))
+	return sum
+}
+
+// 验证签名，同一节点对同一摘要的相同签名只验证一次
+func (cache *verifyCache) verify(key verifyKey, data []byte, sign []byte, pubkey []byte) error {
+	if len(pubkey) == 0 {
+		return fmt.Errorf("%w %q", ErrUnknownSigner, key.NodeID)
+	}
+	value := verifyCacheValue(data, sign)
+	cache.mutex.Lock()
+	cached, ok := cache.entries[key]
+	cache.mutex.Unlock()
+	if ok && bytes.Equal(cached[:], value[:]) {
+		return nil
+	}
+	if err := utils.VerifySign(data, sign, pubkey); err != nil {
+		return err
+	}
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	if _, ok := cache.entries[key]; !ok {
+		if len(cache.order) >= VerifyCacheSize {
+			delete(cache.entries, cache.order[0])
+			cache.order = cache.order[1:]
+		}
+		cache.order = append(cache.order, key)
+	}
+	cache.entries[key] = value
+	return nil
+}
+
+// 验证者（全节点）的公钥：公钥表中还有客户端的公钥，客户端签名的共识消息不能计入法定人数，
+// nodeID不是验证者时返回nil，验证时返回ErrUnknownSigner
+func (p *Pbft) validatorPubkey(nodeID string) []byte {
+	return p.P2P.GetValidatorPubkeys()[nodeID]
+}
+
+// 验证PrePrepare的主节点签名，verified为true时签名已经验证过
+func (p *Pbft) verifyPrePrepare(pp *storage.PrePrepare, verified bool) error {
+	if verified {
+		return nil
+	}
+	primaryID := p.P2P.GetPrimaryID()
+	return p.verifyCache.verify(verifyKey{storage.MsgPrePrepare, pp.Digest, primaryID}, pp.SigningBytes(), pp.Sign, p.validatorPubkey(primaryID))
+}
+
+// 验证Prepare的节点签名，verified为true时签名已经验证过
+func (p *Pbft) verifyPrepare(pre *storage.Prepare, verified bool) error {
+	if verified {
+		return nil
+	}
+	return p.verifyCache.verify(verifyKey{storage.MsgPrepare, pre.Digest, pre.NodeID}, pre.SigningBytes(), pre.Sign, p.validatorPubkey(pre.NodeID))
+}
+
+// 验证Commit的节点签名，verified为true时签名已经验证过
+func (p *Pbft) verifyCommit(c *storage.Commit, verified bool) error {
+	if verified {
+		return nil
+	}
+	return p.verifyCache.verify(verifyKey{storage.MsgCommit, c.Digest, c.NodeID}, c.SigningBytes(), c.Sign, p.validatorPubkey(c.NodeID))
+}
+
+// 记录被拒绝的消息：写入日志并累加发送者被拒绝的消息数量，事件循环和验证协程都会调用
+func (p *Pbft) reject(sender string, msgType storage.MessageType, err error) {
+	p.Loger.Println("节点", p.NodeID, "拒绝来自", sender, "的消息", msgType, ":", err)
+	p.rejectedMutex.Lock()
+	p.rejected[sender]++
+	p.rejectedMutex.Unlock()
+}
+
+// Rejected 各发送者被拒绝的消息数量（格式错误、摘要不符或签名无效）
+func (p *Pbft) Rejected() map[string]int {
+	p.rejectedMutex.Lock()
+	defer p.rejectedMutex.Unlock()
+	rejected := make(map[string]int, len(p.rejected))
+	for sender, count := range p.rejected {
+		rejected[sender] = count
+	}
+	return rejected
+}
+
+// 启动验证协程池和按序投递验证结果的协程
+func (p *Pbft) startVerifiers() {
+	for i := 0; i < p.VerifyWorkers; i++ {
+		go func() {
+			for {
+				select {
+				case job := <-p.verifyJobs:
+					job.done <- p.verifyMessage(job.data)
+				case <-p.stopped:
+					return
+				}
+			}
+		}()
+	}
+	go func() {
+		for {
+			var fn func()
+			select {
+			case job := <-p.verifyOrder:
+				select {
+				case fn = <-job.done:
+				case <-p.stopped:
+					return
+				}
+			case <-p.stopped:
+				return
+			}
+			if fn == nil {
+				continue
+			}
+			select {
+			case p.inbox <- fn:
+			case <-p.stopped:
+				return
+			}
+		}
+	}()
+}
+
+// 将消息交给验证协程池，验证结果按调用顺序投递到事件循环，停止之后丢弃
+func (p *Pbft) dispatchVerify(data []byte) {
+	job := &verifyJob{data, make(chan func(), 1)}
+	select {
+	case p.verifyOrder <- job:
+	case <-p.stopped:
+		return
+	}
+	select {
+	case p.verifyJobs <- job:
+	case <-p.stopped:
+	}
+}
+
+// 在验证协程中解析消息并验证签名，返回交给事件循环的处理函数，消息不合法时返回nil
+func (p *Pbft) verifyMessage(data []byte) func() {
+	env, err := storage.UnpackMessage(data)
+	if err != nil {
+		//无法解析的消息交给事件循环按原来的方式记录
+		return func() { p.handleMessage(data) }
+	}
+	switch env.Type {
+	case storage.MsgPrePrepare:
+		pp, err := storage.UnmarshalPrePrepareProto(env.Payload)
+		if err == nil {
+			err = p.verifyPrePrepare(pp, false)
+		}
+		if err != nil {
+			p.reject(env.Sender, env.Type, err)
+			return nil
+		}
+		return func() { p.handlePrePrepare(env.Sender, pp, true) }
+	case storage.MsgPrepare:
+		pre, err := storage.UnmarshalPrepareProto(env.Payload)
+		if err == nil {
+			err = p.verifyPrepare(pre, false)
+		}
+		if err != nil {
+			p.reject(env.Sender, env.Type, err)
+			return nil
+		}
+		return func() { p.handlePrepare(env.Sender, pre, true) }
+	case storage.MsgCommit:
+		c, err := storage.UnmarshalCommitProto(env.Payload)
+		if err == nil {
+			err = p.verifyCommit(c, false)
+		}
+		if err != nil {
+			p.reject(env.Sender, env.Type, err)
+			return nil
+		}
+		return func() { p.handleCommit(env.Sender, c, true) }
+	default:
+		//客户端请求等其他消息不需要验证节点签名
+		return func() { p.handleMessage(data) }
+	}
+}
@@ -0,0 +1,321 @@
+package consensus
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"simplechain/network"
+	"simplechain/storage"
+	"simplechain/utils"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func testSigner(tb testing.TB) utils.Signer {
+	signer, err := utils.GenerateSigner(utils.SchemeEd25519)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return signer
+}
+
+// 丢弃所有连接的监听，其他节点的地址指向它时被测节点的广播不会失败
+func discardListener(tb testing.TB) net.Listener {
+	sink, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { sink.Close() })
+	go func() {
+		for {
+			conn, err := sink.Accept()
+			if err != nil {
+				return
+			}
+			io.Copy(io.Discard, conn)
+			conn.Close()
+		}
+	}()
+	return sink
+}
+
+// 命中缓存时不再验证签名：换成其他节点的公钥仍然通过；签名或内容不同时重新验证
+func TestVerifyCacheHitAndMiss(t *testing.T) {
+	signer, other := testSigner(t), testSigner(t)
+	cache := newVerifyCache()
+	data := []byte("prepare")
+	sign, err := signer.Sign(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := verifyKey{storage.MsgPrepare, "digest", "node2"}
+	if err := cache.verify(key, data, sign, other.PublicKey()); err == nil {
+		t.Fatal("invalid signature accepted")
+	}
+	if len(cache.entries) != 0 {
+		t.Fatalf("failed verification cached: %d entries", len(cache.entries))
+	}
+	if err := cache.verify(key, data, sign, signer.PublicKey()); err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.verify(key, data, sign, other.PublicKey()); err != nil {
+		t.Errorf("cache miss for a verified signature: %v", err)
+	}
+
+	otherSign, err := other.Sign(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	misses := []struct {
+		name string
+		key  verifyKey
+		data []byte
+		sign []byte
+	}{
+		{"different signature", key, data, otherSign},
+		{"different content", key, []byte("commit"), sign},
+		{"different type", verifyKey{storage.MsgCommit, "digest", "node2"}, data, otherSign},
+		{"different node", verifyKey{storage.MsgPrepare, "digest", "node3"}, data, otherSign},
+	}
+	for _, tc := range misses {
+		if err := cache.verify(tc.key, tc.data, tc.sign, signer.PublicKey()); err == nil {
+			t.Errorf("%s: invalid signature accepted", tc.name)
+		}
+	}
+	if err := cache.verify(verifyKey{storage.MsgPrepare, "digest", "node5"}, data, sign, nil); !errors.Is(err, ErrUnknownSigner) {
+		t.Errorf("missing public key: %v, want ErrUnknownSigner", err)
+	}
+}
+
+// 容量满时淘汰最早加入的项
+func TestVerifyCacheEviction(t *testing.T) {
+	signer, other := testSigner(t), testSigner(t)
+	cache := newVerifyCache()
+	data := []byte("commit")
+	sign, err := signer.Sign(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyOf := func(i int) verifyKey {
+		return verifyKey{storage.MsgCommit, strconv.Itoa(i), "node2"}
+	}
+	for i := 0; i <= VerifyCacheSize; i++ {
+		if err := cache.verify(keyOf(i), data, sign, signer.PublicKey()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(cache.entries) != VerifyCacheSize || len(cache.order) != VerifyCacheSize {
+		t.Fatalf("%d entries and %d keys in order, want %d", len(cache.entries), len(cache.order), VerifyCacheSize)
+	}
+	if err := cache.verify(keyOf(0), data, sign, other.PublicKey()); err == nil {
+		t.Error("oldest entry was not evicted")
+	}
+	for _, i := range []int{1, VerifyCacheSize} {
+		if err := cache.verify(keyOf(i), data, sign, other.PublicKey()); err != nil {
+			t.Errorf("entry %d evicted: %v", i, err)
+		}
+	}
+	//重复验证已缓存的项不改变淘汰顺序
+	if err := cache.verify(keyOf(1), data, sign, signer.PublicKey()); err != nil {
+		t.Fatal(err)
+	}
+	if cache.order[0] != keyOf(1) {
+		t.Errorf("oldest key %v, want %v", cache.order[0], keyOf(1))
+	}
+}
+
+// 验证协程乱序完成时，验证结果仍按消息到达的顺序投递到事件循环，验证失败的消息被跳过
+func TestVerifyOrderedDelivery(t *testing.T) {
+	p := NewPBFT("node2", "", testSigner(t), network.NewP2P("tcp"))
+	p.VerifyWorkers = 0 //只启动按序投递的协程，由测试代替验证协程完成验证
+	p.startVerifiers()
+	defer p.Stop()
+
+	const n = 16
+	jobs := make([]*verifyJob, n)
+	for i := range jobs {
+		jobs[i] = &verifyJob{nil, make(chan func(), 1)}
+		p.verifyOrder <- jobs[i]
+	}
+	delivered := make(chan int, n)
+	for i := n - 1; i >= 0; i-- {
+		if i%5 == 3 {
+			jobs[i].done <- nil
+			continue
+		}
+		i := i
+		jobs[i].done <- func() { delivered <- i }
+	}
+	want := 0
+	for want < n {
+		if want%5 == 3 {
+			want++
+			continue
+		}
+		select {
+		case fn := <-p.inbox:
+			fn()
+		case <-time.After(5 * time.Second):
+			t.Fatalf("message %d not delivered", want)
+		}
+		if got := <-delivered; got != want {
+			t.Fatalf("delivered %d, want %d", got, want)
+		}
+		want++
+	}
+	select {
+	case <-p.inbox:
+		t.Error("rejected message delivered")
+	default:
+	}
+}
+
+// 向一个非主节点的共识实例依次投递预先签名的PrePrepare、Prepare和Commit，
+// 比较在事件循环中依次验证（workers=0）和使用不同大小的验证协程池时完成b.N轮共识所用的时间
+//
+//	go test ./consensus -run '^$' -bench Verify
+func BenchmarkVerify(b *testing.B) {
+	scheme := utils.DefaultScheme
+	sink := discardListener(b)
+	var err error
+	nodeIDs := []string{"node1", "node2", "node3", "node4"}
+	signers := make(map[string]utils.Signer)
+	for _, nodeID := range nodeIDs {
+		if signers[nodeID], err = utils.GenerateSigner(scheme); err != nil {
+			b.Fatal(err)
+		}
+	}
+	for _, workers := range []int{0, 1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			messages, err := verifyBenchMessages(b.N, signers)
+			if err != nil {
+				b.Fatal(err)
+			}
+			p2p := network.NewP2P("tcp")
+			p2p.SetScheme(scheme)
+			for _, nodeID := range nodeIDs {
+				p2p.AddFullNode(nodeID, sink.Addr().String())
+				p2p.AddPubKey(nodeID, signers[nodeID].PublicKey())
+			}
+			p2p.SetPrimaryNode("node1")
+			pbft := NewPBFT("node2", sink.Addr().String(), signers["node2"], p2p)
+			pbft.VerifyWorkers = workers
+			pbft.Start()
+			defer pbft.Stop()
+			b.ResetTimer()
+			for _, message := range messages {
+				pbft.HandleRequest(message)
+			}
+			for i := 0; i < b.N; i++ {
+				<-pbft.Committed()
+			}
+			b.StopTimer()
+			b.ReportMetric(float64(len(messages))/b.Elapsed().Seconds(), "sigs/s")
+		})
+	}
+}
+
+// 为每个序号生成主节点的PrePrepare、另外两个节点的Prepare以及其他三个节点的Commit
+func verifyBenchMessages(rounds int, signers map[string]utils.Signer) ([][]byte, error) {
+	messages := make([][]byte, 0, rounds*6)
+	var err error
+	for i := 0; i < rounds; i++ {
+		r := storage.Request{Message: storage.Message{Content: []byte("bench" + strconv.Itoa(i)), ID: i}, Timestamp: time.Now().UnixNano()}
+		digest := storage.GetDigest(r)
+		pp := storage.PrePrepare{RequestMessage: r, Digest: digest, SequenceID: i}
+		if pp.Sign, err = signers["node1"].Sign(pp.SigningBytes()); err != nil {
+			return nil, err
+		}
+		messages = append(messages, storage.PackMessage(storage.MsgPrePrepare, "node1", pp.MarshalProto()))
+		for _, nodeID := range []string{"node3", "node4"} {
+			pre := storage.Prepare{Digest: digest, SequenceID: i, NodeID: nodeID}
+			if pre.Sign, err = signers[nodeID].Sign(pre.SigningBytes()); err != nil {
+				return nil, err
+			}
+			messages = append(messages, storage.PackMessage(storage.MsgPrepare, nodeID, pre.MarshalProto()))
+		}
+		for _, nodeID := range []string{"node1", "node3", "node4"} {
+			c := storage.Commit{Digest: digest, SequenceID: i, NodeID: nodeID}
+			if c.Sign, err = signers[nodeID].Sign(c.SigningBytes()); err != nil {
+				return nil, err
+			}
+			messages = append(messages, storage.PackMessage(storage.MsgCommit, nodeID, c.MarshalProto()))
+		}
+	}
+	return messages, nil
+}
+
+// 客户端的公钥也在公钥表中，但客户端签名的Prepare和Commit不是验证者的投票，被拒绝且不计入法定人数
+func TestClientVoteRejected(t *testing.T) {
+	sink := discardListener(t)
+	p2p := network.NewP2P("tcp")
+	if err := p2p.SetScheme(utils.SchemeEd25519); err != nil {
+		t.Fatal(err)
+	}
+	signers := make(map[string]utils.Signer)
+	for _, id := range []string{"node1", "node2", "node3", "node4", "client1"} {
+		signers[id] = testSigner(t)
+		if id == "client1" {
+			p2p.AddClient(id, sink.Addr().String())
+		} else {
+			p2p.AddFullNode(id, sink.Addr().String())
+		}
+		if err := p2p.AddPubKey(id, signers[id].PublicKey()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	p2p.SetPrimaryNode("node1")
+	//事件循环没有启动，消息在当前协程中处理
+	p := NewPBFT("node2", sink.Addr().String(), signers["node2"], p2p)
+
+	r := storage.Request{Message: storage.Message{Content: []byte("block"), ID: 0}, Timestamp: time.Now().UnixNano()}
+	digest := storage.GetDigest(r)
+	pp := storage.PrePrepare{RequestMessage: r, Digest: digest, SequenceID: 0}
+	pp.Sign, _ = signers["node1"].Sign(pp.SigningBytes())
+	p.HandleRequest(storage.PackMessage(storage.MsgPrePrepare, "node1", pp.MarshalProto()))
+	prepare := func(id string) {
+		pre := storage.Prepare{Digest: digest, SequenceID: 0, NodeID: id}
+		pre.Sign, _ = signers[id].Sign(pre.SigningBytes())
+		p.HandleRequest(storage.PackMessage(storage.MsgPrepare, id, pre.MarshalProto()))
+	}
+	commit := func(id string) {
+		c := storage.Commit{Digest: digest, SequenceID: 0, NodeID: id}
+		c.Sign, _ = signers[id].Sign(c.SigningBytes())
+		p.HandleRequest(storage.PackMessage(storage.MsgCommit, id, c.MarshalProto()))
+	}
+
+	prepare("client1")
+	if p.IsCommitBordcast[digest] {
+		t.Fatal("client prepare counted toward the prepare quorum")
+	}
+	prepare("node3")
+	if !p.IsCommitBordcast[digest] {
+		t.Fatal("no commit after a validator prepare")
+	}
+	commit("node3")
+	commit("client1")
+	if p.SequenceIDL != 0 {
+		t.Fatal("committed with a client commit in the quorum")
+	}
+	if p.CommitConfirmCount[digest]["client1"] || p.CommitSigns[digest]["client1"] != nil {
+		t.Error("client commit recorded")
+	}
+	if rejected := p.Rejected()["client1"]; rejected != 2 {
+		t.Errorf("%d client messages rejected, want 2", rejected)
+	}
+	commit("node4")
+	if p.SequenceIDL != 1 {
+		t.Fatal("not committed after 2f+1 validator commits")
+	}
+	cert := p.commitCertificate(0, digest)
+	if err := cert.Verify(0, digest, p2p.GetValidatorPubkeys()); err != nil {
+		t.Errorf("certificate does not verify against the validators: %v", err)
+	}
+	for _, id := range cert.Signers {
+		if id == "client1" {
+			t.Error("client signature in the certificate")
+		}
+	}
+}
@@ -0,0 +1,213 @@
+package consensus
+
+import (
+	"simplechain/storage"
+)
+
+// OpenWAL 打开预写日志并重放，恢复崩溃前的协议状态，必须在开始接收消息之前调用
+func (p *Pbft) OpenWAL(path string) error {
+	wal, err := storage.OpenWAL(path)
+	if err != nil {
+		return err
+	}
+	if err := wal.Replay(p.replayRecord); err != nil {
+		wal.Close()
+		return err
+	}
+	//已完成共识的连续消息都视为已提交（低水位线记录可能没来得及写入）
+	for {
+		if _, ok := p.MessageToCommit[p.SequenceIDL]; !ok {
+			break
+		}
+		p.SequenceIDL++
+	}
+	for i := 0; i < p.SequenceIDL; i++ {
+		if commit, ok := p.MessageToCommit[i]; ok && p.MessagePool[commit.Digest] != nil {
+			p.MessageCommitted = append(p.MessageCommitted, p.MessagePool[commit.Digest].Message)
+		}
+	}
+	//只有尚未提交的消息才需要重新广播
+	resend := make([]storage.WALRecord, 0)
+	for _, record := range p.walResend {
+		if walSequenceID(record) >= p.SequenceIDL {
+			resend = append(resend, record)
+		}
+	}
+	p.walResend = resend
+	p.WAL = wal
+	return nil
+}
+
+// 将记录写入预写日志，写入失败时不能继续发出或接受该消息
+func (p *Pbft) appendWAL(recordType storage.WALRecordType, data []byte) bool {
+	if p.WAL == nil {
+		return true
+	}
+	if err := p.WAL.Append(storage.WALRecord{Type: recordType, Data: data}); err != nil {
+		p.Loger.Println("节点", p.NodeID, "写入预写日志失败:", err)
+		return false
+	}
+	return true
+}
+
+// 重放一条预写日志记录，与处理对应消息时对各映射的修改一致
+func (p *Pbft) replayRecord(record storage.WALRecord) error {
+	switch record.Type {
+	case storage.WALPrePrepare:
+		pp, err := storage.DeserializePrePrepare(record.Data)
+		if err != nil {
+			return err
+		}
+		p.MessagePool[pp.Digest] = &pp.RequestMessage
+		p.PrePrepareSigns[pp.Digest] = pp.Sign
+		//重放时主节点可能还未确定，重新广播时再判断
+		p.walResend = append(p.walResend, record)
+	case storage.WALPrepare:
+		pre, err := storage.DeserializePrepare(record.Data)
+		if err != nil {
+			return err
+		}
+		if pre.NodeID == p.NodeID {
+			p.walResend = append(p.walResend, record)
+		} else {
+			p.SetPrePareConfirmMap(pre.Digest, pre.NodeID, true)
+		}
+	case storage.WALCommit:
+		c, err := storage.DeserializeCommit(record.Data)
+		if err != nil {
+			return err
+		}
+		if c.NodeID == p.NodeID {
+			p.IsCommitBordcast[c.Digest] = true
+			p.walResend = append(p.walResend, record)
+		} else {
+			p.SetCommitConfirmMap(c.Digest, c.NodeID, true)
+		}
+		p.SetCommitSign(c.Digest, c.NodeID, c.Sign)
+	case storage.WALCommitted:
+		c, err := storage.DeserializeCommit(record.Data)
+		if err != nil {
+			return err
+		}
+		p.MessageToCommit[c.SequenceID] = *c
+		p.IsReply[c.Digest] = true
+	case storage.WALView:
+		vs, err := storage.DeserializeViewState(record.Data)
+		if err != nil {
+			return err
+		}
+		p.View = vs.View
+		if vs.SequenceID > p.SequenceIDL {
+			p.SequenceIDL = vs.SequenceID
+		}
+	}
+	return nil
+}
+
+// 预写日志中消息记录对应的序号
+func walSequenceID(record storage.WALRecord) int {
+	switch record.Type {
+	case storage.WALPrePrepare:
+		if pp, err := storage.DeserializePrePrepare(record.Data); err == nil {
+			return pp.SequenceID
+		}
+	case storage.WALPrepare:
+		if pre, err := storage.DeserializePrepare(record.Data); err == nil {
+			return pre.SequenceID
+		}
+	case storage.WALCommit, storage.WALCommitted:
+		if c, err := storage.DeserializeCommit(record.Data); err == nil {
+			return c.SequenceID
+		}
+	}
+	return -1
+}
+
+// ResendPending 重新广播崩溃前本节点发出、但尚未提交的消息，使其他节点能够继续完成共识
+// 消息的内容与崩溃前完全相同，但使用当前的私钥重新签名（重启后节点密钥可能已经更换）
+func (p *Pbft) ResendPending() {
+	p.post(p.resendPending)
+}
+
+func (p *Pbft) resendPending() {
+	resend := p.walResend
+	p.walResend = nil
+	for _, record := range resend {
+		if walSequenceID(record) < p.SequenceIDL {
+			continue
+		}
+		var err error
+		switch record.Type {
+		case storage.WALPrePrepare:
+			//只有主节点才会重新广播PrePrepare
+			var pp *storage.PrePrepare
+			if pp, err = storage.DeserializePrePrepare(record.Data); err == nil && p.NodeID == p.P2P.GetPrimaryID() {
+				if pp.Sign, err = p.Signer.Sign(pp.SigningBytes()); err == nil {
+					p.PrePrepareSigns[pp.Digest] = pp.Sign
+					p.P2P.Broadcast(p.NodeID, storage.PackMessage(storage.MsgPrePrepare, p.NodeID, pp.MarshalProto()))
+				}
+			}
+		case storage.WALPrepare:
+			var pre *storage.Prepare
+			if pre, err = storage.DeserializePrepare(record.Data); err == nil {
+				if pre.Sign, err = p.Signer.Sign(pre.SigningBytes()); err == nil {
+					p.P2P.Broadcast(p.NodeID, storage.PackMessage(storage.MsgPrepare, p.NodeID, pre.MarshalProto()))
+				}
+			}
+		case storage.WALCommit:
+			var c *storage.Commit
+			if c, err = storage.DeserializeCommit(record.Data); err == nil {
+				if c.Sign, err = p.Signer.Sign(c.SigningBytes()); err == nil {
+					p.SetCommitSign(c.Digest, p.NodeID, c.Sign)
+					p.P2P.Broadcast(p.NodeID, storage.PackMessage(storage.MsgCommit, p.NodeID, c.MarshalProto()))
+				}
+			}
+		}
+		if err != nil {
+			p.Loger.Println("节点", p.NodeID, "无法重新广播预写日志中的消息", record.Type, ":", err)
+		}
+	}
+	if len(resend) > 0 {
+		p.Loger.Println("节点", p.NodeID, "重新广播了预写日志中尚未提交的消息")
+	}
+}
+
+// GetProposal 获取临时消息池中序号为sequenceID的请求，没有时返回nil
+func (p *Pbft) GetProposal(sequenceID int) *storage.Request {
+	var proposal *storage.Request
+	p.call(func() {
+		for _, request := range p.MessagePool {
+			if request.ID == sequenceID {
+				proposal = request
+				return
+			}
+		}
+	})
+	return proposal
+}
+
+// CompactWAL 丢弃预写日志中序号小于sequenceID的消息记录，调用者需保证这些消息对应的区块已经持久化
+// 压缩在事件循环中异步进行，失败时只记录日志
+func (p *Pbft) CompactWAL(sequenceID int) {
+	p.post(func() {
+		if err := p.compactWAL(sequenceID); err != nil {
+			p.Loger.Println("节点", p.NodeID, "压缩预写日志失败:", err)
+		}
+	})
+}
+
+func (p *Pbft) compactWAL(sequenceID int) error {
+	if p.WAL == nil {
+		return nil
+	}
+	vs := storage.ViewState{View: p.View, SequenceID: p.SequenceIDL}
+	keep := func(record storage.WALRecord) bool {
+		if record.Type == storage.WALView {
+			//只保留压缩期间写入的更新的低水位线
+			latest, err := storage.DeserializeViewState(record.Data)
+			return err == nil && latest.SequenceID > vs.SequenceID
+		}
+		return walSequenceID(record) >= sequenceID
+	}
+	return p.WAL.Compact(keep, storage.WALRecord{Type: storage.WALView, Data: vs.Serialize()})
+}
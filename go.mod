@@ -1,3 +1,5 @@
 module simplechain
 
 go 1.21.4
+
+require google.golang.org/protobuf v1.35.2
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"simplechain/nodes"
+	"simplechain/utils"
+	"strings"
+)
+
+// 生成密钥和创世文件：为配置文件中的每个全节点和客户端从密钥库加载密钥（不存在时生成），
+// 并将所有地址和公钥写入创世文件。私钥用环境变量SIMPLECHAIN_PASSPHRASE中的口令加密。
+//
+//	go run . keygen [-config config] [-keystore keys] [-scheme rsa] [-genesis genesis.json]
+//
+// launch和在本进程中运行所有节点时，网络一行中的创世文件不存在则自动按同样的方式生成。
+
+func runKeygen(args []string) {
+	fs := flag.NewFlagSet("keygen", flag.ExitOnError)
+	configPath := fs.String("config", "config", "记录全节点和客户端地址的配置文件")
+	keystoreDir := fs.String("keystore", "keys", "密钥库目录")
+	schemeName := fs.String("scheme", string(utils.DefaultScheme), "签名方案：rsa、ed25519或ecdsa-p256")
+	genesisPath := fs.String("genesis", "genesis.json", "生成的创世文件")
+	fs.Parse(args)
+
+	scheme, err := utils.ParseSignatureScheme(*schemeName)
+	if err != nil {
+		fmt.Println("Error:", err)
+		return
+	}
+	genesis, err := generateGenesis(*configPath, *keystoreDir, scheme, *genesisPath)
+	if err != nil {
+		fmt.Println("Error:", err)
+		return
+	}
+	fmt.Printf("wrote %s: %d validators, %d clients, keys in %s\n", *genesisPath, len(genesis.Validators), len(genesis.Clients), *keystoreDir)
+}
+
+// 为配置文件中的每个全节点和客户端加载或生成密钥，并写入创世文件
+func generateGenesis(configPath string, keystoreDir string, scheme utils.SignatureScheme, genesisPath string) (*nodes.Genesis, error) {
+	keystore, err := utils.NewKeystore(keystoreDir, os.Getenv(nodes.PassphraseEnv))
+	if err != nil {
+		return nil, fmt.Errorf("%w (set %s)", err, nodes.PassphraseEnv)
+	}
+	file, err := os.Open(configPath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	genesis := &nodes.Genesis{Scheme: scheme}
+	reader := bufio.NewScanner(file)
+	for reader.Scan() {
+		lines := strings.Split(reader.Text(), ",")
+		if len(lines) < 3 || (lines[0] != "fullnode" && lines[0] != "client") {
+			continue
+		}
+		signer, err := keystore.LoadOrGenerate(lines[1], scheme)
+		if err != nil {
+			return nil, err
+		}
+		identity := nodes.GenesisIdentity{ID: lines[1], Addr: lines[2], PublicKey: signer.PublicKey()}
+		if lines[0] == "fullnode" {
+			genesis.Validators = append(genesis.Validators, identity)
+		} else {
+			genesis.Clients = append(genesis.Clients, identity)
+		}
+	}
+	if err := reader.Err(); err != nil {
+		return nil, err
+	}
+	if err := genesis.Validate(); err != nil {
+		return nil, err
+	}
+	if err := genesis.Save(genesisPath); err != nil {
+		return nil, err
+	}
+	return genesis, nil
+}
+
+// 配置文件的网络一行指定了创世文件和密钥库、但创世文件还不存在时，先像keygen一样生成密钥和创世文件
+func ensureGenesis(configPath string) error {
+	file, err := os.Open(configPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	reader := bufio.NewScanner(file)
+	for reader.Scan() {
+		lines := strings.Split(reader.Text(), ",")
+		if lines[0] != "network" {
+			continue
+		}
+		netconfig, err := nodes.ParseNetworkConfig(lines[1:])
+		if err != nil {
+			return err
+		}
+		if netconfig.Genesis == "" || netconfig.Keystore == "" {
+			return nil
+		}
+		if _, err := os.Stat(netconfig.Genesis); !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		scheme := netconfig.Scheme
+		if scheme == "" {
+			scheme = utils.DefaultScheme
+		}
+		genesis, err := generateGenesis(configPath, netconfig.Keystore, scheme, netconfig.Genesis)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s not found, wrote it: %d validators, %d clients, keys in %s\n", netconfig.Genesis, len(genesis.Validators), len(genesis.Clients), netconfig.Keystore)
+		return nil
+	}
+	return reader.Err()
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"simplechain/blockchain"
+	"simplechain/nodes"
+	"simplechain/storage"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// 本地多进程启动器：为配置文件中的每个全节点、客户端和轻节点启动一个 node 子进程，
+// 先启动全节点，等待startup后再启动客户端和轻节点，子进程的输出加上[ID]前缀。
+// 运行duration后（为0时直到收到中断信号）向子进程发送中断信号，
+// 然后打开每个全节点的存储，检查区块高度不低于min-height并且公共高度上的区块哈希一致，
+// 任何子进程提前退出或检查失败时以非零状态退出，可直接用于集成测试。
+//
+//	go run . launch [-config config] [-duration 0] [-startup 2s] [-min-height 0] [-batchsize 10]
+
+const launchStopTimeout = 5 * time.Second //子进程收到中断信号后退出的期限，超时后强制结束
+
+// 启动器创建的子进程
+type launchedProcess struct {
+	id   string
+	cmd  *exec.Cmd
+	done chan struct{} //子进程退出后关闭
+	err  error
+}
+
+func runLaunch(args []string) error {
+	fs := flag.NewFlagSet("launch", flag.ExitOnError)
+	configPath := fs.String("config", "config", "记录全节点和客户端地址的配置文件")
+	duration := fs.Duration("duration", 0, "运行时间，为0时直到收到中断信号")
+	startup := fs.Duration("startup", 2*time.Second, "启动全节点后等待多久再启动客户端")
+	minHeight := fs.Int("min-height", 0, "结束时每个全节点至少达到的区块高度")
+	batchsize := fs.Int("batchsize", 10, "每个区块的交易数量")
+	fs.Parse(args)
+
+	//子进程都从创世文件加载公钥，创世文件必须在启动子进程之前生成
+	if err := ensureGenesis(*configPath); err != nil {
+		return err
+	}
+	fullnodeIDs, clientIDs, err := launchEntries(*configPath)
+	if err != nil {
+		return err
+	}
+	if len(fullnodeIDs) == 0 {
+		return fmt.Errorf("launch: no fullnode in %s", *configPath)
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll("logout", 0755); err != nil {
+		return err
+	}
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(interrupt)
+
+	var procs []*launchedProcess
+	exited := make(chan *launchedProcess, len(fullnodeIDs)+len(clientIDs))
+	var output sync.WaitGroup
+	start := func(id string) error {
+		proc, err := launchNode(exe, id, *configPath, *batchsize, &output)
+		if err != nil {
+			return err
+		}
+		procs = append(procs, proc)
+		go func() {
+			<-proc.done
+			exited <- proc
+		}()
+		return nil
+	}
+
+	//启动阶段或运行期间出现的错误，结束所有子进程后返回
+	var runErr error
+	for _, id := range fullnodeIDs {
+		if runErr = start(id); runErr != nil {
+			break
+		}
+	}
+	if runErr == nil {
+		select {
+		case <-time.After(*startup):
+			for _, id := range clientIDs {
+				if runErr = start(id); runErr != nil {
+					break
+				}
+			}
+		case <-interrupt:
+		case proc := <-exited:
+			runErr = fmt.Errorf("launch: %s exited early: %v", proc.id, proc.err)
+		}
+	}
+	if runErr == nil {
+		var timeout <-chan time.Time
+		if *duration > 0 {
+			timeout = time.After(*duration)
+		}
+		select {
+		case <-timeout:
+		case <-interrupt:
+		case proc := <-exited:
+			runErr = fmt.Errorf("launch: %s exited early: %v", proc.id, proc.err)
+		}
+	}
+	stopProcesses(procs)
+	output.Wait()
+	if runErr != nil {
+		return runErr
+	}
+	return checkChains(fullnodeIDs, *minHeight)
+}
+
+// 配置文件中全节点和客户端（包括轻节点）的ID
+func launchEntries(path string) ([]string, []string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer file.Close()
+	var fullnodeIDs, clientIDs []string
+	reader := bufio.NewScanner(file)
+	for reader.Scan() {
+		lines := strings.Split(reader.Text(), ",")
+		if len(lines) < 3 {
+			continue
+		}
+		if lines[0] == "fullnode" {
+			fullnodeIDs = append(fullnodeIDs, lines[1])
+		} else if lines[0] == "client" || lines[0] == "lightclient" {
+			clientIDs = append(clientIDs, lines[1])
+		}
+	}
+	return fullnodeIDs, clientIDs, reader.Err()
+}
+
+// 启动一个 node 子进程，子进程的标准输出和标准错误逐行加上[ID]前缀后输出
+func launchNode(exe string, id string, config string, batchsize int, output *sync.WaitGroup) (*launchedProcess, error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	cmd := exec.Command(exe, "node", "-id", id, "-config", config, "-batchsize", strconv.Itoa(batchsize))
+	cmd.Stdout = w
+	cmd.Stderr = w
+	if err := cmd.Start(); err != nil {
+		r.Close()
+		w.Close()
+		return nil, fmt.Errorf("launch: start %s: %v", id, err)
+	}
+	//写端只由子进程持有，子进程退出后读端读到EOF
+	w.Close()
+	output.Add(1)
+	go func() {
+		defer output.Done()
+		defer r.Close()
+		reader := bufio.NewScanner(r)
+		for reader.Scan() {
+			fmt.Printf("[%s] %s\n", id, reader.Text())
+		}
+	}()
+	proc := &launchedProcess{id: id, cmd: cmd, done: make(chan struct{})}
+	go func() {
+		proc.err = cmd.Wait()
+		close(proc.done)
+	}()
+	return proc, nil
+}
+
+// 向所有子进程发送中断信号，超时未退出的强制结束
+func stopProcesses(procs []*launchedProcess) {
+	for _, proc := range procs {
+		proc.cmd.Process.Signal(os.Interrupt)
+	}
+	deadline := time.After(launchStopTimeout)
+	for _, proc := range procs {
+		select {
+		case <-proc.done:
+		case <-deadline:
+			proc.cmd.Process.Kill()
+			<-proc.done
+		}
+	}
+}
+
+// 打开每个全节点的存储，检查区块高度并比较公共高度上的区块哈希
+func checkChains(fullnodeIDs []string, minHeight int) error {
+	chains := make([]*blockchain.Blockchain, 0, len(fullnodeIDs))
+	for _, id := range fullnodeIDs {
+		db, err := storage.OpenDB(filepath.Join(nodes.DBDir, id))
+		if err != nil {
+			return fmt.Errorf("launch: open %s: %v", id, err)
+		}
+		defer db.Close()
+		chain, err := blockchain.OpenBlockchain(db)
+		if err != nil {
+			return fmt.Errorf("launch: load %s: %v", id, err)
+		}
+		fmt.Printf("%-8s height %-6d last %x\n", id, chain.CurrentHeight, chain.LastHash)
+		chains = append(chains, chain)
+	}
+
+	common := chains[0].CurrentHeight
+	for _, chain := range chains {
+		common = min(common, chain.CurrentHeight)
+	}
+	if common < minHeight {
+		return fmt.Errorf("launch: common height %d below -min-height %d", common, minHeight)
+	}
+	if common == 0 {
+		return nil
+	}
+	//从快照启动的节点可能没有该高度的区块，跳过
+	var hash []byte
+	for i, chain := range chains {
+		block := chain.GetBlockByHeight(common - 1)
+		if block == nil {
+			continue
+		}
+		if hash == nil {
+			hash = block.Hash
+		} else if !bytes.Equal(hash, block.Hash) {
+			return fmt.Errorf("launch: %s has a different block at height %d", fullnodeIDs[i], common-1)
+		}
+	}
+	fmt.Printf("all %d fullnodes agree on block %d\n", len(chains), common-1)
+	return nil
+}
@@ -10,6 +10,24 @@ import (
 )
 
 func main() {
+	//go run . keygen 生成密钥库和创世文件
+	if len(os.Args) > 1 && os.Args[1] == "keygen" {
+		runKeygen(os.Args[2:])
+		return
+	}
+	//go run . node -id node2 在本进程中只运行一个全节点或客户端
+	if len(os.Args) > 1 && os.Args[1] == "node" {
+		runNode(os.Args[2:])
+		return
+	}
+	//go run . launch 为每个全节点和客户端启动一个进程
+	if len(os.Args) > 1 && os.Args[1] == "launch" {
+		if err := runLaunch(os.Args[2:]); err != nil {
+			fmt.Println("Error:", err)
+			os.Exit(1)
+		}
+		return
+	}
 
 	batchsize := 10
 
@@ -33,33 +51,107 @@ func InitP2P() *network.P2P {
 
 // 初始化客户端和全节点
 func InitClientAndNodes(p2p *network.P2P, batchsize int) (map[string]*nodes.Fullnode, map[string]*nodes.Client) {
+	if err := ensureGenesis("config"); err != nil {
+		fmt.Println("Error:", err)
+		return nil, nil
+	}
+	fullnodeList, clientList, _ := initFromConfig("config", p2p, batchsize, "")
+	return fullnodeList, clientList
+}
+
+// 读取配置文件创建全节点、客户端和轻节点；only不为空时只创建该ID的节点，
+// 其他节点只记录地址，公钥来自创世文件（每个进程一个节点）
+func initFromConfig(path string, p2p *network.P2P, batchsize int, only string) (map[string]*nodes.Fullnode, map[string]*nodes.Client, map[string]*nodes.LightClient) {
 	fullnodeList := make(map[string]*nodes.Fullnode)
 	clientList := make(map[string]*nodes.Client)
+	lightList := make(map[string]*nodes.LightClient)
 
 	// 打开文件
-	file, err := os.Open("config")
+	file, err := os.Open(path)
 	if err != nil {
 		fmt.Println("Error:", err)
-		return nil, nil
+		return nil, nil, nil
 	}
 	defer file.Close()
 
 	// 创建一个带缓冲的读取器
 	reader := bufio.NewScanner(file)
 
+	var netconfig nodes.NetworkConfig
 	// 逐行读取文件内容并输出
 	for reader.Scan() {
 		line := reader.Text() // 获取当前行的字符串
 		lines := strings.Split(line, ",")
-		if lines[0] == "fullnode" {
-			fullnode := nodes.NewFullnode(lines[1], lines[2], p2p, batchsize)
+		if lines[0] == "network" {
+			//网络配置错误时节点无法得到正确的公钥，不再继续创建节点
+			if netconfig, err = nodes.ParseNetworkConfig(lines[1:]); err == nil {
+				err = netconfig.Apply(p2p)
+			}
+			if err != nil {
+				fmt.Println("Error:", err)
+				return nil, nil, nil
+			}
+		} else if only != "" && (lines[0] == "fullnode" || lines[0] == "client" || lines[0] == "lightclient") && (netconfig.Genesis == "" || netconfig.Keystore == "") {
+			//其他进程中节点的公钥只能从创世文件得到
+			fmt.Println("Error: running a single node requires a network line with genesis and keystore before the nodes")
+			return nil, nil, nil
+		} else if only != "" && (lines[0] == "fullnode" || lines[0] == "client" || lines[0] == "lightclient") && lines[1] != only {
+			//其他进程中的节点
+			if lines[0] == "fullnode" {
+				p2p.AddFullNode(lines[1], lines[2])
+				if p2p.GetPrimaryID() == "" {
+					p2p.SetPrimaryNode(lines[1])
+				}
+			} else {
+				p2p.AddClient(lines[1], lines[2])
+			}
+		} else if lines[0] == "fullnode" {
+			config, err := nodes.ParseNodeConfig(lines[3:])
+			if err != nil {
+				fmt.Println("Error:", err)
+				continue
+			}
+			signer, err := netconfig.Signer(lines[1], p2p.GetScheme())
+			if err != nil {
+				fmt.Println("Error:", err)
+				continue
+			}
+			var fullnode *nodes.Fullnode
+			if signer != nil {
+				fullnode = nodes.NewFullnodeWithSigner(lines[1], lines[2], p2p, batchsize, config, signer)
+			} else {
+				fullnode = nodes.NewFullnodeWithConfig(lines[1], lines[2], p2p, batchsize, config)
+			}
 			fullnodeList[lines[1]] = fullnode
-			if p2p.PrimaryNodeID == "" {
+			if p2p.GetPrimaryID() == "" {
 				p2p.SetPrimaryNode(lines[1])
 			}
 		} else if lines[0] == "client" {
-			client := nodes.NewClient(lines[1], lines[2], p2p)
+			signer, err := netconfig.Signer(lines[1], p2p.GetScheme())
+			if err != nil {
+				fmt.Println("Error:", err)
+				continue
+			}
+			var client *nodes.Client
+			if signer != nil {
+				client = nodes.NewClientWithSigner(lines[1], lines[2], p2p, signer)
+			} else {
+				client = nodes.NewClient(lines[1], lines[2], p2p)
+			}
 			clientList[lines[1]] = client
+		} else if lines[0] == "lightclient" {
+			//轻节点只信任创世文件中的验证者
+			genesis := netconfig.LoadedGenesis()
+			if genesis == nil {
+				fmt.Println("Error: light client", lines[1], "requires a network line with genesis before it")
+				continue
+			}
+			lightclient, err := nodes.NewLightClient(lines[1], lines[2], p2p, genesis, "")
+			if err != nil {
+				fmt.Println("Error:", err)
+				continue
+			}
+			lightList[lines[1]] = lightclient
 		}
 	}
 
@@ -68,5 +160,5 @@ func InitClientAndNodes(p2p *network.P2P, batchsize int) (map[string]*nodes.Full
 		fmt.Println("Error:", err)
 	}
 
-	return fullnodeList, clientList
+	return fullnodeList, clientList, lightList
 }
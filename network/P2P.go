@@ -1,46 +1,98 @@
 package network
 
 import (
+	"errors"
+	"fmt"
 	"log"
 	"net"
+	"simplechain/utils"
+	"sort"
+	"sync"
 )
 
+var ErrKeyScheme = errors.New("network: public key does not match the network signature scheme")
+
+// P2P 记录网络中所有节点的地址和公钥，节点加入和消息处理在不同的协程中进行，表项只能通过方法访问
 type P2P struct {
-	NodeTable     map[string]string //全节点地址列表
-	ClientTable   map[string]string //客户端地址列表
-	PubKeyTable   map[string][]byte //全节点和客户端公钥列表
-	NetworkType   string            //网络类型
-	PrimaryNodeID string            //主节点
+	NodeTable     map[string]string     //全节点地址列表
+	ClientTable   map[string]string     //客户端地址列表
+	PubKeyTable   map[string][]byte     //全节点和客户端带类型标记的公钥列表
+	NetworkType   string                //网络类型
+	PrimaryNodeID string                //主节点
+	Scheme        utils.SignatureScheme //网络中所有节点和客户端使用的签名方案
+	mutex         sync.RWMutex          //地址、公钥列表和主节点的读写锁
 }
 
 func NewP2P(nettype string) *P2P {
-	p2p := &P2P{make(map[string]string), make(map[string]string), make(map[string][]byte), nettype, ""}
+	p2p := &P2P{NodeTable: make(map[string]string), ClientTable: make(map[string]string), PubKeyTable: make(map[string][]byte), NetworkType: nettype, Scheme: utils.DefaultScheme}
 	return p2p
 }
 
+// 设置网络的签名方案，只能在加入任何公钥之前设置
+func (p2p *P2P) SetScheme(scheme utils.SignatureScheme) error {
+	p2p.mutex.Lock()
+	defer p2p.mutex.Unlock()
+	if len(p2p.PubKeyTable) > 0 && scheme != p2p.Scheme {
+		return fmt.Errorf("network: cannot change signature scheme to %s after keys are registered", scheme)
+	}
+	p2p.Scheme = scheme
+	return nil
+}
+
+// 获取网络的签名方案
+func (p2p *P2P) GetScheme() utils.SignatureScheme {
+	p2p.mutex.RLock()
+	defer p2p.mutex.RUnlock()
+	return p2p.Scheme
+}
+
 func (p2p *P2P) SetPrimaryNode(nodeID string) {
+	p2p.mutex.Lock()
+	defer p2p.mutex.Unlock()
 	p2p.PrimaryNodeID = nodeID
 }
 
 func (p2p *P2P) AddFullNode(nodeID string, addr string) {
+	p2p.mutex.Lock()
+	defer p2p.mutex.Unlock()
 	p2p.NodeTable[nodeID] = addr
 }
 
-func (p2p *P2P) AddPubKey(nodeID string, pubkey []byte) {
+// 注册带类型标记的公钥，公钥必须能够解析（RSA密钥不短于MinRSAKeyBits位），且类型与网络的签名方案一致
+func (p2p *P2P) AddPubKey(nodeID string, pubkey []byte) error {
+	verifier, err := utils.ParseVerifier(pubkey)
+	if err != nil {
+		return err
+	}
+	scheme := verifier.Scheme()
+	p2p.mutex.Lock()
+	defer p2p.mutex.Unlock()
+	if scheme != p2p.Scheme {
+		return fmt.Errorf("%w: %s key for %s in a %s network", ErrKeyScheme, scheme, nodeID, p2p.Scheme)
+	}
 	p2p.PubKeyTable[nodeID] = pubkey
+	return nil
 }
 
 func (p2p *P2P) AddClient(clientID string, addr string) {
+	p2p.mutex.Lock()
+	defer p2p.mutex.Unlock()
 	p2p.ClientTable[clientID] = addr
 }
 
 // 广播某个全节点fullnode的消息给列表里其他fullnode
 func (p2p *P2P) Broadcast(nodeID string, context []byte) {
+	p2p.mutex.RLock()
+	addrs := make([]string, 0, len(p2p.NodeTable))
 	for k, v := range p2p.NodeTable {
 		if k != nodeID {
-			p2p.SendRequest(context, v)
+			addrs = append(addrs, v)
 		}
 	}
+	p2p.mutex.RUnlock()
+	for _, addr := range addrs {
+		p2p.SendRequest(context, addr)
+	}
 }
 
 // 发送请求
@@ -51,23 +103,31 @@ func (p2p *P2P) SendRequest(context []byte, addr string) {
 		return
 	}
 
-	_, err = conn.Write(context)
-	if err != nil {
-		log.Fatal(err)
+	//对方关闭或重启时写入可能失败，与连接失败一样只记录日志
+	if _, err = conn.Write(context); err != nil {
+		log.Println("send error", err)
 	}
 	conn.Close()
 }
 
 // 获取主节点ID
 func (p2p *P2P) GetPrimaryID() string {
-	if p2p.PrimaryNodeID == "" {
-		return ""
-	}
+	p2p.mutex.RLock()
+	defer p2p.mutex.RUnlock()
 	return p2p.PrimaryNodeID
 }
 
+// 获取主节点地址
+func (p2p *P2P) GetPrimaryAddr() string {
+	p2p.mutex.RLock()
+	defer p2p.mutex.RUnlock()
+	return p2p.NodeTable[p2p.PrimaryNodeID]
+}
+
 // 获取主节点公钥
 func (p2p *P2P) GetPrimaryPubkey() []byte {
+	p2p.mutex.RLock()
+	defer p2p.mutex.RUnlock()
 	if p2p.PrimaryNodeID == "" {
 		return nil
 	}
@@ -76,5 +136,64 @@ func (p2p *P2P) GetPrimaryPubkey() []byte {
 
 // 获取某个节点的公钥
 func (p2p *P2P) GetNodePubkey(nodeID string) []byte {
+	p2p.mutex.RLock()
+	defer p2p.mutex.RUnlock()
 	return p2p.PubKeyTable[nodeID]
 }
+
+// 获取全节点的地址
+func (p2p *P2P) GetNodeAddr(nodeID string) (string, bool) {
+	p2p.mutex.RLock()
+	defer p2p.mutex.RUnlock()
+	addr, ok := p2p.NodeTable[nodeID]
+	return addr, ok
+}
+
+// 获取客户端（包括轻节点）的地址
+func (p2p *P2P) GetClientAddr(clientID string) (string, bool) {
+	p2p.mutex.RLock()
+	defer p2p.mutex.RUnlock()
+	addr, ok := p2p.ClientTable[clientID]
+	return addr, ok
+}
+
+// 获取全节点或客户端（包括轻节点）的地址
+func (p2p *P2P) GetAddr(id string) (string, bool) {
+	p2p.mutex.RLock()
+	defer p2p.mutex.RUnlock()
+	if addr, ok := p2p.NodeTable[id]; ok {
+		return addr, true
+	}
+	addr, ok := p2p.ClientTable[id]
+	return addr, ok
+}
+
+// 获取按ID排序的全节点列表
+func (p2p *P2P) GetNodeIDs() []string {
+	p2p.mutex.RLock()
+	defer p2p.mutex.RUnlock()
+	nodeIDs := make([]string, 0, len(p2p.NodeTable))
+	for nodeID := range p2p.NodeTable {
+		nodeIDs = append(nodeIDs, nodeID)
+	}
+	sort.Strings(nodeIDs)
+	return nodeIDs
+}
+
+// 全节点（验证者）数量
+func (p2p *P2P) NodeCount() int {
+	p2p.mutex.RLock()
+	defer p2p.mutex.RUnlock()
+	return len(p2p.NodeTable)
+}
+
+// 获取所有全节点（验证者）的公钥
+func (p2p *P2P) GetValidatorPubkeys() map[string][]byte {
+	p2p.mutex.RLock()
+	defer p2p.mutex.RUnlock()
+	validators := make(map[string][]byte)
+	for nodeID := range p2p.NodeTable {
+		validators[nodeID] = p2p.PubKeyTable[nodeID]
+	}
+	return validators
+}
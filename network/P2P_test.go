@@ -0,0 +1,38 @@
+package network
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"errors"
+	"simplechain/utils"
+	"testing"
+)
+
+func TestAddPubKeyRejectsShortRSAKey(t *testing.T) {
+	p2p := NewP2P("tcp")
+	if err := p2p.SetScheme(utils.SchemeRSA); err != nil {
+		t.Fatal(err)
+	}
+	priv, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&priv.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p2p.AddPubKey("node1", append([]byte{utils.KeyTypeRSA}, der...)); !errors.Is(err, utils.ErrPublicKey) {
+		t.Errorf("1024-bit key: %v, want ErrPublicKey", err)
+	}
+	if p2p.GetNodePubkey("node1") != nil {
+		t.Error("short key registered")
+	}
+	signer, err := utils.GenerateSigner(utils.SchemeRSA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p2p.AddPubKey("node1", signer.PublicKey()); err != nil {
+		t.Errorf("%d-bit key: %v", utils.RSAKeyBits, err)
+	}
+}
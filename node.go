@@ -0,0 +1,43 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+)
+
+// 单节点进程：从配置文件中只创建ID为id的全节点、客户端或轻节点，其他节点的地址来自配置文件，
+// 公钥来自创世文件，节点之间只通过TCP通信。配置文件第一行必须是带genesis和keystore的network行，
+// 私钥用环境变量SIMPLECHAIN_PASSPHRASE中的口令解密。
+//
+//	go run . node -id node2 [-config config] [-batchsize 10]
+
+func runNode(args []string) {
+	fs := flag.NewFlagSet("node", flag.ExitOnError)
+	id := fs.String("id", "", "要运行的全节点、客户端或轻节点的ID")
+	configPath := fs.String("config", "config", "记录全节点和客户端地址的配置文件")
+	batchsize := fs.Int("batchsize", 10, "每个区块的交易数量")
+	fs.Parse(args)
+	if *id == "" {
+		fmt.Println("Error: missing -id")
+		os.Exit(2)
+	}
+	if err := os.MkdirAll("logout", 0755); err != nil {
+		fmt.Println("Error:", err)
+		os.Exit(1)
+	}
+
+	fullnodeList, clientList, lightList := initFromConfig(*configPath, InitP2P(), *batchsize, *id)
+	if len(fullnodeList)+len(clientList)+len(lightList) == 0 {
+		fmt.Printf("Error: %s was not started (see errors above or check %s)\n", *id, *configPath)
+		os.Exit(1)
+	}
+
+	//客户端读取消息并发给主节点
+	for _, v := range clientList {
+		v.SendRequestToPrimaryNode()
+	}
+
+	// 保持程序运行
+	select {}
+}
@@ -3,7 +3,6 @@ package nodes
 import (
 	"bufio"
 	"crypto/rand"
-	"encoding/json"
 	"fmt"
 	"io"
 	"log"
@@ -17,18 +16,35 @@ import (
 )
 
 type Client struct {
-	ClientID   string       //节点ID
-	Addr       string       //节点网络监听地址
-	RsaPrivKey []byte       //RSA私钥
-	RsaPubKey  []byte       //RSA公钥
-	P2P        *network.P2P //当前节点所在的P2P网络
+	ClientID string       //节点ID
+	Addr     string       //节点网络监听地址
+	Signer   utils.Signer //客户端的签名者，签名方案与网络一致
+	P2P      *network.P2P //当前节点所在的P2P网络
+	Topics   []string     //为发送的每个请求声明的主题
+	Fee      int          //为发送的每个请求支付的费用
+
+	nonce   int                         //下一个请求使用的nonce
+	nonceCh chan *storage.NonceResponse //等待nonce查询的响应
 }
 
+const NonceTimeout = 2 * time.Second //等待nonce查询响应的超时时间
+
 func NewClient(clientID string, addr string, p2p *network.P2P) *Client {
-	priv, pub := utils.GetKeyPair() //生成rsa公私钥
-	p2p.AddClient(clientID, addr)   //将当前节点注册入P2P网络
-	p2p.AddPubKey(clientID, pub)    //将当前节点的公钥写入P2P网络
-	client := &Client{clientID, addr, priv, pub, p2p}
+	signer, err := utils.GenerateSigner(p2p.GetScheme()) //按网络的签名方案生成公私钥
+	if err != nil {
+		log.Panic(err)
+	}
+	return NewClientWithSigner(clientID, addr, p2p, signer)
+}
+
+// NewClientWithSigner 使用已有的公私钥（例如从密钥库加载）创建客户端
+func NewClientWithSigner(clientID string, addr string, p2p *network.P2P, signer utils.Signer) *Client {
+	p2p.AddClient(clientID, addr) //将当前节点注册入P2P网络
+	//将当前节点的公钥写入P2P网络，创世文件已经发布了公钥时检查两者一致
+	if err := registerIdentity(p2p, clientID, signer); err != nil {
+		log.Panic(err)
+	}
+	client := &Client{clientID, addr, signer, p2p, nil, 0, 0, make(chan *storage.NonceResponse, 1)}
 	go client.CreateClientP2PListen() //启动网络监听
 	return client
 }
@@ -66,9 +82,53 @@ func (client *Client) CreateClientP2PListen() {
 
 // 处理接收到的请求
 func (client *Client) HandleRequest(b []byte) {
-	// Code
 	currentTime := time.Now().Format("2006-01-02 15:04:05")
-	fmt.Println(currentTime, client.GetClientID(), "recieves:", string(b))
+	env, err := storage.UnpackMessage(b)
+	if err != nil {
+		fmt.Println(currentTime, client.GetClientID(), "recieves invalid message:", err)
+		return
+	}
+	switch env.Type {
+	case storage.MsgReply:
+		reply, err := storage.UnmarshalReplyProto(env.Payload)
+		if err != nil {
+			fmt.Println(currentTime, client.GetClientID(), "recieves invalid reply from", env.Sender, ":", err)
+			return
+		}
+		fmt.Println(currentTime, client.GetClientID(), "recieves:", reply.NodeID, "节点已将msgid:", reply.MessageID, "存入区块", reply.Height, "中")
+	case storage.MsgNonce:
+		resp, err := storage.UnmarshalNonceResponseProto(env.Payload)
+		if err != nil || resp.Sender != client.Addr {
+			fmt.Println(currentTime, client.GetClientID(), "recieves invalid nonce from", env.Sender)
+			return
+		}
+		//没有等待中的查询时丢弃
+		select {
+		case client.nonceCh <- resp:
+		default:
+		}
+	default:
+		fmt.Println(currentTime, client.GetClientID(), "ignores", env.Type, "from", env.Sender)
+	}
+}
+
+// SyncNonce 向主节点查询下一个请求应使用的nonce，超时则继续使用本地的nonce
+func (client *Client) SyncNonce() {
+	//丢弃之前超时的查询迟到的响应
+	select {
+	case <-client.nonceCh:
+	default:
+	}
+	req := storage.NonceRequest{NodeID: client.ClientID, Sender: client.Addr}
+	client.P2P.SendRequest(storage.PackMessage(storage.MsgNonceReq, client.ClientID, req.MarshalProto()), client.P2P.GetPrimaryAddr())
+	select {
+	case resp := <-client.nonceCh:
+		if resp.Nonce > client.nonce {
+			client.nonce = resp.Nonce
+		}
+	case <-time.After(NonceTimeout):
+		fmt.Println("客户端", client.ClientID, "查询nonce超时，使用本地nonce", client.nonce)
+	}
 }
 
 // 读取文件中的消息并依次发送给主节点
@@ -81,6 +141,8 @@ func (client *Client) SendRequestToPrimaryNode() {
 		return
 	}
 	defer file.Close()
+	//重启后的客户端从已上链和已进入消息池的请求之后继续编号
+	client.SyncNonce()
 
 	// 创建一个带缓冲的读取器
 	reader := bufio.NewScanner(file)
@@ -92,18 +154,25 @@ func (client *Client) SendRequestToPrimaryNode() {
 		r.Timestamp = time.Now().UnixNano()
 		r.ClientAddr = client.Addr
 		r.Message.ID = GetRandom()
+		r.Topics = client.Topics
+		r.Fee = client.Fee
 		//消息内容就是用户的输入
 		r.Message.Content = []byte(line)
-		//将request序列化
-		br, err := json.Marshal(r)
-		if err != nil {
-			log.Panic(err)
+		r.Nonce = client.nonce
+		//客户端用自己的私钥对请求签名，全节点据此确认请求确实来自发送者
+		r.PubKeyID = client.ClientID
+		if r.Sign, err = client.Signer.Sign(r.SigningBytes()); err != nil {
+			fmt.Println("客户端", client.ClientID, "签名request失败:", err)
+			continue
 		}
-		fmt.Println(string(br))
-		//为序列化后的request添加消息类别
-		content := storage.JointMessage(storage.CRequest, br)
+		client.nonce++
+		//将request编码
+		br := r.MarshalProto()
+		fmt.Println("客户端", client.ClientID, "发送request,msgid:", r.Message.ID, ",内容:", line)
+		//将编码后的request装入消息信封
+		content := storage.PackMessage(storage.MsgRequest, client.ClientID, br)
 		//发送给主节点
-		client.P2P.SendRequest(content, client.P2P.NodeTable[client.P2P.GetPrimaryID()])
+		client.P2P.SendRequest(content, client.P2P.GetPrimaryAddr())
 	}
 
 	// 检查是否发生了读取错误
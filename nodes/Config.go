@@ -0,0 +1,255 @@
+package nodes
+
+import (
+	"fmt"
+	"os"
+	"simplechain/blockchain"
+	"simplechain/consensus"
+	"simplechain/network"
+	"simplechain/utils"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// NodeConfig 全节点的配置，由配置文件中全节点一行地址之后的可选字段指定：
+//
+//	fullnode,node1,127.0.0.1:8001                归档模式（默认）
+//	fullnode,node1,127.0.0.1:8001,archive        归档模式
+//	fullnode,node1,127.0.0.1:8001,pruned,32      裁剪模式，保留最近32个区块，省略时保留DefaultPruneDepth个
+//
+// 存储模式之后（或代替存储模式）可以有任意个key=value形式的选项：
+//
+//	mempool=4096                                 交易池容量
+//	ordering=fifo|priority|fair                  打包时的排序策略，默认fifo
+//	maxtxs=10                                    区块最多包含的交易数量，默认为batchsize
+//	maxbytes=1048576                             区块中交易内容的最大总字节数
+//	maxwait=500ms                                第一笔请求到达后最多等待多久封装区块
+//	heartbeat=5s                                 没有请求时多久封装一个空区块，默认不封装
+//	window=4                                     最多同时进行共识的区块数量
+//	verifiers=4                                  并行验证共识消息签名的协程数量，为0时在共识的事件循环中依次验证
+//	bootstrap=blocks|snapshot                    新节点（本地没有区块）的启动方式，默认从创世区块开始同步区块
+//
+// DataDir只能在代码中设置（例如测试使用临时目录）。
+type NodeConfig struct {
+	StorageMode blockchain.StorageMode //存储模式
+	PruneDepth  int                    //裁剪模式下保留区块体和历史状态的区块数量
+
+	MempoolCapacity int            //交易池容量
+	Ordering        OrderingPolicy //打包时的排序策略
+	Seal            SealPolicy     //区块封装策略
+	Window          int            //流水线窗口：最多同时进行共识的区块数量
+	VerifyWorkers   int            //并行验证共识消息签名的协程数量
+	Bootstrap       BootstrapMode  //新节点的启动方式
+	DataDir         string         //预写日志、键值存储和日志文件所在目录的上级目录，为空时使用当前目录
+}
+
+// BootstrapMode 本地没有区块的新节点的启动方式
+type BootstrapMode int
+
+const (
+	BootstrapBlocks   BootstrapMode = iota //从创世区块开始同步所有区块
+	BootstrapSnapshot                      //从对等节点已验证的最新快照恢复状态，只同步快照之后的区块
+)
+
+func DefaultNodeConfig() NodeConfig {
+	return NodeConfig{blockchain.ArchiveMode, blockchain.DefaultPruneDepth, DefaultMempoolCapacity, FIFOOrdering{}, DefaultSealPolicy(), DefaultPipelineWindow, consensus.DefaultVerifyWorkers, BootstrapBlocks, ""}
+}
+
+// ParseNodeConfig 解析配置文件中全节点地址之后的字段
+func ParseNodeConfig(fields []string) (NodeConfig, error) {
+	config := DefaultNodeConfig()
+	//key=value形式的选项与存储模式字段分开解析
+	positional := make([]string, 0, len(fields))
+	for _, field := range fields {
+		key, value, ok := strings.Cut(strings.TrimSpace(field), "=")
+		if !ok {
+			positional = append(positional, field)
+			continue
+		}
+		if err := config.setOption(key, value); err != nil {
+			return config, err
+		}
+	}
+	fields = positional
+	if len(fields) == 0 {
+		return config, nil
+	}
+	switch strings.TrimSpace(fields[0]) {
+	case "", "archive":
+		if len(fields) > 1 {
+			return config, fmt.Errorf("config: unexpected fields after archive: %v", fields[1:])
+		}
+	case "pruned":
+		config.StorageMode = blockchain.PrunedMode
+		if len(fields) > 2 {
+			return config, fmt.Errorf("config: unexpected fields after prune depth: %v", fields[2:])
+		}
+		if len(fields) == 2 {
+			depth, err := strconv.Atoi(strings.TrimSpace(fields[1]))
+			if err != nil || depth < 1 {
+				return config, fmt.Errorf("config: invalid prune depth %q", fields[1])
+			}
+			config.PruneDepth = depth
+		}
+	default:
+		return config, fmt.Errorf("config: unknown storage mode %q", fields[0])
+	}
+	return config, nil
+}
+
+// 设置key=value形式的选项
+func (config *NodeConfig) setOption(key string, value string) error {
+	switch key {
+	case "mempool":
+		capacity, err := strconv.Atoi(value)
+		if err != nil || capacity < 1 {
+			return fmt.Errorf("config: invalid mempool capacity %q", value)
+		}
+		config.MempoolCapacity = capacity
+	case "ordering":
+		policy, err := ParseOrderingPolicy(value)
+		if err != nil {
+			return err
+		}
+		config.Ordering = policy
+	case "maxtxs":
+		maxTxs, err := strconv.Atoi(value)
+		if err != nil || maxTxs < 1 {
+			return fmt.Errorf("config: invalid maxtxs %q", value)
+		}
+		config.Seal.MaxTxs = maxTxs
+	case "maxbytes":
+		maxBytes, err := strconv.Atoi(value)
+		if err != nil || maxBytes < 1 {
+			return fmt.Errorf("config: invalid maxbytes %q", value)
+		}
+		config.Seal.MaxBytes = maxBytes
+	case "window":
+		window, err := strconv.Atoi(value)
+		if err != nil || window < 1 {
+			return fmt.Errorf("config: invalid window %q", value)
+		}
+		config.Window = window
+	case "verifiers":
+		workers, err := strconv.Atoi(value)
+		if err != nil || workers < 0 {
+			return fmt.Errorf("config: invalid verifiers %q", value)
+		}
+		config.VerifyWorkers = workers
+	case "bootstrap":
+		switch value {
+		case "blocks":
+			config.Bootstrap = BootstrapBlocks
+		case "snapshot":
+			config.Bootstrap = BootstrapSnapshot
+		default:
+			return fmt.Errorf("config: unknown bootstrap mode %q", value)
+		}
+	case "maxwait", "heartbeat":
+		d, err := time.ParseDuration(value)
+		if err != nil || d < 0 || (key == "maxwait" && d == 0) {
+			return fmt.Errorf("config: invalid %s %q", key, value)
+		}
+		if key == "maxwait" {
+			config.Seal.MaxWait = d
+		} else {
+			config.Seal.Heartbeat = d
+		}
+	default:
+		return fmt.Errorf("config: unknown option %q", key)
+	}
+	return nil
+}
+
+const PassphraseEnv = "SIMPLECHAIN_PASSPHRASE" //密钥库口令所在的环境变量
+
+// NetworkConfig 网络的配置，由配置文件中可选的网络一行指定，该行必须位于所有全节点和客户端之前：
+//
+//	network,scheme=ed25519                       签名方案：rsa（默认）、ed25519或ecdsa-p256
+//	network,genesis=genesis.json,keystore=keys   从创世文件加载所有节点的地址和公钥，从密钥库加载本地公私钥
+//
+// 密钥库中的私钥用环境变量SIMPLECHAIN_PASSPHRASE中的口令加密。
+type NetworkConfig struct {
+	Scheme   utils.SignatureScheme //签名方案，为空时使用创世文件或默认的方案
+	Genesis  string                //创世文件路径
+	Keystore string                //密钥库目录
+
+	genesis  *Genesis
+	keystore *utils.Keystore
+}
+
+// ParseNetworkConfig 解析配置文件中网络一行的字段
+func ParseNetworkConfig(fields []string) (NetworkConfig, error) {
+	var config NetworkConfig
+	for _, field := range fields {
+		key, value, ok := strings.Cut(strings.TrimSpace(field), "=")
+		if !ok {
+			return config, fmt.Errorf("config: unexpected network field %q", field)
+		}
+		switch key {
+		case "scheme":
+			scheme, err := utils.ParseSignatureScheme(value)
+			if err != nil {
+				return config, err
+			}
+			config.Scheme = scheme
+		case "genesis":
+			config.Genesis = value
+		case "keystore":
+			config.Keystore = value
+		default:
+			return config, fmt.Errorf("config: unknown network option %q", key)
+		}
+	}
+	return config, nil
+}
+
+// Apply 设置网络的签名方案，加载创世文件中的地址和公钥，并打开密钥库
+func (config *NetworkConfig) Apply(p2p *network.P2P) error {
+	if config.Genesis != "" {
+		genesis, err := LoadGenesis(config.Genesis)
+		if err != nil {
+			return err
+		}
+		if config.Scheme != "" && config.Scheme != genesis.Scheme {
+			return fmt.Errorf("config: scheme %s does not match genesis scheme %s", config.Scheme, genesis.Scheme)
+		}
+		if err := genesis.Apply(p2p); err != nil {
+			return err
+		}
+		config.genesis = genesis
+	} else if config.Scheme != "" {
+		if err := p2p.SetScheme(config.Scheme); err != nil {
+			return err
+		}
+	}
+	if config.Keystore != "" {
+		keystore, err := utils.NewKeystore(config.Keystore, os.Getenv(PassphraseEnv))
+		if err != nil {
+			return err
+		}
+		config.keystore = keystore
+	}
+	return nil
+}
+
+// LoadedGenesis 已加载的创世文件，没有配置创世文件时返回nil
+func (config *NetworkConfig) LoadedGenesis() *Genesis {
+	return config.genesis
+}
+
+// Signer 获取id的公私钥：没有配置密钥库时返回nil，由构造函数生成新的公私钥；
+// 配置了创世文件时id必须在创世文件中且密钥必须已经存在，否则密钥不存在时生成并保存
+func (config *NetworkConfig) Signer(id string, scheme utils.SignatureScheme) (utils.Signer, error) {
+	if config.keystore == nil {
+		return nil, nil
+	}
+	if config.genesis == nil {
+		return config.keystore.LoadOrGenerate(id, scheme)
+	}
+	if !config.genesis.Contains(id) {
+		return nil, fmt.Errorf("%w: %s", ErrGenesisIdentity, id)
+	}
+	return config.keystore.Load(id)
+}
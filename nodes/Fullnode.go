@@ -1,51 +1,191 @@
 package nodes
 
 import (
-	"encoding/json"
+	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
 	"os"
+	"path/filepath"
 	"simplechain/blockchain"
 	"simplechain/consensus"
 	"simplechain/network"
 	"simplechain/storage"
 	"simplechain/utils"
-	"strconv"
 	"sync"
 	"time"
 )
 
+const (
+	WALDir             = "./wal"    //共识预写日志所在目录
+	DBDir              = "./db"     //区块和状态的键值存储所在目录
+	LogDir             = "./logout" //节点日志文件所在目录
+	WALCompactInterval = 16         //每上链多少个区块压缩一次共识预写日志
+
+	DefaultPipelineWindow = 4                      //默认最多同时进行共识的区块数量
+	PrimaryCheckInterval  = 100 * time.Millisecond //非主节点检查自己是否成为主节点的间隔
+)
+
+var ErrCommittedBlock = errors.New("fullnode: committed block failed validation")
+
 type Fullnode struct {
-	NodeID     string //节点ID
-	Addr       string //节点网络监听地址
-	RsaPrivKey []byte //RSA私钥
-	RsaPubKey  []byte //RSA公钥
+	NodeID string       //节点ID
+	Addr   string       //节点网络监听地址
+	Signer utils.Signer //节点的签名者，签名方案与网络一致
 
-	MessagePool [][]byte   //接收客户端请求的消息池（队列）
-	mpmutex     sync.Mutex //消息池的互斥锁
+	Mempool *Mempool //接收客户端请求的交易池
 
 	P2P  *network.P2P    //当前节点所在的P2P网络
 	Pbft *consensus.Pbft //当前节点的共识协议是pbft
 
 	BatchSize    int                    //打包区块的大小上限
+	Seal         SealPolicy             //区块封装策略
+	Window       int                    //流水线窗口：已打包但尚未上链的区块数量上限
+	windowCh     chan struct{}          //有区块上链、窗口可能出现空位时发出通知
 	Blockchain   *blockchain.Blockchain //当前节点维护的区块链
 	packedNumber int                    //已经打包的区块数量
+	packedHash   []byte                 //上一个打包的区块的哈希
+	packState    *blockchain.State      //已打包的所有区块应用之后的状态，用于计算新区块的状态根
+	packRollback bool                   //共识后的区块被拒绝，已打包的区块不会再上链，由chainmutex保护
+	chainmutex   sync.Mutex             //区块链的互斥锁（共识上链与区块同步互斥）
+	syncRound    int                    //区块同步时轮询对等节点的计数
+
+	Snapshots map[int]*blockchain.Snapshot //最近的检查点快照，检查点区块高度对应快照
+	restore   *snapshotRestore             //正在进行的快照恢复
+
+	listener  net.Listener   //P2P监听
+	logFile   *os.File       //日志文件
+	quit      chan struct{}  //Close之后关闭，通知各例程退出
+	routines  sync.WaitGroup //网络监听、共识、上链和区块同步例程
+	closeOnce sync.Once
 }
 
 func NewFullnode(nodeID string, addr string, p2p *network.P2P, batchsize int) *Fullnode {
-	priv, pub := utils.GetKeyPair()                         //生成rsa公私钥
-	messagepool := make([][]byte, 0)                        //创建空消息池
-	p2p.AddFullNode(nodeID, addr)                           //将当前节点注册入P2P网络
-	p2p.AddPubKey(nodeID, pub)                              //将当前节点的公钥写入P2P网络
-	pbft := consensus.NewPBFT(nodeID, addr, priv, pub, p2p) //创建共识协议
-	fullnode := &Fullnode{nodeID, addr, priv, pub, messagepool, sync.Mutex{}, p2p, pbft, batchsize, blockchain.NewBlockchain(), 0}
+	return NewFullnodeWithConfig(nodeID, addr, p2p, batchsize, DefaultNodeConfig())
+}
+
+// NewFullnodeWithConfig 按配置创建全节点，每次创建时按网络的签名方案生成新的公私钥
+func NewFullnodeWithConfig(nodeID string, addr string, p2p *network.P2P, batchsize int, config NodeConfig) *Fullnode {
+	signer, err := utils.GenerateSigner(p2p.GetScheme())
+	if err != nil {
+		log.Panic(err)
+	}
+	return NewFullnodeWithSigner(nodeID, addr, p2p, batchsize, config, signer)
+}
+
+// NewFullnodeWithSigner 使用已有的公私钥（例如从密钥库加载）创建全节点
+func NewFullnodeWithSigner(nodeID string, addr string, p2p *network.P2P, batchsize int, config NodeConfig, signer utils.Signer) *Fullnode {
+	p2p.AddFullNode(nodeID, addr) //将当前节点注册入P2P网络
+	//将当前节点的公钥写入P2P网络，创世文件已经发布了公钥时检查两者一致
+	if err := registerIdentity(p2p, nodeID, signer); err != nil {
+		log.Panic(err)
+	}
+	pbft := consensus.NewPBFT(nodeID, addr, signer, p2p) //创建共识协议
+	fullnode := &Fullnode{
+		NodeID:    nodeID,
+		Addr:      addr,
+		Signer:    signer,
+		P2P:       p2p,
+		Pbft:      pbft,
+		BatchSize: batchsize,
+		Seal:      config.Seal,
+		Window:    config.Window,
+		windowCh:  make(chan struct{}, 1),
+		Snapshots: make(map[int]*blockchain.Snapshot),
+		quit:      make(chan struct{}),
+	}
+	pbft.RequestDigest = fullnode.ProposalDigest //共识的请求都是区块，摘要为区块头的哈希
+	pbft.VerifyWorkers = config.VerifyWorkers
+	fullnode.Mempool = NewMempool(config.MempoolCapacity, fullnode.committedNonce, fullnode.admitRequest)
+	fullnode.Mempool.Ordering = config.Ordering
+	if fullnode.Seal.MaxTxs < 1 {
+		fullnode.Seal.MaxTxs = batchsize
+	}
+	fullnode.BatchSize = fullnode.Seal.MaxTxs
+	if fullnode.Window < 1 {
+		fullnode.Window = DefaultPipelineWindow
+	}
+	// 创建日志对象
+	if err := os.MkdirAll(filepath.Join(config.DataDir, LogDir), 0755); err != nil {
+		log.Panic(err)
+	}
+	logFile, err := os.OpenFile(filepath.Join(config.DataDir, LogDir, nodeID+"_log"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		fmt.Println("open log file failed, err:", err)
+	}
+	fullnode.logFile = logFile
+	pbft.Loger = log.New(logFile, "", log.Lshortfile)
+	//从键值存储中加载区块链
+	db, err := storage.OpenDB(filepath.Join(config.DataDir, DBDir, nodeID))
+	if err != nil {
+		log.Panic(err)
+	}
+	if fullnode.Blockchain, err = blockchain.OpenBlockchain(db); err != nil {
+		log.Panic(err)
+	}
+	fullnode.Blockchain.SetStorageMode(config.StorageMode, config.PruneDepth)
+	//重放预写日志恢复共识状态，并将恢复出的已提交区块上链，之后才开始接收消息
+	if err := pbft.OpenWAL(filepath.Join(config.DataDir, WALDir, nodeID+".wal")); err != nil {
+		log.Panic(err)
+	}
+	//已持久化的区块不再需要共识（预写日志可能已经压缩或丢失）
+	pbft.FastForward(fullnode.Blockchain.CurrentHeight)
+	//预写日志中已完成共识但尚未上链的区块直接上链
+	//验证失败的区块之后的区块无法衔接，交给区块同步
+	for _, committed := range pbft.CommittedFrom(fullnode.Blockchain.CurrentHeight) {
+		if err := fullnode.commitToChain(committed, false); err != nil {
+			pbft.Loger.Println("节点", nodeID, "拒绝预写日志中已提交的区块:", err)
+			break
+		}
+	}
+	fullnode.recoverPacking()
+	//构造函数返回时已经开始监听
+	if fullnode.listener, err = net.Listen("tcp", addr); err != nil {
+		log.Panic(err)
+	}
+	pbft.Start() //启动共识的事件循环，之后协议状态只由事件循环访问
+	fullnode.routines.Add(4)
 	go fullnode.CreateFullNodeP2PListen() //启动网络监听
+	go fullnode.AddToChain()              //异步将区块上链
 	go fullnode.RunConsensus()            //开启共识
+	//新节点从快照启动时，快照恢复完成（或放弃）之前不同步区块
+	if config.Bootstrap == BootstrapSnapshot && fullnode.Blockchain.CurrentHeight == 0 {
+		fullnode.BootstrapFromSnapshot()
+	}
+	go fullnode.RunSync() //开启区块同步
 	return fullnode
 }
 
+// Close 停止监听、共识和区块同步，等待各例程退出后关闭预写日志和键值存储
+// 关闭后节点不再处理任何消息，同一目录可以重新创建该节点
+func (fullnode *Fullnode) Close() error {
+	var err error
+	fullnode.closeOnce.Do(func() {
+		close(fullnode.quit)
+		fullnode.listener.Close()
+		//先停止事件循环，等待事件循环的例程随之返回
+		fullnode.Pbft.Stop()
+		fullnode.routines.Wait()
+		err = fullnode.Blockchain.DB.Close()
+		if fullnode.logFile != nil {
+			fullnode.logFile.Close()
+		}
+	})
+	return err
+}
+
+// 节点是否已经关闭
+func (fullnode *Fullnode) closed() bool {
+	select {
+	case <-fullnode.quit:
+		return true
+	default:
+		return false
+	}
+}
+
 func (fullnode *Fullnode) GetNodeID() string {
 	return fullnode.NodeID
 }
@@ -54,25 +194,19 @@ func (fullnode *Fullnode) GetAddress() string {
 	return fullnode.Addr
 }
 
-// 为全节点创建监听器并持续监听处理消息
+// 全节点的监听器持续监听处理消息，节点关闭后返回
 func (fullnode *Fullnode) CreateFullNodeP2PListen() {
-	logFile, err := os.OpenFile("./logout/"+fullnode.NodeID+"_log", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-	if err != nil {
-		fmt.Println("open log file failed, err:", err)
-	}
-	defer logFile.Close()
-	// 创建日志对象
-	fullnode.Pbft.Loger = log.New(logFile, "", log.Lshortfile)
-	listen, err := net.Listen("tcp", fullnode.GetAddress())
-	if err != nil {
-		log.Panic(err)
-	}
+	defer fullnode.routines.Done()
+	listen := fullnode.listener
 	// fmt.Printf("全节点%s开启P2P监听,地址：%s\n", fullnode.NodeID, fullnode.Addr)
 	fullnode.Pbft.Loger.Println("全节点", fullnode.NodeID, "开启P2P监听,地址：", fullnode.Addr)
 	defer listen.Close()
 
 	for {
 		conn, err := listen.Accept()
+		if err != nil && fullnode.closed() {
+			return
+		}
 		if err != nil {
 			log.Panic(err)
 		}
@@ -80,130 +214,395 @@ func (fullnode *Fullnode) CreateFullNodeP2PListen() {
 		if err != nil {
 			log.Panic(err)
 		}
+		//解析消息信封
+		env, err := storage.UnpackMessage(b)
+		switch {
+		//区块同步消息由全节点处理
+		case err == nil && env.Type == storage.MsgSyncReq:
+			fullnode.HandleSyncRequest(env.Payload)
+		case err == nil && env.Type == storage.MsgSyncResp:
+			fullnode.HandleSyncResponse(env.Payload)
+		//快照消息由全节点处理
+		case err == nil && env.Type == storage.MsgSnapReq:
+			fullnode.HandleSnapshotRequest(env.Payload)
+		case err == nil && env.Type == storage.MsgSnapMani:
+			fullnode.HandleSnapshotManifest(env.Payload)
+		case err == nil && env.Type == storage.MsgChunkReq:
+			fullnode.HandleChunkRequest(env.Payload)
+		case err == nil && env.Type == storage.MsgChunk:
+			fullnode.HandleChunk(env.Payload)
+		//轻节点的交易存在证明查询
+		case err == nil && env.Type == storage.MsgTxProofReq:
+			fullnode.HandleTxProofRequest(env.Payload)
+		//客户端的nonce查询
+		case err == nil && env.Type == storage.MsgNonceReq:
+			fullnode.HandleNonceRequest(env.Payload)
 		//主节点处理客户端请求,非主节点交给pbft处理
-		if fullnode.NodeID == fullnode.P2P.GetPrimaryID() {
-			//解析消息
-			cmd, _ := storage.SplitMessage(b)
-			//如果cmd是request,则放入消息池
-			if cmd == string(storage.CRequest) {
-				fullnode.HandleRequest(b)
-			} else {
-				fullnode.Pbft.HandleRequest(b)
-			}
-		} else {
+		case err == nil && env.Type == storage.MsgRequest && fullnode.NodeID == fullnode.P2P.GetPrimaryID():
+			fullnode.HandleRequest(b)
+		default:
 			fullnode.Pbft.HandleRequest(b)
 		}
 	}
 }
 
+// VerifyRequest 验证请求的客户端签名，签名公钥必须注册在请求的发送者地址上
+func (fullnode *Fullnode) VerifyRequest(r *storage.Request) error {
+	if r.PubKeyID == "" || len(r.Sign) == 0 {
+		return storage.ErrRequestUnsigned
+	}
+	if addr, ok := fullnode.P2P.GetClientAddr(r.PubKeyID); !ok || addr != r.ClientAddr {
+		return storage.ErrRequestSigner
+	}
+	return r.VerifySign(fullnode.P2P.GetNodePubkey(r.PubKeyID))
+}
+
+// ProposalDigest 共识中区块请求的摘要，区块不合法（如不能衔接在链末尾、状态根错误）或其中有不合法的交易（如未签名、签名无效）时返回空串
+func (fullnode *Fullnode) ProposalDigest(request storage.Request) string {
+	digest := blockchain.RequestDigest(request)
+	if digest == "" {
+		return ""
+	}
+	block, err := blockchain.DeserializeBlock(request.Content)
+	if err != nil {
+		return ""
+	}
+	for _, tx := range block.Transactions {
+		r, err := tx.GetRequest()
+		if err == nil {
+			err = fullnode.validateRequest(r)
+		}
+		if err != nil {
+			fullnode.Pbft.Loger.Println("节点", fullnode.NodeID, "拒绝区块", block.Height, "中的交易", tx.TxID, ":", err)
+			return ""
+		}
+	}
+	//前一个区块已上链时，与同步区块一样检查哈希链接、nonce和状态根；
+	//否则前一个区块可能还在共识中，只能检查nonce没有被已上链的交易使用，其余检查在上链时进行
+	fullnode.chainmutex.Lock()
+	if block.Height == fullnode.Blockchain.CurrentHeight {
+		err = fullnode.Blockchain.ValidateProposal(block)
+	} else {
+		err = fullnode.Blockchain.State.CheckPendingNonces(block.Transactions)
+	}
+	fullnode.chainmutex.Unlock()
+	if err != nil {
+		fullnode.Pbft.Loger.Println("节点", fullnode.NodeID, "拒绝区块", block.Height, ":", err)
+		return ""
+	}
+	return digest
+}
+
+// GetNonce 发送者下一笔交易应使用的nonce，包括交易池中尚未上链的请求
+func (fullnode *Fullnode) GetNonce(sender string) int {
+	return fullnode.Mempool.NextNonce(sender)
+}
+
+// 发送者已上链的下一个nonce
+func (fullnode *Fullnode) committedNonce(sender string) int {
+	fullnode.chainmutex.Lock()
+	defer fullnode.chainmutex.Unlock()
+	return fullnode.Blockchain.State.GetNonce(sender)
+}
+
+// 请求进入交易池前的验证：除了请求本身合法，还必须能放进一个区块
+func (fullnode *Fullnode) admitRequest(r *storage.Request) error {
+	if len(r.Serialize()) > fullnode.Seal.MaxBytes {
+		return ErrRequestTooLarge
+	}
+	return fullnode.validateRequest(r)
+}
+
+// 请求本身的验证：主题数量、费用和客户端签名，用于进入交易池和验证区块中的交易
+func (fullnode *Fullnode) validateRequest(r *storage.Request) error {
+	//主题过多会使区块的布隆过滤器失去过滤效果
+	if len(r.Topics) > storage.MaxRequestTopics {
+		return storage.ErrRequestTopics
+	}
+	if r.Fee < 0 {
+		return storage.ErrRequestFee
+	}
+	return fullnode.VerifyRequest(r)
+}
+
+// HandleNonceRequest 处理客户端的nonce查询
+func (fullnode *Fullnode) HandleNonceRequest(content []byte) {
+	req, err := storage.UnmarshalNonceRequestProto(content)
+	if err != nil {
+		fullnode.Pbft.Loger.Println("节点", fullnode.NodeID, "无法解析nonce查询:", err)
+		return
+	}
+	addr, ok := fullnode.P2P.GetAddr(req.NodeID)
+	if !ok {
+		return
+	}
+	resp := storage.NonceResponse{NodeID: fullnode.NodeID, Sender: req.Sender, Nonce: fullnode.GetNonce(req.Sender)}
+	fullnode.P2P.SendRequest(storage.PackMessage(storage.MsgNonce, fullnode.NodeID, resp.MarshalProto()), addr)
+}
+
 // 处理接收到的请求
 func (fullnode *Fullnode) HandleRequest(b []byte) {
-	logFile, err := os.OpenFile("./logout/"+fullnode.NodeID+"_log", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	currentTime := time.Now().Format("2006-01-02 15:04:05")
+	env, err := storage.UnpackMessage(b)
 	if err != nil {
-		fmt.Println("open log file failed, err:", err)
+		fullnode.Pbft.Loger.Println(currentTime, fullnode.GetNodeID(), "recieves invalid message:", err)
+		return
+	}
+	r, err := storage.UnmarshalRequestProto(env.Payload)
+	if err != nil {
+		fullnode.Pbft.Loger.Println(currentTime, fullnode.GetNodeID(), "recieves invalid", env.Type, "from", env.Sender, ":", err)
+		return
+	}
+	// fmt.Println(currentTime, fullnode.GetNodeID()+" recieves", env.Type, r.ID)
+	fullnode.Pbft.Loger.Println(currentTime, fullnode.GetNodeID(), "recieves", env.Type, "msgid:", r.ID, "from:", env.Sender, "content:", string(r.Content))
+	//验证通过的请求放入交易池
+	if err := fullnode.Mempool.Add(r); err != nil {
+		fullnode.Pbft.Loger.Println(currentTime, fullnode.GetNodeID(), "rejects", env.Type, "msgid:", r.ID, "nonce:", r.Nonce, "from:", env.Sender, ":", err)
 	}
-	defer logFile.Close()
-	// 创建日志对象
-	fullnode.Pbft.Loger = log.New(logFile, "", log.Lshortfile)
-	currentTime := time.Now().Format("2006-01-02 15:04:05")
-	// fmt.Println(currentTime, fullnode.GetNodeID()+" recieves", string(b))
-	fullnode.Pbft.Loger.Println(currentTime, fullnode.GetNodeID(), "recieves", string(b))
-	//将接收到的消息放入消息池
-	fullnode.mpmutex.Lock()
-	fullnode.MessagePool = append(fullnode.MessagePool, b)
-	fullnode.mpmutex.Unlock()
 }
 
-// 主节点启动共识例程
+// 主节点启动共识例程，节点关闭后返回
 func (fullnode *Fullnode) RunConsensus() {
-	go fullnode.AddToChain() //异步将区块上链
-	for {
+	defer fullnode.routines.Done()
+	for !fullnode.closed() {
 		//如果是主节点,则打包区块
 		if fullnode.NodeID == fullnode.P2P.GetPrimaryID() {
-			var hash []byte
-			if fullnode.Blockchain.GetLastBlock() == nil {
-				hash = []byte{}
-			} else {
-				hash = fullnode.Blockchain.GetLastBlock().Hash
+			//窗口已满时等待前面的区块上链，避免打包速度超过共识速度
+			if !fullnode.waitWindow() {
+				return
+			}
+			//新区块链接到上一个打包的区块，而不是链上最新的区块（上一个区块可能还在共识中）
+			newblock := fullnode.PackBlock(fullnode.packedNumber, fullnode.packedHash)
+			if newblock == nil {
+				return
 			}
-			newblock := fullnode.PackBlock(fullnode.packedNumber, hash)
 			// fmt.Println("主节点打包区块")
 			// fmt.Println("区块高度：", newblock.Height, ", 区块中交易数量：", len(newblock.Transactions))
 			fullnode.packedNumber++
+			fullnode.packedHash = newblock.Hash
 			//将区块转换为消息
 			request := fullnode.BlockToRequest(newblock)
 			//对刚打包的区块进行共识
 			fullnode.Pbft.HandleRequest(request)
+		} else {
+			select {
+			case <-time.After(PrimaryCheckInterval):
+			case <-fullnode.quit:
+			}
 		}
 	}
 }
 
-// 打包区块
+// 按封装策略等待并打包区块，节点关闭时返回nil
 func (fullnode *Fullnode) PackBlock(height int, prevhash []byte) *blockchain.Block {
-	// 在循环中判断 MessagePool 是否为空
+	var heartbeat <-chan time.Time
+	if fullnode.Seal.Heartbeat > 0 {
+		timer := time.NewTimer(fullnode.Seal.Heartbeat)
+		defer timer.Stop()
+		heartbeat = timer.C
+	}
 	for {
-		if len(fullnode.MessagePool) != 0 {
-			time.Sleep(time.Second)
-			// 从消息池中取出消息
-			fullnode.mpmutex.Lock()
-			transactions := make([]*blockchain.Transaction, 0)
-			for i := 0; i < fullnode.BatchSize; i++ {
-				if len(fullnode.MessagePool) != 0 {
-					message := fullnode.MessagePool[0]
-					fullnode.MessagePool = fullnode.MessagePool[1:]
-					// 解析消息
-					_, content := storage.SplitMessage(message)
-					// 将消息内容转换为交易
-					tx := blockchain.NewTransaction(i, content)
-					transactions = append(transactions, tx)
-				} else {
-					break
-				}
-			}
-			fullnode.mpmutex.Unlock()
-			return blockchain.NewBlock(height, prevhash, transactions)
+		ready, empty := fullnode.waitSeal(heartbeat)
+		if !ready {
+			return nil
+		}
+		//状态根为已打包的所有区块以及本区块应用之后的状态
+		if fullnode.packState == nil {
+			fullnode.chainmutex.Lock()
+			fullnode.packState = fullnode.Blockchain.State.Clone()
+			fullnode.chainmutex.Unlock()
+		}
+		transactions := make([]*blockchain.Transaction, 0)
+		if !empty {
+			transactions = fullnode.packTransactions()
+		}
+		//取出的请求都已失效时继续等待，除非是心跳区块
+		if len(transactions) == 0 && !empty {
+			continue
 		}
+		fullnode.packState.ApplyTransactions(transactions)
+		return blockchain.NewBlock(height, prevhash, fullnode.packState.GetRootHash(), fullnode.NodeID, transactions)
 	}
 }
 
-// 一个同步线程：将共识后的区块上链
+// 从交易池中取出请求并转换为交易，丢弃nonce与已打包的状态不衔接的请求
+func (fullnode *Fullnode) packTransactions() []*blockchain.Transaction {
+	transactions := make([]*blockchain.Transaction, 0)
+	for _, message := range fullnode.Mempool.Pack(fullnode.Seal.MaxTxs, fullnode.Seal.MaxBytes) {
+		// 将消息内容转换为交易
+		tx := blockchain.NewTransaction(len(transactions), message)
+		//nonce与已打包的状态不衔接的交易（已被使用或前面有缺失）不能打包
+		if err := fullnode.packState.CheckNonces(append(transactions, tx)); err != nil {
+			fullnode.Pbft.Loger.Println("节点", fullnode.NodeID, "丢弃发送者", tx.Sender, "nonce为", tx.Nonce, "的交易:", err)
+			fullnode.Mempool.Remove(tx)
+			continue
+		}
+		transactions = append(transactions, tx)
+	}
+	return transactions
+}
+
+// 一个同步线程：依次将共识后的区块上链，节点关闭后返回
 func (fullnode *Fullnode) AddToChain() {
+	defer fullnode.routines.Done()
 	for {
-		//判断是否有共识后的区块
-		if fullnode.Pbft.SequenceIDL > fullnode.Blockchain.CurrentHeight {
-			for i := fullnode.Blockchain.CurrentHeight; i < fullnode.Pbft.SequenceIDL; i++ {
-				//将共识后的区块上链
-				fullnode.Pbft.Loger.Println("节点", fullnode.NodeID, "将共识后的区块", i, "上链")
-				request := fullnode.Pbft.MessagePool[fullnode.Pbft.MessageToCommit[i].Digest]
-				block := fullnode.RequestToBlock(request)
-				//回复block中的所有客户端
-				fullnode.ReplyClient(block)
-				blockHeight := fullnode.Blockchain.AddBlock(block)
-				fullnode.Pbft.Loger.Println("节点", fullnode.NodeID, "共识后的区块", i, "上链成功,当前区块链高度为", blockHeight)
-				// fmt.Println("节点", fullnode.NodeID, "共识后的区块", i, "上链成功,当前区块链高度为", blockHeight)
-				// fullnode.PrintBlockInfor(i)
+		select {
+		case committed := <-fullnode.Pbft.Committed():
+			if err := fullnode.commitToChain(committed, true); err != nil {
+				fullnode.Pbft.Loger.Println("节点", fullnode.NodeID, "拒绝共识后的区块:", err)
 			}
+		case <-fullnode.quit:
+			return
 		}
 	}
 }
 
-// 将区块转换为Request消息（request序列化后再添加消息类别）
-func (fullnode *Fullnode) BlockToRequest(block *blockchain.Block) []byte {
-	//将区块序列化
-	seblock, _ := block.SerializeBlock()
-	r := new(storage.Request)
-	r.Timestamp = time.Now().UnixNano()
-	r.ClientAddr = "" //总的区块不包含客户端，每个交易包含客户端
-	r.Message.ID = block.Height
-	//消息内容就是用户的输入
-	r.Message.Content = seblock
-	//将请求序列化
-	serequest, err := json.Marshal(r)
+// 等待流水线窗口出现空位：已打包但尚未上链的区块数量小于Window，节点关闭时返回false
+func (fullnode *Fullnode) waitWindow() bool {
+	for {
+		fullnode.chainmutex.Lock()
+		fullnode.rollbackPacking()
+		inflight := fullnode.packedNumber - fullnode.Blockchain.CurrentHeight
+		fullnode.chainmutex.Unlock()
+		if inflight < fullnode.Window {
+			return true
+		}
+		select {
+		case <-fullnode.windowCh:
+		case <-fullnode.quit:
+			return false
+		}
+	}
+}
+
+// 共识后的区块被拒绝：之后已打包的区块都无法上链，通知打包例程从链上最新的区块重新打包，调用时持有chainmutex
+func (fullnode *Fullnode) rejectCommitted() {
+	fullnode.packRollback = true
+	fullnode.notifyWindow()
+}
+
+// 已打包的区块不会再上链时（共识后的区块被拒绝，或者区块同步在同一高度上链了其他区块），
+// 像从预写日志恢复时一样从链上最新的区块继续打包，其中的请求重新等待打包，只由打包例程调用，调用时持有chainmutex
+func (fullnode *Fullnode) rollbackPacking() {
+	stale := fullnode.packedNumber < fullnode.Blockchain.CurrentHeight ||
+		(fullnode.packedNumber == fullnode.Blockchain.CurrentHeight && !bytes.Equal(fullnode.packedHash, fullnode.Blockchain.LastHash))
+	if !fullnode.packRollback && !stale {
+		return
+	}
+	fullnode.Pbft.Loger.Println("节点", fullnode.NodeID, "已打包到高度", fullnode.packedNumber, "的区块不会上链，从高度", fullnode.Blockchain.CurrentHeight, "重新打包")
+	fullnode.packRollback = false
+	fullnode.packedNumber = fullnode.Blockchain.CurrentHeight
+	fullnode.packedHash = fullnode.Blockchain.LastHash
+	fullnode.packState = nil
+	fullnode.Mempool.ResetPacked()
+}
+
+// 有区块上链后通知等待窗口的打包例程
+func (fullnode *Fullnode) notifyWindow() {
+	select {
+	case fullnode.windowCh <- struct{}{}:
+	default:
+	}
+}
+
+// 将已完成共识的区块上链，reply表示是否回复区块中的客户端
+// 区块必须通过与区块同步相同的验证（哈希链接、交易树根、提交证书、nonce和状态根），
+// 验证失败说明本地状态与提交该区块的节点不一致，区块不上链，返回错误并立即向对等节点请求区块同步
+func (fullnode *Fullnode) commitToChain(committed *consensus.CommittedMessage, reply bool) error {
+	fullnode.chainmutex.Lock()
+	i := committed.SequenceID
+	//区块同步可能已经将该区块上链
+	if i < fullnode.Blockchain.CurrentHeight {
+		fullnode.chainmutex.Unlock()
+		return nil
+	}
+	if i > fullnode.Blockchain.CurrentHeight {
+		//之前的区块由区块同步推进了低水位线，等待区块同步将其上链
+		fullnode.Pbft.Loger.Println("节点", fullnode.NodeID, "共识后的区块", i, "高于当前高度", fullnode.Blockchain.CurrentHeight, ",等待区块同步")
+		fullnode.chainmutex.Unlock()
+		return nil
+	}
+	//将共识后的区块上链
+	fullnode.Pbft.Loger.Println("节点", fullnode.NodeID, "将共识后的区块", i, "上链")
+	block := fullnode.RequestToBlock(committed.Request)
+	if block == nil {
+		fullnode.rejectCommitted()
+		fullnode.chainmutex.Unlock()
+		fullnode.RequestSync()
+		return fmt.Errorf("%w %d: malformed block", ErrCommittedBlock, i)
+	}
+	//保存主节点签名和提交证书，使同步该区块的节点可以验证其已被提交
+	block.Cert = committed.Cert
+	block.ProposerSign = block.Cert.ProposerSign
+	blockHeight, err := fullnode.Blockchain.ImportBlock(block, fullnode.P2P.GetValidatorPubkeys())
 	if err != nil {
-		log.Panic(err)
+		fullnode.rejectCommitted()
+		fullnode.chainmutex.Unlock()
+		fullnode.RequestSync()
+		return fmt.Errorf("%w %d: %v", ErrCommittedBlock, i, err)
+	}
+	fullnode.Pbft.Loger.Println("节点", fullnode.NodeID, "共识后的区块", i, "上链成功,当前区块链高度为", blockHeight)
+	fullnode.blockAdded(block)
+	fullnode.TakeSnapshot(block)
+	fullnode.chainmutex.Unlock()
+	//区块持久化之后才回复block中的所有客户端
+	if reply {
+		fullnode.ReplyClient(block)
+	}
+	//区块已经持久化，预写日志中对应的消息不再需要
+	//压缩交给共识的事件循环，事件循环可能正在等待上链例程接收已提交的区块，因此在新的协程中提交
+	if blockHeight%WALCompactInterval == 0 {
+		go fullnode.Pbft.CompactWAL(blockHeight)
+	}
+	return nil
+}
+
+// Height 当前区块链高度
+func (fullnode *Fullnode) Height() int {
+	fullnode.chainmutex.Lock()
+	defer fullnode.chainmutex.Unlock()
+	return fullnode.Blockchain.CurrentHeight
+}
+
+// 区块上链后从交易池中移除其中的请求，并通知等待流水线窗口的打包例程，调用时持有chainmutex
+// 其他节点提出的区块上链后，本节点已打包的区块不会再上链，其中的请求重新等待打包
+func (fullnode *Fullnode) blockAdded(block *blockchain.Block) {
+	fullnode.Mempool.RemoveCommitted(block, fullnode.Blockchain.State)
+	if block.Proposer != fullnode.NodeID {
+		fullnode.Mempool.ResetPacked()
 	}
-	//添加消息类别
-	request := storage.JointMessage(storage.CRequest, serequest)
+	fullnode.notifyWindow()
+}
+
+// 从预写日志恢复后，主节点从最后一个发出过PrePrepare的区块之后继续打包，避免对同一序号提出不同的区块
+func (fullnode *Fullnode) recoverPacking() {
+	fullnode.packedNumber = fullnode.Blockchain.CurrentHeight
+	fullnode.packedHash = fullnode.Blockchain.LastHash
+	state := fullnode.Blockchain.State.Clone()
+	for {
+		request := fullnode.Pbft.GetProposal(fullnode.packedNumber)
+		if request == nil {
+			break
+		}
+		block := fullnode.RequestToBlock(request)
+		if block == nil || !bytes.Equal(block.PrevBlockHash, fullnode.packedHash) {
+			break
+		}
+		state.ApplyBlock(block)
+		fullnode.packedNumber++
+		fullnode.packedHash = block.Hash
+	}
+	if fullnode.packedNumber > fullnode.Blockchain.CurrentHeight {
+		fullnode.packState = state
+	}
+}
+
+// 将区块转换为Request消息（request编码后装入消息信封）
+func (fullnode *Fullnode) BlockToRequest(block *blockchain.Block) []byte {
+	//区块确定性地转换为请求，使其他节点可以由区块重新计算共识摘要
+	r := blockchain.BlockToRequest(block)
+	//将请求编码后装入消息信封
+	request := storage.PackMessage(storage.MsgRequest, fullnode.NodeID, r.MarshalProto())
 	return request
 }
 
@@ -224,14 +623,72 @@ func (fullnode *Fullnode) PrintBlockInfor(blockNo int) {
 	fmt.Println("区块高度：", block.Height, ", 区块中交易数量：", len(block.Transactions))
 }
 
+// GetTransaction 根据交易哈希查询链上的交易及其存在证明
+func (fullnode *Fullnode) GetTransaction(txHash []byte) (*blockchain.TxWithProof, error) {
+	fullnode.chainmutex.Lock()
+	defer fullnode.chainmutex.Unlock()
+	return fullnode.Blockchain.GetTxByHash(txHash)
+}
+
+// GetTransactionsBySender 查询某个发送者的所有交易及其存在证明
+func (fullnode *Fullnode) GetTransactionsBySender(sender string) ([]*blockchain.TxWithProof, error) {
+	fullnode.chainmutex.Lock()
+	defer fullnode.chainmutex.Unlock()
+	return fullnode.Blockchain.GetTxsBySender(sender)
+}
+
+// GetTransactionsByRequestID 查询请求ID对应的交易及其存在证明
+func (fullnode *Fullnode) GetTransactionsByRequestID(requestID int) ([]*blockchain.TxWithProof, error) {
+	fullnode.chainmutex.Lock()
+	defer fullnode.chainmutex.Unlock()
+	return fullnode.Blockchain.GetTxsByRequestID(requestID)
+}
+
+// GetAccountAt 查询账户在高度为height的区块上链之后的状态
+func (fullnode *Fullnode) GetAccountAt(sender string, height int) (*blockchain.Account, error) {
+	fullnode.chainmutex.Lock()
+	defer fullnode.chainmutex.Unlock()
+	return fullnode.Blockchain.GetAccountAt(sender, height)
+}
+
+// HandleTxProofRequest 处理轻节点的交易存在证明查询，没有找到交易时返回空证明
+func (fullnode *Fullnode) HandleTxProofRequest(content []byte) {
+	req, err := storage.UnmarshalTxProofRequestProto(content)
+	if err != nil {
+		fullnode.Pbft.Loger.Println("节点", fullnode.NodeID, "无法解析交易证明请求:", err)
+		return
+	}
+	addr, ok := fullnode.P2P.GetAddr(req.NodeID)
+	if !ok {
+		return
+	}
+	resp := storage.TxProofResponse{NodeID: fullnode.NodeID, TxHash: req.TxHash}
+	if txp, err := fullnode.GetTransaction(req.TxHash); err == nil {
+		resp.Proof = txp.Serialize()
+	}
+	fullnode.P2P.SendRequest(storage.PackMessage(storage.MsgTxProof, fullnode.NodeID, resp.MarshalProto()), addr)
+}
+
+// ScanTransactions 在高度[from, to)的区块中按发送者和主题查找交易，先检查区块头的布隆过滤器
+func (fullnode *Fullnode) ScanTransactions(filter *blockchain.TxFilter, from int, to int) ([]*blockchain.TxWithProof, error) {
+	fullnode.chainmutex.Lock()
+	defer fullnode.chainmutex.Unlock()
+	return fullnode.Blockchain.ScanTransactions(filter, from, to)
+}
+
 // 回复客户端
 func (fullnode *Fullnode) ReplyClient(block *blockchain.Block) {
 	for i := 0; i < len(block.Transactions); i++ {
 		tx := block.Transactions[i]
+		r, err := tx.GetRequest()
+		if err != nil {
+			fullnode.Pbft.Loger.Println("节点", fullnode.NodeID, "无法解析交易内容:", err)
+			continue
+		}
 		//回复客户端
-		info := fullnode.NodeID + "节点已将msgid:" + strconv.Itoa(tx.TxID) + "存入区块" + strconv.Itoa(block.Height) + "中,消息内容为：" + string(tx.Content)
-		fullnode.Pbft.Loger.Println("节点", fullnode.NodeID, "正在reply客户端")
-		fullnode.P2P.SendRequest([]byte(info), tx.Sender)
+		reply := storage.Reply{MessageID: r.ID, NodeID: fullnode.NodeID, Result: true, Height: block.Height}
+		fullnode.Pbft.Loger.Println("节点", fullnode.NodeID, "正在reply客户端", tx.Sender, "msgid:", r.ID)
+		fullnode.P2P.SendRequest(storage.PackMessage(storage.MsgReply, fullnode.NodeID, reply.MarshalProto()), tx.Sender)
 		// fmt.Println("节点", fullnode.NodeID, "reply客户端完成:消息存入区块", block.Height, "中,消息内容为：", string(tx.Content))
 	}
 }
@@ -0,0 +1,150 @@
+package nodes
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"simplechain/network"
+	"simplechain/utils"
+)
+
+// 创世文件：记录网络的签名方案以及所有验证者（全节点）和客户端的地址与公钥，
+// 每个节点从同一个创世文件得到其他节点的公钥，不再依赖同一进程中共享的P2P公钥表。
+// 验证者的顺序就是主节点的顺序，第一个验证者为初始主节点。
+//
+//	{
+//	  "scheme": "ed25519",
+//	  "validators": [{"id": "node1", "addr": "127.0.0.1:8001", "public_key": "..."}],
+//	  "clients": [{"id": "client1", "addr": "127.0.0.1:6000", "public_key": "..."}]
+//	}
+
+var (
+	ErrGenesisIdentity  = errors.New("genesis: identity is not listed in the genesis file")
+	ErrIdentityMismatch = errors.New("genesis: local key does not match the published public key")
+)
+
+// GenesisIdentity 创世文件中的一个验证者或客户端
+type GenesisIdentity struct {
+	ID        string `json:"id"`
+	Addr      string `json:"addr"`
+	PublicKey []byte `json:"public_key"` //带类型标记的公钥
+}
+
+// Genesis 网络的创世文件
+type Genesis struct {
+	Scheme     utils.SignatureScheme `json:"scheme"`
+	Validators []GenesisIdentity     `json:"validators"`
+	Clients    []GenesisIdentity     `json:"clients"`
+}
+
+// LoadGenesis 读取并检查创世文件
+func LoadGenesis(path string) (*Genesis, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	genesis := new(Genesis)
+	if err := json.Unmarshal(data, genesis); err != nil {
+		return nil, fmt.Errorf("genesis: %v", err)
+	}
+	if err := genesis.Validate(); err != nil {
+		return nil, err
+	}
+	return genesis, nil
+}
+
+// Save 保存创世文件
+func (genesis *Genesis) Save(path string) error {
+	data, err := json.MarshalIndent(genesis, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0644)
+}
+
+// Validate 检查签名方案、ID是否重复以及每个公钥是否属于网络的签名方案
+func (genesis *Genesis) Validate() error {
+	if _, err := utils.ParseSignatureScheme(string(genesis.Scheme)); err != nil {
+		return err
+	}
+	if len(genesis.Validators) == 0 {
+		return errors.New("genesis: no validators")
+	}
+	seen := make(map[string]bool)
+	for _, identity := range genesis.identities() {
+		if identity.ID == "" || identity.Addr == "" {
+			return fmt.Errorf("genesis: identity %q without id or address", identity.ID)
+		}
+		if seen[identity.ID] {
+			return fmt.Errorf("genesis: duplicate identity %q", identity.ID)
+		}
+		seen[identity.ID] = true
+		if _, err := utils.ParseVerifier(identity.PublicKey); err != nil {
+			return fmt.Errorf("genesis: %s: %w", identity.ID, err)
+		}
+		if scheme, _ := utils.KeyScheme(identity.PublicKey); scheme != genesis.Scheme {
+			return fmt.Errorf("genesis: %s: %w", identity.ID, network.ErrKeyScheme)
+		}
+	}
+	return nil
+}
+
+// Apply 将创世文件中的签名方案、地址和公钥写入P2P网络，第一个验证者成为主节点
+func (genesis *Genesis) Apply(p2p *network.P2P) error {
+	if err := p2p.SetScheme(genesis.Scheme); err != nil {
+		return err
+	}
+	for _, validator := range genesis.Validators {
+		p2p.AddFullNode(validator.ID, validator.Addr)
+		if err := p2p.AddPubKey(validator.ID, validator.PublicKey); err != nil {
+			return err
+		}
+	}
+	for _, client := range genesis.Clients {
+		p2p.AddClient(client.ID, client.Addr)
+		if err := p2p.AddPubKey(client.ID, client.PublicKey); err != nil {
+			return err
+		}
+	}
+	if p2p.GetPrimaryID() == "" {
+		p2p.SetPrimaryNode(genesis.Validators[0].ID)
+	}
+	return nil
+}
+
+// ValidatorPubkeys 验证者ID到公钥的映射，用于验证提交证书
+func (genesis *Genesis) ValidatorPubkeys() map[string][]byte {
+	validators := make(map[string][]byte, len(genesis.Validators))
+	for _, validator := range genesis.Validators {
+		validators[validator.ID] = validator.PublicKey
+	}
+	return validators
+}
+
+// 所有验证者和客户端
+func (genesis *Genesis) identities() []GenesisIdentity {
+	return append(append([]GenesisIdentity{}, genesis.Validators...), genesis.Clients...)
+}
+
+// Contains 创世文件中是否有该ID的验证者或客户端
+func (genesis *Genesis) Contains(id string) bool {
+	for _, identity := range genesis.identities() {
+		if identity.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// 将本地密钥的公钥注册到P2P网络；创世文件已经发布了该ID的公钥时，本地密钥必须与之一致
+func registerIdentity(p2p *network.P2P, id string, signer utils.Signer) error {
+	if published := p2p.GetNodePubkey(id); published != nil {
+		if !bytes.Equal(published, signer.PublicKey()) {
+			return fmt.Errorf("%w: %s", ErrIdentityMismatch, id)
+		}
+		return nil
+	}
+	return p2p.AddPubKey(id, signer.PublicKey())
+}
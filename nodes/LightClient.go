@@ -0,0 +1,311 @@
+package nodes
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"simplechain/blockchain"
+	"simplechain/network"
+	"simplechain/storage"
+	"sync"
+	"time"
+)
+
+// 轻节点只同步带提交证书的区块头，不保存区块体和状态，
+// 通过区块头中的交易树根和全节点提供的默克尔存在证明验证交易已经上链，
+// 因此不需要信任提供数据的全节点，只需要信任验证者集合。
+// 验证者集合来自创世文件，之后只能由已验证的区块头改变，而不是读取任何节点都能注册公钥的P2P公钥表；
+// 目前区块头中没有验证者变更，整条区块头链都用创世文件中的验证者集合验证。
+
+const TxProofTimeout = 2 * time.Second //等待单个全节点返回交易证明的超时时间
+
+var ErrLightHeaderMissing = errors.New("lightclient: header not synced yet")
+var ErrLightProofInvalid = errors.New("lightclient: invalid transaction proof")
+var ErrLightNoGenesis = errors.New("lightclient: genesis validators required")
+
+type LightClient struct {
+	ClientID string       //节点ID
+	Addr     string       //节点网络监听地址
+	P2P      *network.P2P //当前节点所在的P2P网络
+
+	Headers    []*blockchain.CertifiedHeader //已验证的带证书区块头，按高度递增，从创世区块开始
+	Validators map[string][]byte             //当前用于验证提交证书的验证者公钥，初始为创世文件中的验证者
+	mutex      sync.Mutex                    //区块头和验证者集合的互斥锁
+	syncRound  int                           //区块头同步时轮询全节点的计数
+
+	pending  map[string][]chan *storage.TxProofResponse //等待中的交易证明查询，键为交易哈希的十六进制
+	pdmutex  sync.Mutex                                 //等待队列和查询计数的互斥锁
+	queryRnd int                                        //交易证明查询时轮询全节点的计数
+
+	Loger *log.Logger //日志
+}
+
+// NewLightClient 创建轻节点，提交证书用创世文件genesis中的验证者公钥验证，
+// 日志写入dataDir下的LogDir目录（dataDir与NodeConfig.DataDir相同，为空时使用当前目录）
+func NewLightClient(clientID string, addr string, p2p *network.P2P, genesis *Genesis, dataDir string) (*LightClient, error) {
+	if genesis == nil {
+		return nil, ErrLightNoGenesis
+	}
+	// 创建日志对象
+	if err := os.MkdirAll(filepath.Join(dataDir, LogDir), 0755); err != nil {
+		return nil, err
+	}
+	logFile, err := os.OpenFile(filepath.Join(dataDir, LogDir, clientID+"_log"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	p2p.AddClient(clientID, addr) //将当前节点注册入P2P网络，全节点据此回复
+	lc := &LightClient{
+		ClientID:   clientID,
+		Addr:       addr,
+		P2P:        p2p,
+		Headers:    make([]*blockchain.CertifiedHeader, 0),
+		Validators: genesis.ValidatorPubkeys(),
+		pending:    make(map[string][]chan *storage.TxProofResponse),
+		Loger:      log.New(logFile, "", log.Lshortfile),
+	}
+	go lc.CreateLightClientP2PListen() //启动网络监听
+	go lc.RunSync()                    //开启区块头同步
+	return lc, nil
+}
+
+// 为轻节点创建监听器并持续监听处理消息
+func (lc *LightClient) CreateLightClientP2PListen() {
+	listen, err := net.Listen("tcp", lc.Addr)
+	if err != nil {
+		log.Panic(err)
+	}
+	lc.Loger.Println("轻节点", lc.ClientID, "开启P2P监听,地址：", lc.Addr)
+	defer listen.Close()
+
+	for {
+		conn, err := listen.Accept()
+		if err != nil {
+			log.Panic(err)
+		}
+		b, err := io.ReadAll(conn)
+		if err != nil {
+			log.Panic(err)
+		}
+		lc.HandleRequest(b)
+	}
+}
+
+// 处理接收到的消息
+func (lc *LightClient) HandleRequest(b []byte) {
+	env, err := storage.UnpackMessage(b)
+	if err != nil {
+		lc.Loger.Println(lc.ClientID, "recieves invalid message:", err)
+		return
+	}
+	switch env.Type {
+	case storage.MsgSyncResp:
+		lc.HandleSyncResponse(env.Payload)
+	case storage.MsgTxProof:
+		lc.HandleTxProof(env.Payload)
+	default:
+		lc.Loger.Println(lc.ClientID, "ignores", env.Type, "from", env.Sender)
+	}
+}
+
+// Height 已验证的区块头高度（下一个待同步的区块头高度）
+func (lc *LightClient) Height() int {
+	lc.mutex.Lock()
+	defer lc.mutex.Unlock()
+	return len(lc.Headers)
+}
+
+// GetHeader 获取已验证的带证书区块头，尚未同步时返回nil
+func (lc *LightClient) GetHeader(height int) *blockchain.CertifiedHeader {
+	lc.mutex.Lock()
+	defer lc.mutex.Unlock()
+	if height < 0 || height >= len(lc.Headers) {
+		return nil
+	}
+	return lc.Headers[height]
+}
+
+// RunSync 区块头同步例程：定期请求本地缺少的区块头
+func (lc *LightClient) RunSync() {
+	ticker := time.NewTicker(SyncInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		lc.RequestHeaders()
+	}
+}
+
+// 按ID排序的全节点列表
+func (lc *LightClient) peers() []string {
+	return lc.P2P.GetNodeIDs()
+}
+
+// RequestHeaders 轮流向一个全节点请求从本地高度开始的带证书区块头
+func (lc *LightClient) RequestHeaders() {
+	peers := lc.peers()
+	if len(peers) == 0 {
+		return
+	}
+	peer := peers[lc.syncRound%len(peers)]
+	lc.syncRound++
+	lc.requestHeadersFrom(peer, lc.Height())
+}
+
+func (lc *LightClient) requestHeadersFrom(peer string, from int) {
+	addr, ok := lc.P2P.GetNodeAddr(peer)
+	if !ok {
+		return
+	}
+	req := storage.SyncRequest{NodeID: lc.ClientID, FromHeight: from, HeadersOnly: true}
+	lc.P2P.SendRequest(storage.PackMessage(storage.MsgSyncReq, lc.ClientID, req.MarshalProto()), addr)
+}
+
+// HandleSyncResponse 验证区块头的哈希链接、主节点签名和提交证书后将其加入本地区块头链
+func (lc *LightClient) HandleSyncResponse(content []byte) {
+	resp, err := storage.UnmarshalSyncResponseProto(content)
+	if err != nil {
+		lc.Loger.Println("轻节点", lc.ClientID, "无法解析区块头同步响应:", err)
+		return
+	}
+	lc.mutex.Lock()
+	imported := 0
+	for _, seheader := range resp.Headers {
+		header, err := blockchain.DeserializeCertifiedHeader(seheader)
+		if err != nil {
+			lc.Loger.Println("轻节点", lc.ClientID, "无法解析节点", resp.NodeID, "同步的区块头:", err)
+			break
+		}
+		//本地已经有的区块头直接跳过
+		if header.Height < len(lc.Headers) {
+			continue
+		}
+		if err := lc.checkHeader(header); err != nil {
+			lc.Loger.Println("轻节点", lc.ClientID, "拒绝节点", resp.NodeID, "同步的区块头", header.Height, ":", err)
+			break
+		}
+		lc.Headers = append(lc.Headers, header)
+		imported++
+	}
+	height := len(lc.Headers)
+	lc.mutex.Unlock()
+	if imported > 0 {
+		lc.Loger.Println("轻节点", lc.ClientID, "从节点", resp.NodeID, "同步了", imported, "个区块头,当前高度为", height)
+	}
+	//对方还有更多区块头则继续请求
+	if imported > 0 && resp.Height > height {
+		lc.requestHeadersFrom(resp.NodeID, height)
+	}
+}
+
+// 检查区块头紧接在本地区块头链之后，且提交证书由当前验证者集合的法定数量签名，调用时持有mutex
+func (lc *LightClient) checkHeader(header *blockchain.CertifiedHeader) error {
+	var lastHash []byte
+	if len(lc.Headers) > 0 {
+		lastHash = lc.Headers[len(lc.Headers)-1].ComputeHash()
+	}
+	if header.Height != len(lc.Headers) || !bytes.Equal(header.PrevBlockHash, lastHash) {
+		return blockchain.ErrBlockLink
+	}
+	return header.Verify(lc.Validators)
+}
+
+// HandleTxProof 将全节点返回的交易证明交给等待中的查询
+func (lc *LightClient) HandleTxProof(content []byte) {
+	resp, err := storage.UnmarshalTxProofResponseProto(content)
+	if err != nil {
+		lc.Loger.Println("轻节点", lc.ClientID, "无法解析交易证明:", err)
+		return
+	}
+	key := hex.EncodeToString(resp.TxHash)
+	lc.pdmutex.Lock()
+	waiters := lc.pending[key]
+	delete(lc.pending, key)
+	lc.pdmutex.Unlock()
+	for _, ch := range waiters {
+		ch <- resp
+	}
+}
+
+// 向全节点peer请求交易证明并等待响应，超时返回nil
+func (lc *LightClient) queryTxProof(peer string, txHash []byte) *storage.TxProofResponse {
+	addr, ok := lc.P2P.GetNodeAddr(peer)
+	if !ok {
+		return nil
+	}
+	key := hex.EncodeToString(txHash)
+	ch := make(chan *storage.TxProofResponse, 1)
+	lc.pdmutex.Lock()
+	lc.pending[key] = append(lc.pending[key], ch)
+	lc.pdmutex.Unlock()
+	req := storage.TxProofRequest{NodeID: lc.ClientID, TxHash: txHash}
+	lc.P2P.SendRequest(storage.PackMessage(storage.MsgTxProofReq, lc.ClientID, req.MarshalProto()), addr)
+	select {
+	case resp := <-ch:
+		return resp
+	case <-time.After(TxProofTimeout):
+		//超时后移除自己，避免迟到的响应阻塞
+		lc.pdmutex.Lock()
+		waiters := lc.pending[key]
+		for i, w := range waiters {
+			if w == ch {
+				lc.pending[key] = append(waiters[:i], waiters[i+1:]...)
+				break
+			}
+		}
+		if len(lc.pending[key]) == 0 {
+			delete(lc.pending, key)
+		}
+		lc.pdmutex.Unlock()
+		return nil
+	}
+}
+
+// VerifyTxProof 验证交易证明中的交易树根与本地已验证区块头一致，且交易哈希能够由存在证明推出该交易树根
+func (lc *LightClient) VerifyTxProof(txp *blockchain.TxWithProof) error {
+	header := lc.GetHeader(txp.Height)
+	if header == nil {
+		return ErrLightHeaderMissing
+	}
+	if !bytes.Equal(txp.TxMHTRoot, header.TxMHTRoot) || !txp.Verify() {
+		return ErrLightProofInvalid
+	}
+	return nil
+}
+
+// GetTransaction 依次向全节点查询交易及其存在证明，返回第一个通过验证的结果
+// 所有全节点都没有该交易时返回blockchain.ErrTxNotFound，交易所在区块的区块头尚未同步时返回ErrLightHeaderMissing
+func (lc *LightClient) GetTransaction(txHash []byte) (*blockchain.TxWithProof, error) {
+	peers := lc.peers()
+	if len(peers) == 0 {
+		return nil, blockchain.ErrTxNotFound
+	}
+	lc.pdmutex.Lock()
+	start := lc.queryRnd
+	lc.queryRnd++
+	lc.pdmutex.Unlock()
+	lastErr := blockchain.ErrTxNotFound
+	for i := range peers {
+		peer := peers[(start+i)%len(peers)]
+		resp := lc.queryTxProof(peer, txHash)
+		if resp == nil || len(resp.Proof) == 0 {
+			continue
+		}
+		txp, err := blockchain.DeserializeTxWithProof(resp.Proof)
+		if err != nil || !bytes.Equal(txp.Transaction.TxHash, txHash) {
+			lc.Loger.Println("轻节点", lc.ClientID, "收到节点", peer, "的无效交易证明")
+			lastErr = ErrLightProofInvalid
+			continue
+		}
+		if err := lc.VerifyTxProof(txp); err != nil {
+			lc.Loger.Println("轻节点", lc.ClientID, "无法验证节点", peer, "的交易证明:", err)
+			lastErr = err
+			continue
+		}
+		return txp, nil
+	}
+	return nil, lastErr
+}
@@ -0,0 +1,303 @@
+package nodes
+
+import (
+	"encoding/hex"
+	"errors"
+	"simplechain/blockchain"
+	"simplechain/storage"
+	"sync"
+)
+
+// 交易池：主节点保存已通过验证、尚未上链的客户端请求。
+// 请求按摘要去重，每个发送者的请求按nonce排序且连续；打包进区块的请求只做标记，
+// 直到包含它们的区块上链才移除，这样其他主节点提出的区块上链后，本节点打包过但未上链的请求可以重新打包。
+// 交易池满时从排队请求最多的发送者末尾淘汰，使单个发送者无法占满交易池。
+
+const DefaultMempoolCapacity = 4096 //交易池默认容量
+
+var ErrMempoolFull = errors.New("mempool: full")
+var ErrMempoolDuplicate = errors.New("mempool: duplicate request")
+
+type mempoolEntry struct {
+	digest  string           //请求摘要（即交易哈希的十六进制）
+	request *storage.Request //请求
+	data    []byte           //请求的规范化编码，即交易内容
+	seq     uint64           //进入交易池的顺序
+	packed  bool             //是否已打包进尚未上链的区块
+}
+
+type Mempool struct {
+	Capacity int            //最多容纳的请求数量
+	Ordering OrderingPolicy //打包时的排序策略
+
+	entries map[string]*mempoolEntry   //摘要对应的请求
+	senders map[string][]*mempoolEntry //每个发送者的请求，按nonce递增
+	seq     uint64                     //下一个进入交易池的序号
+	pending int                        //尚未打包的请求数量
+	pbytes  int                        //尚未打包的请求的总字节数
+	notify  chan struct{}              //有请求变为可打包时发出通知
+	mutex   sync.Mutex
+
+	nonceOf  func(sender string) int      //发送者已上链的下一个nonce
+	validate func(*storage.Request) error //准入验证，如签名检查
+}
+
+// NewMempool 创建交易池，nonceOf返回发送者已上链的下一个nonce，validate为准入验证（可以为nil）
+// 两个函数都在交易池的锁之外调用
+func NewMempool(capacity int, nonceOf func(sender string) int, validate func(*storage.Request) error) *Mempool {
+	if capacity < 1 {
+		capacity = DefaultMempoolCapacity
+	}
+	return &Mempool{
+		Capacity: capacity,
+		Ordering: FIFOOrdering{},
+		entries:  make(map[string]*mempoolEntry),
+		senders:  make(map[string][]*mempoolEntry),
+		notify:   make(chan struct{}, 1),
+		nonceOf:  nonceOf,
+		validate: validate,
+	}
+}
+
+// Add 验证请求后将其加入交易池，请求的nonce必须紧接在发送者已上链和已在交易池中的请求之后
+func (mp *Mempool) Add(r *storage.Request) error {
+	if mp.validate != nil {
+		if err := mp.validate(r); err != nil {
+			return err
+		}
+	}
+	committed := mp.nonceOf(r.ClientAddr)
+	data := r.Serialize()
+	digest := storage.GetDigest(*r)
+	mp.mutex.Lock()
+	defer mp.mutex.Unlock()
+	if _, ok := mp.entries[digest]; ok {
+		return ErrMempoolDuplicate
+	}
+	next := mp.nextNonce(r.ClientAddr, committed)
+	if r.Nonce < next {
+		return blockchain.ErrNonceReused
+	}
+	if r.Nonce > next {
+		return blockchain.ErrNonceGap
+	}
+	if len(mp.entries) >= mp.Capacity && !mp.evictFor(r.ClientAddr) {
+		return ErrMempoolFull
+	}
+	entry := &mempoolEntry{digest, r, data, mp.seq, false}
+	mp.seq++
+	mp.pending++
+	mp.pbytes += len(data)
+	mp.entries[digest] = entry
+	mp.senders[r.ClientAddr] = append(mp.senders[r.ClientAddr], entry)
+	mp.signal()
+	return nil
+}
+
+// 通知等待打包的例程，已有未处理的通知时不再重复发送，调用时持有mutex
+func (mp *Mempool) signal() {
+	select {
+	case mp.notify <- struct{}{}:
+	default:
+	}
+}
+
+// Notify 有请求变为可打包时收到通知，收到通知后应重新检查Pending，多次变化可能只对应一次通知
+func (mp *Mempool) Notify() <-chan struct{} {
+	return mp.notify
+}
+
+// 发送者下一个可以进入交易池的nonce，调用时持有mutex
+func (mp *Mempool) nextNonce(sender string, committed int) int {
+	queue := mp.senders[sender]
+	if len(queue) > 0 && queue[len(queue)-1].request.Nonce+1 > committed {
+		return queue[len(queue)-1].request.Nonce + 1
+	}
+	return committed
+}
+
+// 交易池已满时为sender的新请求腾出位置：淘汰未打包请求最多的其他发送者的最后一个请求，调用时持有mutex
+func (mp *Mempool) evictFor(sender string) bool {
+	victim, most := "", 0
+	for s, queue := range mp.senders {
+		unpacked := 0
+		for _, entry := range queue {
+			if !entry.packed {
+				unpacked++
+			}
+		}
+		if unpacked > most || (unpacked == most && s < victim) {
+			victim, most = s, unpacked
+		}
+	}
+	//新请求的发送者加入后仍是最多的，淘汰它自己的请求没有意义
+	ownQueue := 0
+	for _, entry := range mp.senders[sender] {
+		if !entry.packed {
+			ownQueue++
+		}
+	}
+	if most == 0 || victim == sender || ownQueue+1 >= most {
+		return false
+	}
+	queue := mp.senders[victim]
+	mp.removeEntry(queue[len(queue)-1])
+	return true
+}
+
+// 从交易池中移除请求，调用时持有mutex
+func (mp *Mempool) removeEntry(entry *mempoolEntry) {
+	delete(mp.entries, entry.digest)
+	if !entry.packed {
+		mp.pending--
+		mp.pbytes -= len(entry.data)
+	}
+	sender := entry.request.ClientAddr
+	queue := mp.senders[sender]
+	for i, e := range queue {
+		if e == entry {
+			queue = append(queue[:i], queue[i+1:]...)
+			break
+		}
+	}
+	if len(queue) == 0 {
+		delete(mp.senders, sender)
+	} else {
+		mp.senders[sender] = queue
+	}
+}
+
+// Pack 按排序策略取出最多maxTxs个、总字节数不超过maxBytes的未打包请求并标记为已打包，每个发送者的请求保持nonce顺序
+// 排在最前的请求放不下时停止，不会跳过它打包后面更小的请求
+func (mp *Mempool) Pack(maxTxs int, maxBytes int) [][]byte {
+	mp.mutex.Lock()
+	defer mp.mutex.Unlock()
+	//每个发送者只有第一个未打包的请求可以打包
+	heads := make([]*mempoolEntry, 0, len(mp.senders))
+	for _, queue := range mp.senders {
+		for _, entry := range queue {
+			if !entry.packed {
+				heads = append(heads, entry)
+				break
+			}
+		}
+	}
+	rounds := make(map[string]int)
+	candidate := func(entry *mempoolEntry) *PackCandidate {
+		sender := entry.request.ClientAddr
+		return &PackCandidate{sender, entry.request.Fee, entry.seq, rounds[sender]}
+	}
+	packed := make([][]byte, 0, maxTxs)
+	size := 0
+	for len(packed) < maxTxs && len(heads) > 0 {
+		best := 0
+		for i := 1; i < len(heads); i++ {
+			if mp.Ordering.Less(candidate(heads[i]), candidate(heads[best])) {
+				best = i
+			}
+		}
+		entry := heads[best]
+		if size+len(entry.data) > maxBytes {
+			break
+		}
+		size += len(entry.data)
+		heads[best] = heads[len(heads)-1]
+		heads = heads[:len(heads)-1]
+		entry.packed = true
+		mp.pending--
+		mp.pbytes -= len(entry.data)
+		packed = append(packed, entry.data)
+		rounds[entry.request.ClientAddr]++
+		//该发送者的下一个请求成为新的候选
+		queue := mp.senders[entry.request.ClientAddr]
+		for i, e := range queue {
+			if e == entry && i+1 < len(queue) {
+				heads = append(heads, queue[i+1])
+				break
+			}
+		}
+	}
+	return packed
+}
+
+// Remove 移除交易对应的请求，用于丢弃打包时发现已经无效的请求
+func (mp *Mempool) Remove(tx *blockchain.Transaction) {
+	mp.mutex.Lock()
+	defer mp.mutex.Unlock()
+	if entry, ok := mp.entries[hex.EncodeToString(tx.TxHash)]; ok {
+		mp.removeEntry(entry)
+	}
+}
+
+// RemoveCommitted 区块上链后移除其中的请求，以及nonce已被使用的请求（可能来自其他主节点提出的区块）
+// state为该区块应用之后的状态
+func (mp *Mempool) RemoveCommitted(block *blockchain.Block, state *blockchain.State) {
+	mp.mutex.Lock()
+	defer mp.mutex.Unlock()
+	for _, tx := range block.Transactions {
+		if entry, ok := mp.entries[hex.EncodeToString(tx.TxHash)]; ok {
+			mp.removeEntry(entry)
+		}
+		mp.removeStale(tx.Sender, state.GetNonce(tx.Sender))
+	}
+}
+
+// RemoveStale 移除nonce已被state中已上链交易使用的请求，用于从快照恢复状态之后
+func (mp *Mempool) RemoveStale(state *blockchain.State) {
+	mp.mutex.Lock()
+	defer mp.mutex.Unlock()
+	for sender := range mp.senders {
+		mp.removeStale(sender, state.GetNonce(sender))
+	}
+}
+
+// 移除发送者nonce小于committed的请求，它们位于队列开头，调用时持有mutex
+func (mp *Mempool) removeStale(sender string, committed int) {
+	for queue := mp.senders[sender]; len(queue) > 0 && queue[0].request.Nonce < committed; queue = mp.senders[sender] {
+		mp.removeEntry(queue[0])
+	}
+}
+
+// ResetPacked 将已打包但未上链的请求重新标记为未打包，用于本节点打包的区块不会再上链时
+func (mp *Mempool) ResetPacked() {
+	mp.mutex.Lock()
+	defer mp.mutex.Unlock()
+	mp.pbytes = 0
+	for _, entry := range mp.entries {
+		entry.packed = false
+		mp.pbytes += len(entry.data)
+	}
+	mp.pending = len(mp.entries)
+	if mp.pending > 0 {
+		mp.signal()
+	}
+}
+
+// NextNonce 发送者下一笔请求应使用的nonce，包括交易池中尚未上链的请求
+func (mp *Mempool) NextNonce(sender string) int {
+	committed := mp.nonceOf(sender)
+	mp.mutex.Lock()
+	defer mp.mutex.Unlock()
+	return mp.nextNonce(sender, committed)
+}
+
+// Len 交易池中的请求数量（包括已打包但未上链的请求）
+func (mp *Mempool) Len() int {
+	mp.mutex.Lock()
+	defer mp.mutex.Unlock()
+	return len(mp.entries)
+}
+
+// Pending 尚未打包的请求数量
+func (mp *Mempool) Pending() int {
+	mp.mutex.Lock()
+	defer mp.mutex.Unlock()
+	return mp.pending
+}
+
+// PendingBytes 尚未打包的请求的总字节数
+func (mp *Mempool) PendingBytes() int {
+	mp.mutex.Lock()
+	defer mp.mutex.Unlock()
+	return mp.pbytes
+}
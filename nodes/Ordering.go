@@ -0,0 +1,64 @@
+package nodes
+
+import "fmt"
+
+// 打包顺序：每个发送者只有下一个nonce的请求是候选，排序策略在候选中选出最先打包的请求，
+// 选中后该发送者的下一个请求成为新的候选，因此任何策略下同一发送者的请求都按nonce顺序打包。
+
+// PackCandidate 打包时的候选请求
+type PackCandidate struct {
+	Sender string //发送者
+	Fee    int    //请求的费用
+	Seq    uint64 //进入交易池的顺序
+	Round  int    //该发送者在当前区块中已经打包的请求数量
+}
+
+// OrderingPolicy 打包时交易池中请求的排序策略
+type OrderingPolicy interface {
+	Name() string
+	Less(a, b *PackCandidate) bool //a是否应先于b打包
+}
+
+// FIFOOrdering 按进入交易池的顺序打包
+type FIFOOrdering struct{}
+
+func (FIFOOrdering) Name() string { return "fifo" }
+
+func (FIFOOrdering) Less(a, b *PackCandidate) bool {
+	return a.Seq < b.Seq
+}
+
+// PriorityOrdering 费用高的请求先打包，费用相同时按进入交易池的顺序
+type PriorityOrdering struct{}
+
+func (PriorityOrdering) Name() string { return "priority" }
+
+func (PriorityOrdering) Less(a, b *PackCandidate) bool {
+	if a.Fee != b.Fee {
+		return a.Fee > b.Fee
+	}
+	return a.Seq < b.Seq
+}
+
+// FairOrdering 各发送者轮流打包，每轮每个发送者一个请求，同一轮内按进入交易池的顺序，
+// 发送大量请求的客户端不会使其他客户端的请求等待
+type FairOrdering struct{}
+
+func (FairOrdering) Name() string { return "fair" }
+
+func (FairOrdering) Less(a, b *PackCandidate) bool {
+	if a.Round != b.Round {
+		return a.Round < b.Round
+	}
+	return a.Seq < b.Seq
+}
+
+// ParseOrderingPolicy 根据名称获取排序策略
+func ParseOrderingPolicy(name string) (OrderingPolicy, error) {
+	for _, policy := range []OrderingPolicy{FIFOOrdering{}, PriorityOrdering{}, FairOrdering{}} {
+		if policy.Name() == name {
+			return policy, nil
+		}
+	}
+	return nil, fmt.Errorf("config: unknown ordering policy %q", name)
+}
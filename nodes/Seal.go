@@ -0,0 +1,58 @@
+package nodes
+
+import (
+	"errors"
+	"time"
+)
+
+// 区块封装策略：主节点在交易池中出现第一笔可打包的请求后开始计时，
+// 未打包的请求数量或字节数达到区块上限、或等待超过MaxWait时封装区块；
+// 设置了Heartbeat时，距离上一个区块超过Heartbeat仍没有请求则封装一个空区块，使链在空闲时继续推进。
+
+const (
+	DefaultMaxBlockBytes = 1 << 20     //区块中交易内容的默认最大总字节数
+	DefaultMaxWait       = time.Second //第一笔请求到达后默认最多等待的时间
+)
+
+var ErrRequestTooLarge = errors.New("mempool: request exceeds the block size limit")
+
+// SealPolicy 区块封装策略
+type SealPolicy struct {
+	MaxTxs    int           //区块最多包含的交易数量，为0时使用创建全节点时的batchsize
+	MaxBytes  int           //区块中交易内容的最大总字节数
+	MaxWait   time.Duration //第一笔请求到达后最多等待多久封装区块
+	Heartbeat time.Duration //没有请求时多久封装一个空区块，为0时不封装空区块
+}
+
+func DefaultSealPolicy() SealPolicy {
+	return SealPolicy{0, DefaultMaxBlockBytes, DefaultMaxWait, 0}
+}
+
+// 等待直到可以封装区块，empty为true表示心跳超时，应封装空区块；节点关闭时ready为false
+func (fullnode *Fullnode) waitSeal(heartbeat <-chan time.Time) (ready bool, empty bool) {
+	seal := fullnode.Seal
+	mempool := fullnode.Mempool
+	//等待第一笔可打包的请求
+	for mempool.Pending() == 0 {
+		select {
+		case <-mempool.Notify():
+		case <-heartbeat:
+			return true, true
+		case <-fullnode.quit:
+			return false, false
+		}
+	}
+	//等待请求数量或字节数达到上限，或者超时
+	timer := time.NewTimer(seal.MaxWait)
+	defer timer.Stop()
+	for mempool.Pending() < seal.MaxTxs && mempool.PendingBytes() < seal.MaxBytes {
+		select {
+		case <-mempool.Notify():
+		case <-timer.C:
+			return true, false
+		case <-fullnode.quit:
+			return false, false
+		}
+	}
+	return true, false
+}
@@ -0,0 +1,223 @@
+package nodes
+
+import (
+	"simplechain/blockchain"
+	"simplechain/storage"
+	"sort"
+	"time"
+)
+
+const (
+	SnapshotInterval = 10               //每隔多少个区块创建一次检查点快照
+	SnapshotKeep     = 2                //保留的快照数量
+	RestoreTimeout   = 3 * SyncInterval //快照恢复无进展多久后重新开始
+	RestoreAttempts  = 3                //快照恢复最多尝试的次数，之后改为从创世区块同步区块（例如对等节点还没有快照）
+)
+
+// 正在进行的快照恢复
+type snapshotRestore struct {
+	peer        string                      //提供快照的节点
+	header      *blockchain.CertifiedHeader //已验证的检查点区块头
+	chunkHashes [][]byte                    //快照清单中各分块的哈希
+	chunks      [][]byte                    //已收到并验证的分块
+	received    int                         //已收到的分块数量
+	updated     time.Time                   //最近一次取得进展的时间
+	attempts    int                         //已经发出快照请求的次数
+}
+
+// TakeSnapshot 区块上链后，如果是检查点区块则为其创建快照，调用时需持有chainmutex
+func (fullnode *Fullnode) TakeSnapshot(block *blockchain.Block) {
+	if (block.Height+1)%SnapshotInterval != 0 || block.Cert == nil {
+		return
+	}
+	snapshot := blockchain.NewSnapshot(block.GetCertifiedHeader(), fullnode.Blockchain.State, blockchain.SnapshotChunkSize)
+	fullnode.Snapshots[block.Height] = snapshot
+	//只保留最近的快照
+	heights := make([]int, 0, len(fullnode.Snapshots))
+	for height := range fullnode.Snapshots {
+		heights = append(heights, height)
+	}
+	sort.Ints(heights)
+	for i := 0; i < len(heights)-SnapshotKeep; i++ {
+		delete(fullnode.Snapshots, heights[i])
+	}
+	fullnode.Pbft.Loger.Println("节点", fullnode.NodeID, "为检查点区块", block.Height, "创建快照,分块数量为", len(snapshot.Chunks))
+}
+
+// 获取最新的快照，调用时需持有chainmutex
+func (fullnode *Fullnode) latestSnapshot() *blockchain.Snapshot {
+	var latest *blockchain.Snapshot
+	for _, snapshot := range fullnode.Snapshots {
+		if latest == nil || snapshot.Header.Height > latest.Header.Height {
+			latest = snapshot
+		}
+	}
+	return latest
+}
+
+// BootstrapFromSnapshot 向所有对等节点请求最新快照，从验证通过的快照恢复状态，之后只需同步快照之后的区块
+// 快照恢复期间不同步区块
+func (fullnode *Fullnode) BootstrapFromSnapshot() {
+	fullnode.chainmutex.Lock()
+	attempts := 1
+	if fullnode.restore != nil {
+		attempts = fullnode.restore.attempts + 1
+	}
+	fullnode.restore = &snapshotRestore{updated: time.Now(), attempts: attempts}
+	fullnode.chainmutex.Unlock()
+	fullnode.Pbft.Loger.Println("节点", fullnode.NodeID, "开始从快照启动")
+	req := storage.SnapshotRequest{NodeID: fullnode.NodeID}
+	fullnode.P2P.Broadcast(fullnode.NodeID, storage.PackMessage(storage.MsgSnapReq, fullnode.NodeID, req.MarshalProto()))
+}
+
+// 快照恢复长时间没有进展时（例如对方已经删除了该快照）重新开始，尝试RestoreAttempts次后放弃并恢复区块同步，
+// 由区块同步例程定期调用
+func (fullnode *Fullnode) checkRestoreTimeout() {
+	fullnode.chainmutex.Lock()
+	stale := fullnode.restore != nil && time.Since(fullnode.restore.updated) > RestoreTimeout
+	abandon := stale && fullnode.restore.attempts >= RestoreAttempts
+	if abandon {
+		fullnode.restore = nil
+	}
+	fullnode.chainmutex.Unlock()
+	if abandon {
+		fullnode.Pbft.Loger.Println("节点", fullnode.NodeID, "快照恢复没有进展,改为同步区块")
+	} else if stale {
+		fullnode.BootstrapFromSnapshot()
+	}
+}
+
+// 是否正在进行快照恢复
+func (fullnode *Fullnode) restoring() bool {
+	fullnode.chainmutex.Lock()
+	defer fullnode.chainmutex.Unlock()
+	return fullnode.restore != nil
+}
+
+// HandleSnapshotRequest 返回本地最新快照的清单
+func (fullnode *Fullnode) HandleSnapshotRequest(content []byte) {
+	req, err := storage.UnmarshalSnapshotRequestProto(content)
+	if err != nil {
+		fullnode.Pbft.Loger.Println("节点", fullnode.NodeID, "无法解析快照请求:", err)
+		return
+	}
+	addr, ok := fullnode.P2P.GetNodeAddr(req.NodeID)
+	if !ok {
+		return
+	}
+	fullnode.chainmutex.Lock()
+	snapshot := fullnode.latestSnapshot()
+	fullnode.chainmutex.Unlock()
+	if snapshot == nil {
+		return
+	}
+	mani := storage.SnapshotManifest{NodeID: fullnode.NodeID, Height: snapshot.Header.Height, Header: snapshot.Header.SerializeCertifiedHeader(), ChunkHashes: snapshot.GetChunkHashes()}
+	fullnode.P2P.SendRequest(storage.PackMessage(storage.MsgSnapMani, fullnode.NodeID, mani.MarshalProto()), addr)
+}
+
+// HandleSnapshotManifest 验证快照清单中检查点区块头的提交证书，然后逐个请求分块
+func (fullnode *Fullnode) HandleSnapshotManifest(content []byte) {
+	mani, err := storage.UnmarshalSnapshotManifestProto(content)
+	if err != nil {
+		fullnode.Pbft.Loger.Println("节点", fullnode.NodeID, "无法解析快照清单:", err)
+		return
+	}
+	header, err := blockchain.DeserializeCertifiedHeader(mani.Header)
+	if err != nil || header.Height != mani.Height || len(mani.ChunkHashes) == 0 {
+		fullnode.Pbft.Loger.Println("节点", fullnode.NodeID, "拒绝节点", mani.NodeID, "的快照清单")
+		return
+	}
+	if err := header.Verify(fullnode.P2P.GetValidatorPubkeys()); err != nil {
+		fullnode.Pbft.Loger.Println("节点", fullnode.NodeID, "节点", mani.NodeID, "的快照提交证书验证失败:", err)
+		return
+	}
+	fullnode.chainmutex.Lock()
+	//只接受第一个比本地区块链更新的快照
+	if fullnode.restore == nil || fullnode.restore.header != nil || header.Height < fullnode.Blockchain.CurrentHeight {
+		fullnode.chainmutex.Unlock()
+		return
+	}
+	fullnode.restore.peer = mani.NodeID
+	fullnode.restore.header = header
+	fullnode.restore.chunkHashes = mani.ChunkHashes
+	fullnode.restore.chunks = make([][]byte, len(mani.ChunkHashes))
+	fullnode.restore.updated = time.Now()
+	fullnode.chainmutex.Unlock()
+	fullnode.Pbft.Loger.Println("节点", fullnode.NodeID, "从节点", mani.NodeID, "下载检查点区块", header.Height, "的快照,分块数量为", len(mani.ChunkHashes))
+	addr, _ := fullnode.P2P.GetNodeAddr(mani.NodeID)
+	for i := range mani.ChunkHashes {
+		req := storage.SnapshotChunkRequest{NodeID: fullnode.NodeID, Height: header.Height, Index: i}
+		fullnode.P2P.SendRequest(storage.PackMessage(storage.MsgChunkReq, fullnode.NodeID, req.MarshalProto()), addr)
+	}
+}
+
+// HandleChunkRequest 返回快照的某个分块
+func (fullnode *Fullnode) HandleChunkRequest(content []byte) {
+	req, err := storage.UnmarshalSnapshotChunkRequestProto(content)
+	if err != nil {
+		fullnode.Pbft.Loger.Println("节点", fullnode.NodeID, "无法解析快照分块请求:", err)
+		return
+	}
+	addr, ok := fullnode.P2P.GetNodeAddr(req.NodeID)
+	if !ok {
+		return
+	}
+	fullnode.chainmutex.Lock()
+	snapshot, ok := fullnode.Snapshots[req.Height]
+	fullnode.chainmutex.Unlock()
+	if !ok || req.Index < 0 || req.Index >= len(snapshot.Chunks) {
+		return
+	}
+	chunk := storage.SnapshotChunk{NodeID: fullnode.NodeID, Height: req.Height, Index: req.Index, Data: snapshot.Chunks[req.Index]}
+	fullnode.P2P.SendRequest(storage.PackMessage(storage.MsgChunk, fullnode.NodeID, chunk.MarshalProto()), addr)
+}
+
+// HandleChunk 验证分块哈希，收齐所有分块后恢复状态并以检查点作为区块链的起点
+func (fullnode *Fullnode) HandleChunk(content []byte) {
+	chunk, err := storage.UnmarshalSnapshotChunkProto(content)
+	if err != nil {
+		fullnode.Pbft.Loger.Println("节点", fullnode.NodeID, "无法解析快照分块:", err)
+		return
+	}
+	//快照恢复后共识从新的高度开始，不能在持有chainmutex时向共识的事件循环投递消息
+	if height, ok := fullnode.applyChunk(chunk); ok {
+		fullnode.Pbft.FastForward(height)
+	}
+}
+
+// 保存快照分块，收齐所有分块后恢复状态，返回恢复后的区块链高度
+func (fullnode *Fullnode) applyChunk(chunk *storage.SnapshotChunk) (int, bool) {
+	fullnode.chainmutex.Lock()
+	defer fullnode.chainmutex.Unlock()
+	restore := fullnode.restore
+	if restore == nil || restore.header == nil || chunk.NodeID != restore.peer || chunk.Height != restore.header.Height {
+		return 0, false
+	}
+	if err := blockchain.VerifyChunk(restore.chunkHashes, chunk.Index, chunk.Data); err != nil {
+		fullnode.Pbft.Loger.Println("节点", fullnode.NodeID, "拒绝节点", chunk.NodeID, "的快照分块", chunk.Index, ":", err)
+		return 0, false
+	}
+	if restore.chunks[chunk.Index] == nil {
+		restore.chunks[chunk.Index] = chunk.Data
+		restore.received++
+		restore.updated = time.Now()
+	}
+	if restore.received < len(restore.chunks) {
+		return 0, false
+	}
+	fullnode.restore = nil
+	state, err := blockchain.RestoreState(restore.header, restore.chunks)
+	if err != nil {
+		fullnode.Pbft.Loger.Println("节点", fullnode.NodeID, "快照恢复失败:", err)
+		return 0, false
+	}
+	//恢复期间区块同步可能已经追上了快照
+	if restore.header.Height < fullnode.Blockchain.CurrentHeight {
+		return 0, false
+	}
+	fullnode.Blockchain.RestoreFromSnapshot(restore.header, state)
+	fullnode.Mempool.RemoveStale(state)
+	fullnode.notifyWindow()
+	fullnode.Pbft.Loger.Println("节点", fullnode.NodeID, "已从检查点区块", restore.header.Height, "的快照启动,当前区块链高度为", fullnode.Blockchain.CurrentHeight)
+	return fullnode.Blockchain.CurrentHeight, true
+}
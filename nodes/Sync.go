@@ -0,0 +1,157 @@
+package nodes
+
+import (
+	"simplechain/blockchain"
+	"simplechain/storage"
+	"time"
+)
+
+const (
+	SyncInterval       = 2 * time.Second //区块同步的轮询间隔
+	MaxSyncBatch       = 32              //一次同步响应中最多包含的区块数量
+	MaxHeaderSyncBatch = 256             //一次同步响应中最多包含的区块头数量
+)
+
+// RunSync 区块同步例程：定期向对等节点请求本地缺少的区块，使落后或重启的节点在不停止集群的情况下重新加入
+// 节点关闭后返回
+func (fullnode *Fullnode) RunSync() {
+	defer fullnode.routines.Done()
+	ticker := time.NewTicker(SyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-fullnode.quit:
+			return
+		}
+		//重新广播预写日志中尚未提交的消息（只在重启后的第一轮有效）
+		fullnode.Pbft.ResendPending()
+		fullnode.checkRestoreTimeout()
+		//快照恢复期间不同步区块，恢复完成后只同步快照之后的区块
+		if !fullnode.restoring() {
+			fullnode.RequestSync()
+		}
+	}
+}
+
+// RequestSync 轮流向一个对等节点请求从本地当前高度开始的区块
+func (fullnode *Fullnode) RequestSync() {
+	peers := make([]string, 0)
+	for _, nodeID := range fullnode.P2P.GetNodeIDs() {
+		if nodeID != fullnode.NodeID {
+			peers = append(peers, nodeID)
+		}
+	}
+	if len(peers) == 0 {
+		return
+	}
+	peer := peers[fullnode.syncRound%len(peers)]
+	fullnode.syncRound++
+	fullnode.chainmutex.Lock()
+	height := fullnode.Blockchain.CurrentHeight
+	fullnode.chainmutex.Unlock()
+	fullnode.RequestBlocks(peer, height, 0)
+}
+
+// RequestBlocks 向节点peer请求[from, to)范围内的区块，to为0表示直到对方的最新高度
+func (fullnode *Fullnode) RequestBlocks(peer string, from int, to int) {
+	addr, ok := fullnode.P2P.GetNodeAddr(peer)
+	if !ok {
+		return
+	}
+	req := storage.SyncRequest{NodeID: fullnode.NodeID, FromHeight: from, ToHeight: to}
+	fullnode.P2P.SendRequest(storage.PackMessage(storage.MsgSyncReq, fullnode.NodeID, req.MarshalProto()), addr)
+}
+
+// HandleSyncRequest 处理其他节点的区块同步请求，返回本地已上链的区块及其提交证书，轻节点只请求带证书的区块头
+func (fullnode *Fullnode) HandleSyncRequest(content []byte) {
+	req, err := storage.UnmarshalSyncRequestProto(content)
+	if err != nil {
+		fullnode.Pbft.Loger.Println("节点", fullnode.NodeID, "无法解析区块同步请求:", err)
+		return
+	}
+	addr, ok := fullnode.P2P.GetAddr(req.NodeID)
+	if !ok || req.FromHeight < 0 {
+		return
+	}
+	batch := MaxSyncBatch
+	if req.HeadersOnly {
+		batch = MaxHeaderSyncBatch
+	}
+	fullnode.chainmutex.Lock()
+	height := fullnode.Blockchain.CurrentHeight
+	to := req.ToHeight
+	if to <= 0 || to > height {
+		to = height
+	}
+	if to > req.FromHeight+batch {
+		to = req.FromHeight + batch
+	}
+	resp := storage.SyncResponse{NodeID: fullnode.NodeID, Height: height}
+	//从快照启动的节点没有检查点之前的区块，裁剪模式的节点只有区块头
+	for i := req.FromHeight; i < to && i >= fullnode.Blockchain.BaseHeight; i++ {
+		block := fullnode.Blockchain.GetBlockByHeight(i)
+		if req.HeadersOnly {
+			resp.Headers = append(resp.Headers, block.GetCertifiedHeader().SerializeCertifiedHeader())
+			continue
+		}
+		if i < fullnode.Blockchain.PrunedHeight {
+			break
+		}
+		seblock, err := block.SerializeBlockWithCert()
+		if err != nil {
+			break
+		}
+		resp.Blocks = append(resp.Blocks, seblock)
+	}
+	fullnode.chainmutex.Unlock()
+	//没有对方缺少的区块则不响应
+	if len(resp.Blocks) == 0 && len(resp.Headers) == 0 {
+		return
+	}
+	fullnode.Pbft.Loger.Println("节点", fullnode.NodeID, "向节点", req.NodeID, "发送区块", req.FromHeight, "到", to-1)
+	fullnode.P2P.SendRequest(storage.PackMessage(storage.MsgSyncResp, fullnode.NodeID, resp.MarshalProto()), addr)
+}
+
+// HandleSyncResponse 验证同步得到的区块的哈希链接和提交证书后将其上链，并推进共识的低水位线
+func (fullnode *Fullnode) HandleSyncResponse(content []byte) {
+	resp, err := storage.UnmarshalSyncResponseProto(content)
+	if err != nil {
+		fullnode.Pbft.Loger.Println("节点", fullnode.NodeID, "无法解析区块同步响应:", err)
+		return
+	}
+	validators := fullnode.P2P.GetValidatorPubkeys()
+	fullnode.chainmutex.Lock()
+	imported := 0
+	for _, seblock := range resp.Blocks {
+		block, err := blockchain.DeserializeBlockWithCert(seblock)
+		if err != nil {
+			fullnode.Pbft.Loger.Println("节点", fullnode.NodeID, "无法解析节点", resp.NodeID, "同步的区块:", err)
+			break
+		}
+		//本地已经有的区块直接跳过
+		if block.Height < fullnode.Blockchain.CurrentHeight {
+			continue
+		}
+		if _, err := fullnode.Blockchain.ImportBlock(block, validators); err != nil {
+			fullnode.Pbft.Loger.Println("节点", fullnode.NodeID, "拒绝节点", resp.NodeID, "同步的区块", block.Height, ":", err)
+			break
+		}
+		imported++
+		fullnode.blockAdded(block)
+		fullnode.TakeSnapshot(block)
+	}
+	height := fullnode.Blockchain.CurrentHeight
+	if imported > 0 {
+		fullnode.Pbft.Loger.Println("节点", fullnode.NodeID, "从节点", resp.NodeID, "同步了", imported, "个区块,当前区块链高度为", height)
+	}
+	fullnode.chainmutex.Unlock()
+	//同步上链的区块不再需要本地共识，不能在持有chainmutex时向共识的事件循环投递消息
+	if imported > 0 {
+		fullnode.Pbft.FastForward(height)
+	}
+	//对方还有更多区块则继续请求
+	if imported > 0 && resp.Height > height {
+		fullnode.RequestBlocks(resp.NodeID, height, 0)
+	}
+}
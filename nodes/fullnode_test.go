@@ -0,0 +1,213 @@
+package nodes
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"simplechain/blockchain"
+	"simplechain/consensus"
+	"simplechain/network"
+	"simplechain/storage"
+	"simplechain/utils"
+	"testing"
+	"time"
+)
+
+// 测试网络：4个全节点和一个只注册了地址和公钥的客户端
+type testNetwork struct {
+	p2p       *network.P2P
+	fullnodes []*Fullnode
+	client    utils.Signer
+	sink      net.Listener //客户端地址上丢弃所有连接的监听，节点的回复不会失败
+}
+
+// 本机上一个空闲的地址
+func freeAddr(tb testing.TB) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+func testSigners(tb testing.TB, scheme utils.SignatureScheme, n int) []utils.Signer {
+	signers := make([]utils.Signer, n)
+	for i := range signers {
+		signer, err := utils.GenerateSigner(scheme)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		signers[i] = signer
+	}
+	return signers
+}
+
+// 在dir中用给定的地址和公私钥启动网络，最后一个地址和公私钥属于客户端
+func startTestNetwork(tb testing.TB, dir string, scheme utils.SignatureScheme, config NodeConfig, addrs []string, signers []utils.Signer) *testNetwork {
+	sink, err := net.Listen("tcp", addrs[len(addrs)-1])
+	if err != nil {
+		tb.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := sink.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(io.Discard, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	tn := &testNetwork{p2p: network.NewP2P("tcp"), client: signers[len(signers)-1], sink: sink}
+	if err := tn.p2p.SetScheme(scheme); err != nil {
+		tb.Fatal(err)
+	}
+	tn.p2p.AddClient("client1", sink.Addr().String())
+	if err := tn.p2p.AddPubKey("client1", tn.client.PublicKey()); err != nil {
+		tb.Fatal(err)
+	}
+	config.DataDir = dir
+	for i, addr := range addrs[:len(addrs)-1] {
+		fullnode := NewFullnodeWithSigner(fmt.Sprintf("node%d", i+1), addr, tn.p2p, config.Seal.MaxTxs, config, signers[i])
+		tn.fullnodes = append(tn.fullnodes, fullnode)
+	}
+	return tn
+}
+
+// 向主节点的交易池直接放入nonce在[from, to)之间的请求
+func (tn *testNetwork) fill(tb testing.TB, from int, to int) {
+	for nonce := from; nonce < to; nonce++ {
+		r := &storage.Request{Message: storage.Message{Content: []byte("test"), ID: nonce}, Timestamp: time.Now().UnixNano(), ClientAddr: tn.sink.Addr().String(), Nonce: nonce, PubKeyID: "client1"}
+		sign, err := tn.client.Sign(r.SigningBytes())
+		if err != nil {
+			tb.Fatal(err)
+		}
+		r.Sign = sign
+		if err := tn.fullnodes[0].Mempool.Add(r); err != nil {
+			tb.Fatal(err)
+		}
+	}
+}
+
+// 等待fullnodes的高度都达到height
+func waitHeight(tb testing.TB, fullnodes []*Fullnode, height int, timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for _, fullnode := range fullnodes {
+		for fullnode.Height() < height {
+			if time.Now().After(deadline) {
+				tb.Fatalf("%s at height %d, want %d", fullnode.NodeID, fullnode.Height(), height)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
+
+func (tn *testNetwork) close(tb testing.TB) {
+	for _, fullnode := range tn.fullnodes {
+		if err := fullnode.Close(); err != nil {
+			tb.Error(err)
+		}
+	}
+	tn.sink.Close()
+}
+
+func testConfig(window int, txs int) NodeConfig {
+	config := DefaultNodeConfig()
+	config.Window = window
+	config.Seal.MaxTxs = txs
+	config.Seal.MaxWait = time.Millisecond
+	return config
+}
+
+func TestFullnodeCloseAndReopen(t *testing.T) {
+	dir := t.TempDir()
+	config := testConfig(2, 5)
+	addrs := []string{freeAddr(t), freeAddr(t), freeAddr(t), freeAddr(t), freeAddr(t)}
+	signers := testSigners(t, utils.SchemeEd25519, 5)
+
+	tn := startTestNetwork(t, dir, utils.SchemeEd25519, config, addrs, signers)
+	tn.fill(t, 0, 20)
+	tn.p2p.SetPrimaryNode("node1")
+	waitHeight(t, tn.fullnodes, 4, 30*time.Second)
+	tn.close(t)
+	//重复关闭不报错，关闭后节点的地址可以重新监听
+	if err := tn.fullnodes[0].Close(); err != nil {
+		t.Errorf("second close: %v", err)
+	}
+	for _, addr := range addrs[:4] {
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			t.Fatalf("address still in use after close: %v", err)
+		}
+		l.Close()
+	}
+	heights := make([]int, len(tn.fullnodes))
+	for i, fullnode := range tn.fullnodes {
+		heights[i] = fullnode.Height()
+	}
+
+	//同一目录重新创建的节点保留已提交的区块并继续共识
+	tn = startTestNetwork(t, dir, utils.SchemeEd25519, config, addrs, signers)
+	defer tn.close(t)
+	for i, fullnode := range tn.fullnodes {
+		if fullnode.Height() < heights[i] {
+			t.Errorf("%s reopened at height %d, want at least %d", fullnode.NodeID, fullnode.Height(), heights[i])
+		}
+	}
+	tn.fill(t, 20, 30)
+	tn.p2p.SetPrimaryNode("node1")
+	waitHeight(t, tn.fullnodes, 6, 30*time.Second)
+	if nonce := tn.fullnodes[1].GetNonce(tn.sink.Addr().String()); nonce != 30 {
+		t.Errorf("nonce %d after reopen, want 30", nonce)
+	}
+}
+
+// 共识后的区块被拒绝时，窗口中已打包的区块不会再上链，主节点回滚打包状态后继续出块
+func TestRejectedCommitRollsBackPacking(t *testing.T) {
+	config := testConfig(1, 5)
+	addrs := []string{freeAddr(t), freeAddr(t), freeAddr(t), freeAddr(t), freeAddr(t)}
+	tn := startTestNetwork(t, t.TempDir(), utils.SchemeEd25519, config, addrs, testSigners(t, utils.SchemeEd25519, 5))
+	defer tn.close(t)
+	primary := tn.fullnodes[0]
+	//窗口已满：主节点已打包了一个区块，共识后的该高度的区块却没有有效的提交证书
+	primary.packedNumber = primary.Window
+	block := blockchain.NewBlock(0, primary.Blockchain.LastHash, nil, "node1", nil)
+	request := blockchain.BlockToRequest(block)
+	committed := &consensus.CommittedMessage{SequenceID: 0, Request: &request, Cert: &storage.CommitCertificate{}}
+	if err := primary.commitToChain(committed, false); !errors.Is(err, ErrCommittedBlock) {
+		t.Fatalf("commit without a valid certificate: %v, want ErrCommittedBlock", err)
+	}
+	tn.fill(t, 0, 10)
+	tn.p2p.SetPrimaryNode("node1")
+	waitHeight(t, tn.fullnodes, 2, 30*time.Second)
+}
+
+// 流水线吞吐量：对每个窗口大小在临时目录中启动一个新的4节点网络，
+// 预先向主节点的交易池放入足够的请求，统计提交b.N个区块所用的时间
+//
+//	go test ./nodes -run '^$' -bench PipelineWindow -benchtime 50x
+func BenchmarkPipelineWindow(b *testing.B) {
+	const txs = 10
+	for _, window := range []int{1, 2, 4, 8, 16} {
+		b.Run(fmt.Sprintf("window=%d", window), func(b *testing.B) {
+			config := testConfig(window, txs)
+			if config.MempoolCapacity < b.N*txs {
+				config.MempoolCapacity = b.N * txs
+			}
+			addrs := []string{freeAddr(b), freeAddr(b), freeAddr(b), freeAddr(b), freeAddr(b)}
+			tn := startTestNetwork(b, b.TempDir(), utils.DefaultScheme, config, addrs, testSigners(b, utils.DefaultScheme, 5))
+			defer tn.close(b)
+			tn.fill(b, 0, b.N*txs)
+			b.ResetTimer()
+			tn.p2p.SetPrimaryNode("node1")
+			waitHeight(b, tn.fullnodes[:1], b.N, time.Minute+time.Duration(b.N)*time.Second)
+			b.StopTimer()
+			b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "blocks/s")
+			b.ReportMetric(float64(b.N*txs)/b.Elapsed().Seconds(), "txs/s")
+		})
+	}
+}
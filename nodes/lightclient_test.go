@@ -0,0 +1,38 @@
+package nodes
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"simplechain/network"
+	"testing"
+)
+
+func TestNewLightClientErrors(t *testing.T) {
+	p2p := network.NewP2P("tcp")
+	genesis := &Genesis{Scheme: p2p.GetScheme()}
+	if _, err := NewLightClient("light1", freeAddr(t), p2p, nil, t.TempDir()); !errors.Is(err, ErrLightNoGenesis) {
+		t.Errorf("no genesis: %v, want ErrLightNoGenesis", err)
+	}
+	//日志目录无法创建时返回错误，而不是丢弃日志继续运行
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, LogDir), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewLightClient("light1", freeAddr(t), p2p, genesis, dir); err == nil {
+		t.Error("light client created without a log file")
+	}
+	if _, ok := p2p.GetClientAddr("light1"); ok {
+		t.Error("failed light client registered in the P2P table")
+	}
+
+	dir = t.TempDir()
+	lc, err := NewLightClient("light1", freeAddr(t), p2p, genesis, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lc.Loger.Println("test")
+	if data, err := os.ReadFile(filepath.Join(dir, LogDir, "light1_log")); err != nil || len(data) == 0 {
+		t.Errorf("log file in the data directory: %q, %v", data, err)
+	}
+}
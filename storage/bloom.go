@@ -0,0 +1,90 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+var ErrBloomFormat = errors.New("bloom: invalid encoding")
+
+// BloomFilter 布隆过滤器：判断元素一定不存在或可能存在
+// 使用双重哈希由元素的sha256摘要生成k个位置
+type BloomFilter struct {
+	Bits   []byte //位数组
+	Hashes int    //哈希函数个数k
+}
+
+// NewBloomFilter 为n个元素创建布隆过滤器，每个元素占用bitsPerKey位
+func NewBloomFilter(n int, bitsPerKey int) *BloomFilter {
+	if n < 1 {
+		n = 1
+	}
+	nbits := n * bitsPerKey
+	if nbits < 64 {
+		nbits = 64
+	}
+	//k = bitsPerKey * ln2时误判率最低
+	k := int(math.Round(float64(bitsPerKey) * math.Ln2))
+	if k < 1 {
+		k = 1
+	}
+	if k > 30 {
+		k = 30
+	}
+	return &BloomFilter{make([]byte, (nbits+7)/8), k}
+}
+
+func (bf *BloomFilter) positions(key []byte) (uint64, uint64) {
+	sum := sha256.Sum256(key)
+	return binary.BigEndian.Uint64(sum[0:8]), binary.BigEndian.Uint64(sum[8:16]) | 1
+}
+
+// Add 加入一个元素
+func (bf *BloomFilter) Add(key []byte) {
+	h1, h2 := bf.positions(key)
+	nbits := uint64(len(bf.Bits)) * 8
+	for i := 0; i < bf.Hashes; i++ {
+		pos := (h1 + uint64(i)*h2) % nbits
+		bf.Bits[pos/8] |= 1 << (pos % 8)
+	}
+}
+
+// MayContain 元素可能存在时返回true，返回false时元素一定不存在
+func (bf *BloomFilter) MayContain(key []byte) bool {
+	if len(bf.Bits) == 0 {
+		return true
+	}
+	h1, h2 := bf.positions(key)
+	nbits := uint64(len(bf.Bits)) * 8
+	for i := 0; i < bf.Hashes; i++ {
+		pos := (h1 + uint64(i)*h2) % nbits
+		if bf.Bits[pos/8]&(1<<(pos%8)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Serialize 将布隆过滤器编码为规范化的二进制形式
+func (bf *BloomFilter) Serialize() []byte {
+	e := NewEncoder()
+	e.WriteInt(bf.Hashes)
+	e.WriteBytes(bf.Bits)
+	return e.Bytes()
+}
+
+// DeserializeBloomFilter 解析布隆过滤器
+func DeserializeBloomFilter(data []byte) (*BloomFilter, error) {
+	d := NewDecoder(data)
+	bf := &BloomFilter{Hashes: d.ReadInt()}
+	bf.Bits = d.ReadBytes()
+	if err := d.Finish(); err != nil {
+		return nil, err
+	}
+	if bf.Hashes < 1 || bf.Hashes > 30 {
+		return nil, ErrBloomFormat
+	}
+	return bf, nil
+}
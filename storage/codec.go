@@ -0,0 +1,203 @@
+package storage
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// 规范化的二进制编码：
+// 整数统一编码为8字节大端序，布尔值编码为1字节，
+// 字节串和字符串编码为4字节大端序长度前缀加内容，列表编码为4字节元素个数加各元素。
+// 同一个值只有唯一的编码，哈希和签名都基于这一编码计算。
+
+var ErrCodecShortBuffer = errors.New("codec: unexpected end of data")
+var ErrCodecTrailingData = errors.New("codec: trailing data")
+var ErrCodecInvalidBool = errors.New("codec: invalid bool")
+
+// 单个长度前缀允许的最大长度，防止恶意数据导致超大内存分配
+const maxCodecFieldLength = 1 << 28
+
+// Encoder 规范化二进制编码器
+type Encoder struct {
+	buf []byte
+}
+
+func NewEncoder() *Encoder {
+	return &Encoder{make([]byte, 0, 64)}
+}
+
+func (e *Encoder) WriteUint64(v uint64) {
+	e.buf = binary.BigEndian.AppendUint64(e.buf, v)
+}
+
+func (e *Encoder) WriteInt64(v int64) {
+	e.WriteUint64(uint64(v))
+}
+
+func (e *Encoder) WriteInt(v int) {
+	e.WriteUint64(uint64(int64(v)))
+}
+
+func (e *Encoder) WriteBool(v bool) {
+	if v {
+		e.buf = append(e.buf, 1)
+	} else {
+		e.buf = append(e.buf, 0)
+	}
+}
+
+func (e *Encoder) writeLength(n int) {
+	e.buf = binary.BigEndian.AppendUint32(e.buf, uint32(n))
+}
+
+func (e *Encoder) WriteBytes(v []byte) {
+	e.writeLength(len(v))
+	e.buf = append(e.buf, v...)
+}
+
+func (e *Encoder) WriteString(v string) {
+	e.writeLength(len(v))
+	e.buf = append(e.buf, v...)
+}
+
+func (e *Encoder) WriteBytesList(list [][]byte) {
+	e.writeLength(len(list))
+	for _, v := range list {
+		e.WriteBytes(v)
+	}
+}
+
+func (e *Encoder) WriteStringList(list []string) {
+	e.writeLength(len(list))
+	for _, v := range list {
+		e.WriteString(v)
+	}
+}
+
+// Bytes 获取编码结果
+func (e *Encoder) Bytes() []byte {
+	return e.buf
+}
+
+// Decoder 规范化二进制解码器，出现错误后后续读取均返回零值，错误通过Err或Finish获取
+type Decoder struct {
+	buf []byte
+	off int
+	err error
+}
+
+func NewDecoder(data []byte) *Decoder {
+	return &Decoder{data, 0, nil}
+}
+
+func (d *Decoder) next(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n < 0 || len(d.buf)-d.off < n {
+		d.err = ErrCodecShortBuffer
+		return nil
+	}
+	b := d.buf[d.off : d.off+n]
+	d.off += n
+	return b
+}
+
+func (d *Decoder) ReadUint64() uint64 {
+	b := d.next(8)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint64(b)
+}
+
+func (d *Decoder) ReadInt64() int64 {
+	return int64(d.ReadUint64())
+}
+
+func (d *Decoder) ReadInt() int {
+	return int(d.ReadInt64())
+}
+
+func (d *Decoder) ReadBool() bool {
+	b := d.next(1)
+	if b == nil {
+		return false
+	}
+	switch b[0] {
+	case 0:
+		return false
+	case 1:
+		return true
+	}
+	d.err = ErrCodecInvalidBool
+	return false
+}
+
+func (d *Decoder) readLength() int {
+	b := d.next(4)
+	if b == nil {
+		return 0
+	}
+	n := binary.BigEndian.Uint32(b)
+	if n > maxCodecFieldLength {
+		d.err = ErrCodecShortBuffer
+		return 0
+	}
+	return int(n)
+}
+
+// ReadBytes 读取一个字节串，返回的是数据的拷贝
+func (d *Decoder) ReadBytes() []byte {
+	n := d.readLength()
+	b := d.next(n)
+	if b == nil {
+		return nil
+	}
+	ret := make([]byte, n)
+	copy(ret, b)
+	return ret
+}
+
+func (d *Decoder) ReadString() string {
+	n := d.readLength()
+	b := d.next(n)
+	if b == nil {
+		return ""
+	}
+	return string(b)
+}
+
+func (d *Decoder) ReadBytesList() [][]byte {
+	n := d.readLength()
+	list := make([][]byte, 0)
+	for i := 0; i < n && d.err == nil; i++ {
+		list = append(list, d.ReadBytes())
+	}
+	return list
+}
+
+func (d *Decoder) ReadStringList() []string {
+	n := d.readLength()
+	list := make([]string, 0)
+	for i := 0; i < n && d.err == nil; i++ {
+		list = append(list, d.ReadString())
+	}
+	return list
+}
+
+// Err 获取解码过程中出现的第一个错误
+func (d *Decoder) Err() error {
+	return d.err
+}
+
+// Finish 结束解码，数据必须恰好被读完
+func (d *Decoder) Finish() error {
+	if d.err != nil {
+		return d.err
+	}
+	if d.off != len(d.buf) {
+		return ErrCodecTrailingData
+	}
+	return nil
+}
@@ -0,0 +1,313 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+	"sort"
+	"sync/atomic"
+)
+
+// 段文件：内存表落盘后形成的不可变有序文件，格式为
+// 按键排序的记录 + 索引（键及其记录偏移） + 布隆过滤器 + 定长尾部，
+// 尾部依次为索引偏移、布隆过滤器偏移（各8字节）、前面所有内容的CRC32C校验和、魔数（各4字节）。
+// 打开段文件时只将索引和布隆过滤器读入内存，查询时按偏移读取记录。
+
+var ErrSegmentCorrupt = errors.New("kv: corrupt segment file")
+var errSegmentOrder = errors.New("kv: segment keys out of order")
+
+const (
+	segmentMagic      uint32 = 0x53434b56 //"SCKV"
+	segmentFooterSize        = 24
+	segmentBitsPerKey        = 10 //布隆过滤器每个键占用的位数，误判率约1%
+)
+
+// 一条键值记录，deleted为true表示删除标记
+type kvEntry struct {
+	key     []byte
+	value   []byte
+	deleted bool
+}
+
+func encodeKVEntry(e *Encoder, entry kvEntry) {
+	e.WriteBytes(entry.key)
+	e.WriteBool(entry.deleted)
+	e.WriteBytes(entry.value)
+}
+
+func decodeKVEntry(d *Decoder) kvEntry {
+	entry := kvEntry{}
+	entry.key = d.ReadBytes()
+	entry.deleted = d.ReadBool()
+	entry.value = d.ReadBytes()
+	return entry
+}
+
+type segment struct {
+	path    string
+	file    *os.File
+	keys    [][]byte     //按序排列的键
+	offsets []int64      //各记录在文件中的偏移
+	dataEnd int64        //记录区的结束位置
+	bloom   *BloomFilter //所有键的布隆过滤器
+	refs    atomic.Int32 //引用计数：DB和未释放的迭代器各持有一个引用，归零时关闭文件
+}
+
+// 段文件写入器：按键升序逐条写入记录，记录直接写入临时文件，内存中只保留索引和布隆过滤器
+type segmentWriter struct {
+	path    string
+	file    *os.File
+	w       *bufio.Writer
+	crc     hash.Hash32
+	size    int64 //已写入的字节数
+	keys    [][]byte
+	offsets []int64
+	bloom   *BloomFilter
+	err     error
+}
+
+// 创建段文件写入器，n为记录数量的上限，用于确定布隆过滤器的大小
+func newSegmentWriter(path string, n int) (*segmentWriter, error) {
+	file, err := os.OpenFile(path+".tmp", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &segmentWriter{path: path, file: file, w: bufio.NewWriter(file), crc: crc32.New(walCRCTable), bloom: NewBloomFilter(n, segmentBitsPerKey)}, nil
+}
+
+func (sw *segmentWriter) write(data []byte) {
+	if sw.err != nil {
+		return
+	}
+	if _, sw.err = sw.w.Write(data); sw.err == nil {
+		sw.crc.Write(data)
+		sw.size += int64(len(data))
+	}
+}
+
+// 追加一条记录，键必须大于之前写入的所有键
+func (sw *segmentWriter) add(entry kvEntry) error {
+	if n := len(sw.keys); n > 0 && bytes.Compare(sw.keys[n-1], entry.key) >= 0 {
+		return errSegmentOrder
+	}
+	sw.keys = append(sw.keys, entry.key)
+	sw.offsets = append(sw.offsets, sw.size)
+	sw.bloom.Add(entry.key)
+	e := NewEncoder()
+	encodeKVEntry(e, entry)
+	sw.write(e.Bytes())
+	return sw.err
+}
+
+// 写入索引、布隆过滤器和尾部，落盘后原子地重命名为段文件；失败时删除临时文件
+func (sw *segmentWriter) finish() error {
+	indexOffset := sw.size
+	e := NewEncoder()
+	e.WriteInt(len(sw.keys))
+	for i, key := range sw.keys {
+		e.WriteBytes(key)
+		e.WriteInt64(sw.offsets[i])
+	}
+	sw.write(e.Bytes())
+	bloomOffset := sw.size
+	e = NewEncoder()
+	e.WriteBytes(sw.bloom.Serialize())
+	sw.write(e.Bytes())
+	footer := make([]byte, segmentFooterSize)
+	binary.BigEndian.PutUint64(footer[0:8], uint64(indexOffset))
+	binary.BigEndian.PutUint64(footer[8:16], uint64(bloomOffset))
+	binary.BigEndian.PutUint32(footer[16:20], sw.crc.Sum32())
+	binary.BigEndian.PutUint32(footer[20:24], segmentMagic)
+	sw.write(footer)
+	if sw.err == nil {
+		sw.err = sw.w.Flush()
+	}
+	if sw.err == nil {
+		sw.err = sw.file.Sync()
+	}
+	if err := sw.file.Close(); sw.err == nil {
+		sw.err = err
+	}
+	if sw.err == nil {
+		sw.err = os.Rename(sw.path+".tmp", sw.path)
+	}
+	if sw.err != nil {
+		os.Remove(sw.path + ".tmp")
+	}
+	return sw.err
+}
+
+// 放弃写入并删除临时文件
+func (sw *segmentWriter) abort() {
+	sw.file.Close()
+	os.Remove(sw.path + ".tmp")
+}
+
+// 将按键排序且不重复的记录写入段文件，先写临时文件并落盘，再原子地重命名
+func writeSegment(path string, entries []kvEntry) error {
+	sw, err := newSegmentWriter(path, len(entries))
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err := sw.add(entry); err != nil {
+			sw.abort()
+			return err
+		}
+	}
+	return sw.finish()
+}
+
+// 先写入临时文件并落盘，再重命名为目标文件，保证目标文件要么是旧内容要么是完整的新内容
+func writeFileSync(path string, data []byte) error {
+	tmp := path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// 打开段文件，校验其完整性并加载索引和布隆过滤器，记录本身不读入内存
+func openSegment(path string) (*segment, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	seg, err := loadSegment(path, file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return seg, nil
+}
+
+func loadSegment(path string, file *os.File) (*segment, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	bodySize := info.Size() - segmentFooterSize
+	if bodySize < 0 {
+		return nil, ErrSegmentCorrupt
+	}
+	footer := make([]byte, segmentFooterSize)
+	if _, err := file.ReadAt(footer, bodySize); err != nil {
+		return nil, err
+	}
+	indexOffset := binary.BigEndian.Uint64(footer[0:8])
+	bloomOffset := binary.BigEndian.Uint64(footer[8:16])
+	if binary.BigEndian.Uint32(footer[20:24]) != segmentMagic {
+		return nil, ErrSegmentCorrupt
+	}
+	crc := crc32.New(walCRCTable)
+	if _, err := io.Copy(crc, io.NewSectionReader(file, 0, bodySize)); err != nil {
+		return nil, err
+	}
+	if crc.Sum32() != binary.BigEndian.Uint32(footer[16:20]) {
+		return nil, ErrSegmentCorrupt
+	}
+	if indexOffset > bloomOffset || bloomOffset > uint64(bodySize) {
+		return nil, ErrSegmentCorrupt
+	}
+	meta := make([]byte, uint64(bodySize)-indexOffset)
+	if _, err := file.ReadAt(meta, int64(indexOffset)); err != nil {
+		return nil, err
+	}
+	d := NewDecoder(meta[:bloomOffset-indexOffset])
+	n := d.ReadInt()
+	if n < 0 || n > len(meta) {
+		return nil, ErrSegmentCorrupt
+	}
+	seg := &segment{path: path, file: file, keys: make([][]byte, 0, n), offsets: make([]int64, 0, n), dataEnd: int64(indexOffset)}
+	for i := 0; i < n && d.Err() == nil; i++ {
+		seg.keys = append(seg.keys, d.ReadBytes())
+		seg.offsets = append(seg.offsets, d.ReadInt64())
+	}
+	if err := d.Finish(); err != nil {
+		return nil, ErrSegmentCorrupt
+	}
+	d = NewDecoder(meta[bloomOffset-indexOffset:])
+	sebloom := d.ReadBytes()
+	if err := d.Finish(); err != nil {
+		return nil, ErrSegmentCorrupt
+	}
+	if seg.bloom, err = DeserializeBloomFilter(sebloom); err != nil {
+		return nil, ErrSegmentCorrupt
+	}
+	seg.refs.Store(1)
+	return seg, nil
+}
+
+// 第一个不小于key的键的位置
+func (seg *segment) search(key []byte) int {
+	return sort.Search(len(seg.keys), func(i int) bool {
+		return bytes.Compare(seg.keys[i], key) >= 0
+	})
+}
+
+// 读取第i条记录
+func (seg *segment) readEntry(i int) (kvEntry, error) {
+	end := seg.dataEnd
+	if i+1 < len(seg.offsets) {
+		end = seg.offsets[i+1]
+	}
+	if seg.offsets[i] < 0 || seg.offsets[i] > end {
+		return kvEntry{}, ErrSegmentCorrupt
+	}
+	buf := make([]byte, end-seg.offsets[i])
+	if _, err := seg.file.ReadAt(buf, seg.offsets[i]); err != nil {
+		return kvEntry{}, err
+	}
+	d := NewDecoder(buf)
+	entry := decodeKVEntry(d)
+	if err := d.Finish(); err != nil || !bytes.Equal(entry.key, seg.keys[i]) {
+		return kvEntry{}, ErrSegmentCorrupt
+	}
+	return entry, nil
+}
+
+// 查找键，found为false表示该段中没有这个键
+func (seg *segment) get(key []byte) (entry kvEntry, found bool, err error) {
+	if !seg.bloom.MayContain(key) {
+		return kvEntry{}, false, nil
+	}
+	i := seg.search(key)
+	if i == len(seg.keys) || !bytes.Equal(seg.keys[i], key) {
+		return kvEntry{}, false, nil
+	}
+	entry, err = seg.readEntry(i)
+	return entry, err == nil, err
+}
+
+// 增加一个引用，迭代器在读取期间持有段文件，合并删除段文件后仍可读取
+func (seg *segment) acquire() {
+	seg.refs.Add(1)
+}
+
+// 释放一个引用，最后一个引用释放时关闭文件
+func (seg *segment) release() {
+	if seg.refs.Add(-1) == 0 {
+		seg.close()
+	}
+}
+
+func (seg *segment) close() error {
+	return seg.file.Close()
+}
@@ -0,0 +1,598 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// 嵌入式键值存储引擎（LSM结构）：
+// 写入先以批次为单位追加到预写日志并落盘，再写入内存表；
+// 内存表超过阈值后按键排序写成不可变的段文件，段文件过多时合并为一个；
+// 读取依次查找内存表和从新到旧的段文件，段文件的布隆过滤器用于跳过不包含该键的段。
+// 当前有效的段文件记录在MANIFEST中，MANIFEST通过写临时文件再重命名的方式原子更新，
+// 因此任何时刻崩溃，重启后都能恢复到最后一个写入成功的批次。
+
+var ErrKVNotFound = errors.New("kv: key not found")
+var ErrKVClosed = errors.New("kv: closed")
+var ErrKVManifest = errors.New("kv: corrupt manifest")
+
+const (
+	DefaultMemtableSize = 4 << 20 //内存表落盘的默认阈值（字节）
+	DefaultMaxSegments  = 4       //段文件数量超过该值时进行合并
+
+	kvWALFileName      = "kv.wal"
+	kvManifestFileName = "MANIFEST"
+	kvSegmentSuffix    = ".seg"
+)
+
+// 键值存储预写日志中的批次记录
+const walKVBatch WALRecordType = 0x80
+
+// DB 键值存储
+type DB struct {
+	dir   string
+	mutex sync.RWMutex
+
+	wal      *WAL               //内存表的预写日志
+	memtable map[string]kvEntry //内存表
+	memsize  int                //内存表的大致字节数
+	segments []*segment         //段文件，从旧到新排列
+	nextFile int                //下一个段文件的编号
+	closed   bool
+
+	MemtableSize int //内存表落盘的阈值（字节）
+	MaxSegments  int //段文件数量的上限，超过后合并
+}
+
+// OpenDB 打开（不存在则创建）目录dir下的键值存储
+func OpenDB(dir string) (*DB, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	db := &DB{dir: dir, memtable: make(map[string]kvEntry), MemtableSize: DefaultMemtableSize, MaxSegments: DefaultMaxSegments}
+	names, nextFile, err := readManifest(filepath.Join(dir, kvManifestFileName))
+	if err != nil {
+		return nil, err
+	}
+	db.nextFile = nextFile
+	for _, name := range names {
+		seg, err := openSegment(filepath.Join(dir, name))
+		if err != nil {
+			db.closeSegments()
+			return nil, err
+		}
+		db.segments = append(db.segments, seg)
+	}
+	//删除崩溃时遗留的、未记录在MANIFEST中的段文件和临时文件
+	if err := db.removeObsoleteFiles(names); err != nil {
+		db.closeSegments()
+		return nil, err
+	}
+	if db.wal, err = OpenWAL(filepath.Join(dir, kvWALFileName)); err != nil {
+		db.closeSegments()
+		return nil, err
+	}
+	err = db.wal.Replay(func(record WALRecord) error {
+		if record.Type != walKVBatch {
+			return nil
+		}
+		batch, err := decodeBatch(record.Data)
+		if err != nil {
+			return err
+		}
+		db.applyBatch(batch)
+		return nil
+	})
+	if err != nil {
+		db.wal.Close()
+		db.closeSegments()
+		return nil, err
+	}
+	return db, nil
+}
+
+// MANIFEST的格式：规范化编码的下一个段文件编号和段文件名列表，加4字节CRC32C校验和
+func readManifest(path string) ([]string, int, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, 0, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(data) < 4 || crc32.Checksum(data[:len(data)-4], walCRCTable) != binary.BigEndian.Uint32(data[len(data)-4:]) {
+		return nil, 0, ErrKVManifest
+	}
+	d := NewDecoder(data[:len(data)-4])
+	nextFile := d.ReadInt()
+	names := d.ReadStringList()
+	if err := d.Finish(); err != nil {
+		return nil, 0, ErrKVManifest
+	}
+	return names, nextFile, nil
+}
+
+func (db *DB) writeManifest() error {
+	names := make([]string, 0, len(db.segments))
+	for _, seg := range db.segments {
+		names = append(names, filepath.Base(seg.path))
+	}
+	e := NewEncoder()
+	e.WriteInt(db.nextFile)
+	e.WriteStringList(names)
+	data := binary.BigEndian.AppendUint32(e.Bytes(), crc32.Checksum(e.Bytes(), walCRCTable))
+	if err := writeFileSync(filepath.Join(db.dir, kvManifestFileName), data); err != nil {
+		return err
+	}
+	return syncDir(db.dir)
+}
+
+func (db *DB) removeObsoleteFiles(live []string) error {
+	files, err := os.ReadDir(db.dir)
+	if err != nil {
+		return err
+	}
+	isLive := make(map[string]bool, len(live))
+	for _, name := range live {
+		isLive[name] = true
+	}
+	for _, file := range files {
+		name := file.Name()
+		if strings.HasSuffix(name, ".tmp") || (strings.HasSuffix(name, kvSegmentSuffix) && !isLive[name]) {
+			if err := os.Remove(filepath.Join(db.dir, name)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (db *DB) closeSegments() {
+	for _, seg := range db.segments {
+		seg.release()
+	}
+}
+
+// Get 获取键对应的值，键不存在时返回ErrKVNotFound
+func (db *DB) Get(key []byte) ([]byte, error) {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	if db.closed {
+		return nil, ErrKVClosed
+	}
+	if entry, ok := db.memtable[string(key)]; ok {
+		if entry.deleted {
+			return nil, ErrKVNotFound
+		}
+		return append([]byte(nil), entry.value...), nil
+	}
+	for i := len(db.segments) - 1; i >= 0; i-- {
+		entry, found, err := db.segments[i].get(key)
+		if err != nil {
+			return nil, err
+		}
+		if found {
+			if entry.deleted {
+				return nil, ErrKVNotFound
+			}
+			return entry.value, nil
+		}
+	}
+	return nil, ErrKVNotFound
+}
+
+// Has 判断键是否存在
+func (db *DB) Has(key []byte) (bool, error) {
+	_, err := db.Get(key)
+	if err == ErrKVNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Put 写入一个键值对
+func (db *DB) Put(key []byte, value []byte) error {
+	batch := NewBatch()
+	batch.Put(key, value)
+	return db.Write(batch)
+}
+
+// Delete 删除一个键
+func (db *DB) Delete(key []byte) error {
+	batch := NewBatch()
+	batch.Delete(key)
+	return db.Write(batch)
+}
+
+// Write 原子地写入一个批次：崩溃后批次中的修改要么全部可见，要么全部不可见；
+// 返回nil时批次已经写入预写日志并落盘
+func (db *DB) Write(batch *Batch) error {
+	if batch.Len() == 0 {
+		return nil
+	}
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	if db.closed {
+		return ErrKVClosed
+	}
+	if err := db.wal.Append(WALRecord{Type: walKVBatch, Data: batch.encode()}); err != nil {
+		return err
+	}
+	db.applyBatch(batch)
+	//批次已经写入预写日志，落盘或合并失败不影响本次写入，只记录日志，下一次写入时重试
+	if err := db.maintain(); err != nil {
+		log.Println("kv:", db.dir, "flush or compaction failed, retrying on the next write:", err)
+	}
+	return nil
+}
+
+// 内存表超过阈值时落盘，段文件过多时合并（包括之前失败的合并）
+func (db *DB) maintain() error {
+	if db.memsize >= db.MemtableSize {
+		return db.flush()
+	}
+	if len(db.segments) > db.MaxSegments {
+		return db.compact()
+	}
+	return nil
+}
+
+func (db *DB) applyBatch(batch *Batch) {
+	for _, entry := range batch.entries {
+		if old, ok := db.memtable[string(entry.key)]; ok {
+			db.memsize -= len(old.key) + len(old.value)
+		}
+		db.memtable[string(entry.key)] = entry
+		db.memsize += len(entry.key) + len(entry.value)
+	}
+}
+
+// Flush 将内存表写成段文件
+func (db *DB) Flush() error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	if db.closed {
+		return ErrKVClosed
+	}
+	return db.flush()
+}
+
+func (db *DB) flush() error {
+	if len(db.memtable) == 0 {
+		return nil
+	}
+	entries := db.memtableSnapshot(nil)
+	//没有更旧的段时删除标记可以直接丢弃
+	if len(db.segments) == 0 {
+		entries = dropDeleted(entries)
+	}
+	err := db.addSegment(len(entries), func(sw *segmentWriter) error {
+		for _, entry := range entries {
+			if err := sw.add(entry); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	//段文件已经记录在MANIFEST中，内存表的预写日志可以清空
+	if err := db.wal.Compact(nil); err != nil {
+		return err
+	}
+	db.memtable = make(map[string]kvEntry)
+	db.memsize = 0
+	if len(db.segments) > db.MaxSegments {
+		return db.compact()
+	}
+	return nil
+}
+
+func dropDeleted(entries []kvEntry) []kvEntry {
+	live := entries[:0]
+	for _, entry := range entries {
+		if !entry.deleted {
+			live = append(live, entry)
+		}
+	}
+	return live
+}
+
+// 写成新的段文件并更新MANIFEST，fill按键升序向段文件写入记录，n为记录数量的上限
+func (db *DB) addSegment(n int, fill func(sw *segmentWriter) error) error {
+	name := fmt.Sprintf("%06d%s", db.nextFile, kvSegmentSuffix)
+	path := filepath.Join(db.dir, name)
+	sw, err := newSegmentWriter(path, n)
+	if err != nil {
+		return err
+	}
+	if err := fill(sw); err != nil {
+		sw.abort()
+		return err
+	}
+	if err := sw.finish(); err != nil {
+		return err
+	}
+	seg, err := openSegment(path)
+	if err != nil {
+		return err
+	}
+	db.nextFile++
+	db.segments = append(db.segments, seg)
+	if err := db.writeManifest(); err != nil {
+		db.segments = db.segments[:len(db.segments)-1]
+		seg.release()
+		return err
+	}
+	return nil
+}
+
+// Compact 将所有段文件合并为一个，合并时丢弃被覆盖的旧值和删除标记
+func (db *DB) Compact() error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	if db.closed {
+		return ErrKVClosed
+	}
+	return db.compact()
+}
+
+func (db *DB) compact() error {
+	if len(db.segments) <= 1 {
+		return nil
+	}
+	old := db.segments
+	n := 0
+	for _, seg := range old {
+		n += len(seg.keys)
+	}
+	//逐条归并所有段文件并直接写入新的段文件，所有段都参与合并，删除标记可以丢弃
+	merged := newMergeIterator(nil, old, nil)
+	db.segments = nil
+	err := db.addSegment(n, func(sw *segmentWriter) error {
+		for {
+			entry, ok, err := merged.next()
+			if err != nil || !ok {
+				return err
+			}
+			if err := sw.add(entry); err != nil {
+				return err
+			}
+		}
+	})
+	if err != nil {
+		db.segments = old
+		return err
+	}
+	//新的MANIFEST已经生效，删除旧的段文件；仍在读取的迭代器持有引用，文件在其释放后关闭
+	for _, seg := range old {
+		os.Remove(seg.path)
+		seg.release()
+	}
+	return nil
+}
+
+// 内存表中以prefix开头的记录按键排序后的快照（包含删除标记）
+func (db *DB) memtableSnapshot(prefix []byte) []kvEntry {
+	entries := make([]kvEntry, 0)
+	for key, entry := range db.memtable {
+		if strings.HasPrefix(key, string(prefix)) {
+			entries = append(entries, entry)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return bytes.Compare(entries[i].key, entries[j].key) < 0
+	})
+	return entries
+}
+
+// 归并中的一个有序输入：一个段文件中以前缀开头的记录，或内存表的快照
+type kvCursor struct {
+	seg     *segment  //为nil时读取entries
+	entries []kvEntry //内存表快照
+	pos     int
+	end     int
+}
+
+func newSegmentCursor(seg *segment, prefix []byte) *kvCursor {
+	start := seg.search(prefix)
+	//段中的键有序，以prefix开头的键是连续的一段
+	end := start + sort.Search(len(seg.keys)-start, func(i int) bool {
+		return !bytes.HasPrefix(seg.keys[start+i], prefix)
+	})
+	return &kvCursor{seg: seg, pos: start, end: end}
+}
+
+func (c *kvCursor) valid() bool {
+	return c.pos < c.end
+}
+
+func (c *kvCursor) key() []byte {
+	if c.seg != nil {
+		return c.seg.keys[c.pos]
+	}
+	return c.entries[c.pos].key
+}
+
+func (c *kvCursor) entry() (kvEntry, error) {
+	if c.seg != nil {
+		return c.seg.readEntry(c.pos)
+	}
+	return c.entries[c.pos], nil
+}
+
+// 多路归并：每次取所有输入中最小的键，同一个键只取最新输入中的记录，并跳过删除标记。
+// 输入的数量不超过段文件数量加一，因此逐个比较即可；被覆盖的旧记录只比较键，不读取文件
+type mergeIterator struct {
+	cursors []*kvCursor //从旧到新排列
+}
+
+// 在段文件（从旧到新）和内存表快照之上创建归并迭代器，只包含以prefix开头的记录
+func newMergeIterator(memtable []kvEntry, segments []*segment, prefix []byte) *mergeIterator {
+	m := &mergeIterator{cursors: make([]*kvCursor, 0, len(segments)+1)}
+	for _, seg := range segments {
+		m.cursors = append(m.cursors, newSegmentCursor(seg, prefix))
+	}
+	m.cursors = append(m.cursors, &kvCursor{entries: memtable, end: len(memtable)})
+	return m
+}
+
+// 返回下一条未被删除的记录，ok为false表示已经没有更多记录
+func (m *mergeIterator) next() (entry kvEntry, ok bool, err error) {
+	for {
+		newest := -1
+		for i, c := range m.cursors {
+			//键相同时后面的（更新的）输入优先
+			if c.valid() && (newest < 0 || bytes.Compare(c.key(), m.cursors[newest].key()) <= 0) {
+				newest = i
+			}
+		}
+		if newest < 0 {
+			return kvEntry{}, false, nil
+		}
+		key := m.cursors[newest].key()
+		if entry, err = m.cursors[newest].entry(); err != nil {
+			return kvEntry{}, false, err
+		}
+		for _, c := range m.cursors {
+			if c.valid() && bytes.Equal(c.key(), key) {
+				c.pos++
+			}
+		}
+		if !entry.deleted {
+			return entry, true, nil
+		}
+	}
+}
+
+// NewIterator 创建按键升序遍历所有以prefix开头的键值对的迭代器，prefix为nil时遍历全部
+// 迭代器在创建时获取数据的快照，之后的写入对其不可见；遍历时逐条归并内存表和段文件，
+// 不会把全部数据读入内存。迭代器持有段文件的引用，遍历结束或调用Release后释放
+func (db *DB) NewIterator(prefix []byte) *Iterator {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	if db.closed {
+		return &Iterator{err: ErrKVClosed}
+	}
+	segments := append([]*segment(nil), db.segments...)
+	for _, seg := range segments {
+		seg.acquire()
+	}
+	return &Iterator{merged: newMergeIterator(db.memtableSnapshot(prefix), segments, prefix), segments: segments}
+}
+
+// Close 关闭键值存储
+func (db *DB) Close() error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	if db.closed {
+		return nil
+	}
+	db.closed = true
+	db.closeSegments()
+	return db.wal.Close()
+}
+
+// Batch 一组原子写入的修改
+type Batch struct {
+	entries []kvEntry
+}
+
+func NewBatch() *Batch {
+	return &Batch{make([]kvEntry, 0)}
+}
+
+// Put 在批次中写入一个键值对
+func (batch *Batch) Put(key []byte, value []byte) {
+	batch.entries = append(batch.entries, kvEntry{key: append([]byte(nil), key...), value: append([]byte(nil), value...)})
+}
+
+// Delete 在批次中删除一个键
+func (batch *Batch) Delete(key []byte) {
+	batch.entries = append(batch.entries, kvEntry{key: append([]byte(nil), key...), deleted: true})
+}
+
+// Len 批次中的修改数量
+func (batch *Batch) Len() int {
+	return len(batch.entries)
+}
+
+func (batch *Batch) encode() []byte {
+	e := NewEncoder()
+	e.WriteInt(len(batch.entries))
+	for _, entry := range batch.entries {
+		encodeKVEntry(e, entry)
+	}
+	return e.Bytes()
+}
+
+func decodeBatch(data []byte) (*Batch, error) {
+	d := NewDecoder(data)
+	n := d.ReadInt()
+	batch := NewBatch()
+	for i := 0; i < n && d.Err() == nil; i++ {
+		batch.entries = append(batch.entries, decodeKVEntry(d))
+	}
+	if err := d.Finish(); err != nil {
+		return nil, err
+	}
+	return batch, nil
+}
+
+// Iterator 键值对迭代器，先调用Next移动到第一个键值对
+type Iterator struct {
+	merged   *mergeIterator
+	segments []*segment //持有引用的段文件
+	entry    kvEntry
+	err      error
+}
+
+// Next 移动到下一个键值对，没有更多键值对或出错时返回false并释放迭代器
+func (it *Iterator) Next() bool {
+	if it.err != nil || it.merged == nil {
+		return false
+	}
+	entry, ok, err := it.merged.next()
+	if err != nil || !ok {
+		it.err = err
+		it.Release()
+		return false
+	}
+	it.entry = entry
+	return true
+}
+
+func (it *Iterator) Key() []byte {
+	return it.entry.key
+}
+
+func (it *Iterator) Value() []byte {
+	return it.entry.value
+}
+
+// Err 迭代器创建或遍历时出现的错误
+func (it *Iterator) Err() error {
+	return it.err
+}
+
+// Release 释放迭代器持有的段文件，提前结束遍历时调用；可以重复调用
+func (it *Iterator) Release() {
+	if it.merged == nil {
+		return
+	}
+	it.merged = nil
+	for _, seg := range it.segments {
+		seg.release()
+	}
+	it.segments = nil
+}
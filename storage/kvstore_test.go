@@ -0,0 +1,766 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// 键值存储的期望内容
+type kvModel map[string]string
+
+func (m kvModel) apply(batch *Batch) {
+	for _, entry := range batch.entries {
+		if entry.deleted {
+			delete(m, string(entry.key))
+		} else {
+			m[string(entry.key)] = string(entry.value)
+		}
+	}
+}
+
+// 随机批次：在少量键上写入和删除，使批次之间相互覆盖
+func randomBatch(rng *rand.Rand, seq int) *Batch {
+	batch := NewBatch()
+	for i, n := 0, 1+rng.Intn(6); i < n; i++ {
+		key := []byte(fmt.Sprintf("key-%02d", rng.Intn(40)))
+		if rng.Intn(4) == 0 {
+			batch.Delete(key)
+		} else {
+			batch.Put(key, []byte(fmt.Sprintf("value-%d-%d-%s", seq, i, strings.Repeat("x", rng.Intn(64)))))
+		}
+	}
+	return batch
+}
+
+func openTestDB(t *testing.T, dir string) *DB {
+	t.Helper()
+	db, err := OpenDB(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// 检查键值存储的内容与期望完全一致：遍历的结果以及touched中每个键的Get结果
+func checkDB(t *testing.T, db *DB, want kvModel, touched map[string]bool) {
+	t.Helper()
+	keys := make([]string, 0, len(want))
+	for k := range want {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	it := db.NewIterator(nil)
+	i := 0
+	for it.Next() {
+		if i >= len(keys) || string(it.Key()) != keys[i] || string(it.Value()) != want[keys[i]] {
+			t.Fatalf("iterator entry %d = %q:%q, want %d keys %v", i, it.Key(), it.Value(), len(keys), keys)
+		}
+		i++
+	}
+	if it.Err() != nil {
+		t.Fatal(it.Err())
+	}
+	if i != len(keys) {
+		t.Fatalf("iterator returned %d entries, want %d", i, len(keys))
+	}
+	for key := range touched {
+		value, err := db.Get([]byte(key))
+		expected, ok := want[key]
+		switch {
+		case ok && (err != nil || string(value) != expected):
+			t.Fatalf("Get(%q) = %q, %v, want %q", key, value, err, expected)
+		case !ok && err != ErrKVNotFound:
+			t.Fatalf("Get(%q) = %q, %v, want ErrKVNotFound", key, value, err)
+		}
+	}
+}
+
+func touchedKeys(batches ...*Batch) map[string]bool {
+	touched := make(map[string]bool)
+	for _, batch := range batches {
+		for _, entry := range batch.entries {
+			touched[string(entry.key)] = true
+		}
+	}
+	return touched
+}
+
+// 复制目录中的所有文件，相当于在此刻崩溃后磁盘上留下的内容（每次写入都已落盘）
+func copyDir(t *testing.T, src string, dst string) {
+	t.Helper()
+	files, err := os.ReadDir(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(dst, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range files {
+		data, err := os.ReadFile(filepath.Join(src, file.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dst, file.Name()), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func readFile(t *testing.T, path string) []byte {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func writeFile(t *testing.T, path string, data []byte) {
+	t.Helper()
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// 重新打开后不能留下临时文件和未记录在MANIFEST中的段文件
+func checkNoObsoleteFiles(t *testing.T, dir string) {
+	t.Helper()
+	names, _, err := readManifest(filepath.Join(dir, kvManifestFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	live := make(map[string]bool)
+	for _, name := range names {
+		live[name] = true
+	}
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range files {
+		name := file.Name()
+		if strings.HasSuffix(name, ".tmp") || (strings.HasSuffix(name, kvSegmentSuffix) && !live[name]) {
+			t.Errorf("obsolete file %s left after reopen", name)
+		}
+	}
+}
+
+func TestKVReopen(t *testing.T) {
+	dir := t.TempDir()
+	db := openTestDB(t, dir)
+	db.MemtableSize = 512
+	rng := rand.New(rand.NewSource(1))
+	model := make(kvModel)
+	var batches []*Batch
+	for i := 0; i < 200; i++ {
+		batch := randomBatch(rng, i)
+		if err := db.Write(batch); err != nil {
+			t.Fatal(err)
+		}
+		model.apply(batch)
+		batches = append(batches, batch)
+	}
+	touched := touchedKeys(batches...)
+	checkDB(t, db, model, touched)
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Get([]byte("key-00")); err != ErrKVClosed {
+		t.Errorf("Get after Close = %v, want ErrKVClosed", err)
+	}
+	if err := db.Put([]byte("key-00"), nil); err != ErrKVClosed {
+		t.Errorf("Put after Close = %v, want ErrKVClosed", err)
+	}
+	db = openTestDB(t, dir)
+	defer db.Close()
+	checkDB(t, db, model, touched)
+}
+
+// 预写日志中最后一个批次只写了一部分（任意偏移处崩溃）：之前确认的批次全部存在，该批次完全不存在
+func TestKVTornWALWrite(t *testing.T) {
+	for seed := int64(0); seed < 50; seed++ {
+		rng := rand.New(rand.NewSource(seed))
+		dir := t.TempDir()
+		db := openTestDB(t, dir)
+		model := make(kvModel)
+		var batches []*Batch
+		for i, n := 0, 1+rng.Intn(20); i < n; i++ {
+			batch := randomBatch(rng, i)
+			if err := db.Write(batch); err != nil {
+				t.Fatal(err)
+			}
+			model.apply(batch)
+			batches = append(batches, batch)
+		}
+		//部分数据已经落盘成段文件
+		if seed%2 == 1 {
+			if err := db.Flush(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		db.Close()
+
+		torn := randomBatch(rng, len(batches))
+		record := encodeWALRecord(WALRecord{Type: walKVBatch, Data: torn.encode()})
+		cut := rng.Intn(len(record))
+		file, err := os.OpenFile(filepath.Join(dir, kvWALFileName), os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		file.Write(record[:cut])
+		file.Close()
+
+		touched := touchedKeys(append(batches, torn)...)
+		db = openTestDB(t, dir)
+		checkDB(t, db, model, touched)
+		//截断不完整的记录之后，新的批次能够正常追加和重放
+		next := randomBatch(rng, len(batches)+1)
+		if err := db.Write(next); err != nil {
+			t.Fatal(err)
+		}
+		model.apply(next)
+		db.Close()
+		db = openTestDB(t, dir)
+		checkDB(t, db, model, touchedKeys(next))
+		checkDB(t, db, model, touched)
+		db.Close()
+	}
+}
+
+// 在整个预写日志的任意偏移处截断：完整落在截断点之前的批次存在，其余批次完全不存在
+func TestKVTruncatedWAL(t *testing.T) {
+	rng := rand.New(rand.NewSource(7))
+	dir := t.TempDir()
+	db := openTestDB(t, dir)
+	var batches []*Batch
+	var ends []int //每个批次的记录在日志中的结束位置
+	size := 0
+	for i := 0; i < 30; i++ {
+		batch := randomBatch(rng, i)
+		if err := db.Write(batch); err != nil {
+			t.Fatal(err)
+		}
+		size += len(encodeWALRecord(WALRecord{Type: walKVBatch, Data: batch.encode()}))
+		batches = append(batches, batch)
+		ends = append(ends, size)
+	}
+	db.Close()
+	wal := readFile(t, filepath.Join(dir, kvWALFileName))
+	if len(wal) != size {
+		t.Fatalf("WAL has %d bytes, want %d", len(wal), size)
+	}
+	touched := touchedKeys(batches...)
+	for trial := 0; trial < 100; trial++ {
+		cut := rng.Intn(len(wal) + 1)
+		crashed := t.TempDir()
+		writeFile(t, filepath.Join(crashed, kvWALFileName), wal[:cut])
+		model := make(kvModel)
+		for i, batch := range batches {
+			if ends[i] <= cut {
+				model.apply(batch)
+			}
+		}
+		db := openTestDB(t, crashed)
+		checkDB(t, db, model, touched)
+		db.Close()
+	}
+}
+
+// 对base的副本执行op（不改变内容的落盘或合并），然后构造op执行过程中各个时刻崩溃后磁盘上的状态：
+// 段文件的临时文件写了一部分、段文件已重命名但MANIFEST的临时文件写了一部分、
+// 新的MANIFEST已生效但预写日志尚未清空或旧的段文件尚未删除。
+// 每个状态重新打开后内容都必须与model一致
+func checkCrashDuring(t *testing.T, rng *rand.Rand, base string, model kvModel, touched map[string]bool, op func(db *DB) error) {
+	t.Helper()
+	after := t.TempDir()
+	copyDir(t, base, after)
+	db := openTestDB(t, after)
+	db.MaxSegments = 1 << 10
+	if err := op(db); err != nil {
+		t.Fatal(err)
+	}
+	checkDB(t, db, model, touched)
+	db.Close()
+
+	oldManifest, _ := os.ReadFile(filepath.Join(base, kvManifestFileName))
+	newManifest := readFile(t, filepath.Join(after, kvManifestFileName))
+	if bytes.Equal(oldManifest, newManifest) {
+		t.Fatal("op did not change the MANIFEST")
+	}
+	names, _, err := readManifest(filepath.Join(after, kvManifestFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var newSegments []string
+	for _, name := range names {
+		if _, err := os.Stat(filepath.Join(base, name)); os.IsNotExist(err) {
+			newSegments = append(newSegments, name)
+		}
+	}
+	if len(newSegments) != 1 {
+		t.Fatalf("op wrote %d segments, want 1", len(newSegments))
+	}
+	segName := newSegments[0]
+	segData := readFile(t, filepath.Join(after, segName))
+
+	crashes := map[string]func(dir string){
+		"segment write": func(dir string) {
+			writeFile(t, filepath.Join(dir, segName+".tmp"), segData[:rng.Intn(len(segData))])
+		},
+		"segment rename": func(dir string) {
+			writeFile(t, filepath.Join(dir, segName), segData)
+		},
+		"manifest write": func(dir string) {
+			writeFile(t, filepath.Join(dir, segName), segData)
+			writeFile(t, filepath.Join(dir, kvManifestFileName+".tmp"), newManifest[:rng.Intn(len(newManifest))])
+		},
+		"manifest rename": func(dir string) {
+			writeFile(t, filepath.Join(dir, segName), segData)
+			writeFile(t, filepath.Join(dir, kvManifestFileName), newManifest)
+		},
+	}
+	for name, crash := range crashes {
+		for trial := 0; trial < 5; trial++ {
+			dir := t.TempDir()
+			copyDir(t, base, dir)
+			crash(dir)
+			db, err := OpenDB(dir)
+			if err != nil {
+				t.Fatalf("crash during %s: %v", name, err)
+			}
+			checkDB(t, db, model, touched)
+			checkNoObsoleteFiles(t, dir)
+			db.Close()
+		}
+	}
+}
+
+func TestKVCrashDuringFlush(t *testing.T) {
+	rng := rand.New(rand.NewSource(3))
+	for round := 0; round < 3; round++ {
+		base := t.TempDir()
+		db := openTestDB(t, base)
+		db.MaxSegments = 1 << 10
+		model := make(kvModel)
+		var batches []*Batch
+		//round个已有的段文件加上预写日志中的批次
+		for s := 0; s <= round; s++ {
+			for i := 0; i < 15; i++ {
+				batch := randomBatch(rng, s*100+i)
+				if err := db.Write(batch); err != nil {
+					t.Fatal(err)
+				}
+				model.apply(batch)
+				batches = append(batches, batch)
+			}
+			if s < round {
+				if err := db.Flush(); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		db.Close()
+		checkCrashDuring(t, rng, base, model, touchedKeys(batches...), (*DB).Flush)
+	}
+}
+
+func TestKVCrashDuringCompaction(t *testing.T) {
+	rng := rand.New(rand.NewSource(4))
+	base := t.TempDir()
+	db := openTestDB(t, base)
+	db.MaxSegments = 1 << 10
+	model := make(kvModel)
+	var batches []*Batch
+	for s := 0; s < 4; s++ {
+		for i := 0; i < 15; i++ {
+			batch := randomBatch(rng, s*100+i)
+			if err := db.Write(batch); err != nil {
+				t.Fatal(err)
+			}
+			model.apply(batch)
+			batches = append(batches, batch)
+		}
+		if err := db.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	//预写日志中还有未落盘的批次
+	for i := 0; i < 5; i++ {
+		batch := randomBatch(rng, 1000+i)
+		if err := db.Write(batch); err != nil {
+			t.Fatal(err)
+		}
+		model.apply(batch)
+		batches = append(batches, batch)
+	}
+	if len(db.segments) != 4 {
+		t.Fatalf("%d segments before compaction, want 4", len(db.segments))
+	}
+	db.Close()
+	checkCrashDuring(t, rng, base, model, touchedKeys(batches...), (*DB).Compact)
+
+	//合并后只剩一个段文件，且其中不再有删除标记
+	db = openTestDB(t, base)
+	defer db.Close()
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if len(db.segments) != 1 {
+		t.Fatalf("%d segments after compaction, want 1", len(db.segments))
+	}
+	for i := range db.segments[0].keys {
+		entry, err := db.segments[0].readEntry(i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if entry.deleted {
+			t.Errorf("tombstone for %q survived compaction", entry.key)
+		}
+	}
+	checkDB(t, db, model, touchedKeys(batches...))
+}
+
+// 段文件过多时写入会自动合并
+func TestKVAutoCompaction(t *testing.T) {
+	db := openTestDB(t, t.TempDir())
+	defer db.Close()
+	db.MemtableSize = 256
+	db.MaxSegments = 3
+	rng := rand.New(rand.NewSource(5))
+	model := make(kvModel)
+	var batches []*Batch
+	for i := 0; i < 300; i++ {
+		batch := randomBatch(rng, i)
+		if err := db.Write(batch); err != nil {
+			t.Fatal(err)
+		}
+		model.apply(batch)
+		batches = append(batches, batch)
+		if len(db.segments) > db.MaxSegments {
+			t.Fatalf("%d segments, limit %d", len(db.segments), db.MaxSegments)
+		}
+	}
+	checkDB(t, db, model, touchedKeys(batches...))
+}
+
+// 在段文件的临时路径上创建目录，使写入下一个（或之后第skip个）段文件失败
+func blockSegment(t *testing.T, db *DB, skip int) string {
+	path := filepath.Join(db.dir, fmt.Sprintf("%06d%s.tmp", db.nextFile+skip, kvSegmentSuffix))
+	if err := os.Mkdir(path, 0755); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// 批次写入预写日志后，落盘或合并失败不使写入失败，之后的写入重试
+func TestKVFlushFailure(t *testing.T) {
+	dir := t.TempDir()
+	db := openTestDB(t, dir)
+	db.MemtableSize = 256
+	rng := rand.New(rand.NewSource(6))
+	model := make(kvModel)
+	var batches []*Batch
+	write := func() {
+		t.Helper()
+		batch := randomBatch(rng, len(batches))
+		if err := db.Write(batch); err != nil {
+			t.Fatalf("write reported a failed flush: %v", err)
+		}
+		model.apply(batch)
+		batches = append(batches, batch)
+	}
+
+	blocked := blockSegment(t, db, 0)
+	for db.memsize < 2*db.MemtableSize {
+		write()
+	}
+	if len(db.segments) != 0 {
+		t.Fatalf("%d segments written while blocked", len(db.segments))
+	}
+	checkDB(t, db, model, touchedKeys(batches...))
+	os.Remove(blocked)
+	write()
+	if len(db.segments) != 1 || db.memsize != 0 {
+		t.Fatalf("flush not retried: %d segments, memtable %d bytes", len(db.segments), db.memsize)
+	}
+
+	//合并失败时同样在之后的写入中重试
+	db.MaxSegments = 1
+	blocked = blockSegment(t, db, 1)
+	for len(db.segments) < 2 {
+		write()
+	}
+	os.Remove(blocked)
+	write()
+	if len(db.segments) != 1 {
+		t.Fatalf("compaction not retried: %d segments", len(db.segments))
+	}
+	checkDB(t, db, model, touchedKeys(batches...))
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db = openTestDB(t, dir)
+	defer db.Close()
+	checkDB(t, db, model, touchedKeys(batches...))
+	checkNoObsoleteFiles(t, dir)
+}
+
+// 已生效的MANIFEST或段文件损坏时打开失败，而不是静默地丢失数据
+func TestKVCorruptFiles(t *testing.T) {
+	base := t.TempDir()
+	db := openTestDB(t, base)
+	for i := 0; i < 10; i++ {
+		db.Put([]byte(fmt.Sprintf("key-%d", i)), []byte("value"))
+	}
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	names := make([]string, 0)
+	for _, seg := range db.segments {
+		names = append(names, filepath.Base(seg.path))
+	}
+	db.Close()
+
+	manifest := readFile(t, filepath.Join(base, kvManifestFileName))
+	for cut := 0; cut < len(manifest); cut++ {
+		dir := t.TempDir()
+		copyDir(t, base, dir)
+		writeFile(t, filepath.Join(dir, kvManifestFileName), manifest[:cut])
+		if _, err := OpenDB(dir); err != ErrKVManifest {
+			t.Fatalf("MANIFEST truncated to %d bytes: %v, want ErrKVManifest", cut, err)
+		}
+	}
+
+	segData := readFile(t, filepath.Join(base, names[0]))
+	for _, pos := range []int{0, len(segData) / 2, len(segData) - 1} {
+		dir := t.TempDir()
+		copyDir(t, base, dir)
+		corrupt := append([]byte(nil), segData...)
+		corrupt[pos] ^= 0x01
+		writeFile(t, filepath.Join(dir, names[0]), corrupt)
+		if _, err := OpenDB(dir); err != ErrSegmentCorrupt {
+			t.Fatalf("segment byte %d flipped: %v, want ErrSegmentCorrupt", pos, err)
+		}
+	}
+	dir := t.TempDir()
+	copyDir(t, base, dir)
+	writeFile(t, filepath.Join(dir, names[0]), segData[:len(segData)/2])
+	if _, err := OpenDB(dir); err != ErrSegmentCorrupt {
+		t.Fatalf("truncated segment: %v, want ErrSegmentCorrupt", err)
+	}
+}
+
+func TestKVPrefixIterator(t *testing.T) {
+	db := openTestDB(t, t.TempDir())
+	defer db.Close()
+	db.MaxSegments = 1 << 10
+	put := func(key string, value string) {
+		if err := db.Put([]byte(key), []byte(value)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	//旧的段、较新的段和内存表中的值相互覆盖
+	put("a/1", "old")
+	put("a/2", "old")
+	put("a/3", "old")
+	put("b/1", "old")
+	put("a", "no slash")
+	db.Flush()
+	put("a/2", "new")
+	db.Delete([]byte("a/3"))
+	put("a/4", "segment")
+	db.Flush()
+	put("a/0", "memtable")
+	db.Delete([]byte("a/4"))
+	put("ab", "other prefix")
+	put("c/1", "memtable")
+
+	collect := func(it *Iterator) []string {
+		var got []string
+		for it.Next() {
+			got = append(got, string(it.Key())+"="+string(it.Value()))
+		}
+		if it.Err() != nil {
+			t.Fatal(it.Err())
+		}
+		return got
+	}
+	cases := []struct {
+		prefix string
+		want   []string
+	}{
+		{"a/", []string{"a/0=memtable", "a/1=old", "a/2=new"}},
+		{"a", []string{"a=no slash", "a/0=memtable", "a/1=old", "a/2=new", "ab=other prefix"}},
+		{"b/", []string{"b/1=old"}},
+		{"c/", []string{"c/1=memtable"}},
+		{"d/", nil},
+	}
+	for _, tc := range cases {
+		if got := collect(db.NewIterator([]byte(tc.prefix))); strings.Join(got, ",") != strings.Join(tc.want, ",") {
+			t.Errorf("prefix %q: %v, want %v", tc.prefix, got, tc.want)
+		}
+	}
+	if got := collect(db.NewIterator(nil)); len(got) != 7 {
+		t.Errorf("full iteration returned %v", got)
+	}
+
+	//迭代器创建之后的写入对其不可见
+	it := db.NewIterator([]byte("a/"))
+	put("a/5", "later")
+	db.Delete([]byte("a/1"))
+	if got := collect(it); strings.Join(got, ",") != "a/0=memtable,a/1=old,a/2=new" {
+		t.Errorf("iterator saw later writes: %v", got)
+	}
+
+	db.Close()
+	it = db.NewIterator(nil)
+	if it.Next() || !errors.Is(it.Err(), ErrKVClosed) {
+		t.Errorf("iterator on a closed store: %v", it.Err())
+	}
+}
+
+// 迭代器持有段文件：遍历期间合并删除旧的段文件、关闭存储都不影响遍历，遍历结束或释放后关闭段文件
+func TestKVIteratorHoldsSegments(t *testing.T) {
+	db := openTestDB(t, t.TempDir())
+	db.MaxSegments = 1 << 10
+	const n = 300
+	for i := 0; i < n; i++ {
+		if err := db.Put([]byte(fmt.Sprintf("key-%04d", i)), []byte(fmt.Sprintf("value-%d", i))); err != nil {
+			t.Fatal(err)
+		}
+		if i%100 == 99 {
+			if err := db.Flush(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	old := append([]*segment(nil), db.segments...)
+	it := db.NewIterator(nil)
+	released := db.NewIterator([]byte("key-01"))
+	if !released.Next() || string(released.Key()) != "key-0100" {
+		t.Fatal("prefix iterator did not start at key-0100")
+	}
+	released.Release()
+	released.Release()
+	if released.Next() {
+		t.Error("released iterator moved")
+	}
+	for i := 0; i < n/2; i++ {
+		if !it.Next() || string(it.Key()) != fmt.Sprintf("key-%04d", i) {
+			t.Fatalf("entry %d: %q, %v", i, it.Key(), it.Err())
+		}
+	}
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	for _, seg := range old {
+		if _, err := os.Stat(seg.path); !os.IsNotExist(err) {
+			t.Errorf("%s not removed by compaction: %v", seg.path, err)
+		}
+		if refs := seg.refs.Load(); refs != 1 {
+			t.Errorf("%s has %d references during iteration, want 1", seg.path, refs)
+		}
+	}
+	for i := n / 2; i < n; i++ {
+		if !it.Next() || string(it.Key()) != fmt.Sprintf("key-%04d", i) || string(it.Value()) != fmt.Sprintf("value-%d", i) {
+			t.Fatalf("entry %d after compaction: %q=%q, %v", i, it.Key(), it.Value(), it.Err())
+		}
+	}
+	if it.Next() || it.Err() != nil {
+		t.Fatalf("iterator did not end cleanly: %v", it.Err())
+	}
+	for _, seg := range old {
+		if refs := seg.refs.Load(); refs != 0 {
+			t.Errorf("%s has %d references after iteration, want 0", seg.path, refs)
+		}
+	}
+}
+
+func TestBloomFilter(t *testing.T) {
+	const n = 2000
+	bf := NewBloomFilter(n, segmentBitsPerKey)
+	for i := 0; i < n; i++ {
+		bf.Add([]byte(fmt.Sprintf("present-%d", i)))
+	}
+	for i := 0; i < n; i++ {
+		if !bf.MayContain([]byte(fmt.Sprintf("present-%d", i))) {
+			t.Fatalf("false negative for present-%d", i)
+		}
+	}
+	falsePositives := 0
+	for i := 0; i < n; i++ {
+		if bf.MayContain([]byte(fmt.Sprintf("absent-%d", i))) {
+			falsePositives++
+		}
+	}
+	//每个键10位时误判率约1%
+	if falsePositives > n/20 {
+		t.Errorf("%d false positives out of %d", falsePositives, n)
+	}
+
+	decoded, err := DeserializeBloomFilter(bf.Serialize())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Hashes != bf.Hashes || !bytes.Equal(decoded.Bits, bf.Bits) {
+		t.Error("bloom filter changed after serialization")
+	}
+	e := NewEncoder()
+	e.WriteInt(0)
+	e.WriteBytes(bf.Bits)
+	if _, err := DeserializeBloomFilter(e.Bytes()); err != ErrBloomFormat {
+		t.Errorf("zero hash functions: %v, want ErrBloomFormat", err)
+	}
+	if _, err := DeserializeBloomFilter(bf.Serialize()[:10]); err == nil {
+		t.Error("truncated bloom filter accepted")
+	}
+}
+
+// 布隆过滤器排除的键不读取段文件：关闭段文件后查询这些键仍然返回不存在
+func TestSegmentBloomNegative(t *testing.T) {
+	var entries []kvEntry
+	for i := 0; i < 500; i++ {
+		entries = append(entries, kvEntry{key: []byte(fmt.Sprintf("key-%04d", i)), value: []byte("value")})
+	}
+	path := filepath.Join(t.TempDir(), "000000"+kvSegmentSuffix)
+	if err := writeSegment(path, entries); err != nil {
+		t.Fatal(err)
+	}
+	seg, err := openSegment(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		got, found, err := seg.get(entry.key)
+		if err != nil || !found || !bytes.Equal(got.value, entry.value) {
+			t.Fatalf("get(%q) = %q, %v, %v", entry.key, got.value, found, err)
+		}
+	}
+	seg.close()
+	excluded := 0
+	for i := 0; i < 500; i++ {
+		key := []byte(fmt.Sprintf("missing-%04d", i))
+		if seg.bloom.MayContain(key) {
+			continue
+		}
+		excluded++
+		if _, found, err := seg.get(key); found || err != nil {
+			t.Fatalf("get(%q) on a closed segment = %v, %v", key, found, err)
+		}
+	}
+	if excluded < 450 {
+		t.Errorf("bloom filter excluded only %d of 500 missing keys", excluded)
+	}
+	//存在的键需要读取记录，文件已关闭时返回读取错误
+	if _, found, err := seg.get([]byte("key-0000")); err == nil || found {
+		t.Errorf("get of a present key on a closed segment = %v, %v, want a read error", found, err)
+	}
+}
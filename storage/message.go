@@ -3,8 +3,9 @@ package storage
 import (
 	"crypto/sha256"
 	"encoding/hex"
-	"encoding/json"
-	"log"
+	"errors"
+	"fmt"
+	"simplechain/utils"
 )
 
 type Message struct {
@@ -12,12 +13,25 @@ type Message struct {
 	ID      int
 }
 
+// 每个请求最多声明的主题个数
+const MaxRequestTopics = 8
+
 // <REQUEST,o,t,c>
 type Request struct {
 	Message
 	Timestamp int64
 	//相当于clientID
 	ClientAddr string
+	//用户声明的主题，与发送者一起计入区块的布隆过滤器，便于按主题扫描交易，最多MaxRequestTopics个
+	Topics []string
+	//发送者的第几笔交易（从0开始），必须按顺序连续使用，防止请求被重放
+	Nonce int
+	//客户端愿意支付的费用（优先级），按优先级打包时费用高的请求先打包，不能为负
+	Fee int
+	//签名公钥的ID，即注册在P2P网络中的客户端ID，该客户端的地址必须是ClientAddr
+	PubKeyID string
+	//客户端对SigningBytes的签名
+	Sign []byte
 }
 
 // <<PRE-PREPARE,v,n,d>,m>
@@ -49,50 +63,371 @@ type Reply struct {
 	MessageID int
 	NodeID    string
 	Result    bool
+	Height    int //请求所在的区块高度
+}
+
+// 区块同步请求：请求[FromHeight, ToHeight)范围内的区块，ToHeight为0表示直到对方的最新高度
+type SyncRequest struct {
+	NodeID      string
+	FromHeight  int
+	ToHeight    int
+	HeadersOnly bool //只请求带证书的区块头（轻节点）
+}
+
+// 区块同步响应
+type SyncResponse struct {
+	NodeID  string   //响应节点ID
+	Height  int      //响应节点当前的区块高度
+	Blocks  [][]byte //带提交证书的区块编码，按高度递增
+	Headers [][]byte //只请求区块头时为带证书的区块头编码，按高度递增
+}
+
+// 快照请求：请求对方最新的快照
+type SnapshotRequest struct {
+	NodeID string
+}
+
+// 快照清单
+type SnapshotManifest struct {
+	NodeID      string   //响应节点ID
+	Height      int      //检查点区块高度
+	Header      []byte   //带证书的检查点区块头编码
+	ChunkHashes [][]byte //各分块的哈希
+}
+
+// 快照分块请求
+type SnapshotChunkRequest struct {
+	NodeID string
+	Height int
+	Index  int
+}
+
+// 快照分块
+type SnapshotChunk struct {
+	NodeID string
+	Height int
+	Index  int
+	Data   []byte
+}
+
+// nonce查询请求：查询发送者下一笔交易应使用的nonce
+type NonceRequest struct {
+	NodeID string //请求方ID
+	Sender string //发送者（客户端地址）
 }
 
-const prefixCMDLength = 12
+// nonce查询响应
+type NonceResponse struct {
+	NodeID string
+	Sender string
+	Nonce  int
+}
+
+// 交易存在证明请求
+type TxProofRequest struct {
+	NodeID string
+	TxHash []byte
+}
+
+// 交易存在证明响应，Proof为空表示对方没有找到该交易
+type TxProofResponse struct {
+	NodeID string
+	TxHash []byte
+	Proof  []byte //交易及其存在证明的规范化编码
+}
 
-type Command string
+// 对消息详情进行摘要（摘要覆盖Request的规范化编码）
+func GetDigest(request Request) string {
+	hash := sha256.Sum256(request.Serialize())
+	//进行十六进制字符串编码
+	return hex.EncodeToString(hash[:])
+}
 
+// 签名内容的类别标签，避免一种消息的签名被挪用为另一种消息的签名
 const (
-	CRequest    Command = "request"
-	CPrePrepare Command = "preprepare"
-	CPrepare    Command = "prepare"
-	CCommit     Command = "commit"
+	signTagRequest    = "simplechain/request"
+	signTagPrePrepare = "simplechain/preprepare"
+	signTagPrepare    = "simplechain/prepare"
+	signTagCommit     = "simplechain/commit"
 )
 
-// 默认前十二位为命令名称
-func JointMessage(cmd Command, content []byte) []byte {
-	b := make([]byte, prefixCMDLength)
-	for i, v := range []byte(cmd) {
-		b[i] = v
+// Serialize 将Request编码为规范化的二进制形式
+func (request *Request) Serialize() []byte {
+	e := NewEncoder()
+	request.encodeTo(e)
+	return e.Bytes()
+}
+
+func (request *Request) encodeTo(e *Encoder) {
+	e.WriteInt(request.ID)
+	e.WriteBytes(request.Content)
+	e.WriteInt64(request.Timestamp)
+	e.WriteString(request.ClientAddr)
+	e.WriteStringList(request.Topics)
+	e.WriteInt(request.Nonce)
+	e.WriteInt(request.Fee)
+	e.WriteString(request.PubKeyID)
+	e.WriteBytes(request.Sign)
+}
+
+// SigningBytes 客户端签名覆盖的内容：除签名以外的所有字段
+func (request *Request) SigningBytes() []byte {
+	e := NewEncoder()
+	e.WriteString(signTagRequest)
+	e.WriteInt(request.ID)
+	e.WriteBytes(request.Content)
+	e.WriteInt64(request.Timestamp)
+	e.WriteString(request.ClientAddr)
+	e.WriteStringList(request.Topics)
+	e.WriteInt(request.Nonce)
+	e.WriteInt(request.Fee)
+	e.WriteString(request.PubKeyID)
+	return e.Bytes()
+}
+
+var ErrRequestUnsigned = errors.New("request: missing client signature")
+var ErrRequestSigner = errors.New("request: signing key is not registered to the sender")
+var ErrRequestSign = errors.New("request: invalid client signature")
+var ErrRequestTopics = errors.New("request: too many topics")
+var ErrRequestFee = errors.New("request: negative fee")
+
+// VerifySign 使用签名公钥验证客户端签名
+func (request *Request) VerifySign(pubkey []byte) error {
+	if request.PubKeyID == "" || len(request.Sign) == 0 {
+		return ErrRequestUnsigned
+	}
+	if len(pubkey) == 0 {
+		return ErrRequestSign
+	}
+	if err := utils.VerifySign(request.SigningBytes(), request.Sign, pubkey); err != nil {
+		return fmt.Errorf("%w: %v", ErrRequestSign, err)
+	}
+	return nil
+}
+
+func (request *Request) decodeFrom(d *Decoder) {
+	request.ID = d.ReadInt()
+	request.Content = d.ReadBytes()
+	request.Timestamp = d.ReadInt64()
+	request.ClientAddr = d.ReadString()
+	request.Topics = d.ReadStringList()
+	request.Nonce = d.ReadInt()
+	request.Fee = d.ReadInt()
+	request.PubKeyID = d.ReadString()
+	request.Sign = d.ReadBytes()
+}
+
+// DeserializeRequest 从规范化编码中解析Request
+func DeserializeRequest(data []byte) (*Request, error) {
+	request := new(Request)
+	d := NewDecoder(data)
+	request.decodeFrom(d)
+	if err := d.Finish(); err != nil {
+		return nil, err
+	}
+	return request, nil
+}
+
+// Serialize 将PrePrepare编码为规范化的二进制形式
+func (pp *PrePrepare) Serialize() []byte {
+	e := NewEncoder()
+	pp.RequestMessage.encodeTo(e)
+	e.WriteString(pp.Digest)
+	e.WriteInt(pp.SequenceID)
+	e.WriteBytes(pp.Sign)
+	return e.Bytes()
+}
+
+// SigningBytes 主节点签名覆盖的内容
+func (pp *PrePrepare) SigningBytes() []byte {
+	e := NewEncoder()
+	e.WriteString(signTagPrePrepare)
+	e.WriteString(pp.Digest)
+	e.WriteInt(pp.SequenceID)
+	return e.Bytes()
+}
+
+// DeserializePrePrepare 从规范化编码中解析PrePrepare
+func DeserializePrePrepare(data []byte) (*PrePrepare, error) {
+	pp := new(PrePrepare)
+	d := NewDecoder(data)
+	pp.RequestMessage.decodeFrom(d)
+	pp.Digest = d.ReadString()
+	pp.SequenceID = d.ReadInt()
+	pp.Sign = d.ReadBytes()
+	if err := d.Finish(); err != nil {
+		return nil, err
+	}
+	return pp, nil
+}
+
+// Serialize 将Prepare编码为规范化的二进制形式
+func (pre *Prepare) Serialize() []byte {
+	e := NewEncoder()
+	e.WriteString(pre.Digest)
+	e.WriteInt(pre.SequenceID)
+	e.WriteString(pre.NodeID)
+	e.WriteBytes(pre.Sign)
+	return e.Bytes()
+}
+
+// SigningBytes 节点签名覆盖的内容
+func (pre *Prepare) SigningBytes() []byte {
+	e := NewEncoder()
+	e.WriteString(signTagPrepare)
+	e.WriteString(pre.Digest)
+	e.WriteInt(pre.SequenceID)
+	e.WriteString(pre.NodeID)
+	return e.Bytes()
+}
+
+// DeserializePrepare 从规范化编码中解析Prepare
+func DeserializePrepare(data []byte) (*Prepare, error) {
+	pre := new(Prepare)
+	d := NewDecoder(data)
+	pre.Digest = d.ReadString()
+	pre.SequenceID = d.ReadInt()
+	pre.NodeID = d.ReadString()
+	pre.Sign = d.ReadBytes()
+	if err := d.Finish(); err != nil {
+		return nil, err
+	}
+	return pre, nil
+}
+
+// Serialize 将Commit编码为规范化的二进制形式
+func (c *Commit) Serialize() []byte {
+	e := NewEncoder()
+	e.WriteString(c.Digest)
+	e.WriteInt(c.SequenceID)
+	e.WriteString(c.NodeID)
+	e.WriteBytes(c.Sign)
+	return e.Bytes()
+}
+
+// SigningBytes 节点签名覆盖的内容
+func (c *Commit) SigningBytes() []byte {
+	e := NewEncoder()
+	e.WriteString(signTagCommit)
+	e.WriteString(c.Digest)
+	e.WriteInt(c.SequenceID)
+	e.WriteString(c.NodeID)
+	return e.Bytes()
+}
+
+// DeserializeCommit 从规范化编码中解析Commit
+func DeserializeCommit(data []byte) (*Commit, error) {
+	c := new(Commit)
+	d := NewDecoder(data)
+	c.Digest = d.ReadString()
+	c.SequenceID = d.ReadInt()
+	c.NodeID = d.ReadString()
+	c.Sign = d.ReadBytes()
+	if err := d.Finish(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Serialize 将Reply编码为规范化的二进制形式
+func (reply *Reply) Serialize() []byte {
+	e := NewEncoder()
+	e.WriteInt(reply.MessageID)
+	e.WriteString(reply.NodeID)
+	e.WriteBool(reply.Result)
+	e.WriteInt(reply.Height)
+	return e.Bytes()
+}
+
+// DeserializeReply 从规范化编码中解析Reply
+func DeserializeReply(data []byte) (*Reply, error) {
+	reply := new(Reply)
+	d := NewDecoder(data)
+	reply.MessageID = d.ReadInt()
+	reply.NodeID = d.ReadString()
+	reply.Result = d.ReadBool()
+	reply.Height = d.ReadInt()
+	if err := d.Finish(); err != nil {
+		return nil, err
 	}
-	joint := append(b, content...)
-	return joint
+	return reply, nil
+}
+
+// 提交证书：证明序号为SequenceID、摘要为Digest的请求已被至少2f+1个节点提交
+type CommitCertificate struct {
+	SequenceID   int      //请求序号
+	Digest       string   //请求摘要
+	ProposerID   string   //主节点ID
+	ProposerSign []byte   //主节点的PrePrepare签名
+	Signers      []string //提交了该请求的节点ID
+	Signs        [][]byte //与Signers一一对应的Commit签名
 }
 
-// 默认前十二位为命令名称
-func SplitMessage(message []byte) (cmd string, content []byte) {
-	cmdBytes := message[:prefixCMDLength]
-	newCMDBytes := make([]byte, 0)
-	for _, v := range cmdBytes {
-		if v != byte(0) {
-			newCMDBytes = append(newCMDBytes, v)
+var ErrCertMismatch = errors.New("certificate: sequence or digest mismatch")
+var ErrCertProposerSign = errors.New("certificate: invalid proposer signature")
+var ErrCertQuorum = errors.New("certificate: not enough valid commit signatures")
+
+// Quorum 节点总数为n时达成共识所需的最少节点数2f+1
+func Quorum(n int) int {
+	f := (n - 1) / 3
+	return 2*f + 1
+}
+
+// Verify 使用验证者公钥列表验证证书：主节点签名有效，且至少2f+1个不同验证者的Commit签名有效
+func (cert *CommitCertificate) Verify(sequenceID int, digest string, validators map[string][]byte) error {
+	if cert.SequenceID != sequenceID || cert.Digest != digest || len(cert.Signers) != len(cert.Signs) {
+		return ErrCertMismatch
+	}
+	pp := PrePrepare{Digest: cert.Digest, SequenceID: cert.SequenceID}
+	proposerKey, ok := validators[cert.ProposerID]
+	if !ok || utils.VerifySign(pp.SigningBytes(), cert.ProposerSign, proposerKey) != nil {
+		return ErrCertProposerSign
+	}
+	valid := make(map[string]bool)
+	for i, nodeID := range cert.Signers {
+		pubKey, ok := validators[nodeID]
+		if !ok || valid[nodeID] {
+			continue
+		}
+		c := Commit{Digest: cert.Digest, SequenceID: cert.SequenceID, NodeID: nodeID}
+		if utils.VerifySign(c.SigningBytes(), cert.Signs[i], pubKey) == nil {
+			valid[nodeID] = true
 		}
 	}
-	cmd = string(newCMDBytes)
-	content = message[prefixCMDLength:]
-	return
+	if len(valid) < Quorum(len(validators)) {
+		return ErrCertQuorum
+	}
+	return nil
 }
 
-// 对消息详情进行摘要
-func GetDigest(request Request) string {
-	b, err := json.Marshal(request)
-	if err != nil {
-		log.Panic(err)
+func (cert *CommitCertificate) encodeTo(e *Encoder) {
+	e.WriteInt(cert.SequenceID)
+	e.WriteString(cert.Digest)
+	e.WriteString(cert.ProposerID)
+	e.WriteBytes(cert.ProposerSign)
+	e.WriteStringList(cert.Signers)
+	e.WriteBytesList(cert.Signs)
+}
+
+// Serialize 将提交证书编码为规范化的二进制形式
+func (cert *CommitCertificate) Serialize() []byte {
+	e := NewEncoder()
+	cert.encodeTo(e)
+	return e.Bytes()
+}
+
+// DeserializeCommitCertificate 从规范化编码中解析提交证书
+func DeserializeCommitCertificate(data []byte) (*CommitCertificate, error) {
+	cert := new(CommitCertificate)
+	d := NewDecoder(data)
+	cert.SequenceID = d.ReadInt()
+	cert.Digest = d.ReadString()
+	cert.ProposerID = d.ReadString()
+	cert.ProposerSign = d.ReadBytes()
+	cert.Signers = d.ReadStringList()
+	cert.Signs = d.ReadBytesList()
+	if err := d.Finish(); err != nil {
+		return nil, err
 	}
-	hash := sha256.Sum256(b)
-	//进行十六进制字符串编码
-	return hex.EncodeToString(hash[:])
+	return cert, nil
 }
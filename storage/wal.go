@@ -0,0 +1,242 @@
+package storage
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// 预写日志（WAL）：共识节点在发出或接受消息之前先将其追加到日志并落盘，
+// 崩溃重启后重放日志即可恢复发出过的PrePrepare、Prepare、Commit以及视图和序号，
+// 避免重启后对同一序号做出与之前矛盾的投票。
+//
+// 每条记录的格式为：4字节长度 + 4字节CRC32C校验和 + 1字节记录类型 + 记录内容，
+// 长度和校验和都覆盖记录类型和记录内容。崩溃时可能只写入了最后一条记录的一部分，
+// 重放时遇到不完整或校验失败的记录即认为日志到此结束，并截断其后的数据。
+
+var ErrWALClosed = errors.New("wal: closed")
+
+// 单条记录允许的最大长度
+const maxWALRecordLength = 1 << 28
+
+const walHeaderSize = 8
+
+var walCRCTable = crc32.MakeTable(crc32.Castagnoli)
+
+type WALRecordType uint8
+
+const (
+	WALPrePrepare WALRecordType = iota + 1 //发出或接受的PrePrepare
+	WALPrepare                             //发出或接受的Prepare
+	WALCommit                              //发出或接受的Commit
+	WALCommitted                           //完成共识的消息（内容为触发提交的Commit）
+	WALView                                //当前视图和低水位线
+)
+
+// WALRecord 预写日志中的一条记录，Data为对应消息的规范化编码
+type WALRecord struct {
+	Type WALRecordType
+	Data []byte
+}
+
+// ViewState 共识的视图编号和低水位线
+type ViewState struct {
+	View       int //当前视图编号
+	SequenceID int //当前低水位线
+}
+
+func (vs *ViewState) Serialize() []byte {
+	e := NewEncoder()
+	e.WriteInt(vs.View)
+	e.WriteInt(vs.SequenceID)
+	return e.Bytes()
+}
+
+func DeserializeViewState(data []byte) (*ViewState, error) {
+	d := NewDecoder(data)
+	vs := &ViewState{View: d.ReadInt(), SequenceID: d.ReadInt()}
+	if err := d.Finish(); err != nil {
+		return nil, err
+	}
+	return vs, nil
+}
+
+// WAL 只追加的预写日志文件
+type WAL struct {
+	path  string
+	file  *os.File
+	mutex sync.Mutex
+}
+
+// OpenWAL 打开（不存在则创建）预写日志，打开后应先调用Replay再追加新记录
+func OpenWAL(path string) (*WAL, error) {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	_, statErr := os.Stat(path)
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	//新建的文件需要同步所在目录，保证崩溃后文件本身仍然存在
+	if os.IsNotExist(statErr) {
+		if err := syncDir(dir); err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+	return &WAL{path: path, file: file}, nil
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// Path 日志文件路径
+func (wal *WAL) Path() string {
+	return wal.path
+}
+
+// Append 追加一条记录并落盘，返回后记录保证在崩溃后仍然存在
+func (wal *WAL) Append(record WALRecord) error {
+	wal.mutex.Lock()
+	defer wal.mutex.Unlock()
+	if wal.file == nil {
+		return ErrWALClosed
+	}
+	if _, err := wal.file.Write(encodeWALRecord(record)); err != nil {
+		return err
+	}
+	return wal.file.Sync()
+}
+
+func encodeWALRecord(record WALRecord) []byte {
+	buf := make([]byte, walHeaderSize, walHeaderSize+1+len(record.Data))
+	buf = append(buf, byte(record.Type))
+	buf = append(buf, record.Data...)
+	binary.BigEndian.PutUint32(buf[0:4], uint32(len(buf)-walHeaderSize))
+	binary.BigEndian.PutUint32(buf[4:8], crc32.Checksum(buf[walHeaderSize:], walCRCTable))
+	return buf
+}
+
+// Replay 按写入顺序对日志中的每条完整记录调用fn，并截断末尾不完整的记录
+// fn返回错误时停止重放并返回该错误
+func (wal *WAL) Replay(fn func(record WALRecord) error) error {
+	wal.mutex.Lock()
+	defer wal.mutex.Unlock()
+	if wal.file == nil {
+		return ErrWALClosed
+	}
+	if _, err := wal.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	data, err := io.ReadAll(wal.file)
+	if err != nil {
+		return err
+	}
+	offset := 0
+	for {
+		record, n := decodeWALRecord(data[offset:])
+		if n == 0 {
+			break
+		}
+		if err := fn(record); err != nil {
+			return err
+		}
+		offset += n
+	}
+	//截断崩溃时写了一半的记录，之后追加的记录才能被正确读出
+	if offset < len(data) {
+		if err := wal.file.Truncate(int64(offset)); err != nil {
+			return err
+		}
+		return wal.file.Sync()
+	}
+	return nil
+}
+
+// 解析一条记录，返回记录及其占用的字节数，记录不完整或已损坏时返回0
+func decodeWALRecord(data []byte) (WALRecord, int) {
+	if len(data) < walHeaderSize {
+		return WALRecord{}, 0
+	}
+	length := int(binary.BigEndian.Uint32(data[0:4]))
+	if length < 1 || length > maxWALRecordLength || len(data)-walHeaderSize < length {
+		return WALRecord{}, 0
+	}
+	body := data[walHeaderSize : walHeaderSize+length]
+	if crc32.Checksum(body, walCRCTable) != binary.BigEndian.Uint32(data[4:8]) {
+		return WALRecord{}, 0
+	}
+	record := WALRecord{Type: WALRecordType(body[0]), Data: append([]byte(nil), body[1:]...)}
+	return record, walHeaderSize + length
+}
+
+// Compact 原子地重写日志：只保留keep返回true的记录（keep为nil时不保留任何记录），并在末尾追加extra中的记录
+// 重写过程中崩溃时，日志要么是旧内容要么是完整的新内容
+func (wal *WAL) Compact(keep func(record WALRecord) bool, extra ...WALRecord) error {
+	wal.mutex.Lock()
+	defer wal.mutex.Unlock()
+	if wal.file == nil {
+		return ErrWALClosed
+	}
+	if _, err := wal.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	data, err := io.ReadAll(wal.file)
+	if err != nil {
+		return err
+	}
+	kept := make([]byte, 0)
+	for offset := 0; ; {
+		record, n := decodeWALRecord(data[offset:])
+		if n == 0 {
+			break
+		}
+		if keep != nil && keep(record) {
+			kept = append(kept, data[offset:offset+n]...)
+		}
+		offset += n
+	}
+	for _, record := range extra {
+		kept = append(kept, encodeWALRecord(record)...)
+	}
+	if err := writeFileSync(wal.path, kept); err != nil {
+		return err
+	}
+	if err := syncDir(filepath.Dir(wal.path)); err != nil {
+		return err
+	}
+	//重新打开重命名后的新文件
+	file, err := os.OpenFile(wal.path, os.O_RDWR|os.O_APPEND, 0644)
+	wal.file.Close()
+	wal.file = file
+	if err != nil {
+		//旧文件已被替换，不能再向其追加
+		wal.file = nil
+		return err
+	}
+	return nil
+}
+
+// Close 关闭日志文件
+func (wal *WAL) Close() error {
+	wal.mutex.Lock()
+	defer wal.mutex.Unlock()
+	if wal.file == nil {
+		return nil
+	}
+	err := wal.file.Close()
+	wal.file = nil
+	return err
+}
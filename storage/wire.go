@@ -0,0 +1,382 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"log"
+
+	pb "simplechain/storage/proto"
+
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// 网络消息的protobuf编解码：消息类型由proto/simplechain.proto生成（proto/simplechain.pb.go），
+// 本文件在生成的类型与storage包中的消息结构之间转换。
+// 修改.proto文件后运行go generate ./storage重新生成，wire_test.go检查编码与.proto文件一致
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative proto/simplechain.proto
+
+const (
+	ProtocolVersion    uint32 = 1 //当前协议版本
+	MinProtocolVersion uint32 = 1 //能够接受的最低协议版本
+)
+
+type MessageType uint32
+
+const (
+	MsgUnknown    MessageType = 0
+	MsgRequest    MessageType = 1
+	MsgPrePrepare MessageType = 2
+	MsgPrepare    MessageType = 3
+	MsgCommit     MessageType = 4
+	MsgReply      MessageType = 5
+	MsgSyncReq    MessageType = 6
+	MsgSyncResp   MessageType = 7
+	MsgSnapReq    MessageType = 8
+	MsgSnapMani   MessageType = 9
+	MsgChunkReq   MessageType = 10
+	MsgChunk      MessageType = 11
+	MsgTxProofReq MessageType = 12
+	MsgTxProof    MessageType = 13
+	MsgNonceReq   MessageType = 14
+	MsgNonce      MessageType = 15
+)
+
+var messageTypeNames = map[MessageType]string{
+	MsgRequest:    "request",
+	MsgPrePrepare: "preprepare",
+	MsgPrepare:    "prepare",
+	MsgCommit:     "commit",
+	MsgReply:      "reply",
+	MsgSyncReq:    "syncrequest",
+	MsgSyncResp:   "syncresponse",
+	MsgSnapReq:    "snapshotrequest",
+	MsgSnapMani:   "snapshotmanifest",
+	MsgChunkReq:   "chunkrequest",
+	MsgChunk:      "chunk",
+	MsgTxProofReq: "txproofrequest",
+	MsgTxProof:    "txproof",
+	MsgNonceReq:   "noncerequest",
+	MsgNonce:      "nonce",
+}
+
+func (t MessageType) String() string {
+	if name, ok := messageTypeNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("unknown(%d)", uint32(t))
+}
+
+// IsKnown 判断是否是当前版本能够处理的消息类型
+func (t MessageType) IsKnown() bool {
+	_, ok := messageTypeNames[t]
+	return ok
+}
+
+var ErrUnknownMessageType = errors.New("wire: unknown message type")
+var ErrIncompatibleVersion = errors.New("wire: incompatible protocol version")
+var ErrProtoWireType = errors.New("wire: unexpected protobuf wire type")
+
+// Envelope 网络消息信封
+type Envelope struct {
+	Version    uint32      //发送方使用的协议版本
+	MinVersion uint32      //发送方能够接受的最低协议版本
+	Type       MessageType //消息类型
+	Sender     string      //发送方ID
+	Payload    []byte      //消息本体
+}
+
+// PackMessage 将消息本体装入当前协议版本的信封并编码
+func PackMessage(msgType MessageType, sender string, payload []byte) []byte {
+	env := &Envelope{ProtocolVersion, MinProtocolVersion, msgType, sender, payload}
+	return env.MarshalProto()
+}
+
+// UnpackMessage 解析信封，协议版本不兼容或消息类型未知时返回错误
+// 消息类型未知时仍返回解析出的信封，便于调用方记录日志
+func UnpackMessage(data []byte) (*Envelope, error) {
+	env, err := UnmarshalEnvelopeProto(data)
+	if err != nil {
+		return nil, err
+	}
+	//双方支持的协议版本区间没有交集则拒绝
+	if env.Version < MinProtocolVersion || env.MinVersion > ProtocolVersion {
+		return env, ErrIncompatibleVersion
+	}
+	if !env.Type.IsKnown() {
+		return env, ErrUnknownMessageType
+	}
+	return env, nil
+}
+
+func (env *Envelope) MarshalProto() []byte {
+	return marshalProto(&pb.Envelope{Version: env.Version, MinVersion: env.MinVersion, Type: pb.MessageType(env.Type), Sender: env.Sender, Payload: env.Payload})
+}
+
+func UnmarshalEnvelopeProto(data []byte) (*Envelope, error) {
+	m := new(pb.Envelope)
+	if err := unmarshalProto(data, m); err != nil {
+		return nil, err
+	}
+	return &Envelope{m.Version, m.MinVersion, MessageType(m.Type), m.Sender, m.Payload}, nil
+}
+
+func (request *Request) toProto() *pb.Request {
+	return &pb.Request{
+		Id:         int64(request.ID),
+		Content:    request.Content,
+		Timestamp:  request.Timestamp,
+		ClientAddr: request.ClientAddr,
+		Topics:     request.Topics,
+		PubKeyId:   request.PubKeyID,
+		Sign:       request.Sign,
+		Nonce:      int64(request.Nonce),
+		Fee:        int64(request.Fee),
+	}
+}
+
+// m为nil时得到零值的请求
+func requestFromProto(m *pb.Request) Request {
+	return Request{
+		Message:    Message{Content: m.GetContent(), ID: int(m.GetId())},
+		Timestamp:  m.GetTimestamp(),
+		ClientAddr: m.GetClientAddr(),
+		Topics:     m.GetTopics(),
+		Nonce:      int(m.GetNonce()),
+		Fee:        int(m.GetFee()),
+		PubKeyID:   m.GetPubKeyId(),
+		Sign:       m.GetSign(),
+	}
+}
+
+func (request *Request) MarshalProto() []byte {
+	return marshalProto(request.toProto())
+}
+
+func UnmarshalRequestProto(data []byte) (*Request, error) {
+	m := new(pb.Request)
+	if err := unmarshalProto(data, m); err != nil {
+		return nil, err
+	}
+	request := requestFromProto(m)
+	return &request, nil
+}
+
+func (pp *PrePrepare) MarshalProto() []byte {
+	return marshalProto(&pb.PrePrepare{Request: pp.RequestMessage.toProto(), Digest: pp.Digest, SequenceId: int64(pp.SequenceID), Sign: pp.Sign})
+}
+
+func UnmarshalPrePrepareProto(data []byte) (*PrePrepare, error) {
+	m := new(pb.PrePrepare)
+	if err := unmarshalProto(data, m); err != nil {
+		return nil, err
+	}
+	return &PrePrepare{requestFromProto(m.Request), m.Digest, int(m.SequenceId), m.Sign}, nil
+}
+
+func (pre *Prepare) MarshalProto() []byte {
+	return marshalProto(&pb.Prepare{Digest: pre.Digest, SequenceId: int64(pre.SequenceID), NodeId: pre.NodeID, Sign: pre.Sign})
+}
+
+func UnmarshalPrepareProto(data []byte) (*Prepare, error) {
+	m := new(pb.Prepare)
+	if err := unmarshalProto(data, m); err != nil {
+		return nil, err
+	}
+	return &Prepare{m.Digest, int(m.SequenceId), m.NodeId, m.Sign}, nil
+}
+
+func (c *Commit) MarshalProto() []byte {
+	return marshalProto(&pb.Commit{Digest: c.Digest, SequenceId: int64(c.SequenceID), NodeId: c.NodeID, Sign: c.Sign})
+}
+
+func UnmarshalCommitProto(data []byte) (*Commit, error) {
+	m := new(pb.Commit)
+	if err := unmarshalProto(data, m); err != nil {
+		return nil, err
+	}
+	return &Commit{m.Digest, int(m.SequenceId), m.NodeId, m.Sign}, nil
+}
+
+func (reply *Reply) MarshalProto() []byte {
+	return marshalProto(&pb.Reply{MessageId: int64(reply.MessageID), NodeId: reply.NodeID, Result: reply.Result, Height: int64(reply.Height)})
+}
+
+func UnmarshalReplyProto(data []byte) (*Reply, error) {
+	m := new(pb.Reply)
+	if err := unmarshalProto(data, m); err != nil {
+		return nil, err
+	}
+	return &Reply{int(m.MessageId), m.NodeId, m.Result, int(m.Height)}, nil
+}
+
+func (req *SyncRequest) MarshalProto() []byte {
+	return marshalProto(&pb.SyncRequest{NodeId: req.NodeID, FromHeight: int64(req.FromHeight), ToHeight: int64(req.ToHeight), HeadersOnly: req.HeadersOnly})
+}
+
+func UnmarshalSyncRequestProto(data []byte) (*SyncRequest, error) {
+	m := new(pb.SyncRequest)
+	if err := unmarshalProto(data, m); err != nil {
+		return nil, err
+	}
+	return &SyncRequest{m.NodeId, int(m.FromHeight), int(m.ToHeight), m.HeadersOnly}, nil
+}
+
+func (resp *SyncResponse) MarshalProto() []byte {
+	return marshalProto(&pb.SyncResponse{NodeId: resp.NodeID, Height: int64(resp.Height), Blocks: resp.Blocks, Headers: resp.Headers})
+}
+
+func UnmarshalSyncResponseProto(data []byte) (*SyncResponse, error) {
+	m := new(pb.SyncResponse)
+	if err := unmarshalProto(data, m); err != nil {
+		return nil, err
+	}
+	return &SyncResponse{m.NodeId, int(m.Height), nonNilList(m.Blocks), m.Headers}, nil
+}
+
+func (req *SnapshotRequest) MarshalProto() []byte {
+	return marshalProto(&pb.SnapshotRequest{NodeId: req.NodeID})
+}
+
+func UnmarshalSnapshotRequestProto(data []byte) (*SnapshotRequest, error) {
+	m := new(pb.SnapshotRequest)
+	if err := unmarshalProto(data, m); err != nil {
+		return nil, err
+	}
+	return &SnapshotRequest{m.NodeId}, nil
+}
+
+func (mani *SnapshotManifest) MarshalProto() []byte {
+	return marshalProto(&pb.SnapshotManifest{NodeId: mani.NodeID, Height: int64(mani.Height), Header: mani.Header, ChunkHashes: mani.ChunkHashes})
+}
+
+func UnmarshalSnapshotManifestProto(data []byte) (*SnapshotManifest, error) {
+	m := new(pb.SnapshotManifest)
+	if err := unmarshalProto(data, m); err != nil {
+		return nil, err
+	}
+	return &SnapshotManifest{m.NodeId, int(m.Height), m.Header, nonNilList(m.ChunkHashes)}, nil
+}
+
+func (req *SnapshotChunkRequest) MarshalProto() []byte {
+	return marshalProto(&pb.SnapshotChunkRequest{NodeId: req.NodeID, Height: int64(req.Height), Index: int64(req.Index)})
+}
+
+func UnmarshalSnapshotChunkRequestProto(data []byte) (*SnapshotChunkRequest, error) {
+	m := new(pb.SnapshotChunkRequest)
+	if err := unmarshalProto(data, m); err != nil {
+		return nil, err
+	}
+	return &SnapshotChunkRequest{m.NodeId, int(m.Height), int(m.Index)}, nil
+}
+
+func (chunk *SnapshotChunk) MarshalProto() []byte {
+	return marshalProto(&pb.SnapshotChunk{NodeId: chunk.NodeID, Height: int64(chunk.Height), Index: int64(chunk.Index), Data: chunk.Data})
+}
+
+func UnmarshalSnapshotChunkProto(data []byte) (*SnapshotChunk, error) {
+	m := new(pb.SnapshotChunk)
+	if err := unmarshalProto(data, m); err != nil {
+		return nil, err
+	}
+	return &SnapshotChunk{m.NodeId, int(m.Height), int(m.Index), m.Data}, nil
+}
+
+func (req *NonceRequest) MarshalProto() []byte {
+	return marshalProto(&pb.NonceRequest{NodeId: req.NodeID, Sender: req.Sender})
+}
+
+func UnmarshalNonceRequestProto(data []byte) (*NonceRequest, error) {
+	m := new(pb.NonceRequest)
+	if err := unmarshalProto(data, m); err != nil {
+		return nil, err
+	}
+	return &NonceRequest{m.NodeId, m.Sender}, nil
+}
+
+func (resp *NonceResponse) MarshalProto() []byte {
+	return marshalProto(&pb.NonceResponse{NodeId: resp.NodeID, Sender: resp.Sender, Nonce: int64(resp.Nonce)})
+}
+
+func UnmarshalNonceResponseProto(data []byte) (*NonceResponse, error) {
+	m := new(pb.NonceResponse)
+	if err := unmarshalProto(data, m); err != nil {
+		return nil, err
+	}
+	return &NonceResponse{m.NodeId, m.Sender, int(m.Nonce)}, nil
+}
+
+func (req *TxProofRequest) MarshalProto() []byte {
+	return marshalProto(&pb.TxProofRequest{NodeId: req.NodeID, TxHash: req.TxHash})
+}
+
+func UnmarshalTxProofRequestProto(data []byte) (*TxProofRequest, error) {
+	m := new(pb.TxProofRequest)
+	if err := unmarshalProto(data, m); err != nil {
+		return nil, err
+	}
+	return &TxProofRequest{m.NodeId, m.TxHash}, nil
+}
+
+func (resp *TxProofResponse) MarshalProto() []byte {
+	return marshalProto(&pb.TxProofResponse{NodeId: resp.NodeID, TxHash: resp.TxHash, Proof: resp.Proof})
+}
+
+func UnmarshalTxProofResponseProto(data []byte) (*TxProofResponse, error) {
+	m := new(pb.TxProofResponse)
+	if err := unmarshalProto(data, m); err != nil {
+		return nil, err
+	}
+	return &TxProofResponse{m.NodeId, m.TxHash, m.Proof}, nil
+}
+
+// 消息中的字符串都是节点ID、地址和十六进制摘要，编码只会因为字符串不是合法的UTF-8而失败，
+// 此时返回nil，接收方会因为协议版本或签名无效而拒绝
+func marshalProto(m proto.Message) []byte {
+	data, err := proto.Marshal(m)
+	if err != nil {
+		log.Println("wire: marshal", m.ProtoReflect().Descriptor().Name(), "failed:", err)
+		return nil
+	}
+	return data
+}
+
+// 解码后检查字段的线类型：protobuf运行时把线类型与.proto不符的已知字段当作未知字段保留，这里作为错误返回
+func unmarshalProto(data []byte, m proto.Message) error {
+	if err := proto.Unmarshal(data, m); err != nil {
+		return err
+	}
+	return checkWireTypes(m.ProtoReflect())
+}
+
+func checkWireTypes(m protoreflect.Message) error {
+	fields := m.Descriptor().Fields()
+	for unknown := m.GetUnknown(); len(unknown) > 0; {
+		num, _, n := protowire.ConsumeField(unknown)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		if fields.ByNumber(num) != nil {
+			return ErrProtoWireType
+		}
+		unknown = unknown[n:]
+	}
+	var err error
+	m.Range(func(fd protoreflect.FieldDescriptor, v protoreflect.Value) bool {
+		if fd.Message() != nil && !fd.IsList() && !fd.IsMap() {
+			err = checkWireTypes(v.Message())
+		}
+		return err == nil
+	})
+	return err
+}
+
+// 解码得到的列表字段为空时也返回非nil的空列表
+func nonNilList(list [][]byte) [][]byte {
+	if list == nil {
+		return make([][]byte, 0)
+	}
+	return list
+}
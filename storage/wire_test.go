@@ -0,0 +1,277 @@
+package storage
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	pb "simplechain/storage/proto"
+
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+const protoPath = "proto/simplechain.proto"
+
+// 生成的Go代码中嵌入的.proto文件描述符
+func loadSchema(t *testing.T) protoreflect.FileDescriptor {
+	t.Helper()
+	fd := pb.File_proto_simplechain_proto
+	if fd.Path() != protoPath {
+		t.Fatalf("generated code is for %s, want %s", fd.Path(), protoPath)
+	}
+	return fd
+}
+
+// fields 以.proto中的字段名描述期望的字段值，嵌套消息用fields表示
+type fields map[string]interface{}
+
+type wireCase struct {
+	message   string
+	value     interface{}
+	marshal   func() []byte
+	unmarshal func([]byte) (interface{}, error)
+	want      fields
+}
+
+var testRequest = Request{Message{[]byte("transfer 10"), -42}, 1700000000123456789, "127.0.0.1:6000", []string{"pay", "fee"}, 7, 3, "client1", []byte{1, 2, 3}}
+
+var testRequestFields = fields{
+	"id": int64(-42), "content": []byte("transfer 10"), "timestamp": int64(1700000000123456789), "client_addr": "127.0.0.1:6000",
+	"topics": []string{"pay", "fee"}, "pub_key_id": "client1", "sign": []byte{1, 2, 3}, "nonce": int64(7), "fee": int64(3),
+}
+
+func wireCases() []wireCase {
+	env := &Envelope{ProtocolVersion, MinProtocolVersion, MsgCommit, "node2", []byte("payload")}
+	request := testRequest
+	pp := &PrePrepare{testRequest, "digest", 9, []byte{4, 5}}
+	pre := &Prepare{"digest-p", 10, "node3", []byte{6}}
+	commit := &Commit{"digest-c", 11, "node4", []byte{7}}
+	reply := &Reply{12, "node1", true, 5}
+	syncReq := &SyncRequest{"node2", 3, 8, true}
+	syncResp := &SyncResponse{"node1", 8, [][]byte{{1}, {2, 3}}, [][]byte{{4}}}
+	snapReq := &SnapshotRequest{"node4"}
+	mani := &SnapshotManifest{"node1", 64, []byte("header"), [][]byte{{8}, {9}}}
+	chunkReq := &SnapshotChunkRequest{"node4", 64, 1}
+	chunk := &SnapshotChunk{"node1", 64, 1, []byte("chunk")}
+	nonceReq := &NonceRequest{"client1", "127.0.0.1:6000"}
+	nonceResp := &NonceResponse{"node1", "127.0.0.1:6000", 8}
+	proofReq := &TxProofRequest{"light1", []byte("txhash")}
+	proofResp := &TxProofResponse{"node1", []byte("txhash"), []byte("proof")}
+	return []wireCase{
+		{"Envelope", env, env.MarshalProto, func(b []byte) (interface{}, error) { return UnmarshalEnvelopeProto(b) },
+			fields{"version": uint32(ProtocolVersion), "min_version": uint32(MinProtocolVersion), "type": protoreflect.EnumNumber(MsgCommit), "sender": "node2", "payload": []byte("payload")}},
+		{"Request", &request, request.MarshalProto, func(b []byte) (interface{}, error) { return UnmarshalRequestProto(b) }, testRequestFields},
+		{"PrePrepare", pp, pp.MarshalProto, func(b []byte) (interface{}, error) { return UnmarshalPrePrepareProto(b) },
+			fields{"request": testRequestFields, "digest": "digest", "sequence_id": int64(9), "sign": []byte{4, 5}}},
+		{"Prepare", pre, pre.MarshalProto, func(b []byte) (interface{}, error) { return UnmarshalPrepareProto(b) },
+			fields{"digest": "digest-p", "sequence_id": int64(10), "node_id": "node3", "sign": []byte{6}}},
+		{"Commit", commit, commit.MarshalProto, func(b []byte) (interface{}, error) { return UnmarshalCommitProto(b) },
+			fields{"digest": "digest-c", "sequence_id": int64(11), "node_id": "node4", "sign": []byte{7}}},
+		{"Reply", reply, reply.MarshalProto, func(b []byte) (interface{}, error) { return UnmarshalReplyProto(b) },
+			fields{"message_id": int64(12), "node_id": "node1", "result": true, "height": int64(5)}},
+		{"SyncRequest", syncReq, syncReq.MarshalProto, func(b []byte) (interface{}, error) { return UnmarshalSyncRequestProto(b) },
+			fields{"node_id": "node2", "from_height": int64(3), "to_height": int64(8), "headers_only": true}},
+		{"SyncResponse", syncResp, syncResp.MarshalProto, func(b []byte) (interface{}, error) { return UnmarshalSyncResponseProto(b) },
+			fields{"node_id": "node1", "height": int64(8), "blocks": [][]byte{{1}, {2, 3}}, "headers": [][]byte{{4}}}},
+		{"SnapshotRequest", snapReq, snapReq.MarshalProto, func(b []byte) (interface{}, error) { return UnmarshalSnapshotRequestProto(b) },
+			fields{"node_id": "node4"}},
+		{"SnapshotManifest", mani, mani.MarshalProto, func(b []byte) (interface{}, error) { return UnmarshalSnapshotManifestProto(b) },
+			fields{"node_id": "node1", "height": int64(64), "header": []byte("header"), "chunk_hashes": [][]byte{{8}, {9}}}},
+		{"SnapshotChunkRequest", chunkReq, chunkReq.MarshalProto, func(b []byte) (interface{}, error) { return UnmarshalSnapshotChunkRequestProto(b) },
+			fields{"node_id": "node4", "height": int64(64), "index": int64(1)}},
+		{"SnapshotChunk", chunk, chunk.MarshalProto, func(b []byte) (interface{}, error) { return UnmarshalSnapshotChunkProto(b) },
+			fields{"node_id": "node1", "height": int64(64), "index": int64(1), "data": []byte("chunk")}},
+		{"NonceRequest", nonceReq, nonceReq.MarshalProto, func(b []byte) (interface{}, error) { return UnmarshalNonceRequestProto(b) },
+			fields{"node_id": "client1", "sender": "127.0.0.1:6000"}},
+		{"NonceResponse", nonceResp, nonceResp.MarshalProto, func(b []byte) (interface{}, error) { return UnmarshalNonceResponseProto(b) },
+			fields{"node_id": "node1", "sender": "127.0.0.1:6000", "nonce": int64(8)}},
+		{"TxProofRequest", proofReq, proofReq.MarshalProto, func(b []byte) (interface{}, error) { return UnmarshalTxProofRequestProto(b) },
+			fields{"node_id": "light1", "tx_hash": []byte("txhash")}},
+		{"TxProofResponse", proofResp, proofResp.MarshalProto, func(b []byte) (interface{}, error) { return UnmarshalTxProofResponseProto(b) },
+			fields{"node_id": "node1", "tx_hash": []byte("txhash"), "proof": []byte("proof")}},
+	}
+}
+
+// storage包中消息结构的编码由protobuf运行时按.proto的动态描述解析得到期望的字段值，
+// protobuf运行时的编码也能被还原为相同的消息结构
+func TestWireMatchesProto(t *testing.T) {
+	fd := loadSchema(t)
+	covered := make(map[string]bool)
+	for _, tc := range wireCases() {
+		t.Run(tc.message, func(t *testing.T) {
+			md := fd.Messages().ByName(protoreflect.Name(tc.message))
+			if md == nil {
+				t.Fatalf("message %s not in %s", tc.message, protoPath)
+			}
+			covered[tc.message] = true
+			msg := dynamicpb.NewMessage(md)
+			if err := proto.Unmarshal(tc.marshal(), msg); err != nil {
+				t.Fatal(err)
+			}
+			if unknown := msg.GetUnknown(); len(unknown) > 0 {
+				t.Fatalf("fields not in %s or with the wrong wire type: %x", protoPath, unknown)
+			}
+			checkFields(t, tc.message, msg, tc.want)
+
+			encoded, err := proto.MarshalOptions{Deterministic: true}.Marshal(msg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			decoded, err := tc.unmarshal(encoded)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(decoded, tc.value) {
+				t.Fatalf("round trip through the protobuf runtime:\n got %+v\nwant %+v", decoded, tc.value)
+			}
+		})
+	}
+	for i := 0; i < fd.Messages().Len(); i++ {
+		if name := string(fd.Messages().Get(i).Name()); !covered[name] {
+			t.Errorf("message %s in %s has no wire test", name, protoPath)
+		}
+	}
+}
+
+func checkFields(t *testing.T, path string, msg protoreflect.Message, want fields) {
+	t.Helper()
+	fieldDescs := msg.Descriptor().Fields()
+	for i := 0; i < fieldDescs.Len(); i++ {
+		fdesc := fieldDescs.Get(i)
+		name := string(fdesc.Name())
+		expect, ok := want[name]
+		if !ok {
+			t.Errorf("%s.%s: no expected value", path, name)
+			continue
+		}
+		value := msg.Get(fdesc)
+		switch {
+		case fdesc.IsList():
+			list := value.List()
+			got := reflect.MakeSlice(reflect.TypeOf(expect), 0, list.Len())
+			for j := 0; j < list.Len(); j++ {
+				got = reflect.Append(got, reflect.ValueOf(list.Get(j).Interface()))
+			}
+			if !reflect.DeepEqual(got.Interface(), expect) {
+				t.Errorf("%s.%s = %v, want %v", path, name, got.Interface(), expect)
+			}
+		case fdesc.Message() != nil:
+			checkFields(t, path+"."+name, value.Message(), expect.(fields))
+		default:
+			if got := value.Interface(); !reflect.DeepEqual(got, expect) {
+				t.Errorf("%s.%s = %v (%T), want %v (%T)", path, name, got, got, expect, expect)
+			}
+		}
+	}
+	for name := range want {
+		if fieldDescs.ByName(protoreflect.Name(name)) == nil {
+			t.Errorf("%s.%s: not in %s", path, name, protoPath)
+		}
+	}
+}
+
+// MessageType的取值与.proto中的枚举一致
+func TestMessageTypesMatchProto(t *testing.T) {
+	enum := loadSchema(t).Enums().ByName("MessageType")
+	want := map[MessageType]protoreflect.Name{
+		MsgUnknown: "MESSAGE_TYPE_UNKNOWN", MsgRequest: "REQUEST", MsgPrePrepare: "PRE_PREPARE", MsgPrepare: "PREPARE",
+		MsgCommit: "COMMIT", MsgReply: "REPLY", MsgSyncReq: "SYNC_REQUEST", MsgSyncResp: "SYNC_RESPONSE",
+		MsgSnapReq: "SNAPSHOT_REQUEST", MsgSnapMani: "SNAPSHOT_MANIFEST", MsgChunkReq: "SNAPSHOT_CHUNK_REQUEST",
+		MsgChunk: "SNAPSHOT_CHUNK", MsgTxProofReq: "TX_PROOF_REQUEST", MsgTxProof: "TX_PROOF",
+		MsgNonceReq: "NONCE_REQUEST", MsgNonce: "NONCE",
+	}
+	if enum.Values().Len() != len(want) {
+		t.Fatalf("%s has %d message types, want %d", protoPath, enum.Values().Len(), len(want))
+	}
+	for msgType, name := range want {
+		value := enum.Values().ByName(name)
+		if value == nil || value.Number() != protoreflect.EnumNumber(msgType) {
+			t.Errorf("%s should be %s = %d in %s", msgType, name, msgType, protoPath)
+		}
+		if msgType != MsgUnknown && !msgType.IsKnown() {
+			t.Errorf("%s is not known", msgType)
+		}
+	}
+}
+
+func TestUnpackMessage(t *testing.T) {
+	env, err := UnpackMessage(PackMessage(MsgPrepare, "node2", []byte("payload")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.Type != MsgPrepare || env.Sender != "node2" || string(env.Payload) != "payload" {
+		t.Fatalf("unexpected envelope %+v", env)
+	}
+}
+
+// 未知的消息类型被拒绝，但仍返回信封便于记录发送方
+func TestUnpackMessageUnknownType(t *testing.T) {
+	for _, msgType := range []MessageType{MsgUnknown, MsgNonce + 1, 1000} {
+		env, err := UnpackMessage(PackMessage(msgType, "node9", []byte("x")))
+		if !errors.Is(err, ErrUnknownMessageType) {
+			t.Fatalf("type %d: err = %v, want ErrUnknownMessageType", msgType, err)
+		}
+		if env == nil || env.Sender != "node9" {
+			t.Fatalf("type %d: envelope not returned", msgType)
+		}
+	}
+}
+
+// 双方支持的协议版本区间没有交集时拒绝，有交集时接受
+func TestUnpackMessageVersion(t *testing.T) {
+	cases := []struct {
+		version, minVersion uint32
+		ok                  bool
+	}{
+		{ProtocolVersion, MinProtocolVersion, true},
+		{ProtocolVersion + 1, MinProtocolVersion, true}, //更新的发送方仍兼容当前版本
+		{ProtocolVersion + 2, ProtocolVersion + 1, false},
+		{MinProtocolVersion - 1, 0, false},
+	}
+	for _, tc := range cases {
+		data := (&Envelope{tc.version, tc.minVersion, MsgCommit, "node2", nil}).MarshalProto()
+		_, err := UnpackMessage(data)
+		if tc.ok && err != nil {
+			t.Errorf("version %d/%d rejected: %v", tc.version, tc.minVersion, err)
+		}
+		if !tc.ok && !errors.Is(err, ErrIncompatibleVersion) {
+			t.Errorf("version %d/%d: err = %v, want ErrIncompatibleVersion", tc.version, tc.minVersion, err)
+		}
+	}
+}
+
+// 未知字段被忽略，已知字段的线类型错误或数据截断时返回错误
+func TestUnmarshalMalformed(t *testing.T) {
+	request := testRequest
+	data := request.MarshalProto()
+	withUnknown := protowire.AppendTag(append([]byte(nil), data...), 100, protowire.VarintType)
+	withUnknown = protowire.AppendVarint(withUnknown, 1)
+	if decoded, err := UnmarshalRequestProto(withUnknown); err != nil || !reflect.DeepEqual(*decoded, request) {
+		t.Errorf("unknown field not ignored: %v", err)
+	}
+
+	id := protowire.Number(loadSchema(t).Messages().ByName("Request").Fields().ByName("id").Number())
+	wrongType := protowire.AppendTag(nil, id, protowire.BytesType)
+	wrongType = protowire.AppendBytes(wrongType, []byte("x"))
+	if _, err := UnmarshalRequestProto(wrongType); !errors.Is(err, ErrProtoWireType) {
+		t.Errorf("wrong wire type: err = %v, want ErrProtoWireType", err)
+	}
+	ppRequest := protowire.Number(loadSchema(t).Messages().ByName("PrePrepare").Fields().ByName("request").Number())
+	nested := protowire.AppendTag(nil, ppRequest, protowire.BytesType)
+	nested = protowire.AppendBytes(nested, wrongType)
+	if _, err := UnmarshalPrePrepareProto(nested); !errors.Is(err, ErrProtoWireType) {
+		t.Errorf("wrong wire type in the nested request: err = %v, want ErrProtoWireType", err)
+	}
+
+	for n := 1; n < len(data); n++ {
+		if decoded, err := UnmarshalRequestProto(data[:n]); err == nil && reflect.DeepEqual(*decoded, request) {
+			t.Fatalf("truncated request of %d/%d bytes decoded as the full request", n, len(data))
+		}
+	}
+	if _, err := UnpackMessage([]byte{0xff}); err == nil {
+		t.Error("malformed envelope accepted")
+	}
+}
@@ -0,0 +1,251 @@
+package utils
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// 密钥库：每个节点或客户端的密钥保存在目录中的<ID>.key文件里，
+// 私钥以PKCS#8编码，用口令经PBKDF2-HMAC-SHA256派生的密钥做AES-256-GCM加密后保存，
+// ID、签名方案和公钥作为附加数据参与认证，文件被篡改或口令错误时无法解密。
+
+const (
+	KeystoreIterations = 100000 //PBKDF2的迭代次数
+	keystoreSaltSize   = 16
+	keystoreKeySize    = 32 //AES-256
+	keystoreKDF        = "pbkdf2-hmac-sha256"
+	keystoreCipher     = "aes-256-gcm"
+)
+
+var (
+	ErrKeyNotFound     = errors.New("keystore: key not found")
+	ErrPassphrase      = errors.New("keystore: wrong passphrase or corrupted key file")
+	ErrEmptyPassphrase = errors.New("keystore: empty passphrase")
+	ErrKeyFile         = errors.New("keystore: malformed key file")
+)
+
+// 密钥文件的内容
+type keyFile struct {
+	ID         string          `json:"id"`
+	Scheme     SignatureScheme `json:"scheme"`
+	PublicKey  []byte          `json:"public_key"`
+	KDF        string          `json:"kdf"`
+	Iterations int             `json:"iterations"`
+	Salt       []byte          `json:"salt"`
+	Cipher     string          `json:"cipher"`
+	Nonce      []byte          `json:"nonce"`
+	Ciphertext []byte          `json:"ciphertext"`
+}
+
+// Keystore 保存在目录中的加密密钥
+type Keystore struct {
+	Dir        string
+	passphrase []byte
+}
+
+func NewKeystore(dir string, passphrase string) (*Keystore, error) {
+	if passphrase == "" {
+		return nil, ErrEmptyPassphrase
+	}
+	return &Keystore{dir, []byte(passphrase)}, nil
+}
+
+func (ks *Keystore) path(id string) string {
+	return filepath.Join(ks.Dir, id+".key")
+}
+
+// Load 加载并解密id的密钥，不存在时返回ErrKeyNotFound
+func (ks *Keystore) Load(id string) (Signer, error) {
+	data, err := os.ReadFile(ks.path(id))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("%w: %s", ErrKeyNotFound, id)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var kf keyFile
+	if err := json.Unmarshal(data, &kf); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrKeyFile, err)
+	}
+	if kf.ID != id || kf.KDF != keystoreKDF || kf.Cipher != keystoreCipher || kf.Iterations < 1 {
+		return nil, ErrKeyFile
+	}
+	aead, err := keystoreAEAD(ks.passphrase, kf.Salt, kf.Iterations)
+	if err != nil {
+		return nil, err
+	}
+	if len(kf.Nonce) != aead.NonceSize() {
+		return nil, ErrKeyFile
+	}
+	der, err := aead.Open(nil, kf.Nonce, kf.Ciphertext, kf.additionalData())
+	if err != nil {
+		return nil, ErrPassphrase
+	}
+	signer, err := ParseSigner(der)
+	if err != nil {
+		return nil, err
+	}
+	if signer.Scheme() != kf.Scheme || !hmac.Equal(signer.PublicKey(), kf.PublicKey) {
+		return nil, ErrKeyFile
+	}
+	return signer, nil
+}
+
+// Store 加密并保存id的密钥，覆盖已有的密钥文件
+func (ks *Keystore) Store(id string, signer Signer) error {
+	der, err := MarshalSigner(signer)
+	if err != nil {
+		return err
+	}
+	kf := keyFile{ID: id, Scheme: signer.Scheme(), PublicKey: signer.PublicKey(), KDF: keystoreKDF, Iterations: KeystoreIterations, Cipher: keystoreCipher}
+	kf.Salt = make([]byte, keystoreSaltSize)
+	if _, err := rand.Read(kf.Salt); err != nil {
+		return err
+	}
+	aead, err := keystoreAEAD(ks.passphrase, kf.Salt, kf.Iterations)
+	if err != nil {
+		return err
+	}
+	kf.Nonce = make([]byte, aead.NonceSize())
+	if _, err := rand.Read(kf.Nonce); err != nil {
+		return err
+	}
+	kf.Ciphertext = aead.Seal(nil, kf.Nonce, der, kf.additionalData())
+	data, err := json.MarshalIndent(&kf, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(ks.Dir, 0700); err != nil {
+		return err
+	}
+	//先写入临时文件再重命名，崩溃时不会留下不完整的密钥文件
+	tmp := ks.path(id) + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, ks.path(id))
+}
+
+// LoadOrGenerate 加载id的密钥，不存在时按scheme生成并保存，已有密钥的方案必须与scheme一致
+func (ks *Keystore) LoadOrGenerate(id string, scheme SignatureScheme) (Signer, error) {
+	signer, err := ks.Load(id)
+	if errors.Is(err, ErrKeyNotFound) {
+		if signer, err = GenerateSigner(scheme); err != nil {
+			return nil, err
+		}
+		if err := ks.Store(id, signer); err != nil {
+			return nil, err
+		}
+		return signer, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if signer.Scheme() != scheme {
+		return nil, fmt.Errorf("keystore: key %s uses %s, network uses %s", id, signer.Scheme(), scheme)
+	}
+	return signer, nil
+}
+
+// 认证的附加数据：ID、签名方案和公钥
+func (kf *keyFile) additionalData() []byte {
+	ad := make([]byte, 0, len(kf.ID)+len(kf.Scheme)+len(kf.PublicKey)+2)
+	ad = append(ad, kf.ID...)
+	ad = append(ad, 0)
+	ad = append(ad, kf.Scheme...)
+	ad = append(ad, 0)
+	return append(ad, kf.PublicKey...)
+}
+
+func keystoreAEAD(passphrase []byte, salt []byte, iterations int) (cipher.AEAD, error) {
+	if len(salt) != keystoreSaltSize {
+		return nil, ErrKeyFile
+	}
+	block, err := aes.NewCipher(pbkdf2SHA256(passphrase, salt, iterations, keystoreKeySize))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// PBKDF2-HMAC-SHA256（RFC 8018）
+func pbkdf2SHA256(password []byte, salt []byte, iterations int, keyLen int) []byte {
+	prf := hmac.New(sha256.New, password)
+	key := make([]byte, 0, keyLen+sha256.Size)
+	u := make([]byte, sha256.Size)
+	t := make([]byte, sha256.Size)
+	var counter [4]byte
+	for block := uint32(1); len(key) < keyLen; block++ {
+		binary.BigEndian.PutUint32(counter[:], block)
+		prf.Reset()
+		prf.Write(salt)
+		prf.Write(counter[:])
+		u = prf.Sum(u[:0])
+		copy(t, u)
+		for i := 1; i < iterations; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+		key = append(key, t...)
+	}
+	return key[:keyLen]
+}
+
+// MarshalSigner 将签名者的私钥编码为PKCS#8
+func MarshalSigner(signer Signer) ([]byte, error) {
+	switch s := signer.(type) {
+	case *rsaSigner:
+		return x509.MarshalPKCS8PrivateKey(s.priv)
+	case *ed25519Signer:
+		return x509.MarshalPKCS8PrivateKey(s.priv)
+	case *ecdsaSigner:
+		return x509.MarshalPKCS8PrivateKey(s.priv)
+	}
+	return nil, fmt.Errorf("%w %q", ErrUnknownScheme, signer.Scheme())
+}
+
+// ParseSigner 由PKCS#8编码的私钥得到签名者
+func ParseSigner(der []byte) (Signer, error) {
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrPrivateKey, err)
+	}
+	switch priv := key.(type) {
+	case *rsa.PrivateKey:
+		pub, err := x509.MarshalPKIXPublicKey(&priv.PublicKey)
+		if err != nil {
+			return nil, err
+		}
+		return &rsaSigner{priv, tagPublicKey(KeyTypeRSA, pub)}, nil
+	case ed25519.PrivateKey:
+		return &ed25519Signer{priv, tagPublicKey(KeyTypeEd25519, priv.Public().(ed25519.PublicKey))}, nil
+	case *ecdsa.PrivateKey:
+		if priv.Curve != elliptic.P256() {
+			return nil, fmt.Errorf("%w: unsupported curve", ErrPrivateKey)
+		}
+		pub, err := x509.MarshalPKIXPublicKey(&priv.PublicKey)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsaSigner{priv, tagPublicKey(KeyTypeECDSAP256, pub)}, nil
+	}
+	return nil, fmt.Errorf("%w: unsupported key type %T", ErrPrivateKey, key)
+}
@@ -0,0 +1,140 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// PBKDF2-HMAC-SHA256的已知答案（RFC 7914第11节及RFC 6070的SHA-256版本）
+func TestPBKDF2SHA256(t *testing.T) {
+	cases := []struct {
+		password   string
+		salt       string
+		iterations int
+		want       string
+	}{
+		{"password", "salt", 1, "120fb6cffcf8b32c43e7225256c4f837a86548c92ccc35480805987cb70be17b"},
+		{"password", "salt", 2, "ae4d0c95af6b46d32d0adff928f06dd02a303f8ef3c251dfd6e2d85a95474c43"},
+		{"password", "salt", 4096, "c5e478d59288c841aa530db6845c4c8d962893a001ce4e11a4963873aa98134a"},
+		{"passwordPASSWORDpassword", "saltSALTsaltSALTsaltSALTsaltSALTsalt", 4096, "348c89dbcbd32b2f32d814b8116e84cf2b17347ebc1800181c4e2a1fb8dd53e1c635518c7dac47e9"},
+		{"pass\x00word", "sa\x00lt", 4096, "89b69d0516f829893c696226650a8687"},
+		{"passwd", "salt", 1, "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc49ca9cccf179b645991664b39d77ef317c71b845b1e30bd509112041d3a19783"},
+		{"Password", "NaCl", 80000, "4ddcd8f60b98be21830cee5ef22701f9641a4418d04c0414aeff08876b34ab56a1d425a1225833549adb841b51c9b3176a272bdebba1d078478f62b397f33c8d"},
+	}
+	for _, tc := range cases {
+		want, err := hex.DecodeString(tc.want)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := pbkdf2SHA256([]byte(tc.password), []byte(tc.salt), tc.iterations, len(want)); !bytes.Equal(got, want) {
+			t.Errorf("pbkdf2(%q, %q, %d) = %x, want %x", tc.password, tc.salt, tc.iterations, got, want)
+		}
+	}
+}
+
+func testKeystore(t *testing.T, dir string, passphrase string) *Keystore {
+	ks, err := NewKeystore(dir, passphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ks
+}
+
+func TestKeystoreRoundTrip(t *testing.T) {
+	if _, err := NewKeystore(t.TempDir(), ""); !errors.Is(err, ErrEmptyPassphrase) {
+		t.Errorf("empty passphrase: %v, want ErrEmptyPassphrase", err)
+	}
+	ks := testKeystore(t, t.TempDir(), "pw")
+	for _, scheme := range []SignatureScheme{SchemeRSA, SchemeEd25519, SchemeECDSAP256} {
+		id := string(scheme)
+		signer, err := ks.LoadOrGenerate(id, scheme)
+		if err != nil {
+			t.Fatal(err)
+		}
+		loaded, err := ks.Load(id)
+		if err != nil {
+			t.Fatalf("%s: %v", scheme, err)
+		}
+		if loaded.Scheme() != scheme || !bytes.Equal(loaded.PublicKey(), signer.PublicKey()) {
+			t.Errorf("%s: loaded a different key", scheme)
+		}
+		sign, err := loaded.Sign([]byte("data"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := VerifySign([]byte("data"), sign, signer.PublicKey()); err != nil {
+			t.Errorf("%s: %v", scheme, err)
+		}
+	}
+	if _, err := ks.Load("missing"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("missing key: %v, want ErrKeyNotFound", err)
+	}
+}
+
+func TestKeystoreWrongPassphrase(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := testKeystore(t, dir, "pw").LoadOrGenerate("node1", SchemeEd25519); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := testKeystore(t, dir, "pw2").Load("node1"); !errors.Is(err, ErrPassphrase) {
+		t.Errorf("wrong passphrase: %v, want ErrPassphrase", err)
+	}
+	//口令错误时不能覆盖已有的密钥
+	if _, err := testKeystore(t, dir, "pw2").LoadOrGenerate("node1", SchemeEd25519); !errors.Is(err, ErrPassphrase) {
+		t.Errorf("wrong passphrase: %v, want ErrPassphrase", err)
+	}
+	if _, err := testKeystore(t, dir, "pw").Load("node1"); err != nil {
+		t.Errorf("right passphrase: %v", err)
+	}
+}
+
+// 修改密钥文件中的密文或作为附加数据的ID、签名方案、公钥后，GCM认证失败
+func TestKeystoreTampered(t *testing.T) {
+	other, err := GenerateSigner(SchemeEd25519)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		name   string
+		id     string //加载的ID，修改ID时密钥文件也改名
+		tamper func(kf *keyFile)
+	}{
+		{"ciphertext", "node1", func(kf *keyFile) { kf.Ciphertext[0] ^= 1 }},
+		{"truncated ciphertext", "node1", func(kf *keyFile) { kf.Ciphertext = kf.Ciphertext[:len(kf.Ciphertext)-1] }},
+		{"nonce", "node1", func(kf *keyFile) { kf.Nonce[0] ^= 1 }},
+		{"salt", "node1", func(kf *keyFile) { kf.Salt[0] ^= 1 }},
+		{"id", "node2", func(kf *keyFile) { kf.ID = "node2" }},
+		{"scheme", "node1", func(kf *keyFile) { kf.Scheme = SchemeECDSAP256 }},
+		{"public key", "node1", func(kf *keyFile) { kf.PublicKey = other.PublicKey() }},
+	}
+	for _, tc := range cases {
+		dir := t.TempDir()
+		ks := testKeystore(t, dir, "pw")
+		if _, err := ks.LoadOrGenerate("node1", SchemeEd25519); err != nil {
+			t.Fatal(err)
+		}
+		data, err := os.ReadFile(filepath.Join(dir, "node1.key"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var kf keyFile
+		if err := json.Unmarshal(data, &kf); err != nil {
+			t.Fatal(err)
+		}
+		tc.tamper(&kf)
+		if data, err = json.Marshal(&kf); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, tc.id+".key"), data, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ks.Load(tc.id); !errors.Is(err, ErrPassphrase) {
+			t.Errorf("tampered %s: %v, want ErrPassphrase", tc.name, err)
+		}
+	}
+}
@@ -7,53 +7,13 @@ import (
 	"crypto/sha256"
 	"crypto/x509"
 	"encoding/pem"
-	"errors"
 	"fmt"
-	"log"
-	"os"
-	"strconv"
 )
 
-// 如果当前目录下不存在目录Keys，则创建目录，并为各个节点生成rsa公私钥
-func GenRsaKeys() {
-	if !isExist("./Keys") {
-		fmt.Println("检测到还未生成公私钥目录，正在生成公私钥 ...")
-		err := os.Mkdir("Keys", 0644)
-		if err != nil {
-			log.Panic()
-		}
-		for i := 0; i <= 4; i++ {
-			if !isExist("./Keys/N" + strconv.Itoa(i)) {
-				err := os.Mkdir("./Keys/N"+strconv.Itoa(i), 0644)
-				if err != nil {
-					log.Panic()
-				}
-			}
-			priv, pub := GetKeyPair()
-			privFileName := "Keys/N" + strconv.Itoa(i) + "/N" + strconv.Itoa(i) + "_RSA_PIV"
-			file, err := os.OpenFile(privFileName, os.O_RDWR|os.O_CREATE, 0644)
-			if err != nil {
-				log.Panic(err)
-			}
-			defer file.Close()
-			file.Write(priv)
-
-			pubFileName := "Keys/N" + strconv.Itoa(i) + "/N" + strconv.Itoa(i) + "_RSA_PUB"
-			file2, err := os.OpenFile(pubFileName, os.O_RDWR|os.O_CREATE, 0644)
-			if err != nil {
-				log.Panic(err)
-			}
-			defer file2.Close()
-			file2.Write(pub)
-		}
-		fmt.Println("已为节点们生成RSA公私钥")
-	}
-}
-
 // 生成一对rsa公私钥
 func GetKeyPair() (prvkey, pubkey []byte) {
 	// 生成私钥文件
-	privateKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	privateKey, err := rsa.GenerateKey(rand.Reader, RSAKeyBits)
 	if err != nil {
 		panic(err)
 	}
@@ -76,61 +36,37 @@ func GetKeyPair() (prvkey, pubkey []byte) {
 	return
 }
 
-// 判断文件或文件夹是否存在
-func isExist(path string) bool {
-	_, err := os.Stat(path)
-	if err != nil {
-		if os.IsExist(err) {
-			return true
-		}
-		if os.IsNotExist(err) {
-			return false
-		}
-		fmt.Println(err)
-		return false
-	}
-	return true
-}
-
-// 数字签名
-func RsaSignWithSha256(data []byte, keyBytes []byte) []byte {
-	h := sha256.New()
-	h.Write(data)
-	hashed := h.Sum(nil)
+// 数字签名，私钥无法解析时返回ErrPrivateKey
+func RsaSignWithSha256(data []byte, keyBytes []byte) ([]byte, error) {
 	block, _ := pem.Decode(keyBytes)
 	if block == nil {
-		panic(errors.New("private key error"))
+		return nil, ErrPrivateKey
 	}
 	privateKey, err := x509.ParsePKCS1PrivateKey(block.Bytes)
 	if err != nil {
-		fmt.Println("ParsePKCS8PrivateKey err", err)
-		panic(err)
-	}
-
-	signature, err := rsa.SignPKCS1v15(rand.Reader, privateKey, crypto.SHA256, hashed)
-	if err != nil {
-		fmt.Printf("Error from signing: %s\n", err)
-		panic(err)
+		return nil, fmt.Errorf("%w: %v", ErrPrivateKey, err)
 	}
-
-	return signature
+	hashed := sha256.Sum256(data)
+	return rsa.SignPKCS1v15(rand.Reader, privateKey, crypto.SHA256, hashed[:])
 }
 
-// 签名验证
-func RsaVerySignWithSha256(data, signData, keyBytes []byte) bool {
+// 签名验证，公钥无法解析时返回ErrPublicKey，签名无效时返回ErrSignature
+func RsaVerySignWithSha256(data, signData, keyBytes []byte) error {
 	block, _ := pem.Decode(keyBytes)
 	if block == nil {
-		panic(errors.New("public key error"))
+		return ErrPublicKey
 	}
 	pubKey, err := x509.ParsePKIXPublicKey(block.Bytes)
 	if err != nil {
-		panic(err)
+		return fmt.Errorf("%w: %v", ErrPublicKey, err)
+	}
+	rsaPubKey, ok := pubKey.(*rsa.PublicKey)
+	if !ok {
+		return fmt.Errorf("%w: not an RSA key", ErrPublicKey)
 	}
-
 	hashed := sha256.Sum256(data)
-	err = rsa.VerifyPKCS1v15(pubKey.(*rsa.PublicKey), crypto.SHA256, hashed[:], signData)
-	if err != nil {
-		panic(err)
+	if rsa.VerifyPKCS1v15(rsaPubKey, crypto.SHA256, hashed[:], signData) != nil {
+		return ErrSignature
 	}
-	return true
+	return nil
 }
@@ -0,0 +1,241 @@
+package utils
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"errors"
+	"fmt"
+)
+
+// 可替换的签名方案：网络中所有节点和客户端使用同一种方案，
+// 公钥的第一个字节标记密钥类型，其余部分为公钥本体（RSA和ECDSA为PKIX编码，Ed25519为32字节原始公钥），
+// 验证时根据标记选择算法，不同方案的公钥不会被误用。
+
+// SignatureScheme 签名方案
+type SignatureScheme string
+
+const (
+	SchemeRSA       SignatureScheme = "rsa"        //RSA PKCS#1 v1.5，SHA-256
+	SchemeEd25519   SignatureScheme = "ed25519"    //Ed25519
+	SchemeECDSAP256 SignatureScheme = "ecdsa-p256" //ECDSA P-256，SHA-256，ASN.1编码的签名
+
+	DefaultScheme = SchemeRSA //默认签名方案
+	RSAKeyBits    = 2048      //RSA密钥长度
+	MinRSAKeyBits = 2048      //公钥允许的最小RSA密钥长度
+)
+
+// 公钥的类型标记
+const (
+	KeyTypeRSA       byte = 1
+	KeyTypeEd25519   byte = 2
+	KeyTypeECDSAP256 byte = 3
+)
+
+var (
+	ErrUnknownScheme = errors.New("utils: unknown signature scheme")
+	ErrPublicKey     = errors.New("utils: malformed public key")
+	ErrPrivateKey    = errors.New("utils: malformed private key")
+	ErrSignature     = errors.New("utils: invalid signature")
+)
+
+// Signer 持有私钥的签名者
+type Signer interface {
+	Scheme() SignatureScheme
+	PublicKey() []byte //带类型标记的公钥
+	Sign(data []byte) ([]byte, error)
+}
+
+// Verifier 由带类型标记的公钥得到的签名验证者
+type Verifier interface {
+	Scheme() SignatureScheme
+	Verify(data []byte, sign []byte) error //签名无效时返回ErrSignature
+}
+
+// ParseSignatureScheme 根据名称获取签名方案
+func ParseSignatureScheme(name string) (SignatureScheme, error) {
+	switch scheme := SignatureScheme(name); scheme {
+	case SchemeRSA, SchemeEd25519, SchemeECDSAP256:
+		return scheme, nil
+	}
+	return "", fmt.Errorf("%w %q", ErrUnknownScheme, name)
+}
+
+// GenerateSigner 生成指定方案的密钥对
+func GenerateSigner(scheme SignatureScheme) (Signer, error) {
+	switch scheme {
+	case SchemeRSA:
+		priv, err := rsa.GenerateKey(rand.Reader, RSAKeyBits)
+		if err != nil {
+			return nil, err
+		}
+		der, err := x509.MarshalPKIXPublicKey(&priv.PublicKey)
+		if err != nil {
+			return nil, err
+		}
+		return &rsaSigner{priv, tagPublicKey(KeyTypeRSA, der)}, nil
+	case SchemeEd25519:
+		pub, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		return &ed25519Signer{priv, tagPublicKey(KeyTypeEd25519, pub)}, nil
+	case SchemeECDSAP256:
+		priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		der, err := x509.MarshalPKIXPublicKey(&priv.PublicKey)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsaSigner{priv, tagPublicKey(KeyTypeECDSAP256, der)}, nil
+	}
+	return nil, fmt.Errorf("%w %q", ErrUnknownScheme, scheme)
+}
+
+// KeyScheme 获取带类型标记的公钥所属的签名方案
+func KeyScheme(pubkey []byte) (SignatureScheme, error) {
+	if len(pubkey) == 0 {
+		return "", ErrPublicKey
+	}
+	switch pubkey[0] {
+	case KeyTypeRSA:
+		return SchemeRSA, nil
+	case KeyTypeEd25519:
+		return SchemeEd25519, nil
+	case KeyTypeECDSAP256:
+		return SchemeECDSAP256, nil
+	}
+	return "", fmt.Errorf("%w: unknown key type %d", ErrPublicKey, pubkey[0])
+}
+
+// ParseVerifier 解析带类型标记的公钥，短于MinRSAKeyBits位的RSA公钥返回ErrPublicKey
+func ParseVerifier(pubkey []byte) (Verifier, error) {
+	scheme, err := KeyScheme(pubkey)
+	if err != nil {
+		return nil, err
+	}
+	key := pubkey[1:]
+	switch scheme {
+	case SchemeRSA:
+		pub, err := x509.ParsePKIXPublicKey(key)
+		if rsaPub, ok := pub.(*rsa.PublicKey); err == nil && ok {
+			//过短的RSA密钥可以被分解，不能用于验证签名
+			if rsaPub.N.BitLen() < MinRSAKeyBits {
+				return nil, fmt.Errorf("%w: %d-bit RSA key, want at least %d", ErrPublicKey, rsaPub.N.BitLen(), MinRSAKeyBits)
+			}
+			return rsaVerifier{rsaPub}, nil
+		}
+	case SchemeEd25519:
+		if len(key) == ed25519.PublicKeySize {
+			return ed25519Verifier{ed25519.PublicKey(key)}, nil
+		}
+	case SchemeECDSAP256:
+		pub, err := x509.ParsePKIXPublicKey(key)
+		if ecPub, ok := pub.(*ecdsa.PublicKey); err == nil && ok && ecPub.Curve == elliptic.P256() {
+			return ecdsaVerifier{ecPub}, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: invalid %s key", ErrPublicKey, scheme)
+}
+
+// VerifySign 用带类型标记的公钥验证签名，公钥无法解析时返回ErrPublicKey，签名无效时返回ErrSignature
+func VerifySign(data []byte, sign []byte, pubkey []byte) error {
+	verifier, err := ParseVerifier(pubkey)
+	if err != nil {
+		return err
+	}
+	return verifier.Verify(data, sign)
+}
+
+func tagPublicKey(keyType byte, key []byte) []byte {
+	return append([]byte{keyType}, key...)
+}
+
+type rsaSigner struct {
+	priv *rsa.PrivateKey
+	pub  []byte
+}
+
+func (s *rsaSigner) Scheme() SignatureScheme { return SchemeRSA }
+
+func (s *rsaSigner) PublicKey() []byte { return s.pub }
+
+func (s *rsaSigner) Sign(data []byte) ([]byte, error) {
+	hashed := sha256.Sum256(data)
+	return rsa.SignPKCS1v15(rand.Reader, s.priv, crypto.SHA256, hashed[:])
+}
+
+type rsaVerifier struct {
+	pub *rsa.PublicKey
+}
+
+func (v rsaVerifier) Scheme() SignatureScheme { return SchemeRSA }
+
+func (v rsaVerifier) Verify(data []byte, sign []byte) error {
+	hashed := sha256.Sum256(data)
+	if rsa.VerifyPKCS1v15(v.pub, crypto.SHA256, hashed[:], sign) != nil {
+		return ErrSignature
+	}
+	return nil
+}
+
+type ed25519Signer struct {
+	priv ed25519.PrivateKey
+	pub  []byte
+}
+
+func (s *ed25519Signer) Scheme() SignatureScheme { return SchemeEd25519 }
+
+func (s *ed25519Signer) PublicKey() []byte { return s.pub }
+
+func (s *ed25519Signer) Sign(data []byte) ([]byte, error) {
+	return ed25519.Sign(s.priv, data), nil
+}
+
+type ed25519Verifier struct {
+	pub ed25519.PublicKey
+}
+
+func (v ed25519Verifier) Scheme() SignatureScheme { return SchemeEd25519 }
+
+func (v ed25519Verifier) Verify(data []byte, sign []byte) error {
+	if len(sign) != ed25519.SignatureSize || !ed25519.Verify(v.pub, data, sign) {
+		return ErrSignature
+	}
+	return nil
+}
+
+type ecdsaSigner struct {
+	priv *ecdsa.PrivateKey
+	pub  []byte
+}
+
+func (s *ecdsaSigner) Scheme() SignatureScheme { return SchemeECDSAP256 }
+
+func (s *ecdsaSigner) PublicKey() []byte { return s.pub }
+
+func (s *ecdsaSigner) Sign(data []byte) ([]byte, error) {
+	hashed := sha256.Sum256(data)
+	return ecdsa.SignASN1(rand.Reader, s.priv, hashed[:])
+}
+
+type ecdsaVerifier struct {
+	pub *ecdsa.PublicKey
+}
+
+func (v ecdsaVerifier) Scheme() SignatureScheme { return SchemeECDSAP256 }
+
+func (v ecdsaVerifier) Verify(data []byte, sign []byte) error {
+	hashed := sha256.Sum256(data)
+	if !ecdsa.VerifyASN1(v.pub, hashed[:], sign) {
+		return ErrSignature
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+package utils
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"errors"
+	"testing"
+)
+
+// 带类型标记的RSA公钥和对data的签名
+func testRSAKey(t *testing.T, bits int, data []byte) ([]byte, []byte) {
+	priv, err := rsa.GenerateKey(rand.Reader, bits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&priv.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hashed := sha256.Sum256(data)
+	sign, err := rsa.SignPKCS1v15(rand.Reader, priv, crypto.SHA256, hashed[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tagPublicKey(KeyTypeRSA, der), sign
+}
+
+func TestParseVerifierRSAKeySize(t *testing.T) {
+	data := []byte("data")
+	for _, bits := range []int{1024, 2047} {
+		pubkey, sign := testRSAKey(t, bits, data)
+		if _, err := ParseVerifier(pubkey); !errors.Is(err, ErrPublicKey) {
+			t.Errorf("%d-bit key: %v, want ErrPublicKey", bits, err)
+		}
+		if err := VerifySign(data, sign, pubkey); !errors.Is(err, ErrPublicKey) {
+			t.Errorf("signature with %d-bit key: %v, want ErrPublicKey", bits, err)
+		}
+	}
+	pubkey, sign := testRSAKey(t, MinRSAKeyBits, data)
+	if err := VerifySign(data, sign, pubkey); err != nil {
+		t.Errorf("%d-bit key: %v", MinRSAKeyBits, err)
+	}
+}